@@ -0,0 +1,745 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Constants for the JSON API
+const (
+	apiPrefix  = "/api/v1/"
+	apiMaxBody = 1 << 20 // Maximum size of a request body
+)
+
+// apiReadOnly holds the general config fields that can only be changed on the config page.
+var apiReadOnly = map[string]bool{"Username": true, "Password": true, "CurrentPassword": true}
+
+// apiWriteOnly holds the general config fields that can be changed, but are never returned.
+var apiWriteOnly = map[string]bool{"MailPass": true, "MqttPass": true, "InfluxToken": true}
+
+/* ApiError is the body of all error responses of the API. Fields holds the
+message per invalid field of a request body or query.*/
+type apiError struct {
+	Error  string
+	Fields map[string]string `json:",omitempty"`
+}
+
+// ApiSunscreen represents the status of a sunscreen in the API.
+type apiSunscreen struct {
+	Id       int
+	Name     string
+	Mode     string
+	Position string
+	Percent  int // Percent down, 0 is up and 100 is down
+	Start    time.Time
+	Stop     time.Time
+	Commands []Command // Running, queued and recently ended commands
+}
+
+// ApiSensor represents the status of a light sensor in the API.
+type apiSensor struct {
+	Id     int
+	Name   string
+	Light  *int // Last measured light, nil if nothing has been measured
+	Failed bool
+}
+
+// ApiMovement represents a movement in the history of the sunscreens.
+type apiMovement struct {
+	Time     time.Time
+	Mode     string
+	Position string
+	Light    []int // Light that was used for evaluating the movement
+	Id       int   // Id of the sunscreen, 0 for movements stored before multiple sunscreens were supported
+	Name     string
+	Lock     string // Safety locks of the sunscreen at the time of the movement, e.g. "wind rain"
+}
+
+// ApiLight represents a measurement in the light history.
+type apiLight struct {
+	Time    time.Time
+	Light   int
+	Sensors map[string]int // Light per sensor name
+}
+
+// ApiCommand is the body of a command request.
+type apiCommand struct {
+	Action   string // up, down, stop, goto, preset, auto or manual
+	Position *int   // Position in percent down for goto
+	Preset   string // Name of the preset for preset
+	Confirm  bool   // Confirms a movement during a frost lock
+}
+
+/* HandlerAPI serves the JSON API. Requests are authorised by the session cookie
+of the web interface or HTTP basic authentication. All errors are returned as an
+apiError with an appropriate status code. Config is represented by the values of
+the fields on the config page, with the same names and units, e.g.
+{"DurUp": "45"}; booleans are "true" or "", and a PATCH with a subset of the
+fields is validated completely before anything is saved.
+
+Url options:
+	GET   /api/v1/status                      status of sunscreens and light
+	GET   /api/v1/events                      live events, see streamEvents
+	POST  /api/v1/sunscreens/<id>/command     move a sunscreen or set its mode
+	GET   /api/v1/sunscreens/<id>/config      config of a sunscreen
+	PATCH /api/v1/sunscreens/<id>/config
+	GET   /api/v1/lightsensor/config          config of the light sensor
+	PATCH /api/v1/lightsensor/config
+	GET   /api/v1/config                      general config
+	PATCH /api/v1/config
+	GET   /api/v1/history/movements?limit=<n> movements, newest first
+	GET   /api/v1/history/light?limit=<n>     light measurements, newest first*/
+func handlerAPI(w http.ResponseWriter, req *http.Request) {
+	if !apiAuthorized(req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gosunscreen"`)
+		apiFail(w, http.StatusUnauthorized, "Not logged in, use the session cookie or basic authentication", nil)
+		return
+	}
+	url := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, apiPrefix), "/"), "/")
+	switch fromSlice(url, 0) {
+	case "status":
+		if len(url) == 1 {
+			if apiAllow(w, req, http.MethodGet) {
+				apiStatus(w)
+			}
+			return
+		}
+	case "sunscreens":
+		id, err := strToInt(fromSlice(url, 1))
+		s := getSunscreen(id)
+		if err != nil || s == nil || len(url) != 3 {
+			break
+		}
+		switch fromSlice(url, 2) {
+		case "command":
+			if apiAllow(w, req, http.MethodPost) {
+				apiSunscreenCommand(w, req, s)
+			}
+			return
+		case "config":
+			if apiAllow(w, req, http.MethodGet, http.MethodPatch) {
+				apiSunscreenConfig(w, req, s)
+			}
+			return
+		}
+	case "lightsensor":
+		if fromSlice(url, 1) == "config" && len(url) == 2 {
+			if apiAllow(w, req, http.MethodGet, http.MethodPatch) {
+				apiLightsensorConfig(w, req)
+			}
+			return
+		}
+	case "config":
+		if len(url) == 1 {
+			if apiAllow(w, req, http.MethodGet, http.MethodPatch) {
+				apiConfig(w, req)
+			}
+			return
+		}
+	case "events":
+		if len(url) == 1 {
+			if apiAllow(w, req, http.MethodGet) {
+				streamEvents(w, req)
+			}
+			return
+		}
+	case "history":
+		if len(url) != 2 || (url[1] != "movements" && url[1] != "light") {
+			break
+		}
+		if apiAllow(w, req, http.MethodGet) {
+			apiHistory(w, req, url[1])
+		}
+		return
+	}
+	apiFail(w, http.StatusNotFound, fmt.Sprintf("Unknown resource '%v'", req.URL.Path), nil)
+}
+
+/* ApiAuthorized returns true if the request has the session cookie of a logged
+in user, or the username and password of config for basic authentication.*/
+func apiAuthorized(req *http.Request) bool {
+	if alreadyLoggedIn(req) {
+		return true
+	}
+	u, p, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+	muConf.Lock()
+	username, password := config.Username, config.Password
+	muConf.Unlock()
+	if u != username || bcrypt.CompareHashAndPassword(password, []byte(p)) != nil {
+		log.Printf("%v entered incorrect credentials for the API", getIP(req))
+		return false
+	}
+	return true
+}
+
+// ApiAllow returns true if the method of req is one of methods, otherwise it responds 405.
+func apiAllow(w http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if req.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	apiFail(w, http.StatusMethodNotAllowed, fmt.Sprintf("Method %v is not allowed, use %v", req.Method, strings.Join(methods, " or ")), nil)
+	return false
+}
+
+// ApiRespond writes v as JSON with status code.
+func apiRespond(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Unable to write API response: %v", err)
+	}
+}
+
+// ApiFail responds with an apiError with msg and the messages of errs per field.
+func apiFail(w http.ResponseWriter, code int, msg string, errs formErrors) {
+	e := apiError{Error: msg}
+	if len(errs) > 0 {
+		e.Fields = map[string]string{}
+		for _, fe := range errs {
+			if m, ok := e.Fields[fe.Field]; ok {
+				e.Fields[fe.Field] = m + "; " + fe.Message
+			} else {
+				e.Fields[fe.Field] = fe.Message
+			}
+		}
+	}
+	apiRespond(w, code, e)
+}
+
+// ApiDecode decodes the JSON body of req into v, it returns an error if the body is invalid.
+func apiDecode(w http.ResponseWriter, req *http.Request, v interface{}) error {
+	d := json.NewDecoder(http.MaxBytesReader(w, req.Body, apiMaxBody))
+	d.UseNumber()
+	if err := d.Decode(v); err != nil {
+		return fmt.Errorf("Invalid JSON body (%v)", err)
+	}
+	if d.More() {
+		return errors.New("Invalid JSON body (unexpected data after object)")
+	}
+	return nil
+}
+
+// ApiStatus responds with the status of all sunscreens and the light sensors.
+func apiStatus(w http.ResponseWriter) {
+	status := struct {
+		Sunscreens []apiSunscreen
+		Light      *int // Last combined light, nil if nothing has been measured
+		Sensors    []apiSensor
+		Wind       windStatus
+		Rain       rainStatus
+		Temp       tempStatus
+		Frost      frostStatus
+		Forecast   *forecast // Cached forecast of today, nil if it has not been fetched
+	}{Sunscreens: []apiSunscreen{}, Sensors: []apiSensor{}, Wind: getWindStatus(), Rain: getRainStatus(), Temp: getTempStatus(), Frost: getFrostStatus(), Forecast: cachedForecast(time.Now())}
+	muSunscrn.Lock()
+	for _, s := range sunscreens {
+		status.Sunscreens = append(status.Sunscreens, s.state())
+	}
+	muSunscrn.Unlock()
+	muLS.Lock()
+	status.Light = lastLight(ls.Data)
+	for _, sn := range ls.Sensors {
+		status.Sensors = append(status.Sensors, apiSensor{sn.Id, sn.Name, lastLight(sn.Data), sn.Failed})
+	}
+	muLS.Unlock()
+	apiRespond(w, http.StatusOK, status)
+}
+
+// State returns the status of sunscreen s. The caller should hold muSunscrn.
+func (s *Sunscreen) state() apiSunscreen {
+	return apiSunscreen{s.Id, s.Name, s.Mode, s.Position, s.Percent, s.Start, s.Stop, s.commands()}
+}
+
+// LastLight returns the last value of data, or nil if data is empty.
+func lastLight(data []int) *int {
+	if len(data) == 0 {
+		return nil
+	}
+	l := data[len(data)-1]
+	return &l
+}
+
+/* ApiSunscreenCommand carries out the command in the body of req for sunscreen
+s. Movements switch the sunscreen to manual mode and respond 202 with the queued
+command, auto and manual only set the mode.*/
+func apiSunscreenCommand(w http.ResponseWriter, req *http.Request, s *Sunscreen) {
+	var body apiCommand
+	if err := apiDecode(w, req, &body); err != nil {
+		apiFail(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	mode, pos := manual, ""
+	switch strings.ToLower(body.Action) {
+	case up, down:
+		pos = strings.ToLower(body.Action)
+	case cmdStop:
+		pos = "stop"
+	case cmdGoto:
+		if body.Position == nil || *body.Position < 0 || *body.Position > 100 {
+			apiFail(w, http.StatusUnprocessableEntity, "Invalid command", formErrors{{"Position", "Position should be a percentage down within range 0-100"}})
+			return
+		}
+		pos = fmt.Sprint(*body.Position)
+	case "preset":
+		if _, ok := s.preset(body.Preset); !ok {
+			apiFail(w, http.StatusUnprocessableEntity, "Invalid command", formErrors{{"Preset", fmt.Sprintf("Unknown preset '%v'", body.Preset)}})
+			return
+		}
+		pos = body.Preset
+	case auto:
+		mode = auto
+	case manual:
+	default:
+		apiFail(w, http.StatusUnprocessableEntity, "Invalid command", formErrors{{"Action", fmt.Sprintf("Unknown action '%v', should be up, down, stop, goto, preset, auto or manual", body.Action)}})
+		return
+	}
+	log.Printf("Received API command '%v' for sunscreen '%v'", body.Action, s.Name)
+	c, err := s.setMode(mode, pos, srcApi, body.Confirm)
+	if err != nil {
+		apiFail(w, http.StatusUnprocessableEntity, err.Error(), nil)
+		return
+	}
+	data := struct {
+		Mode    string
+		Command *Command // Queued command, nil if only the mode was set
+	}{Mode: s.Mode}
+	if c == nil {
+		apiRespond(w, http.StatusOK, data)
+		return
+	}
+	cmd := *c
+	data.Command = &cmd
+	apiRespond(w, http.StatusAccepted, data)
+}
+
+// ApiSunscreenConfig responds with the config of sunscreen s, after applying the patch in the body of req.
+func apiSunscreenConfig(w http.ResponseWriter, req *http.Request, s *Sunscreen) {
+	if req.Method == http.MethodPatch {
+		muSunscrn.Lock()
+		values := sunscreenForm(s)
+		muSunscrn.Unlock()
+		if !apiPatch(w, req, values, nil) {
+			return
+		}
+		form := url.Values{}
+		for k, v := range values {
+			form.Set(fmt.Sprintf("%v-%v", k, s.Id), v)
+		}
+		// Validate on a copy, so an invalid patch does not change anything
+		muSunscrn.Lock()
+		cp := *s
+		errs, pinsChanged := updateSunscreen(&http.Request{PostForm: form}, &cp)
+		if len(errs) == 0 {
+			*s = cp
+			saveSunscreens()
+			log.Printf("Saved sunscreen '%v' through API", s.Name)
+		}
+		muSunscrn.Unlock()
+		if len(errs) > 0 {
+			apiFail(w, http.StatusUnprocessableEntity, fmt.Sprintf("Unable to save sunscreen '%v'", s.Name), errs)
+			return
+		}
+		s.resetAutoTime(0)
+		if pinsChanged {
+			s.init()
+		}
+		updateStartStop(ls, 0)
+	}
+	muSunscrn.Lock()
+	values := sunscreenForm(s)
+	muSunscrn.Unlock()
+	apiRespond(w, http.StatusOK, values)
+}
+
+// ApiLightsensorConfig responds with the config of the light sensor, after applying the patch in the body of req.
+func apiLightsensorConfig(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPatch {
+		muLS.Lock()
+		values := lightsensorForm()
+		muLS.Unlock()
+		if !apiPatch(w, req, values, nil) {
+			return
+		}
+		// Validate on a copy, so an invalid patch does not change anything
+		muLS.Lock()
+		cp := *ls
+		cp.Sensors = append([]Sensor{}, ls.Sensors...)
+		errs := updateLightsensor(formRequest(values), &cp)
+		if len(errs) == 0 {
+			*ls = cp
+			SaveToJSON(ls, fileLightsensor)
+		}
+		muLS.Unlock()
+		if len(errs) > 0 {
+			apiFail(w, http.StatusUnprocessableEntity, "Unable to save lightsensor", errs)
+			return
+		}
+		log.Println("Saved lightsensor through API")
+	}
+	muLS.Lock()
+	values := lightsensorForm()
+	muLS.Unlock()
+	apiRespond(w, http.StatusOK, values)
+}
+
+// ApiConfig responds with the general config, after applying the patch in the body of req.
+func apiConfig(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPatch {
+		muConf.Lock()
+		values := configForm()
+		muConf.Unlock()
+		if !apiPatch(w, req, values, apiReadOnly) {
+			return
+		}
+		// Validate on a copy, so an invalid patch does not change anything
+		muConf.Lock()
+		old, cp := config, config
+		errs := updateConfig(formRequest(values), &cp)
+		if len(errs) == 0 {
+			config = cp
+			SaveToJSON(config, fileConfig)
+		}
+		muConf.Unlock()
+		if len(errs) > 0 {
+			apiFail(w, http.StatusUnprocessableEntity, "Unable to save general config", errs)
+			return
+		}
+		log.Println("Saved general config through API")
+		restartChangedServices(old)
+		updateStartStop(ls, 0)
+	}
+	muConf.Lock()
+	values := configForm()
+	muConf.Unlock()
+	for k := range apiWriteOnly {
+		delete(values, k)
+	}
+	apiRespond(w, http.StatusOK, values)
+}
+
+/* ApiPatch merges the JSON object in the body of req into the form values.
+Values can be strings, numbers, booleans or null (an empty value). It responds
+with an error and returns false if the body is invalid or contains a field that
+is unknown or readOnly.*/
+func apiPatch(w http.ResponseWriter, req *http.Request, values map[string]string, readOnly map[string]bool) bool {
+	var patch map[string]interface{}
+	if err := apiDecode(w, req, &patch); err != nil {
+		apiFail(w, http.StatusBadRequest, err.Error(), nil)
+		return false
+	}
+	var errs formErrors
+	for k, v := range patch {
+		if _, ok := values[k]; !ok || readOnly[k] {
+			if readOnly[k] {
+				errs = append(errs, fieldError{k, fmt.Sprintf("Field '%v' can only be changed on the config page", k)})
+			} else {
+				errs = append(errs, fieldError{k, fmt.Sprintf("Unknown field '%v'", k)})
+			}
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			values[k] = v
+		case json.Number:
+			values[k] = v.String()
+		case bool:
+			values[k] = ""
+			if v {
+				values[k] = "true"
+			}
+		case nil:
+			values[k] = ""
+		default:
+			errs = append(errs, fieldError{k, fmt.Sprintf("Field '%v' should be a string, number, boolean or null", k)})
+		}
+	}
+	if len(errs) > 0 {
+		apiFail(w, http.StatusUnprocessableEntity, "Invalid fields", errs)
+		return false
+	}
+	return true
+}
+
+// FormRequest returns a request with values as posted form, as read by the update functions.
+func formRequest(values map[string]string) *http.Request {
+	form := url.Values{}
+	for k, v := range values {
+		form.Set(k, v)
+	}
+	return &http.Request{PostForm: form}
+}
+
+// Checkbox returns the value of a checkbox on the config page.
+func checkbox(b bool) string {
+	if b {
+		return "true"
+	}
+	return ""
+}
+
+/* SunscreenForm returns the config of sunscreen s as the values of the fields on
+the config page, without the suffixed Id. The caller should hold muSunscrn.*/
+func sunscreenForm(s *Sunscreen) map[string]string {
+	values := map[string]string{
+		"Name":          s.Name,
+		"Sensor":        fmt.Sprint(s.Sensor),
+		"AutoStart":     checkbox(s.AutoStart),
+		"Start":         hourMinute(s.Start),
+		"SunStart":      minutes(s.SunStart),
+		"AutoStop":      checkbox(s.AutoStop),
+		"Stop":          hourMinute(s.Stop),
+		"SunStop":       minutes(s.SunStop),
+		"StopLimit":     minutes(s.StopLimit),
+		"DurDown":       seconds(s.DurDown),
+		"DurUp":         seconds(s.DurUp),
+		"Presets":       presetsToString(s.Presets),
+		"AutoPreset":    s.AutoPreset,
+		"Rehome":        fmt.Sprint(s.Rehome),
+		"Actuator":      s.Actuator,
+		"Device":        s.Device,
+		"DeviceUrl":     s.DeviceUrl,
+		"RtsPin":        "",
+		"RtsAddress":    hex(s.RtsAddress),
+		"Polarity":      s.Polarity,
+		"DeadTime":      milliseconds(s.DeadTime),
+		"PinDown":       s.PinDown.String(),
+		"PinUp":         s.PinUp.String(),
+		"LimitUp":       "",
+		"LimitDown":     "",
+		"LimitTimeout":  seconds(s.LimitTimeout),
+		"KnxUpDown":     s.KnxUpDown,
+		"KnxStop":       s.KnxStop,
+		"KnxPosition":   s.KnxPosition,
+		"KnxState":      s.KnxState,
+		"IgnoreRain":    checkbox(s.IgnoreRain),
+		"IndoorMin":     optionalFloat(s.IndoorMin),
+		"IndoorMax":     optionalFloat(s.IndoorMax),
+		"OutdoorMin":    optionalFloat(s.OutdoorMin),
+		"OutdoorMax":    optionalFloat(s.OutdoorMax),
+		"ForecastLower": checkbox(s.ForecastLower),
+	}
+	if s.Actuator == actuatorRTS {
+		values["RtsPin"] = s.RtsPin.String()
+	}
+	if s.LimitUp != nil {
+		values["LimitUp"] = s.LimitUp.String()
+	}
+	if s.LimitDown != nil {
+		values["LimitDown"] = s.LimitDown.String()
+	}
+	return values
+}
+
+/* LightsensorForm returns the config of the light sensor as the values of the
+fields on the config page. The caller should hold muLS.*/
+func lightsensorForm() map[string]string {
+	values := map[string]string{
+		"Good":         fmt.Sprint(ls.Good),
+		"Neutral":      fmt.Sprint(ls.Neutral),
+		"Bad":          fmt.Sprint(ls.Bad),
+		"TimesGood":    fmt.Sprint(ls.TimesGood),
+		"TimesNeutral": fmt.Sprint(ls.TimesNeutral),
+		"TimesBad":     fmt.Sprint(ls.TimesBad),
+		"Outliers":     fmt.Sprint(ls.Outliers),
+		"Fusion":       ls.Fusion,
+		"Interval":     seconds(ls.Interval),
+	}
+	for _, sn := range ls.Sensors {
+		values[fmt.Sprintf("SensorName-%v", sn.Id)] = sn.Name
+		values[fmt.Sprintf("SensorPin-%v", sn.Id)] = sn.Pin.String()
+		values[fmt.Sprintf("LightFactor-%v", sn.Id)] = fmt.Sprint(sn.LightFactor)
+	}
+	return values
+}
+
+/* ConfigForm returns the general config as the values of the fields on the
+config page. Passwords are empty, as an empty password is not changed. The caller
+should hold muConf.*/
+func configForm() map[string]string {
+	values := map[string]string{
+		"RefreshRate":        minutes(config.RefreshRate),
+		"MoveHistory":        fmt.Sprint(config.MoveHistory),
+		"LogRecords":         fmt.Sprint(config.LogRecords),
+		"IpWhitelist":        sliceToString(config.IpWhitelist),
+		"Port":               fmt.Sprint(config.Port),
+		"Cert":               config.Cert,
+		"Key":                config.Key,
+		"Username":           config.Username,
+		"EnableMail":         checkbox(config.EnableMail),
+		"MailFrom":           config.MailFrom,
+		"MailUser":           config.MailUser,
+		"MailPass":           "",
+		"MailTo":             sliceToString(config.MailTo),
+		"MailHost":           config.MailHost,
+		"MailPort":           fmt.Sprint(config.MailPort),
+		"EnableMqtt":         checkbox(config.EnableMqtt),
+		"MqttHost":           config.MqttHost,
+		"MqttPort":           "",
+		"MqttUser":           config.MqttUser,
+		"MqttPass":           "",
+		"MqttTopic":          config.MqttTopic,
+		"MqttDiscovery":      checkbox(config.MqttDiscovery),
+		"EnableInflux":       checkbox(config.EnableInflux),
+		"InfluxUrl":          config.InfluxUrl,
+		"InfluxToken":        "",
+		"EnableModbus":       checkbox(config.EnableModbus),
+		"ModbusPort":         "",
+		"EnableHomekit":      checkbox(config.EnableHomekit),
+		"HomekitName":        config.HomekitName,
+		"HomekitPort":        "",
+		"EnableKnx":          checkbox(config.EnableKnx),
+		"KnxGateway":         config.KnxGateway,
+		"KnxLight":           config.KnxLight,
+		"EnableWind":         checkbox(config.EnableWind),
+		"WindPin":            "",
+		"WindFactor":         fmt.Sprint(config.WindFactor),
+		"WindLock":           fmt.Sprint(config.WindLock),
+		"WindRelease":        fmt.Sprint(config.WindRelease),
+		"WindCalm":           minutes(config.WindCalm),
+		"EnableRain":         checkbox(config.EnableRain),
+		"RainPin":            "",
+		"RainPolarity":       config.RainPolarity,
+		"RainDebounce":       seconds(config.RainDebounce),
+		"RainDry":            minutes(config.RainDry),
+		"EnableTemp":         checkbox(config.EnableTemp),
+		"TempIndoor":         config.TempIndoor,
+		"TempOutdoor":        config.TempOutdoor,
+		"EnableFrost":        checkbox(config.EnableFrost),
+		"FrostTemp":          fmt.Sprint(config.FrostTemp),
+		"Latitude":           fmt.Sprint(config.Location.Latitude),
+		"Longitude":          fmt.Sprint(config.Location.Longitude),
+		"UtcOffset":          fmt.Sprint(config.Location.UtcOffset),
+		"EnableForecast":     checkbox(config.EnableForecast),
+		"ForecastProvider":   config.ForecastProvider,
+		"ForecastUrl":        config.ForecastUrl,
+		"ForecastMaxTemp":    fmt.Sprint(config.ForecastMaxTemp),
+		"ForecastCloudCover": fmt.Sprint(config.ForecastCloudCover),
+	}
+	if config.MqttPort != 0 {
+		values["MqttPort"] = fmt.Sprint(config.MqttPort)
+	}
+	if config.ModbusPort != 0 {
+		values["ModbusPort"] = fmt.Sprint(config.ModbusPort)
+	}
+	if config.HomekitPort != 0 {
+		values["HomekitPort"] = fmt.Sprint(config.HomekitPort)
+	}
+	if config.WindPin != (Pin{}) {
+		values["WindPin"] = config.WindPin.String()
+	}
+	if config.RainPin != (Pin{}) {
+		values["RainPin"] = config.RainPin.String()
+	}
+	return values
+}
+
+/* ApiHistory responds with the movement or light history, newest first. The
+optional query limit sets the maximum number of records.*/
+func apiHistory(w http.ResponseWriter, req *http.Request, kind string) {
+	limit := -1
+	if v := req.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			apiFail(w, http.StatusBadRequest, "Invalid query", formErrors{{"limit", fmt.Sprintf("Limit '%v' should be a positive number", v)}})
+			return
+		}
+		limit = n
+	}
+	file := fileStats
+	if kind == "light" {
+		file = fileLight
+	}
+	rows := reverseXSS(readCSV(file))
+	if limit >= 0 && len(rows) > limit {
+		rows = rows[:limit]
+	}
+	if kind == "light" {
+		apiRespond(w, http.StatusOK, lightHistory(rows))
+		return
+	}
+	apiRespond(w, http.StatusOK, movementHistory(rows))
+}
+
+/* MovementHistory converts the rows of fileStats (time, mode, position, light,
+Id of the sunscreen and safety locks) to movements. Rows that cannot be read are skipped.*/
+func movementHistory(rows [][]string) []apiMovement {
+	muSunscrn.Lock()
+	names := map[int]string{}
+	for _, s := range sunscreens {
+		names[s.Id] = s.Name
+	}
+	muSunscrn.Unlock()
+	movements := []apiMovement{}
+	for _, row := range rows {
+		if len(row) < 3 {
+			continue
+		}
+		t, err := time.ParseInLocation("02-01-2006 15:04:05", row[0], time.Local)
+		if err != nil {
+			continue
+		}
+		m := apiMovement{Time: t, Mode: row[1], Position: row[2], Light: []int{}}
+		if len(row) > 3 {
+			for _, f := range strings.Fields(strings.Trim(row[3], "[]")) {
+				if l, err := strconv.Atoi(f); err == nil {
+					m.Light = append(m.Light, l)
+				}
+			}
+		}
+		if len(row) > 4 {
+			m.Id, _ = strconv.Atoi(row[4])
+			m.Name = names[m.Id]
+		}
+		if len(row) > 5 {
+			m.Lock = row[5]
+		}
+		movements = append(movements, m)
+	}
+	return movements
+}
+
+/* LightHistory converts the rows of fileLight (time, light and sensor=light per
+sensor) to measurements. Rows that cannot be read are skipped.*/
+func lightHistory(rows [][]string) []apiLight {
+	lights := []apiLight{}
+	for _, row := range rows {
+		if len(row) < 2 {
+			continue
+		}
+		t, err := time.ParseInLocation("02-01-2006 15:04:05", row[0], time.Local)
+		if err != nil {
+			continue
+		}
+		l, err := strconv.Atoi(row[1])
+		if err != nil {
+			continue
+		}
+		m := apiLight{Time: t, Light: l, Sensors: map[string]int{}}
+		for _, f := range row[2:] {
+			if i := strings.LastIndex(f, "="); i > 0 {
+				if v, err := strconv.Atoi(f[i+1:]); err == nil {
+					m.Sensors[f[:i]] = v
+				}
+			}
+		}
+		lights = append(lights, m)
+	}
+	return lights
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// setupApi sets up a sunscreen, light sensor and config with user admin and password secret.
+func setupApi(t *testing.T) *Sunscreen {
+	inTempDir(t)
+	hw = newSimGPIO()
+	password, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	muConf.Lock()
+	config = Config{Username: "admin", Password: password, Port: 8081, MoveHistory: 10, MailPort: 25, MqttPass: "mqttsecret"}
+	muConf.Unlock()
+	s := &Sunscreen{Id: 1, Name: "Front", Mode: auto, Position: up, Actuator: actuatorRelay, Polarity: activeLow,
+		Device: deviceShelly, PinDown: Pin{Line: 1}, PinUp: Pin{Line: 2}, DurDown: 20 * time.Second, DurUp: 30 * time.Second}
+	muSunscrn.Lock()
+	sunscreens = []*Sunscreen{s}
+	muSunscrn.Unlock()
+	muLS.Lock()
+	ls = &LightSensor{Good: 10, Neutral: 20, Bad: 30, TimesGood: 5, TimesNeutral: 5, TimesBad: 5, Fusion: fusionMedian,
+		Interval: time.Minute, Sensors: []Sensor{{Id: 1, Name: "Roof", Pin: Pin{Line: 4}, LightFactor: 1, Data: []int{42}}}, Data: []int{42}}
+	muLS.Unlock()
+	return s
+}
+
+// apiRequest sends a request with basic authentication to the API and decodes the response into v.
+func apiRequest(t *testing.T, method, path, body string, v interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	handlerAPI(w, req)
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%v %v: want JSON, got content type '%v'", method, path, ct)
+	}
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%v %v: invalid JSON response '%v' (%v)", method, path, w.Body.String(), err)
+		}
+	}
+	return w
+}
+
+func TestApiAuth(t *testing.T) {
+	setupApi(t)
+	for _, user := range []string{"", "admin:wrong", "root:secret"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/status", nil)
+		if user != "" {
+			parts := strings.Split(user, ":")
+			req.SetBasicAuth(parts[0], parts[1])
+		}
+		w := httptest.NewRecorder()
+		handlerAPI(w, req)
+		var e apiError
+		json.Unmarshal(w.Body.Bytes(), &e)
+		if w.Code != http.StatusUnauthorized || e.Error == "" {
+			t.Errorf("'%v': want 401 with error, got %v %v", user, w.Code, w.Body.String())
+		}
+	}
+	var status struct {
+		Sunscreens []apiSunscreen
+		Light      *int
+	}
+	if w := apiRequest(t, http.MethodGet, "/api/v1/status", "", &status); w.Code != http.StatusOK {
+		t.Fatalf("Want 200, got %v", w.Code)
+	}
+	if len(status.Sunscreens) != 1 || status.Sunscreens[0].Position != up || status.Light == nil || *status.Light != 42 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+}
+
+func TestApiErrors(t *testing.T) {
+	setupApi(t)
+	tests := []struct {
+		method, path, body string
+		code               int
+	}{
+		{http.MethodGet, "/api/v1/unknown", "", http.StatusNotFound},
+		{http.MethodGet, "/api/v1/sunscreens/2/config", "", http.StatusNotFound},
+		{http.MethodGet, "/api/v1/sunscreens/1/command", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/api/v1/sunscreens/1/command", "{", http.StatusBadRequest},
+		{http.MethodPost, "/api/v1/sunscreens/1/command", `{"Action": "sideways"}`, http.StatusUnprocessableEntity},
+		{http.MethodPost, "/api/v1/sunscreens/1/command", `{"Action": "goto", "Position": 120}`, http.StatusUnprocessableEntity},
+		{http.MethodGet, "/api/v1/history/light?limit=x", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		var e apiError
+		if w := apiRequest(t, tt.method, tt.path, tt.body, &e); w.Code != tt.code || e.Error == "" {
+			t.Errorf("%v %v: want %v with error, got %v %+v", tt.method, tt.path, tt.code, w.Code, e)
+		}
+	}
+	w := apiRequest(t, http.MethodDelete, "/api/v1/config", "", nil)
+	if allow := w.Header().Get("Allow"); allow != "GET, PATCH" {
+		t.Errorf("Want Allow 'GET, PATCH', got '%v'", allow)
+	}
+}
+
+func TestApiCommand(t *testing.T) {
+	s := setupApi(t)
+	var resp struct {
+		Mode    string
+		Command *Command
+	}
+	w := apiRequest(t, http.MethodPost, "/api/v1/sunscreens/1/command", `{"Action": "goto", "Position": 40}`, &resp)
+	if w.Code != http.StatusAccepted || resp.Mode != manual || resp.Command == nil || resp.Command.Target != 40 || resp.Command.Source != srcApi {
+		t.Errorf("Want 202 with goto 40%% from api, got %v %+v", w.Code, resp)
+	}
+	w = apiRequest(t, http.MethodPost, "/api/v1/sunscreens/1/command", `{"Action": "auto"}`, &resp)
+	if w.Code != http.StatusOK || resp.Mode != auto || resp.Command != nil {
+		t.Errorf("Want 200 with mode auto, got %v %+v", w.Code, resp)
+	}
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	s.closeQueue()
+}
+
+func TestApiSunscreenConfig(t *testing.T) {
+	s := setupApi(t)
+	var values map[string]string
+	apiRequest(t, http.MethodGet, "/api/v1/sunscreens/1/config", "", &values)
+	if values["DurUp"] != "30" || values["PinUp"] != "2" || values["AutoStart"] != "" {
+		t.Errorf("Unexpected config %v", values)
+	}
+	w := apiRequest(t, http.MethodPatch, "/api/v1/sunscreens/1/config", `{"DurUp": 45, "Name": "Back"}`, &values)
+	if w.Code != http.StatusOK || values["DurUp"] != "45" || s.DurUp != 45*time.Second || s.Name != "Back" {
+		t.Errorf("Want DurUp 45 and name Back, got %v %v", w.Code, values)
+	}
+	// An invalid patch is rejected completely
+	var e apiError
+	w = apiRequest(t, http.MethodPatch, "/api/v1/sunscreens/1/config", `{"DurDown": "slow", "Name": "Side", "Colour": "red"}`, &e)
+	if w.Code != http.StatusUnprocessableEntity || e.Fields["Colour"] == "" {
+		t.Errorf("Want 422 for unknown field, got %v %+v", w.Code, e)
+	}
+	w = apiRequest(t, http.MethodPatch, "/api/v1/sunscreens/1/config", `{"DurDown": "slow", "Name": "Side", "Start": "9"}`, &e)
+	if w.Code != http.StatusUnprocessableEntity || e.Fields["DurDown"] == "" || e.Fields["Start"] == "" {
+		t.Errorf("Want 422 for DurDown and Start, got %v %+v", w.Code, e)
+	}
+	if s.Name != "Back" || s.DurDown != 20*time.Second {
+		t.Errorf("Sunscreen should not change after an invalid patch, got '%v' %v", s.Name, s.DurDown)
+	}
+}
+
+func TestApiConfig(t *testing.T) {
+	setupApi(t)
+	var values map[string]string
+	w := apiRequest(t, http.MethodPatch, "/api/v1/config", `{"MoveHistory": 20, "EnableMail": true}`, &values)
+	if w.Code != http.StatusOK || values["MoveHistory"] != "20" || values["EnableMail"] != "true" || config.MoveHistory != 20 {
+		t.Errorf("Want MoveHistory 20 with mail enabled, got %v %v", w.Code, values)
+	}
+	if _, ok := values["MqttPass"]; ok || config.MqttPass != "mqttsecret" {
+		t.Errorf("MQTT password should be kept and not be returned, got %v", values)
+	}
+	var e apiError
+	w = apiRequest(t, http.MethodPatch, "/api/v1/config", `{"MoveHistory": 30, "Port": 80, "Username": "root"}`, &e)
+	if w.Code != http.StatusUnprocessableEntity || e.Fields["Username"] == "" {
+		t.Errorf("Want 422 for Username, got %v %+v", w.Code, e)
+	}
+	w = apiRequest(t, http.MethodPatch, "/api/v1/config", `{"MoveHistory": 30, "Port": 80}`, &e)
+	if w.Code != http.StatusUnprocessableEntity || e.Fields["Port"] == "" || config.MoveHistory != 20 {
+		t.Errorf("Want 422 for Port and unchanged config, got %v %+v (MoveHistory %v)", w.Code, e, config.MoveHistory)
+	}
+	// Light sensor
+	w = apiRequest(t, http.MethodPatch, "/api/v1/lightsensor/config", `{"Good": 40, "LightFactor-1": 3}`, &e)
+	if w.Code != http.StatusUnprocessableEntity || e.Fields["Good"] == "" || ls.Sensors[0].LightFactor != 1 {
+		t.Errorf("Want 422 for Good and unchanged light sensor, got %v %+v", w.Code, e)
+	}
+	w = apiRequest(t, http.MethodPatch, "/api/v1/lightsensor/config", `{"Good": 15, "LightFactor-1": 3}`, &values)
+	if w.Code != http.StatusOK || ls.Good != 15 || ls.Sensors[0].LightFactor != 3 || values["SensorName-1"] != "Roof" {
+		t.Errorf("Want Good 15 and LightFactor 3, got %v %v", w.Code, values)
+	}
+}
+
+func TestApiConfigConcurrent(t *testing.T) {
+	setupApi(t)
+	var wg sync.WaitGroup
+	for i := 1; i <= 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			apiRequest(t, http.MethodPatch, "/api/v1/config", fmt.Sprintf(`{"MoveHistory": %v}`, i), nil)
+		}(i)
+		go func() {
+			defer wg.Done()
+			apiRequest(t, http.MethodPatch, "/api/v1/config", `{"MoveHistory": 99, "Port": 80}`, nil)
+		}()
+	}
+	wg.Wait()
+	// An invalid patch should neither be applied nor undo a concurrent valid patch
+	var saved Config
+	if err := readJSON(fileConfig, &saved); err != nil {
+		t.Fatal(err)
+	}
+	muConf.Lock()
+	defer muConf.Unlock()
+	if config.MoveHistory == 99 || config.MoveHistory != saved.MoveHistory {
+		t.Errorf("Want saved MoveHistory %v in config, got %v", saved.MoveHistory, config.MoveHistory)
+	}
+}
+
+func TestRestartChangedServices(t *testing.T) {
+	setupApi(t)
+	old := services
+	t.Cleanup(func() { services = old })
+	var started []string
+	services = []service{
+		{func(c *Config) interface{} { return c.MoveHistory }, func() { started = append(started, "history") }},
+		{func(c *Config) interface{} { return [2]interface{}{c.EnableMail, c.MailPort} }, func() { started = append(started, "mail") }},
+	}
+	apiRequest(t, http.MethodPatch, "/api/v1/config", `{"MoveHistory": 20}`, nil)
+	apiRequest(t, http.MethodPatch, "/api/v1/config", `{"MoveHistory": 20, "Port": 80}`, nil)
+	apiRequest(t, http.MethodPatch, "/api/v1/config", `{"MailPort": 587}`, nil)
+	if !reflect.DeepEqual(started, []string{"history", "mail"}) {
+		t.Errorf("Want services restarted once their settings changed, got %v", started)
+	}
+}
+
+func TestLastLight(t *testing.T) {
+	setupApi(t)
+	muLS.Lock()
+	ls.Data = addData(ls.Data, 10, 7)
+	ls.Sensors[0].Data = addData(ls.Sensors[0].Data, 10, 8)
+	muLS.Unlock()
+	var status struct {
+		Light   *int
+		Sensors []apiSensor
+	}
+	apiRequest(t, http.MethodGet, "/api/v1/status", "", &status)
+	if status.Light == nil || *status.Light != 7 || len(status.Sensors) != 1 || status.Sensors[0].Light == nil || *status.Sensors[0].Light != 8 {
+		t.Errorf("Want newest light 7 and sensor light 8, got %+v", status)
+	}
+	if l := lastLight(nil); l != nil {
+		t.Errorf("Want no light without data, got %v", *l)
+	}
+}
+
+func TestApiHistory(t *testing.T) {
+	setupApi(t)
+	appendCSV(fileStats, [][]string{
+		{"01-06-2024 10:00:00", "auto", "down", "[10 20]"},
+		{"01-06-2024 12:00:00", "manual", "up", "[]", "1"},
+	})
+	appendCSV(fileLight, [][]string{{"01-06-2024 10:00:00", "25", "Roof=25", "Wall=30"}})
+	var movements []apiMovement
+	apiRequest(t, http.MethodGet, "/api/v1/history/movements?limit=1", "", &movements)
+	if len(movements) != 1 || movements[0].Name != "Front" || movements[0].Position != up || movements[0].Time.Hour() != 12 {
+		t.Errorf("Want the last movement of Front, got %+v", movements)
+	}
+	apiRequest(t, http.MethodGet, "/api/v1/history/movements", "", &movements)
+	if len(movements) != 2 || len(movements[1].Light) != 2 || movements[1].Id != 0 {
+		t.Errorf("Want 2 movements, the first without sunscreen, got %+v", movements)
+	}
+	var lights []apiLight
+	apiRequest(t, http.MethodGet, "/api/v1/history/light", "", &lights)
+	if len(lights) != 1 || lights[0].Light != 25 || lights[0].Sensors["Wall"] != 30 {
+		t.Errorf("Unexpected light history %+v", lights)
+	}
+}
@@ -1,14 +1,14 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/smtp"
 	"os"
+	"strings"
 	"sync"
 	"time"
-
-	"github.com/stianeikeland/go-rpio/v4"
 )
 
 // Constants for config folder and files
@@ -17,6 +17,8 @@ const (
 	fileConfig      = "./config/config.json"
 	fileSunscrn     = "./config/sunscreen.json"
 	fileLightsensor = "./config/lightsensor.json"
+	fileRTS         = "./config/rts.json"
+	fileHomekit     = "./config/homekit.json"
 	folderLog       = "logs"
 	fileLog         = "./logs/logfile.log"
 	fileStats       = "./logs/sunscreen_stats.csv"
@@ -24,9 +26,9 @@ const (
 )
 
 var (
-	ls     = &LightSensor{}
-	s      = &Sunscreen{}
-	config Config
+	ls         = &LightSensor{}
+	sunscreens = []*Sunscreen{}
+	config     Config
 )
 
 var (
@@ -49,6 +51,13 @@ func init() {
 // TODO: review global/local funcs and vars
 
 func main() {
+	hardware := flag.String("hardware", hwRpio, "GPIO backend to use: rpio, chardev or sim")
+	simWind := flag.Float64("sim-wind", 0, "Pulse frequency in Hz of the simulated anemometer")
+	flag.StringVar(&w1Dir, "w1-dir", w1Dir, "Directory of the 1-Wire devices in sysfs, e.g. to use a fake directory")
+	simRain := flag.Bool("sim-rain", false, "Simulated rain sensor detects rain")
+	simLight := flag.String("sim-light", "", "Comma separated light values (RC counts) returned in turn by the simulated light sensors, use ';' to separate the values per sensor")
+	flag.Parse()
+
 	// TODO: check if below can be stored in a separate func
 	// Open logfile or create if not exists
 	f, err := os.OpenFile(fileLog, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
@@ -60,27 +69,115 @@ func main() {
 	log.SetOutput(f)
 	log.Println("--------Start of program--------")
 
-	// Open connection RPIO pins
-	rpio.Open()
+	// Open connection GPIO pins
+	hw, err = newGPIO(*hardware)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = hw.Open(); err != nil {
+		log.Fatal("Unable to open GPIO:", err)
+	}
 	loadConfig()
-	s.init()
-	updateStartStop(s, ls, 0)
+	if sim, ok := hw.(*simGPIO); ok && *simLight != "" {
+		// Scripts are separated by ';' and assigned to the sensors in order, a single script is used for all sensors
+		scripts := strings.Split(*simLight, ";")
+		for i, sn := range ls.Sensors {
+			script, err := parseSimScript(scripts[min(i, len(scripts)-1)])
+			if err != nil {
+				log.Fatal(err)
+			}
+			sim.SetLight(sn.Pin, script)
+		}
+	}
+	if sim, ok := hw.(*simGPIO); ok && *simWind > 0 {
+		sim.SetFrequency(config.WindPin, *simWind)
+	}
+	if sim, ok := hw.(*simGPIO); ok && config.EnableRain {
+		// The simulated rain sensor reads dry, unless rain is simulated
+		level := Low
+		if (config.RainPolarity == activeHigh) == *simRain {
+			level = High
+		}
+		sim.SetLevel(config.RainPin, level)
+	}
+	for _, s := range sunscreens {
+		s.init()
+	}
+	updateStartStop(ls, 0)
+	for _, sv := range services {
+		sv.start()
+	}
+	go events.watchSunscreens(nil)
 
 	log.Println("Starting monitor")
 	if ls != nil {
-		go ls.MonitorMove(s)
+		go ls.MonitorMove()
 	}
 	startServer()
 }
 
-// UpdateStartStop resets all start/stop to today + d (e.g. d=0 resets it to today.
-func updateStartStop(s *Sunscreen, ls *LightSensor, d int) {
-	s.resetStartStop(d)
+// Service is a subsystem that is started with its settings in config.
+type service struct {
+	settings func(c *Config) interface{} // Settings of the service in c, they should be comparable
+	start    func()                      // (Re)starts the service with the settings in config
+}
+
+// Services are started in this order, e.g. frost protection after the temperature sensors it depends on.
+var services = []service{
+	{func(c *Config) interface{} {
+		return [7]interface{}{c.EnableMqtt, c.MqttHost, c.MqttPort, c.MqttUser, c.MqttPass, c.MqttTopic, c.MqttDiscovery}
+	}, startMqtt},
+	{func(c *Config) interface{} { return [3]interface{}{c.EnableInflux, c.InfluxUrl, c.InfluxToken} }, startInflux},
+	{func(c *Config) interface{} { return [2]interface{}{c.EnableModbus, c.ModbusPort} }, startModbus},
+	{func(c *Config) interface{} { return [3]interface{}{c.EnableHomekit, c.HomekitName, c.HomekitPort} }, startHomekit},
+	{func(c *Config) interface{} { return [3]interface{}{c.EnableKnx, c.KnxGateway, c.KnxLight} }, startKnx},
+	{func(c *Config) interface{} { return [2]interface{}{c.EnableWind, c.WindPin} }, startWind},
+	{func(c *Config) interface{} { return [3]interface{}{c.EnableRain, c.RainPin, c.RainPolarity} }, startRain},
+	{func(c *Config) interface{} { return [3]interface{}{c.EnableTemp, c.TempIndoor, c.TempOutdoor} }, startTemp},
+	{func(c *Config) interface{} { return [2]interface{}{c.EnableFrost, c.FrostTemp} }, startFrost},
+	{func(c *Config) interface{} {
+		return [5]interface{}{c.EnableForecast, c.ForecastProvider, c.ForecastUrl, c.Location.Latitude, c.Location.Longitude}
+	}, startForecast},
+}
+
+// RestartChangedServices restarts the services of which the settings in config differ from those in old.
+func restartChangedServices(old Config) {
+	muConf.Lock()
+	c := config
+	muConf.Unlock()
+	for _, sv := range services {
+		if sv.settings(&old) != sv.settings(&c) {
+			sv.start()
+		}
+	}
+}
+
+/* UpdateStartStop resets all start/stop of the sunscreens to today + d (e.g. d=0
+resets it to today) and sets the start/stop of the light sensor so it covers the
+earliest start and latest stop of all sunscreens.*/
+func updateStartStop(ls *LightSensor, d int) {
+	screens := listSunscreens()
+	for _, s := range screens {
+		s.resetStartStop(d)
+	}
+	// Without sunscreens, light is not monitored until the next day
+	start := time.Date(time.Now().Year(), time.Now().Month(), time.Now().Day(), 0, 0, 0, 0, time.Now().Location()).AddDate(0, 0, d+1)
+	stop := start
+	muSunscrn.Lock()
+	for i, s := range screens {
+		if i == 0 || s.Start.Before(start) {
+			start = s.Start
+		}
+		if i == 0 || s.Stop.After(stop) {
+			stop = s.Stop
+		}
+	}
+	muSunscrn.Unlock()
 	// Light sensor should start in time so at sunscreen start enough light has been gathered
 	muLS.Lock()
 	dur := time.Duration((max(ls.TimesGood, ls.TimesNeutral, ls.TimesBad)+ls.Outliers)/int(ls.Interval.Minutes())) * time.Minute
-	ls.Start = s.Start.Add(-dur)
-	ls.Stop = s.Stop.Add(time.Duration(30 * time.Minute))
+	ls.Start = start.Add(-dur)
+	ls.Stop = stop.Add(time.Duration(30 * time.Minute))
 	muLS.Unlock()
 }
 
@@ -108,6 +205,9 @@ func min(xi ...int) int {
 
 // SendMail sends mail to
 func sendMail(subj, body string) {
+	muConf.Lock()
+	config := config
+	muConf.Unlock()
 	if config.EnableMail {
 		//Format message
 		var msgTo string
@@ -130,6 +230,7 @@ func sendMail(subj, body string) {
 		err := smtp.SendMail(fmt.Sprintf("%v:%v", config.MailHost, config.MailPort), auth, config.MailFrom, config.MailTo, msg)
 		if err != nil {
 			log.Println("Unable to send mail:", err)
+			countMailFailure()
 			return
 		}
 		log.Println("Send mail to", config.MailTo)
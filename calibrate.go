@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Constants for the steps of a calibration
+const (
+	calHoming = "homing"    // Moving up until the user presses stop or the limit switch closes
+	calReady  = "ready"     // Sunscreen is up, ready to measure down
+	calDown   = "measuring" // Measuring the duration down
+	calAtDown = "down"      // Sunscreen is down, ready to measure up
+	calUp     = "returning" // Measuring the duration up
+	calDone   = "done"      // Both durations are measured and can be saved
+)
+
+// calibrateMax is the maximum time the motor runs during a calibration step.
+const calibrateMax = 5 * time.Minute
+
+/* Calibration represents the measurement of the travel times of a sunscreen.
+The sunscreen is first moved up to a known end, after which a full travel down
+and up are timed. Each travel ends when the user presses stop or the limit
+switch in that direction closes.*/
+type Calibration struct {
+	Step    string        // Current step of the calibration
+	DurDown time.Duration // Measured duration to move down
+	DurUp   time.Duration // Measured duration to move up
+	Err     string        // Error of the last step, if any
+}
+
+/* Calibrate takes an action (start, next, stop, save or cancel) and advances
+the calibration of the sunscreen accordingly. The caller should hold muSunscrn.*/
+func (s *Sunscreen) calibrate(action string) error {
+	cal := s.calibration
+	switch action {
+	case "start":
+		if cal != nil {
+			return fmt.Errorf("Sunscreen '%v' is being calibrated already", s.Name)
+		}
+		if s.actuator == nil {
+			return fmt.Errorf("Actuator of sunscreen '%v' is not initiated, please check its configuration", s.Name)
+		}
+		s.submit(newCommand(cmdStop, 0, srcWeb))
+		if s.Mode != manual {
+			log.Printf("Mode of sunscreen '%v' is set to manual for calibration", s.Name)
+			s.Mode = manual
+		}
+		s.calibration = &Calibration{Step: calHoming}
+		if c := s.submit(newCommand(cmdCalibrate, 0, srcWeb)); c.Status == cmdCancelled {
+			s.calibration = nil
+			return fmt.Errorf("Unable to start calibration of sunscreen '%v': %v", s.Name, c.Err)
+		}
+		log.Printf("Started calibration of sunscreen '%v'", s.Name)
+	case "next":
+		step, target := "", 0
+		switch {
+		case cal == nil:
+			return fmt.Errorf("Sunscreen '%v' is not being calibrated", s.Name)
+		case cal.Step == calReady:
+			step, target = calDown, 100
+		case cal.Step == calAtDown:
+			step, target = calUp, 0
+		default:
+			return fmt.Errorf("Unable to continue calibration of sunscreen '%v' while %v", s.Name, cal.Step)
+		}
+		// The step is set before submitting, as the worker may start measuring right away
+		previous := cal.Step
+		cal.Step, cal.Err = step, ""
+		if c := s.submit(newCommand(cmdCalibrate, target, srcWeb)); c.Status == cmdCancelled {
+			cal.Step, cal.Err = previous, c.Err
+			return fmt.Errorf("Unable to continue calibration of sunscreen '%v': %v", s.Name, c.Err)
+		}
+	case "stop":
+		s.submit(newCommand(cmdStop, 0, srcWeb))
+	case "save":
+		if cal == nil || cal.Step != calDone {
+			return fmt.Errorf("Calibration of sunscreen '%v' is not done", s.Name)
+		}
+		s.DurDown, s.DurUp = cal.DurDown, cal.DurUp
+		s.calibration = nil
+		saveSunscreens()
+		log.Printf("Saved calibration of sunscreen '%v': %v down and %v up", s.Name, s.DurDown, s.DurUp)
+	case "cancel":
+		if cal == nil {
+			return nil
+		}
+		s.calibration = nil
+		s.submit(newCommand(cmdStop, 0, srcWeb))
+		log.Printf("Cancelled calibration of sunscreen '%v'", s.Name)
+	default:
+		return fmt.Errorf("Unknown calibration action '%v'", action)
+	}
+	return nil
+}
+
+/* Measure runs the current step of the calibration: it runs the motor in the
+direction of target until stop is closed or the limit switch closes, and
+stores the measured duration. It should only be called by the worker of the
+sunscreen.*/
+func (s *Sunscreen) measure(target int, stop <-chan struct{}) error {
+	muSunscrn.Lock()
+	cal, a := s.calibration, s.actuator
+	if cal == nil || a == nil {
+		muSunscrn.Unlock()
+		return fmt.Errorf("Sunscreen '%v' is not being calibrated", s.Name)
+	}
+	goUp := target == 0
+	var closed func() bool
+	if limit := s.limit(goUp); limit != nil {
+		closed = func() bool { return hw.Read(*limit) == limitClosed }
+	}
+	s.travelUp = goUp
+	s.Position = moving
+	log.Printf("Calibrating sunscreen '%v': %v", s.Name, cal.Step)
+	muSunscrn.Unlock()
+	// The motor is at its end when the user presses stop or the limit switch closes
+	var elapsed time.Duration
+	err := fmt.Errorf("Stopped before the motor started")
+	if waitDeadTime(a, goUp, stop) {
+		err = a.start(goUp)
+	}
+	if err == nil {
+		elapsed = travelFor(calibrateMax, stop, closed)
+		a.halt(true)
+	}
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	if s.calibration != cal {
+		// Calibration was cancelled during the movement
+		s.Position = unknown
+		saveSunscreens()
+		return nil
+	}
+	if err == nil && elapsed == calibrateMax {
+		err = fmt.Errorf("No end reached within %v", calibrateMax)
+	}
+	if err != nil {
+		s.Position = unknown
+		saveSunscreens()
+		cal.Err = err.Error()
+		return fmt.Errorf("Unable to calibrate sunscreen '%v': %v", s.Name, err)
+	}
+	s.Position, s.Percent, s.Moves = positionOf(target), target, 0
+	elapsed = elapsed.Round(time.Millisecond)
+	switch cal.Step {
+	case calHoming:
+		cal.Step = calReady
+	case calDown:
+		cal.DurDown, cal.Step = elapsed, calAtDown
+	case calUp:
+		cal.DurUp, cal.Step = elapsed, calDone
+	}
+	log.Printf("Calibrating sunscreen '%v': %v after %v", s.Name, cal.Step, elapsed)
+	saveSunscreens()
+	return nil
+}
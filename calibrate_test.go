@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// waitStep waits until the calibration of s reaches step.
+func waitStep(t *testing.T, s *Sunscreen, step string) {
+	for end := time.Now().Add(2 * time.Second); time.Now().Before(end); time.Sleep(5 * time.Millisecond) {
+		muSunscrn.Lock()
+		got := s.calibration.Step
+		muSunscrn.Unlock()
+		if got == step {
+			return
+		}
+	}
+	t.Fatalf("Calibration should reach step %v", step)
+}
+
+func TestCalibrate(t *testing.T) {
+	inTempDir(t)
+	sim := newSimGPIO()
+	hw = sim
+	limitUp, limitDown := Pin{Line: 5}, Pin{Line: 6}
+	s := &Sunscreen{Name: "Test", Mode: auto, Position: unknown, PinDown: Pin{Line: 17}, PinUp: Pin{Line: 22}, DurDown: time.Minute, DurUp: time.Minute, LimitUp: &limitUp, LimitDown: &limitDown}
+	sim.SetLevel(limitUp, High)
+	sim.SetLevel(limitDown, High)
+	s.init()
+	defer func() {
+		muSunscrn.Lock()
+		s.closeQueue()
+		muSunscrn.Unlock()
+	}()
+
+	// Homing is ended by the user
+	muSunscrn.Lock()
+	if err := s.calibrate("start"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Mode != manual {
+		t.Errorf("Mode should be manual during calibration, got %v", s.Mode)
+	}
+	if c := s.submit(newCommand(cmdGoto, 100, srcWeb)); c.Status != cmdCancelled {
+		t.Errorf("Commands should be ignored during calibration, got %v", c.Status)
+	}
+	muSunscrn.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	muSunscrn.Lock()
+	s.calibrate("stop")
+	muSunscrn.Unlock()
+	waitStep(t, s, calReady)
+
+	// Measuring is ended by the limit switches
+	sim.SetLevel(limitUp, limitClosed)
+	muSunscrn.Lock()
+	s.calibrate("next")
+	muSunscrn.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	sim.SetLevel(limitUp, High)
+	sim.SetLevel(limitDown, limitClosed)
+	waitStep(t, s, calAtDown)
+	muSunscrn.Lock()
+	if err := s.calibrate("save"); err == nil {
+		t.Errorf("Calibration should not be saved before it is done")
+	}
+	s.calibrate("next")
+	muSunscrn.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	sim.SetLevel(limitDown, High)
+	sim.SetLevel(limitUp, limitClosed)
+	waitStep(t, s, calDone)
+
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	if err := s.calibrate("save"); err != nil {
+		t.Fatal(err)
+	}
+	if s.DurDown < 100*time.Millisecond || s.DurDown > 300*time.Millisecond || s.DurUp < 50*time.Millisecond || s.DurUp > 250*time.Millisecond {
+		t.Errorf("Want measured durations of about 100ms down and 50ms up, got %v and %v", s.DurDown, s.DurUp)
+	}
+	if s.calibration != nil || s.Position != up {
+		t.Errorf("Calibration should end with the sunscreen up, got %v", s.Position)
+	}
+}
+
+func TestCalibrateLocked(t *testing.T) {
+	inTempDir(t)
+	hw = newSimGPIO()
+	resetFrost(t)
+	s := &Sunscreen{Name: "Test", Mode: manual, Position: up, PinDown: Pin{Line: 17}, PinUp: Pin{Line: 22}, DurDown: time.Minute, DurUp: time.Minute}
+	s.init()
+	muFrost.Lock()
+	frost.Enabled, frost.Locked = true, true
+	muFrost.Unlock()
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	defer s.closeQueue()
+
+	if err := s.calibrate("start"); err == nil || s.calibration != nil {
+		t.Errorf("Want calibration not started during frost lock, got %+v (%v)", s.calibration, err)
+	}
+	// A cancelled step keeps the calibration at its previous step, so it can be continued
+	s.calibration = &Calibration{Step: calReady}
+	if err := s.calibrate("next"); err == nil || s.calibration.Step != calReady || s.calibration.Err != "Locked by frost, confirmation required" {
+		t.Errorf("Want calibration kept ready with error, got %+v (%v)", s.calibration, err)
+	}
+}
@@ -21,6 +21,22 @@ func SaveToJSON(i interface{}, fileName string) {
 	}
 }
 
+/* SaveToJSONPerm stores i into the file fileName like SaveToJSON, but with
+permissions perm, also if the file exists already, e.g. 0600 for a file with
+secrets.*/
+func saveToJSONPerm(i interface{}, fileName string, perm os.FileMode) {
+	bs, err := json.Marshal(i)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = ioutil.WriteFile(fileName, bs, perm); err != nil {
+		log.Fatal("Error", err)
+	}
+	if err = os.Chmod(fileName, perm); err != nil {
+		log.Fatal("Error", err)
+	}
+}
+
 // ReadJSON reads from the given json file location and returns any error.
 // into i interface.
 func readJSON(fname string, i interface{}) error {
@@ -40,6 +56,59 @@ func readJSON(fname string, i interface{}) error {
 	return nil
 }
 
+/*LoadSunscreens reads all sunscreens from fileSunscrn. A file containing a
+single sunscreen (as stored by earlier versions) is converted into a list with
+that sunscreen.*/
+func loadSunscreens() error {
+	sunscreens = []*Sunscreen{}
+	err := readJSON(fileSunscrn, &sunscreens)
+	if err != nil {
+		s := &Sunscreen{}
+		if err2 := readJSON(fileSunscrn, s); err2 != nil {
+			return err
+		}
+		log.Printf("Converted single sunscreen in '%v' to a list of sunscreens", fileSunscrn)
+		sunscreens = []*Sunscreen{s}
+	}
+	maxId := 0
+	for _, s := range sunscreens {
+		maxId = max(maxId, s.Id)
+	}
+	for _, s := range sunscreens {
+		if s.Id == 0 {
+			maxId++
+			s.Id = maxId
+		}
+		if s.Name == "" {
+			s.Name = fmt.Sprintf("Sunscreen %v", s.Id)
+		}
+		if s.Mode == "" {
+			s.Mode = manual
+		}
+		if s.Actuator == "" {
+			s.Actuator = actuatorRelay
+		}
+		if s.Device == "" {
+			s.Device = deviceShelly
+		}
+		if s.Polarity == "" {
+			// Relays were always active low before the polarity could be configured
+			s.Polarity = activeLow
+			s.DeadTime = relayDeadTime
+		}
+		switch s.Position {
+		case "", moving:
+			// Position is lost if the program stopped while moving
+			s.Position = unknown
+		case up:
+			s.Percent = 0
+		case down:
+			s.Percent = 100
+		}
+	}
+	return nil
+}
+
 /*LoadConfig reads the JSON file from fname and does some initial checks.
 This should only be called at start-up when no race conditions can occur,
 since no mutex is implemented in this func.*/
@@ -58,21 +127,55 @@ func loadConfig() {
 		pw := []uint8{36, 50, 97, 36, 48, 52, 36, 71, 89, 66, 56, 116, 79, 102, 65, 57, 52, 84, 114, 82, 46, 107, 89, 65, 65, 71, 73, 77, 79, 76, 108, 81, 69, 114, 99, 68, 104, 52, 88, 81, 79, 89, 115, 81, 78, 99, 69, 53, 53, 73, 73, 97, 73, 114, 71, 70, 50, 81, 103, 46}
 		config.Password = pw
 	}
+	if config.ForecastProvider == "" {
+		config.ForecastProvider = providerOpenMeteo
+	}
+	// Default forecast policy for configs saved before it existed, zero thresholds that were saved are kept
+	saved := struct{ ForecastMaxTemp, ForecastCloudCover *float64 }{}
+	readJSON(fileConfig, &saved)
+	if saved.ForecastMaxTemp == nil {
+		config.ForecastMaxTemp = 28
+	}
+	if saved.ForecastCloudCover == nil {
+		config.ForecastCloudCover = 30
+	}
 	if config.RefreshRate == time.Duration(0) {
 		config.RefreshRate, err = time.ParseDuration("1h")
 		log.Fatal("Error setting default refreshrate:", err)
 	}
 
-	// Load sunscreen
-	err = readJSON(fileSunscrn, &s)
+	// Load sunscreens
+	err = loadSunscreens()
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err = loadRtsCodes(); err != nil {
+		log.Fatal(err)
+	}
 
 	// Load lightsensor
 	err = readJSON(fileLightsensor, &ls)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if len(ls.Sensors) == 0 {
+		// Convert the single sensor stored by earlier versions
+		legacy := struct {
+			Pin         Pin
+			LightFactor int
+		}{}
+		if err := readJSON(fileLightsensor, &legacy); err == nil && legacy.Pin != (Pin{}) {
+			sn := ls.addSensor()
+			sn.Pin, sn.LightFactor = legacy.Pin, max(legacy.LightFactor, 1)
+			log.Printf("Converted light sensor pin %v to '%v'", sn.Pin, sn.Name)
+		}
+	}
+	if !validFusion(ls.Fusion) {
+		ls.Fusion = fusionMedian
+	}
 	ls.Data = []int{} // Make sure data is empty (since restarted)
+	for i := range ls.Sensors {
+		ls.Sensors[i].Data = []int{}
+		ls.Sensors[i].Failed = false
+	}
 }
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Constants for the type of an event
+const (
+	evtSunscreen = "sunscreen" // Position, mode or commands of a sunscreen have changed
+	evtLight     = "light"     // New light has been measured
+	evtDecision  = "decision"  // Outcome of evaluating the light for a sunscreen in auto mode
+	evtWind      = "wind"      // New wind speed has been measured
+	evtRain      = "rain"      // Rain or dry weather has been detected, or the rain lock was released
+	evtTemp      = "temp"      // New temperatures have been read
+	evtFrost     = "frost"     // The frost status has been checked against the outdoor temperature
+	evtReload    = "reload"    // Sunscreens have been added or deleted, so the page should be reloaded
+)
+
+// Constants for the event stream
+const (
+	eventInterval  = 250 * time.Millisecond // Interval at which sunscreens are checked for changes
+	eventKeepAlive = 30 * time.Second       // Interval of comments that keep idle connections open
+	eventBuffer    = 32                     // Number of events queued per client
+)
+
+// Event represents a change that is pushed to the clients of the event stream.
+type event struct {
+	Type string
+	Data interface{}
+}
+
+// LightEvent is the data of a light event.
+type lightEvent struct {
+	Time    time.Time
+	Light   int   // Combined light
+	Ok      bool  // False if no sensor was available
+	Data    []int // Combined light used for evaluating the sunscreens
+	Sensors []sensorEvent
+}
+
+// SensorEvent is the light of a sensor in a light event.
+type sensorEvent struct {
+	apiSensor
+	Data []int // Light of the sensor
+}
+
+// DecisionEvent is the data of a decision event.
+type decisionEvent struct {
+	Time     time.Time
+	Id       int
+	Name     string
+	Position string // Position at the time of the decision
+	Action   string // up, down or none
+	Reason   string
+}
+
+/* EventHub distributes events to the clients of the event stream. A client
+that does not keep up is dropped, it is expected to reconnect.*/
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan event]struct{}
+}
+
+// events is the hub of all events.
+var events = &eventHub{subs: map[chan event]struct{}{}}
+
+// Subscribe returns a channel that receives all events until it is unsubscribed or dropped.
+func (h *eventHub) subscribe() chan event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan event, eventBuffer)
+	h.subs[ch] = struct{}{}
+	return ch
+}
+
+// Unsubscribe stops sending events to ch and closes it.
+func (h *eventHub) unsubscribe(ch chan event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// Subscribers returns the number of subscribed clients.
+func (h *eventHub) subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// Publish sends an event of type typ with data to all clients, without blocking.
+func (h *eventHub) publish(typ string, data interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- event{typ, data}:
+		default:
+			log.Println("Dropped client of event stream that does not keep up")
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+/* WatchSunscreens publishes a sunscreen event whenever the state of a sunscreen
+has changed, and a reload event when sunscreens have been added or deleted. It
+checks every eventInterval while there are clients, until quit is closed.*/
+func (h *eventHub) watchSunscreens(quit <-chan struct{}) {
+	t := time.NewTicker(eventInterval)
+	defer t.Stop()
+	var last map[int]string // State per sunscreen as JSON
+	for {
+		select {
+		case <-quit:
+			return
+		case <-t.C:
+		}
+		if h.subscribers() == 0 {
+			last = nil
+			continue
+		}
+		states := sunscreenStates()
+		current := map[int]string{}
+		for _, st := range states {
+			bs, _ := json.Marshal(st)
+			current[st.Id] = string(bs)
+		}
+		if last == nil {
+			last = current
+			continue
+		}
+		reload := len(current) != len(last)
+		for _, st := range states {
+			if old, ok := last[st.Id]; !ok {
+				reload = true
+			} else if old != current[st.Id] {
+				h.publish(evtSunscreen, st)
+			}
+		}
+		if reload {
+			h.publish(evtReload, nil)
+		}
+		last = current
+	}
+}
+
+// SunscreenStates returns the state of all sunscreens, ordered by Id.
+func sunscreenStates() []apiSunscreen {
+	muSunscrn.Lock()
+	states := []apiSunscreen{}
+	for _, s := range sunscreens {
+		states = append(states, s.state())
+	}
+	muSunscrn.Unlock()
+	sort.Slice(states, func(i, j int) bool { return states[i].Id < states[j].Id })
+	return states
+}
+
+// LightState returns a light event with the last measured light. The caller should hold muLS.
+func lightState(ok bool) lightEvent {
+	e := lightEvent{Time: time.Now(), Ok: ok, Data: copyData(ls.Data), Sensors: []sensorEvent{}}
+	if l := lastLight(ls.Data); l != nil {
+		e.Light = *l
+	}
+	for _, sn := range ls.Sensors {
+		e.Sensors = append(e.Sensors, sensorEvent{apiSensor{sn.Id, sn.Name, lastLight(sn.Data), sn.Failed}, copyData(sn.Data)})
+	}
+	return e
+}
+
+// Decide publishes a decision event with action and reason for sunscreen s.
+func (s *Sunscreen) decide(action, reason string) {
+	muSunscrn.Lock()
+	e := decisionEvent{time.Now(), s.Id, s.Name, s.Position, action, reason}
+	muSunscrn.Unlock()
+	events.publish(evtDecision, e)
+}
+
+// HandlerEvents streams the events to a logged in user of the web interface.
+func handlerEvents(w http.ResponseWriter, req *http.Request) {
+	if !alreadyLoggedIn(req) {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	streamEvents(w, req)
+}
+
+/* StreamEvents sends events to the client as Server-Sent Events until the
+client disconnects. The stream starts with the current state of all sunscreens
+and the last light.*/
+func streamEvents(w http.ResponseWriter, req *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := events.subscribe()
+	defer events.unsubscribe(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	for _, st := range sunscreenStates() {
+		writeEvent(w, event{evtSunscreen, st})
+	}
+	muLS.Lock()
+	if len(ls.Data) > 0 {
+		writeEvent(w, event{evtLight, lightState(true)})
+	}
+	muLS.Unlock()
+	if wind := getWindStatus(); wind.Enabled {
+		writeEvent(w, event{evtWind, wind})
+	}
+	if rain := getRainStatus(); rain.Enabled {
+		writeEvent(w, event{evtRain, rain})
+	}
+	if temp := getTempStatus(); temp.Enabled && !temp.Time.IsZero() {
+		writeEvent(w, event{evtTemp, temp})
+	}
+	if frost := getFrostStatus(); frost.Enabled {
+		writeEvent(w, event{evtFrost, frost})
+	}
+	f.Flush()
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			writeEvent(w, e)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		f.Flush()
+	}
+}
+
+// WriteEvent writes e in the format of Server-Sent Events, with its data as JSON.
+func writeEvent(w http.ResponseWriter, e event) {
+	bs, err := json.Marshal(e.Data)
+	if err != nil {
+		log.Printf("Unable to encode %v event: %v", e.Type, err)
+		return
+	}
+	fmt.Fprintf(w, "event: %v\ndata: %s\n\n", e.Type, bs)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nextEvent returns the next event received on ch, or fails the test after a few seconds.
+func nextEvent(t *testing.T, ch chan event) event {
+	t.Helper()
+	select {
+	case e, ok := <-ch:
+		if !ok {
+			t.Fatal("Event channel was closed")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for event")
+	}
+	return event{}
+}
+
+func TestEventHub(t *testing.T) {
+	h := &eventHub{subs: map[chan event]struct{}{}}
+	fast, slow := h.subscribe(), h.subscribe()
+	for i := 0; i <= eventBuffer; i++ {
+		h.publish(evtLight, i)
+		if e := nextEvent(t, fast); e.Data != i {
+			t.Fatalf("Want event %v, got %v", i, e.Data)
+		}
+	}
+	// The slow client did not receive any event and is dropped when its buffer is full
+	for i := 0; i < eventBuffer; i++ {
+		<-slow
+	}
+	if _, ok := <-slow; ok || h.subscribers() != 1 {
+		t.Errorf("Slow client should be dropped, %v subscribers left", h.subscribers())
+	}
+	h.unsubscribe(fast)
+	h.unsubscribe(slow)
+	if h.subscribers() != 0 {
+		t.Errorf("Want no subscribers, got %v", h.subscribers())
+	}
+}
+
+func TestWatchSunscreens(t *testing.T) {
+	s := &Sunscreen{Id: 1, Name: "Front", Mode: auto, Position: up}
+	muSunscrn.Lock()
+	sunscreens = []*Sunscreen{s}
+	muSunscrn.Unlock()
+	h := &eventHub{subs: map[chan event]struct{}{}}
+	ch := h.subscribe()
+	quit := make(chan struct{})
+	defer close(quit)
+	go h.watchSunscreens(quit)
+	time.Sleep(2 * eventInterval)
+	muSunscrn.Lock()
+	s.Position, s.Percent = partial, 40
+	muSunscrn.Unlock()
+	e := nextEvent(t, ch)
+	if st, ok := e.Data.(apiSunscreen); e.Type != evtSunscreen || !ok || st.Position != partial || st.Percent != 40 {
+		t.Errorf("Want sunscreen event at 40%%, got %+v", e)
+	}
+	muSunscrn.Lock()
+	sunscreens = append(sunscreens, &Sunscreen{Id: 2, Name: "Back", Mode: auto, Position: up})
+	muSunscrn.Unlock()
+	if e := nextEvent(t, ch); e.Type != evtReload {
+		t.Errorf("Want reload event after adding a sunscreen, got %+v", e)
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	inTempDir(t)
+	muSunscrn.Lock()
+	sunscreens = []*Sunscreen{{Id: 1, Name: "Front", Mode: auto, Position: up}}
+	muSunscrn.Unlock()
+	muLS.Lock()
+	ls = &LightSensor{}
+	muLS.Unlock()
+	srv := httptest.NewServer(http.HandlerFunc(streamEvents))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Want content type text/event-stream, got %v", ct)
+	}
+	r := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		lines := []string{}
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+	if got := readEvent(); !strings.HasPrefix(got, "event: sunscreen\ndata: {\"Id\":1,\"Name\":\"Front\"") {
+		t.Errorf("Stream should start with the state of the sunscreens, got %q", got)
+	}
+	waitFor(t, "subscription", func() bool { return events.subscribers() == 1 })
+	s := &Sunscreen{Id: 1, Name: "Front", Position: down}
+	s.decide(up, "Light was bad")
+	if got := readEvent(); !strings.HasPrefix(got, "event: decision\n") || !strings.Contains(got, `"Action":"up","Reason":"Light was bad"`) {
+		t.Errorf("Want decision event, got %q", got)
+	}
+}
+
+func TestEvaluateDecision(t *testing.T) {
+	inTempDir(t)
+	s := &Sunscreen{Id: 1, Name: "Front", Mode: auto, Position: up}
+	muSunscrn.Lock()
+	sunscreens = []*Sunscreen{s}
+	muSunscrn.Unlock()
+	ch := events.subscribe()
+	defer events.unsubscribe(ch)
+	s.evaluate([]int{50, 50, 5}, 10, 20, 30, 2, 2, 2, 1)
+	if d, ok := nextEvent(t, ch).Data.(decisionEvent); !ok || d.Action != "none" || d.Position != up {
+		t.Errorf("Want no action with light good 1 of 3 times, got %+v", d)
+	}
+	s.evaluate([]int{5, 50, 5}, 10, 20, 30, 2, 2, 2, 1)
+	if d, ok := nextEvent(t, ch).Data.(decisionEvent); !ok || d.Action != down {
+		t.Errorf("Want down with light good 2 of 3 times, got %+v", d)
+	}
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	s.closeQueue()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Constants for the weather forecast
+const (
+	providerOpenMeteo = "open-meteo"                             // Open-Meteo, see https://open-meteo.com
+	openMeteoUrl      = "https://api.open-meteo.com/v1/forecast" // Default url of the forecast API of Open-Meteo
+	forecastTimeout   = 10 * time.Second                         // Timeout of a request to the provider
+	forecastCache     = 3 * time.Hour                            // Duration a forecast is cached
+	forecastRetry     = 15 * time.Minute                         // Duration after which a failed request is attempted again
+	forecastWindow    = time.Hour                                // Duration after the start of a sunscreen in which the forecast keeps it down
+)
+
+var (
+	muForecast       sync.Mutex
+	forecaster       forecastProvider        // Provider of the forecast, nil if the forecast is disabled, guarded by muForecast
+	forecasts        = map[string]forecast{} // Cached forecasts by date, e.g. 2023-06-01, guarded by muForecast
+	forecastFailed   time.Time               // Time the last request failed, guarded by muForecast
+	forecastErr      error                   // Error of the last failed request, guarded by muForecast
+	forecastFetching bool                    // True while a forecast is fetched from the provider, guarded by muForecast
+)
+
+// Forecast represents the weather forecast of a day.
+type forecast struct {
+	Date       string    // Date of the forecast, e.g. 2023-06-01
+	MaxTemp    float64   // Maximum temperature in °C
+	CloudCover float64   // Mean cloud cover in percent
+	Fetched    time.Time // Time the forecast was fetched from the provider
+}
+
+// ForecastProvider fetches the weather forecast of a day at a location.
+type forecastProvider interface {
+	forecast(lat, long float64, day time.Time) (forecast, error)
+}
+
+/* ForecastPolicy lowers sunscreens pre-emptively on days with a hot and clear
+forecast, i.e. a maximum temperature above MaxTemp and a cloud cover below
+CloudCover, so they are down at Start instead of after the light has been good
+for a while. The forecast keeps a sunscreen down for forecastWindow after its
+Start; after that, the light decides again, e.g. when the day turns out cloudy.*/
+type forecastPolicy struct {
+	MaxTemp    float64 // Maximum temperature in °C
+	CloudCover float64 // Cloud cover in percent
+}
+
+// StartForecast (re)creates the forecast provider with the settings in config and clears the cache.
+func startForecast() {
+	muConf.Lock()
+	enabled, name, u := config.EnableForecast, config.ForecastProvider, config.ForecastUrl
+	muConf.Unlock()
+	muForecast.Lock()
+	defer muForecast.Unlock()
+	forecaster, forecasts, forecastFailed, forecastErr, forecastFetching = nil, map[string]forecast{}, time.Time{}, nil, false
+	if !enabled {
+		return
+	}
+	p, err := newForecastProvider(name, u)
+	if err != nil {
+		log.Printf("Unable to start weather forecast: %v", err)
+		return
+	}
+	log.Printf("Starting weather forecast of %v", name)
+	forecaster = p
+}
+
+// NewForecastProvider returns the provider with name, using url u instead of its default url if u is not empty.
+func newForecastProvider(name, u string) (forecastProvider, error) {
+	switch name {
+	case providerOpenMeteo:
+		if u == "" {
+			u = openMeteoUrl
+		}
+		return newOpenMeteo(u)
+	default:
+		return nil, fmt.Errorf("Unknown forecast provider '%v', should be %v", name, providerOpenMeteo)
+	}
+}
+
+/* GetForecast returns the forecast of day at config.Location. A forecast is
+fetched from the provider once per forecastCache, and after a failure not
+before forecastRetry has passed. The request is made without holding
+muForecast, so a slow provider does not block other callers; they get the
+cached forecast or an error while it is fetched.*/
+func getForecast(day time.Time) (forecast, error) {
+	muConf.Lock()
+	lat, long := config.Location.Latitude, config.Location.Longitude
+	muConf.Unlock()
+	date := day.Format("2006-01-02")
+	muForecast.Lock()
+	p := forecaster
+	switch f, ok := forecasts[date]; {
+	case p == nil:
+		muForecast.Unlock()
+		return forecast{}, fmt.Errorf("Weather forecast is disabled")
+	case ok && time.Since(f.Fetched) < forecastCache:
+		muForecast.Unlock()
+		return f, nil
+	case time.Since(forecastFailed) < forecastRetry:
+		err := forecastErr
+		muForecast.Unlock()
+		return forecast{}, err
+	case forecastFetching:
+		muForecast.Unlock()
+		return forecast{}, fmt.Errorf("Weather forecast is being fetched")
+	}
+	forecastFetching = true
+	muForecast.Unlock()
+
+	f, err := p.forecast(lat, long, day)
+	muForecast.Lock()
+	defer muForecast.Unlock()
+	if forecaster != p {
+		// Restarted with other settings while fetching
+		return forecast{}, fmt.Errorf("Weather forecast has been restarted")
+	}
+	forecastFetching = false
+	if err != nil {
+		log.Printf("Unable to get weather forecast, retrying after %v: %v", forecastRetry, err)
+		forecastFailed, forecastErr = time.Now(), err
+		return forecast{}, err
+	}
+	f.Fetched = time.Now()
+	forecasts[date] = f
+	return f, nil
+}
+
+// CachedForecast returns the cached forecast of day, or nil if it has not been fetched.
+func cachedForecast(day time.Time) *forecast {
+	muForecast.Lock()
+	defer muForecast.Unlock()
+	if f, ok := forecasts[day.Format("2006-01-02")]; ok {
+		return &f
+	}
+	return nil
+}
+
+/* ForecastDecision returns down with its reason if the forecast of day meets
+the forecast policy of config, or an empty action if it does not or the
+forecast is unavailable. A failure is logged by getForecast once per retry.*/
+func forecastDecision(day time.Time) (string, string) {
+	f, err := getForecast(day)
+	if err != nil {
+		return "", ""
+	}
+	muConf.Lock()
+	p := forecastPolicy{config.ForecastMaxTemp, config.ForecastCloudCover}
+	muConf.Unlock()
+	return p.decide(f)
+}
+
+// Decide returns down with its reason if f forecasts a hot and clear day, or an empty action if it does not.
+func (p forecastPolicy) decide(f forecast) (string, string) {
+	if f.MaxTemp > p.MaxTemp && f.CloudCover < p.CloudCover {
+		return down, fmt.Sprintf("Forecast maximum temperature %.1f °C is above %v °C and cloud cover %.0f%% is below %v%%", f.MaxTemp, p.MaxTemp, f.CloudCover, p.CloudCover)
+	}
+	return "", ""
+}
+
+// OpenMeteo fetches daily forecasts from the forecast API of Open-Meteo.
+type openMeteo struct {
+	url    string // Url of the forecast API, e.g. https://api.open-meteo.com/v1/forecast
+	client *http.Client
+}
+
+// NewOpenMeteo returns a provider for the forecast API of Open-Meteo at url u.
+func newOpenMeteo(u string) (*openMeteo, error) {
+	pu, err := url.Parse(u)
+	if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+		return nil, fmt.Errorf("Url of forecast '%v' should be an http(s) url, e.g. %v", u, openMeteoUrl)
+	}
+	return &openMeteo{url: u, client: &http.Client{Timeout: forecastTimeout}}, nil
+}
+
+/* Forecast requests the maximum temperature and mean cloud cover of day, in
+the time zone of the location:
+	{"daily": {"time": ["2023-06-01"], "temperature_2m_max": [29.3], "cloud_cover_mean": [12]}}*/
+func (o *openMeteo) forecast(lat, long float64, day time.Time) (forecast, error) {
+	date := day.Format("2006-01-02")
+	q := url.Values{}
+	q.Set("latitude", strconv.FormatFloat(lat, 'f', -1, 64))
+	q.Set("longitude", strconv.FormatFloat(long, 'f', -1, 64))
+	q.Set("daily", "temperature_2m_max,cloud_cover_mean")
+	q.Set("timezone", "auto")
+	q.Set("start_date", date)
+	q.Set("end_date", date)
+	resp, err := o.client.Get(o.url + "?" + q.Encode())
+	if err != nil {
+		return forecast{}, err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Reason string `json:"reason"`
+		Daily  struct {
+			Time       []string   `json:"time"`
+			MaxTemp    []*float64 `json:"temperature_2m_max"`
+			CloudCover []*float64 `json:"cloud_cover_mean"`
+		} `json:"daily"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body)
+	switch {
+	case resp.StatusCode != http.StatusOK:
+		return forecast{}, fmt.Errorf("Open-Meteo responded %v: %v", resp.Status, body.Reason)
+	case err != nil:
+		return forecast{}, fmt.Errorf("Invalid response of Open-Meteo: %v", err)
+	}
+	for i, t := range body.Daily.Time {
+		if t != date {
+			continue
+		}
+		if i >= len(body.Daily.MaxTemp) || i >= len(body.Daily.CloudCover) || body.Daily.MaxTemp[i] == nil || body.Daily.CloudCover[i] == nil {
+			break
+		}
+		return forecast{Date: date, MaxTemp: *body.Daily.MaxTemp[i], CloudCover: *body.Daily.CloudCover[i]}, nil
+	}
+	return forecast{}, fmt.Errorf("No forecast of Open-Meteo for %v", date)
+}
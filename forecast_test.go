@@ -0,0 +1,261 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubOpenMeteo starts a local Open-Meteo forecast API that responds with body and counts the requests in n.
+func stubOpenMeteo(t *testing.T, status int, body string, n *int32) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(n, 1)
+		q := req.URL.Query()
+		if q.Get("latitude") != "52.37" || q.Get("longitude") != "4.89" || q.Get("daily") != "temperature_2m_max,cloud_cover_mean" || q.Get("start_date") != "2023-06-01" {
+			t.Errorf("Unexpected request of forecast: %v", req.URL)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// setupForecast starts the forecast with provider Open-Meteo at url u, and stops it at the end of the test.
+func setupForecast(t *testing.T, u string) {
+	muConf.Lock()
+	config.EnableForecast, config.ForecastProvider, config.ForecastUrl = true, providerOpenMeteo, u
+	config.ForecastMaxTemp, config.ForecastCloudCover = 28, 30
+	config.Location.Latitude, config.Location.Longitude = 52.37, 4.89
+	muConf.Unlock()
+	startForecast()
+	t.Cleanup(func() {
+		muConf.Lock()
+		config.EnableForecast = false
+		muConf.Unlock()
+		startForecast()
+	})
+}
+
+func TestOpenMeteo(t *testing.T) {
+	day := time.Date(2023, 6, 1, 9, 0, 0, 0, time.Local)
+	tests := []struct {
+		status int
+		body   string
+		want   forecast
+		ok     bool
+	}{
+		{http.StatusOK, `{"daily": {"time": ["2023-06-01"], "temperature_2m_max": [29.3], "cloud_cover_mean": [12]}}`, forecast{Date: "2023-06-01", MaxTemp: 29.3, CloudCover: 12}, true},
+		{http.StatusOK, `{"daily": {"time": ["2023-06-01"], "temperature_2m_max": [null], "cloud_cover_mean": [12]}}`, forecast{}, false},
+		{http.StatusOK, `{"daily": {"time": ["2023-06-02"], "temperature_2m_max": [29.3], "cloud_cover_mean": [12]}}`, forecast{}, false},
+		{http.StatusOK, `{"daily": `, forecast{}, false},
+		{http.StatusBadRequest, `{"error": true, "reason": "Latitude must be in range of -90 to 90°"}`, forecast{}, false},
+	}
+	for _, tt := range tests {
+		var n int32
+		srv := stubOpenMeteo(t, tt.status, tt.body, &n)
+		o, err := newOpenMeteo(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := o.forecast(52.37, 4.89, day)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("Response %v %v: want %+v (ok %v), got %+v (%v)", tt.status, tt.body, tt.want, tt.ok, got, err)
+		}
+	}
+	if _, err := newForecastProvider(providerOpenMeteo, "ftp://example.com"); err == nil {
+		t.Error("Want error for url that is not http(s)")
+	}
+	if _, err := newForecastProvider("buienradar", ""); err == nil {
+		t.Error("Want error for unknown provider")
+	}
+}
+
+func TestForecastCache(t *testing.T) {
+	setupApi(t)
+	day := time.Date(2023, 6, 1, 9, 0, 0, 0, time.Local)
+	var n int32
+	srv := stubOpenMeteo(t, http.StatusOK, `{"daily": {"time": ["2023-06-01"], "temperature_2m_max": [29.3], "cloud_cover_mean": [12]}}`, &n)
+	setupForecast(t, srv.URL)
+	for i := 0; i < 3; i++ {
+		if f, err := getForecast(day); err != nil || f.MaxTemp != 29.3 || f.Fetched.IsZero() {
+			t.Errorf("Want forecast of 29.3 °C, got %+v (%v)", f, err)
+		}
+	}
+	if n != 1 {
+		t.Errorf("Want forecast fetched once, got %v requests", n)
+	}
+	if f := cachedForecast(day); f == nil || f.CloudCover != 12 {
+		t.Errorf("Want cached forecast, got %+v", f)
+	}
+
+	// A failed request is not attempted again before forecastRetry
+	srv.Close()
+	muForecast.Lock()
+	forecasts = map[string]forecast{}
+	muForecast.Unlock()
+	for i := 0; i < 2; i++ {
+		if _, err := getForecast(day); err == nil {
+			t.Error("Want error of unavailable provider")
+		}
+	}
+	if n != 1 {
+		t.Errorf("Want failed request not attempted again, got %v requests", n)
+	}
+}
+
+func TestForecastSlowProvider(t *testing.T) {
+	setupApi(t)
+	day := time.Date(2023, 6, 1, 9, 0, 0, 0, time.Local)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.Write([]byte(`{"daily": {"time": ["2023-06-01"], "temperature_2m_max": [29.3], "cloud_cover_mean": [12]}}`))
+	}))
+	t.Cleanup(srv.Close)
+	var once sync.Once
+	unblock := func() { once.Do(func() { close(release) }) }
+	t.Cleanup(unblock)
+	setupForecast(t, srv.URL)
+	done := make(chan error)
+	go func() {
+		_, err := getForecast(day)
+		done <- err
+	}()
+	waitFor(t, "fetching", func() bool {
+		muForecast.Lock()
+		defer muForecast.Unlock()
+		return forecastFetching
+	})
+
+	// Other callers are not blocked while the forecast is fetched
+	if _, err := getForecast(day); err == nil {
+		t.Error("Want error while the forecast is fetched")
+	}
+	if f := cachedForecast(day); f != nil {
+		t.Errorf("Want no cached forecast yet, got %+v", f)
+	}
+	unblock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if f := cachedForecast(day); f == nil || f.MaxTemp != 29.3 {
+		t.Errorf("Want cached forecast after fetching, got %+v", f)
+	}
+}
+
+func TestForecastDefaults(t *testing.T) {
+	inTempDir(t)
+	t.Cleanup(func() {
+		muConf.Lock()
+		config = Config{}
+		muConf.Unlock()
+	})
+	files := map[string]string{fileSunscrn: `[]`, fileLightsensor: `{}`, fileRTS: `{}`}
+	tests := []struct {
+		config              string
+		maxTemp, cloudCover float64
+	}{
+		{`{"RefreshRate": 60000000000}`, 28, 30}, // Saved before the forecast existed
+		{`{"RefreshRate": 60000000000, "ForecastMaxTemp": 0, "ForecastCloudCover": 0}`, 0, 0},
+		{`{"RefreshRate": 60000000000, "ForecastMaxTemp": 25}`, 25, 30},
+	}
+	for _, tt := range tests {
+		files[fileConfig] = tt.config
+		for file, data := range files {
+			if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		config = Config{}
+		loadConfig()
+		if config.ForecastMaxTemp != tt.maxTemp || config.ForecastCloudCover != tt.cloudCover {
+			t.Errorf("%v: want %v °C and %v%%, got %v °C and %v%%", tt.config, tt.maxTemp, tt.cloudCover, config.ForecastMaxTemp, config.ForecastCloudCover)
+		}
+	}
+}
+
+func TestForecastPolicy(t *testing.T) {
+	p := forecastPolicy{MaxTemp: 28, CloudCover: 30}
+	tests := []struct {
+		maxTemp, cloudCover float64
+		want                string
+	}{
+		{29, 10, down},
+		{28, 10, ""},
+		{32, 30, ""},
+		{20, 0, ""},
+	}
+	for _, tt := range tests {
+		if got, reason := p.decide(forecast{MaxTemp: tt.maxTemp, CloudCover: tt.cloudCover}); got != tt.want || (got == "") != (reason == "") {
+			t.Errorf("%v °C and %v%%: want '%v', got '%v' (%v)", tt.maxTemp, tt.cloudCover, tt.want, got, reason)
+		}
+	}
+}
+
+func TestForecastEvaluate(t *testing.T) {
+	s := setupApi(t)
+	var n int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&n, 1)
+		date := req.URL.Query().Get("start_date")
+		w.Write([]byte(`{"daily": {"time": ["` + date + `"], "temperature_2m_max": [31.5], "cloud_cover_mean": [5]}}`))
+	}))
+	t.Cleanup(srv.Close)
+	setupForecast(t, srv.URL)
+	s.init()
+
+	// Without ForecastLower, bad light does not move the sunscreen down
+	s.evaluate([]int{50, 50, 50, 50, 50}, 10, 20, 30, 5, 5, 5, 0)
+	muSunscrn.Lock()
+	if xc := s.commands(); len(xc) != 0 || n != 0 {
+		t.Errorf("Want no command nor forecast without ForecastLower, got %+v and %v requests", xc, n)
+	}
+	s.ForecastLower, s.Start = true, time.Now().Add(-time.Minute)
+	muSunscrn.Unlock()
+
+	// A hot and clear day lowers the sunscreen at start regardless of light
+	s.evaluate([]int{50, 50, 50, 50, 50}, 10, 20, 30, 5, 5, 5, 0)
+	muSunscrn.Lock()
+	if xc := s.commands(); len(xc) != 1 || xc[0].Source != srcAuto || xc[0].Target != 100 {
+		t.Errorf("Want sunscreen lowered by forecast, got %+v", xc)
+	}
+	s.submit(newCommand(cmdStop, 0, srcWeb))
+	muSunscrn.Unlock()
+	waitFor(t, "stop", func() bool {
+		muSunscrn.Lock()
+		defer muSunscrn.Unlock()
+		return s.running == nil && len(s.queue) == 0
+	})
+
+	var status struct{ Forecast *forecast }
+	apiRequest(t, http.MethodGet, "/api/v1/status", "", &status)
+	if status.Forecast == nil || status.Forecast.MaxTemp != 31.5 || n != 1 {
+		t.Errorf("Want cached forecast in status, got %+v and %v requests", status.Forecast, n)
+	}
+
+	// After forecastWindow, bad light moves the sunscreen up despite the forecast
+	muSunscrn.Lock()
+	s.Position, s.Percent, s.Start = down, 100, time.Now().Add(-forecastWindow)
+	muSunscrn.Unlock()
+	s.evaluate([]int{50, 50, 50, 50, 50}, 10, 20, 30, 5, 5, 5, 0)
+	muSunscrn.Lock()
+	if xc := s.commands(); len(xc) == 0 || xc[0].Source != srcAuto || xc[0].Target != 0 {
+		t.Errorf("Want sunscreen moved up by bad light after the forecast window, got %+v", xc)
+	}
+	s.submit(newCommand(cmdStop, 0, srcWeb))
+	muSunscrn.Unlock()
+	waitFor(t, "stop", func() bool {
+		muSunscrn.Lock()
+		defer muSunscrn.Unlock()
+		return s.running == nil && len(s.queue) == 0
+	})
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	s.closeQueue()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// frostMargin is the margin in °C above config.FrostTemp the outdoor temperature should reach to release the frost lock.
+const frostMargin = 1.0
+
+var (
+	muFrost sync.Mutex
+	frost   = &frostStatus{} // Guarded by muFrost
+)
+
+/* FrostStatus represents the frost lock. When the outdoor temperature drops
+below config.FrostTemp, a sunscreen may be frozen to its frame and tear if the
+motor drives it. Therefore all automatic movements, including the retractions
+of a wind or rain lock, are blocked and movements of users should be confirmed,
+until the outdoor temperature has risen to config.FrostTemp + frostMargin. The
+outdoor temperature is read from the DS18B20 configured as config.TempOutdoor;
+while it is unavailable the lock is kept as it is.*/
+type frostStatus struct {
+	Enabled bool      // True if frost protection is enabled
+	Locked  bool      // True if the sunscreens are locked because of frost
+	Since   time.Time // Time the lock was last set or released
+	Reason  string    // Reason the lock was last set or released
+}
+
+/* StartFrost applies the frost protection settings in config to the last
+outdoor temperature. A frost lock is released when frost protection is
+disabled.*/
+func startFrost() {
+	muConf.Lock()
+	enabled := config.EnableFrost
+	muConf.Unlock()
+	muFrost.Lock()
+	if !enabled && frost.Locked {
+		log.Println("Released frost lock, frost protection is disabled")
+		frost.Locked, frost.Since, frost.Reason = false, time.Now(), "Frost protection is disabled"
+	}
+	muFrost.Unlock()
+	checkFrost(getTempStatus().Outdoor)
+}
+
+// FrostLocked returns true if the sunscreens are locked because of frost.
+func frostLocked() bool {
+	muFrost.Lock()
+	defer muFrost.Unlock()
+	return frost.Locked
+}
+
+// GetFrostStatus returns a copy of the frost status, e.g. for showing it on a page.
+func getFrostStatus() frostStatus {
+	muFrost.Lock()
+	defer muFrost.Unlock()
+	return *frost
+}
+
+/* CheckFrost sets or releases the frost lock for the outdoor temperature,
+which is nil if it is unavailable, and publishes the frost status.*/
+func checkFrost(outdoor *float64) {
+	muConf.Lock()
+	enabled, limit := config.EnableFrost, config.FrostTemp
+	muConf.Unlock()
+	muFrost.Lock()
+	frost.Enabled = enabled
+	changed := enabled && outdoor != nil && frost.update(*outdoor, limit, time.Now())
+	status := *frost
+	muFrost.Unlock()
+	events.publish(evtFrost, status)
+	switch {
+	case changed && status.Locked:
+		msg := fmt.Sprintf("%v, blocking automatic movements of all sunscreens. Movements of users should be confirmed until the outdoor temperature has risen to %v °C.", status.Reason, limit+frostMargin)
+		log.Println(msg)
+		go sendMail("Sunscreens locked by frost", msg)
+	case changed:
+		log.Printf("%v, released frost lock", status.Reason)
+	}
+}
+
+/* Update takes the outdoor temperature at now and sets the lock if it is below
+limit, or releases it if it is at least limit + frostMargin. It returns true if
+the lock was set or released. The caller should hold muFrost.*/
+func (f *frostStatus) update(outdoor, limit float64, now time.Time) bool {
+	switch {
+	case !f.Locked && outdoor < limit:
+		f.Locked, f.Since = true, now
+		f.Reason = fmt.Sprintf("Outdoor temperature %.1f °C is below %v °C", outdoor, limit)
+		return true
+	case f.Locked && outdoor >= limit+frostMargin:
+		f.Locked, f.Since = false, now
+		f.Reason = fmt.Sprintf("Outdoor temperature %.1f °C has risen to %v °C", outdoor, limit+frostMargin)
+		return true
+	}
+	return false
+}
+
+// Automatic returns true if source moves sunscreens without a user, e.g. auto mode or a safety lock.
+func automatic(source string) bool {
+	switch source {
+	case srcAuto, srcSchedule, srcWind, srcRain:
+		return true
+	}
+	return false
+}
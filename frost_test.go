@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetFrost clears the frost status, also at the end of the test.
+func resetFrost(t *testing.T) {
+	reset := func() {
+		muFrost.Lock()
+		frost = &frostStatus{}
+		muFrost.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestFrostUpdate(t *testing.T) {
+	start := time.Date(2023, 12, 1, 6, 0, 0, 0, time.UTC)
+	tests := []struct {
+		outdoor float64
+		changed bool
+		locked  bool
+	}{
+		{5, false, false},
+		{2, false, false},
+		{1.9, true, true},
+		{-4, false, true},
+		{2.5, false, true}, // Within margin
+		{3, true, false},
+		{2.5, false, false},
+	}
+	f := &frostStatus{}
+	for i, tt := range tests {
+		if changed := f.update(tt.outdoor, 2, start.Add(time.Duration(i)*time.Minute)); changed != tt.changed || f.Locked != tt.locked {
+			t.Errorf("%v °C: want changed %v and locked %v, got %v and %v", tt.outdoor, tt.changed, tt.locked, changed, f.Locked)
+		}
+	}
+	if !f.Since.Equal(start.Add(5*time.Minute)) || !strings.Contains(f.Reason, "3.0 °C") {
+		t.Errorf("Want lock released at 6:05 by 3 °C, got %+v", f)
+	}
+}
+
+func TestFrostLock(t *testing.T) {
+	s := setupApi(t)
+	resetFrost(t)
+	muConf.Lock()
+	config.EnableFrost, config.FrostTemp = true, 2
+	muConf.Unlock()
+	s.init()
+	outdoor := -1.5
+	checkFrost(&outdoor)
+	if !frostLocked() {
+		t.Fatal("Want frost lock below 2 °C")
+	}
+
+	muSunscrn.Lock()
+	if c := s.submit(newCommand(cmdGoto, 100, srcAuto)); c.Status != cmdCancelled || c.Err != "Locked by frost" {
+		t.Errorf("Want command of auto mode cancelled, got %+v", c)
+	}
+	if c := s.submit(newCommand(cmdGoto, 0, srcRain)); c.Status != cmdCancelled || c.Err != "Locked by frost" {
+		t.Errorf("Want retraction of rain lock cancelled, got %+v", c)
+	}
+	if c, err := s.setMode(manual, down, srcMqtt, false); err != nil || c.Status != cmdCancelled || c.Err != "Locked by frost, confirmation required" {
+		t.Errorf("Want unconfirmed command of user cancelled, got %+v (%v)", c, err)
+	}
+	if s.locks() != "frost" {
+		t.Errorf("Want frost lock for sunscreen, got '%v'", s.locks())
+	}
+	muSunscrn.Unlock()
+
+	var resp struct{ Command *Command }
+	w := apiRequest(t, http.MethodPost, "/api/v1/sunscreens/1/command", `{"Action": "down", "Confirm": true}`, &resp)
+	if w.Code != http.StatusAccepted || resp.Command == nil || resp.Command.Status != cmdQueued || !resp.Command.Confirmed {
+		t.Errorf("Want confirmed command queued, got %v: %+v", w.Code, resp.Command)
+	}
+	var status struct{ Frost frostStatus }
+	apiRequest(t, http.MethodGet, "/api/v1/status", "", &status)
+	if !status.Frost.Enabled || !status.Frost.Locked || !strings.Contains(status.Frost.Reason, "-1.5 °C") {
+		t.Errorf("Want frost lock with reason in status, got %+v", status.Frost)
+	}
+
+	muSunscrn.Lock()
+	s.submit(newCommand(cmdStop, 0, srcWeb))
+	muSunscrn.Unlock()
+	waitFor(t, "stop", func() bool {
+		muSunscrn.Lock()
+		defer muSunscrn.Unlock()
+		return s.running == nil && len(s.queue) == 0
+	})
+
+	// Disabling frost protection releases the lock
+	muConf.Lock()
+	config.EnableFrost = false
+	muConf.Unlock()
+	startFrost()
+	if st := getFrostStatus(); st.Enabled || st.Locked {
+		t.Errorf("Want frost lock released, got %+v", st)
+	}
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	s.closeQueue()
+}
+
+func TestFrostWind(t *testing.T) {
+	s := setupApi(t)
+	resetFrost(t)
+	resetWind(t)
+	muSunscrn.Lock()
+	s.Mode, s.Position, s.Percent = manual, down, 100
+	muSunscrn.Unlock()
+	s.init()
+	muFrost.Lock()
+	frost.Enabled, frost.Locked = true, true
+	muFrost.Unlock()
+	muWind.Lock()
+	wind.update(20, 15, 10, time.Minute, time.Now())
+	muWind.Unlock()
+	retractAll(srcWind)
+
+	// A frozen sunscreen is not retracted by wind
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	if xc := s.commands(); len(xc) != 1 || xc[0].Source != srcWind || xc[0].Status != cmdCancelled || xc[0].Err != "Locked by frost" {
+		t.Errorf("Want retraction of wind lock cancelled during frost lock, got %+v", xc)
+	}
+	if s.running != nil || len(s.queue) != 0 || s.Percent != 100 {
+		t.Errorf("Want sunscreen kept down, got %v%% and %+v", s.Percent, s.commands())
+	}
+	s.closeQueue()
+}
+
+func TestFrostConfig(t *testing.T) {
+	setupApi(t)
+	resetFrost(t)
+	var resp apiError
+	w := apiRequest(t, http.MethodPatch, "/api/v1/config", `{"EnableFrost": "true", "FrostTemp": "1.5"}`, &resp)
+	if w.Code != http.StatusUnprocessableEntity || resp.Fields["EnableFrost"] == "" {
+		t.Errorf("Want 422 for frost protection without outdoor sensor, got %v: %+v", w.Code, resp)
+	}
+	w = apiRequest(t, http.MethodPatch, "/api/v1/config", `{"FrostTemp": "cold"}`, &resp)
+	if w.Code != http.StatusUnprocessableEntity || resp.Fields["FrostTemp"] == "" {
+		t.Errorf("Want 422 for invalid temperature, got %v: %+v", w.Code, resp)
+	}
+	w = apiRequest(t, http.MethodPatch, "/api/v1/config", `{"FrostTemp": "1.5"}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Want 200, got %v: %v", w.Code, w.Body.String())
+	}
+	muConf.Lock()
+	defer muConf.Unlock()
+	if config.FrostTemp != 1.5 || config.EnableFrost {
+		t.Errorf("Want frost temperature saved, got %+v", config)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/stianeikeland/go-rpio/v4"
+)
+
+// Constants for the available GPIO hardware backends
+const (
+	hwRpio    = "rpio"
+	hwChardev = "chardev"
+	hwSim     = "sim"
+)
+
+// Constants for the state of a GPIO pin
+const (
+	Low State = iota
+	High
+)
+
+/* Pin represents a GPIO line, identified by the number of the gpiochip and the
+line offset on that chip. For the rpio backend, Chip is always 0 and Line is the
+BCM pin number.*/
+type Pin struct {
+	Chip int // Number of the GPIO chip, i.e. N in /dev/gpiochipN
+	Line int // Line offset on the GPIO chip
+}
+
+// State represents the logical level of a GPIO pin, i.e. Low or High.
+type State uint8
+
+/* GPIO represents a hardware backend through which the sunscreen relays and
+the light sensor are controlled. Next to the Raspberry Pi implementation (rpio),
+a simulated backend is available so the program can run without hardware.*/
+type GPIO interface {
+	Open() error           // Open prepares the backend for use.
+	Close() error          // Close releases all resources held by the backend.
+	Check(p Pin) error     // Check returns an error if the pin is not available on this backend.
+	Output(p Pin)          // Output sets the pin to output mode.
+	Input(p Pin)           // Input sets the pin to input mode.
+	Write(p Pin, st State) // Write sets the state of an output pin.
+	Read(p Pin) State      // Read returns the current state of the pin.
+}
+
+// hw is the GPIO backend that is used for all pins.
+var hw GPIO = &rpioGPIO{}
+
+// NewGPIO takes the name of a hardware backend and returns the corresponding GPIO.
+func newGPIO(name string) (GPIO, error) {
+	switch name {
+	case hwRpio, "":
+		return &rpioGPIO{}, nil
+	case hwChardev:
+		return newChardevGPIO(chardevSys), nil
+	case hwSim:
+		return newSimGPIO(), nil
+	default:
+		return nil, fmt.Errorf("Unknown hardware '%v', should be %v, %v or %v", name, hwRpio, hwChardev, hwSim)
+	}
+}
+
+/* ParsePin takes a pin formatted as "chip:line" (e.g. "1:17") or as a line
+only (e.g. "17", which is line 17 on chip 0) and returns it as a Pin.*/
+func parsePin(s string) (Pin, error) {
+	var p Pin
+	var err error
+	s = strings.TrimSpace(s)
+	chip, line := "0", s
+	if i := strings.Index(s, ":"); i != -1 {
+		chip, line = s[:i], s[i+1:]
+	}
+	p.Chip, err = strconv.Atoi(chip)
+	if err != nil || p.Chip < 0 {
+		return p, fmt.Errorf("Invalid chip '%v' in pin '%v'", chip, s)
+	}
+	p.Line, err = strconv.Atoi(line)
+	if err != nil || p.Line < 0 {
+		return p, fmt.Errorf("Invalid line '%v' in pin '%v'", line, s)
+	}
+	return p, nil
+}
+
+func (p Pin) String() string {
+	if p.Chip == 0 {
+		return fmt.Sprint(p.Line)
+	}
+	return fmt.Sprintf("%v:%v", p.Chip, p.Line)
+}
+
+// UnmarshalJSON also accepts a single number, which is how pins were stored before chips were supported.
+func (p *Pin) UnmarshalJSON(b []byte) error {
+	if line, err := strconv.Atoi(string(b)); err == nil {
+		*p = Pin{Line: line}
+		return nil
+	}
+	type pin Pin
+	return json.Unmarshal(b, (*pin)(p))
+}
+
+func (st State) String() string {
+	if st == Low {
+		return "low"
+	}
+	return "high"
+}
+
+// RpioGPIO controls the GPIO pins of a Raspberry Pi through go-rpio.
+type rpioGPIO struct{}
+
+func (r *rpioGPIO) Open() error {
+	return rpio.Open()
+}
+
+func (r *rpioGPIO) Close() error {
+	return rpio.Close()
+}
+
+func (r *rpioGPIO) Check(p Pin) error {
+	if p.Chip != 0 || !(p.Line > 0 && p.Line < 28) {
+		return fmt.Errorf("Pin '%v' should be on chip 0 within range 1-27", p)
+	}
+	return nil
+}
+
+func (r *rpioGPIO) Output(p Pin) {
+	rpio.Pin(p.Line).Output()
+}
+
+func (r *rpioGPIO) Input(p Pin) {
+	rpio.Pin(p.Line).Input()
+}
+
+func (r *rpioGPIO) Write(p Pin, st State) {
+	rpio.Pin(p.Line).Write(rpio.State(st))
+}
+
+func (r *rpioGPIO) Read(p Pin) State {
+	return State(rpio.Pin(p.Line).Read())
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"unsafe"
+)
+
+// Constants of the Linux GPIO character device uAPI (v2), see include/uapi/linux/gpio.h
+const (
+	gpioMaxNameSize        = 32
+	gpioV2LinesMax         = 64
+	gpioV2LineNumAttrsMax  = 10
+	gpioV2LineFlagInput    = 1 << 2
+	gpioV2LineFlagOutput   = 1 << 3
+	gpioV2LineAttrIDValues = 2
+	gpioChardevConsumer    = "gosunscreen"
+	gpioChardevPath        = "/dev/gpiochip%v"
+)
+
+// Ioctl request codes of the Linux GPIO character device uAPI
+var (
+	gpioGetChipInfoIoctl     = ioctlRead(0x01, unsafe.Sizeof(gpioChipInfo{}))
+	gpioV2GetLineIoctl       = ioctlReadWrite(0x07, unsafe.Sizeof(gpioV2LineRequest{}))
+	gpioV2LineSetConfigIoctl = ioctlReadWrite(0x0D, unsafe.Sizeof(gpioV2LineConfig{}))
+	gpioV2LineGetValuesIoctl = ioctlReadWrite(0x0E, unsafe.Sizeof(gpioV2LineValues{}))
+	gpioV2LineSetValuesIoctl = ioctlReadWrite(0x0F, unsafe.Sizeof(gpioV2LineValues{}))
+)
+
+// Structs below mirror the memory layout of their counterparts in include/uapi/linux/gpio.h
+type gpioChipInfo struct {
+	Name  [gpioMaxNameSize]byte
+	Label [gpioMaxNameSize]byte
+	Lines uint32
+}
+
+type gpioV2LineAttribute struct {
+	ID      uint32
+	Padding uint32
+	Value   uint64 // Flags, output values or debounce period, depending on ID
+}
+
+type gpioV2LineConfigAttribute struct {
+	Attr gpioV2LineAttribute
+	Mask uint64
+}
+
+type gpioV2LineConfig struct {
+	Flags    uint64
+	NumAttrs uint32
+	Padding  [5]uint32
+	Attrs    [gpioV2LineNumAttrsMax]gpioV2LineConfigAttribute
+}
+
+type gpioV2LineRequest struct {
+	Offsets         [gpioV2LinesMax]uint32
+	Consumer        [gpioMaxNameSize]byte
+	Config          gpioV2LineConfig
+	NumLines        uint32
+	EventBufferSize uint32
+	Padding         [5]uint32
+	Fd              int32
+}
+
+type gpioV2LineValues struct {
+	Bits uint64
+	Mask uint64
+}
+
+func ioctlRead(nr, size uintptr) uintptr {
+	return 2<<30 | size<<16 | 0xB4<<8 | nr
+}
+
+func ioctlReadWrite(nr, size uintptr) uintptr {
+	return 3<<30 | size<<16 | 0xB4<<8 | nr
+}
+
+/* Ioctler represents the system calls used by the chardev backend. The real
+implementation calls the kernel, tests can replace it with a fake.*/
+type ioctler interface {
+	Open(path string) (int, error)
+	Close(fd int) error
+	Ioctl(fd int, req uintptr, arg unsafe.Pointer) error
+}
+
+/* ChardevGPIO controls GPIO lines through the Linux GPIO character devices
+(/dev/gpiochipN). Each pin is requested as a single line on first use and kept
+until Close is called.*/
+type chardevGPIO struct {
+	mu    sync.Mutex
+	sys   ioctler
+	chips map[int]int          // File descriptor per opened chip
+	lines map[Pin]*chardevLine // Requested lines
+}
+
+// ChardevLine represents a line that has been requested from a chip.
+type chardevLine struct {
+	fd     int   // File descriptor of the line request
+	output bool  // True if the line is configured as output
+	value  State // Last known value of the line
+}
+
+func newChardevGPIO(sys ioctler) *chardevGPIO {
+	return &chardevGPIO{
+		sys:   sys,
+		chips: map[int]int{},
+		lines: map[Pin]*chardevLine{},
+	}
+}
+
+func (g *chardevGPIO) Open() error {
+	return nil
+}
+
+// Close releases all requested lines and closes all chips.
+func (g *chardevGPIO) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var err error
+	for p, l := range g.lines {
+		if err2 := g.sys.Close(l.fd); err2 != nil {
+			err = fmt.Errorf("Unable to release pin %v: %v", p, err2)
+		}
+	}
+	for chip, fd := range g.chips {
+		if err2 := g.sys.Close(fd); err2 != nil {
+			err = fmt.Errorf("Unable to close chip %v: %v", chip, err2)
+		}
+	}
+	g.lines = map[Pin]*chardevLine{}
+	g.chips = map[int]int{}
+	return err
+}
+
+// Check returns an error if the chip of p does not exist or does not have line p.Line.
+func (g *chardevGPIO) Check(p Pin) error {
+	if p.Chip < 0 || p.Line < 0 {
+		return fmt.Errorf("Pin '%v' should not be negative", p)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fd, err := g.chip(p.Chip)
+	if err != nil {
+		return err
+	}
+	var info gpioChipInfo
+	if err := g.sys.Ioctl(fd, gpioGetChipInfoIoctl, unsafe.Pointer(&info)); err != nil {
+		return fmt.Errorf("Unable to read info of chip %v: %v", p.Chip, err)
+	}
+	if p.Line >= int(info.Lines) {
+		return fmt.Errorf("Pin '%v' should be within range 0-%v of chip %v", p, int(info.Lines)-1, p.Chip)
+	}
+	return nil
+}
+
+func (g *chardevGPIO) Output(p Pin) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.configure(p, true); err != nil {
+		log.Printf("Unable to set pin %v to output: %v", p, err)
+	}
+}
+
+func (g *chardevGPIO) Input(p Pin) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.configure(p, false); err != nil {
+		log.Printf("Unable to set pin %v to input: %v", p, err)
+	}
+}
+
+func (g *chardevGPIO) Write(p Pin, st State) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	l, ok := g.lines[p]
+	if !ok || !l.output {
+		log.Printf("Unable to write to pin %v, pin is not set to output", p)
+		return
+	}
+	values := gpioV2LineValues{Bits: uint64(st), Mask: 1}
+	if err := g.sys.Ioctl(l.fd, gpioV2LineSetValuesIoctl, unsafe.Pointer(&values)); err != nil {
+		log.Printf("Unable to write %v to pin %v: %v", st, p, err)
+		return
+	}
+	l.value = st
+}
+
+func (g *chardevGPIO) Read(p Pin) State {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	l, err := g.line(p)
+	if err != nil {
+		log.Printf("Unable to read pin %v: %v", p, err)
+		return Low
+	}
+	st, err := g.read(l)
+	if err != nil {
+		log.Printf("Unable to read pin %v: %v", p, err)
+	}
+	return st
+}
+
+// Chip returns the file descriptor of chip n, opening the chip if needed.
+func (g *chardevGPIO) chip(n int) (int, error) {
+	if fd, ok := g.chips[n]; ok {
+		return fd, nil
+	}
+	fd, err := g.sys.Open(fmt.Sprintf(gpioChardevPath, n))
+	if err != nil {
+		return 0, fmt.Errorf("Unable to open chip %v: %v", n, err)
+	}
+	g.chips[n] = fd
+	return fd, nil
+}
+
+/* Line returns the requested line for p. If the line has not been requested
+yet, it is requested as input so the current value is known before the line is
+ever switched to output.*/
+func (g *chardevGPIO) line(p Pin) (*chardevLine, error) {
+	if l, ok := g.lines[p]; ok {
+		return l, nil
+	}
+	fd, err := g.chip(p.Chip)
+	if err != nil {
+		return nil, err
+	}
+	var req gpioV2LineRequest
+	req.Offsets[0] = uint32(p.Line)
+	copy(req.Consumer[:], gpioChardevConsumer)
+	req.Config.Flags = gpioV2LineFlagInput
+	req.NumLines = 1
+	if err := g.sys.Ioctl(fd, gpioV2GetLineIoctl, unsafe.Pointer(&req)); err != nil {
+		return nil, fmt.Errorf("Unable to request line: %v", err)
+	}
+	l := &chardevLine{fd: int(req.Fd)}
+	if l.value, err = g.read(l); err != nil {
+		g.sys.Close(l.fd)
+		return nil, err
+	}
+	g.lines[p] = l
+	return l, nil
+}
+
+// Configure sets the direction of p. When switching to output, the last known value is kept.
+func (g *chardevGPIO) configure(p Pin, output bool) error {
+	l, err := g.line(p)
+	if err != nil {
+		return err
+	}
+	if l.output == output {
+		return nil
+	}
+	var cfg gpioV2LineConfig
+	cfg.Flags = gpioV2LineFlagInput
+	if output {
+		cfg.Flags = gpioV2LineFlagOutput
+		cfg.NumAttrs = 1
+		cfg.Attrs[0] = gpioV2LineConfigAttribute{
+			Attr: gpioV2LineAttribute{ID: gpioV2LineAttrIDValues, Value: uint64(l.value)},
+			Mask: 1,
+		}
+	}
+	if err := g.sys.Ioctl(l.fd, gpioV2LineSetConfigIoctl, unsafe.Pointer(&cfg)); err != nil {
+		return err
+	}
+	l.output = output
+	return nil
+}
+
+func (g *chardevGPIO) read(l *chardevLine) (State, error) {
+	values := gpioV2LineValues{Mask: 1}
+	if err := g.sys.Ioctl(l.fd, gpioV2LineGetValuesIoctl, unsafe.Pointer(&values)); err != nil {
+		return l.value, err
+	}
+	return State(values.Bits & 1), nil
+}
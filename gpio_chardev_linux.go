@@ -0,0 +1,27 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// chardevSys calls the kernel for the chardev backend.
+var chardevSys ioctler = sysIoctl{}
+
+type sysIoctl struct{}
+
+func (sysIoctl) Open(path string) (int, error) {
+	return syscall.Open(path, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+}
+
+func (sysIoctl) Close(fd int) error {
+	return syscall.Close(fd)
+}
+
+func (sysIoctl) Ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
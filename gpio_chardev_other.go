@@ -0,0 +1,27 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// chardevSys is not available since GPIO character devices only exist on Linux.
+var chardevSys ioctler = noIoctl{}
+
+var errNoChardev = errors.New("GPIO character devices are only supported on Linux")
+
+type noIoctl struct{}
+
+func (noIoctl) Open(path string) (int, error) {
+	return 0, errNoChardev
+}
+
+func (noIoctl) Close(fd int) error {
+	return errNoChardev
+}
+
+func (noIoctl) Ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	return errNoChardev
+}
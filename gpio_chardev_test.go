@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// fakeChip represents a GPIO chip with its line flags and values as kept by the kernel.
+type fakeChip struct {
+	lines  uint32
+	flags  map[uint32]uint64
+	values map[uint32]uint64
+}
+
+// fakeIoctl emulates the GPIO character device uAPI for a number of chips.
+type fakeIoctl struct {
+	chips  map[string]*fakeChip
+	fds    map[int]*fakeChip // Open chip per file descriptor
+	lines  map[int]uint32    // Requested line offset per line file descriptor
+	owners map[int]*fakeChip // Chip per line file descriptor
+	next   int
+	reqs   []uintptr
+}
+
+func newFakeIoctl(lines ...uint32) *fakeIoctl {
+	f := &fakeIoctl{
+		chips:  map[string]*fakeChip{},
+		fds:    map[int]*fakeChip{},
+		lines:  map[int]uint32{},
+		owners: map[int]*fakeChip{},
+		next:   3,
+	}
+	for i, n := range lines {
+		f.chips[fmt.Sprintf(gpioChardevPath, i)] = &fakeChip{n, map[uint32]uint64{}, map[uint32]uint64{}}
+	}
+	return f
+}
+
+func (f *fakeIoctl) Open(path string) (int, error) {
+	c, ok := f.chips[path]
+	if !ok {
+		return 0, syscall.ENOENT
+	}
+	f.next++
+	f.fds[f.next] = c
+	return f.next, nil
+}
+
+func (f *fakeIoctl) Close(fd int) error {
+	delete(f.fds, fd)
+	delete(f.lines, fd)
+	delete(f.owners, fd)
+	return nil
+}
+
+func (f *fakeIoctl) Ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	f.reqs = append(f.reqs, req)
+	switch req {
+	case gpioGetChipInfoIoctl:
+		c, ok := f.fds[fd]
+		if !ok {
+			return syscall.EBADF
+		}
+		(*gpioChipInfo)(arg).Lines = c.lines
+	case gpioV2GetLineIoctl:
+		c, ok := f.fds[fd]
+		if !ok {
+			return syscall.EBADF
+		}
+		r := (*gpioV2LineRequest)(arg)
+		if r.NumLines != 1 || r.Offsets[0] >= c.lines {
+			return syscall.EINVAL
+		}
+		f.next++
+		f.lines[f.next] = r.Offsets[0]
+		f.owners[f.next] = c
+		c.flags[r.Offsets[0]] = r.Config.Flags
+		r.Fd = int32(f.next)
+	case gpioV2LineSetConfigIoctl:
+		c, ok := f.owners[fd]
+		if !ok {
+			return syscall.EBADF
+		}
+		cfg := (*gpioV2LineConfig)(arg)
+		c.flags[f.lines[fd]] = cfg.Flags
+		for _, a := range cfg.Attrs[:cfg.NumAttrs] {
+			if a.Attr.ID == gpioV2LineAttrIDValues && a.Mask&1 != 0 {
+				c.values[f.lines[fd]] = a.Attr.Value & 1
+			}
+		}
+	case gpioV2LineGetValuesIoctl:
+		c, ok := f.owners[fd]
+		if !ok {
+			return syscall.EBADF
+		}
+		(*gpioV2LineValues)(arg).Bits = c.values[f.lines[fd]]
+	case gpioV2LineSetValuesIoctl:
+		c, ok := f.owners[fd]
+		if !ok {
+			return syscall.EBADF
+		}
+		if c.flags[f.lines[fd]]&gpioV2LineFlagOutput == 0 {
+			return syscall.EPERM
+		}
+		c.values[f.lines[fd]] = (*gpioV2LineValues)(arg).Bits & 1
+	default:
+		return syscall.ENOTTY
+	}
+	return nil
+}
+
+func TestChardevIoctlSizes(t *testing.T) {
+	tests := []struct {
+		name string
+		got  uintptr
+		want uintptr
+	}{
+		{"gpiochip_info", unsafe.Sizeof(gpioChipInfo{}), 68},
+		{"gpio_v2_line_config", unsafe.Sizeof(gpioV2LineConfig{}), 272},
+		{"gpio_v2_line_request", unsafe.Sizeof(gpioV2LineRequest{}), 592},
+		{"gpio_v2_line_values", unsafe.Sizeof(gpioV2LineValues{}), 16},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("Size of %v: want %v, got %v", tt.name, tt.want, tt.got)
+		}
+	}
+	if gpioV2GetLineIoctl != 0xC250B407 {
+		t.Errorf("GPIO_V2_GET_LINE_IOCTL: want 0xC250B407, got %#x", gpioV2GetLineIoctl)
+	}
+}
+
+func TestChardevCheck(t *testing.T) {
+	g := newChardevGPIO(newFakeIoctl(54, 8))
+	tests := []struct {
+		pin Pin
+		ok  bool
+	}{
+		{Pin{0, 17}, true},
+		{Pin{0, 54}, false},
+		{Pin{1, 7}, true},
+		{Pin{1, 8}, false},
+		{Pin{2, 0}, false},
+		{Pin{0, -1}, false},
+	}
+	for _, tt := range tests {
+		if err := g.Check(tt.pin); (err == nil) != tt.ok {
+			t.Errorf("Check(%v): want ok=%v, got %v", tt.pin, tt.ok, err)
+		}
+	}
+}
+
+func TestParsePin(t *testing.T) {
+	tests := []struct {
+		s   string
+		pin Pin
+		ok  bool
+	}{
+		{"17", Pin{0, 17}, true},
+		{" 1:7 ", Pin{1, 7}, true},
+		{"-1", Pin{}, false},
+		{"1:-7", Pin{}, false},
+		{"-1:7", Pin{}, false},
+		{"a:7", Pin{}, false},
+	}
+	for _, tt := range tests {
+		p, err := parsePin(tt.s)
+		if (err == nil) != tt.ok || (tt.ok && p != tt.pin) {
+			t.Errorf("parsePin(%q): want %v (ok %v), got %v (%v)", tt.s, tt.pin, tt.ok, p, err)
+		}
+	}
+}
+
+func TestChardevRelay(t *testing.T) {
+	f := newFakeIoctl(54)
+	f.chips["/dev/gpiochip0"].values[17] = 1
+	g := newChardevGPIO(f)
+	p := Pin{0, 17}
+	g.Output(p)
+	c := f.chips["/dev/gpiochip0"]
+	if c.flags[17] != gpioV2LineFlagOutput || c.values[17] != 1 {
+		t.Fatalf("Line should be output and keep its high value, got flags %v value %v", c.flags[17], c.values[17])
+	}
+	g.Write(p, Low)
+	if c.values[17] != 0 || g.Read(p) != Low {
+		t.Errorf("Line should be low, got %v", c.values[17])
+	}
+	g.Write(p, High)
+	if c.values[17] != 1 || g.Read(p) != High {
+		t.Errorf("Line should be high, got %v", c.values[17])
+	}
+	g.Input(p)
+	if c.flags[17] != gpioV2LineFlagInput {
+		t.Errorf("Line should be input, got flags %v", c.flags[17])
+	}
+	if err := g.Close(); err != nil || len(f.fds)+len(f.owners) != 0 {
+		t.Errorf("All file descriptors should be closed (%v)", err)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// simLightDefault is the RC count returned by a simulated light sensor without a script.
+const simLightDefault = 5000
+
+/* SimGPIO is a simulated GPIO backend. Output pins behave like relays of which
+the state is kept in memory. Input pins behave like the RC circuit of the light
+sensor: after the pin is driven low (discharging the capacitor) and switched
+back to input, it reads Low for the number of times returned by the light
+script of that pin, after which it reads High. Input pins with a level set by
+SetLevel, e.g. limit switches, always read that level, and input pins with a
+frequency set by SetFrequency, e.g. an anemometer, read a square wave.*/
+type simGPIO struct {
+	mu      sync.Mutex
+	outputs map[Pin]bool       // True if the pin is in output mode
+	states  map[Pin]State      // Current state of each pin
+	remain  map[Pin]int        // Remaining number of Low reads until the capacitor is charged
+	scripts map[Pin]func() int // Light script per pin returning the next RC count
+	history map[Pin][]State    // All states written to an output pin
+	levels  map[Pin]State      // Fixed level of input pins
+	trains  map[Pin][][]pulse  // All pulse trains sent on an output pin
+	freqs   map[Pin]float64    // Frequency in Hz of the square wave on input pins
+	start   time.Time          // Start of all square waves
+}
+
+func newSimGPIO() *simGPIO {
+	return &simGPIO{
+		outputs: map[Pin]bool{},
+		states:  map[Pin]State{},
+		remain:  map[Pin]int{},
+		scripts: map[Pin]func() int{},
+		history: map[Pin][]State{},
+		levels:  map[Pin]State{},
+		trains:  map[Pin][][]pulse{},
+		freqs:   map[Pin]float64{},
+		start:   time.Now(),
+	}
+}
+
+func (g *simGPIO) Open() error {
+	log.Println("Using simulated GPIO")
+	return nil
+}
+
+func (g *simGPIO) Close() error {
+	return nil
+}
+
+func (g *simGPIO) Check(p Pin) error {
+	return nil
+}
+
+func (g *simGPIO) Output(p Pin) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.outputs[p] = true
+}
+
+// Input sets p to input mode. If the pin was discharged, the next light value is taken from the script.
+func (g *simGPIO) Input(p Pin) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.outputs[p] && g.states[p] == Low {
+		g.remain[p] = simLightDefault
+		if f, ok := g.scripts[p]; ok {
+			g.remain[p] = f()
+		}
+	}
+	g.outputs[p] = false
+}
+
+func (g *simGPIO) Write(p Pin, st State) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.outputs[p] {
+		return
+	}
+	if old, ok := g.states[p]; !ok || old != st {
+		log.Printf("Simulated pin %v set to %v", p, st)
+	}
+	g.states[p] = st
+	g.history[p] = append(g.history[p], st)
+}
+
+func (g *simGPIO) Read(p Pin) State {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.outputs[p] {
+		return g.states[p]
+	}
+	if st, ok := g.levels[p]; ok {
+		return st
+	}
+	if f, ok := g.freqs[p]; ok {
+		if _, frac := math.Modf(time.Since(g.start).Seconds() * f); frac >= 0.5 {
+			return High
+		}
+		return Low
+	}
+	if g.remain[p] > 0 {
+		g.remain[p]--
+		return Low
+	}
+	return High
+}
+
+// SetLight sets the script f that returns the RC count for each light measurement on p.
+func (g *simGPIO) SetLight(p Pin, f func() int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.scripts[p] = f
+}
+
+// SetLevel sets the level that input pin p reads, e.g. to open or close a limit switch.
+func (g *simGPIO) SetLevel(p Pin, st State) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.levels[p] = st
+}
+
+// SetFrequency sets the frequency in Hz of the square wave that input pin p reads, e.g. to simulate an anemometer.
+func (g *simGPIO) SetFrequency(p Pin, f float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.freqs[p] = f
+}
+
+// Pulse records the pulse train on output pin p, without waiting for its duration.
+func (g *simGPIO) Pulse(p Pin, pulses []pulse) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.outputs[p] {
+		return
+	}
+	log.Printf("Simulated pin %v sent %v pulses", p, len(pulses))
+	g.trains[p] = append(g.trains[p], pulses)
+	g.states[p] = Low
+}
+
+// Trains returns all pulse trains that were sent on output pin p.
+func (g *simGPIO) Trains(p Pin) [][]pulse {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([][]pulse{}, g.trains[p]...)
+}
+
+// History returns all states that were written to output pin p.
+func (g *simGPIO) History(p Pin) []State {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]State{}, g.history[p]...)
+}
+
+/* SimScript takes one or more RC counts and returns a light script that
+returns these values in order, starting again at the first value after the last
+one has been returned.*/
+func simScript(xi ...int) func() int {
+	var mu sync.Mutex
+	i := 0
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(xi) == 0 {
+			return simLightDefault
+		}
+		x := xi[i%len(xi)]
+		i++
+		return x
+	}
+}
+
+// ParseSimScript takes a comma separated list of RC counts and returns it as a light script.
+func parseSimScript(s string) (func() int, error) {
+	var xi []int
+	for _, v := range stringToSlice(s) {
+		if v == "" {
+			continue
+		}
+		x, err := strconv.Atoi(v)
+		if err != nil || x < 0 {
+			return nil, fmt.Errorf("Invalid light value '%v' in '%v'", v, strings.TrimSpace(s))
+		}
+		xi = append(xi, x)
+	}
+	return simScript(xi...), nil
+}
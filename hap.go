@@ -0,0 +1,1131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Constants for the types of TLV8 items used in pairing
+const (
+	tlvMethod        byte = 0x00
+	tlvIdentifier    byte = 0x01
+	tlvSalt          byte = 0x02
+	tlvPublicKey     byte = 0x03
+	tlvProof         byte = 0x04
+	tlvEncryptedData byte = 0x05
+	tlvState         byte = 0x06
+	tlvError         byte = 0x07
+	tlvSignature     byte = 0x0A
+	tlvPermissions   byte = 0x0B
+	tlvSeparator     byte = 0xFF
+)
+
+// Constants for the errors of pairing
+const (
+	tlvErrUnknown        byte = 0x01
+	tlvErrAuthentication byte = 0x02
+	tlvErrMaxTries       byte = 0x05
+	tlvErrUnavailable    byte = 0x06
+	tlvErrBusy           byte = 0x07
+)
+
+// Constants for the pairing methods
+const (
+	hapPairSetup        byte = 0x00
+	hapPairSetupAuth    byte = 0x01
+	hapAddPairing       byte = 0x03
+	hapRemovePairing    byte = 0x04
+	hapListPairings     byte = 0x05
+	hapPermissionsAdmin byte = 0x01
+)
+
+// Constants for the status of a characteristic in a response
+const (
+	hapStatusSuccess        = 0
+	hapStatusUnauthorized   = -70401 // Request denied due to insufficient privileges
+	hapStatusReadOnly       = -70404
+	hapStatusWriteOnly      = -70405
+	hapStatusNoNotification = -70406
+	hapStatusNotFound       = -70409
+	hapStatusInvalidValue   = -70410
+)
+
+// Constants for the HAP server
+const (
+	hapAuthRequired    = 470 // HTTP status of a request that requires pair-verify first
+	hapMaxBody         = 64 * 1024
+	hapMaxFrame        = 1024 // Maximum length of the plain text of an encrypted frame
+	hapMaxAttempts     = 100  // Failed pair-setup attempts after which pairing is refused
+	hapFileMode        = 0600 // Permissions of the file with the private key, setup code and pairings
+	hapContentTypeTLV8 = "application/pairing+tlv8"
+	hapContentTypeJSON = "application/hap+json"
+	hapSrpUsername     = "Pair-Setup"
+)
+
+// Constants for the permissions of a characteristic
+const (
+	hapPermRead   = "pr"
+	hapPermWrite  = "pw"
+	hapPermNotify = "ev"
+)
+
+// srpN is the 3072-bit group of RFC 5054 used by HAP, with generator srpG.
+var (
+	srpN, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3BE39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AAAC42DAD33170D04507A33A85521ABDF1CBA64ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6BF12FFA06D98A0864D87602733EC86A64521F2B18177B200CBBE117577A615D6C770988C0BAD946E208E24FA074E5AB3143DB5BFCE0FD108E4B82D120A93AD2CAFFFFFFFFFFFFFFFF", 16)
+	srpG    = big.NewInt(5)
+)
+
+// TlvItem is an item of a TLV8 message.
+type tlvItem struct {
+	typ   byte
+	value []byte
+}
+
+// Tlv8 is a TLV8 message, items of the same type may occur more than once (e.g. in a list of pairings).
+type tlv8 []tlvItem
+
+// Get returns the value of the first item of type typ, or nil.
+func (t tlv8) get(typ byte) []byte {
+	for _, item := range t {
+		if item.typ == typ {
+			return item.value
+		}
+	}
+	return nil
+}
+
+// Encode returns the TLV8 encoding of t, values longer than 255 bytes are split into fragments.
+func (t tlv8) encode() []byte {
+	var b bytes.Buffer
+	for _, item := range t {
+		v := item.value
+		for {
+			n := min(len(v), 255)
+			b.WriteByte(item.typ)
+			b.WriteByte(byte(n))
+			b.Write(v[:n])
+			v = v[n:]
+			if len(v) == 0 {
+				break
+			}
+		}
+	}
+	return b.Bytes()
+}
+
+// DecodeTLV8 decodes a TLV8 message, joining the fragments of values longer than 255 bytes.
+func decodeTLV8(b []byte) (tlv8, error) {
+	t := tlv8{}
+	fragment := false // Last item had the maximum length, so it may continue in the next item
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, errors.New("Truncated TLV8 item")
+		}
+		typ, v := b[0], b[2:2+int(b[1])]
+		if fragment && t[len(t)-1].typ == typ {
+			t[len(t)-1].value = append(t[len(t)-1].value, v...)
+		} else {
+			t = append(t, tlvItem{typ, append([]byte{}, v...)})
+		}
+		fragment = len(v) == 255
+		b = b[2+len(v):]
+	}
+	return t, nil
+}
+
+// TlvByte returns an item of type typ with a single byte value v.
+func tlvByte(typ, v byte) tlvItem {
+	return tlvItem{typ, []byte{v}}
+}
+
+// TlvFailure returns the response with error code to a pairing request in state.
+func tlvFailure(state, code byte) tlv8 {
+	return tlv8{tlvByte(tlvState, state), tlvByte(tlvError, code)}
+}
+
+// SrpHash returns the SHA-512 hash of the concatenation of parts.
+func srpHash(parts ...[]byte) []byte {
+	h := sha512.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// SrpPad returns x as big endian bytes, left padded with zeros to the length of srpN.
+func srpPad(x *big.Int) []byte {
+	b := make([]byte, (srpN.BitLen()+7)/8)
+	return x.FillBytes(b)
+}
+
+// SrpInt returns the hash of parts as an integer.
+func srpInt(parts ...[]byte) *big.Int {
+	return new(big.Int).SetBytes(srpHash(parts...))
+}
+
+// SrpVerifier returns the password verifier v of user with password and salt.
+func srpVerifier(salt []byte, user, password string) *big.Int {
+	x := srpInt(salt, srpHash([]byte(user+":"+password)))
+	return new(big.Int).Exp(srpG, x, srpN)
+}
+
+// SrpProof returns the proof M1 of the client, which the server checks.
+func srpProof(user string, salt, A, B, K []byte) []byte {
+	hN, hG := srpHash(srpN.Bytes()), srpHash(srpG.Bytes())
+	for i := range hN {
+		hN[i] ^= hG[i]
+	}
+	return srpHash(hN, srpHash([]byte(user)), salt, A, B, K)
+}
+
+/* SrpServer is the server side of SRP-6a (SHA-512, 3072-bit group) as used by
+pair-setup, with username Pair-Setup and the setup code as password.*/
+type srpServer struct {
+	salt []byte
+	v    *big.Int
+	b    *big.Int
+	B    []byte // Public key of the server, padded
+	K    []byte // Session key, set after the proof of the client is verified
+}
+
+// NewSrpServer returns the server side of SRP for user with password and a random salt.
+func newSrpServer(user, password string) (*srpServer, error) {
+	salt := make([]byte, 16)
+	priv := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(priv); err != nil {
+		return nil, err
+	}
+	s := &srpServer{salt: salt, v: srpVerifier(salt, user, password), b: new(big.Int).SetBytes(priv)}
+	// B = k*v + g^b
+	k := srpInt(srpN.Bytes(), srpPad(srpG))
+	B := new(big.Int).Mul(k, s.v)
+	B.Add(B, new(big.Int).Exp(srpG, s.b, srpN))
+	s.B = srpPad(B.Mod(B, srpN))
+	return s, nil
+}
+
+// Verify checks the public key A and proof M1 of the client and returns the proof M2 of the server.
+func (s *srpServer) verify(user string, a, m1 []byte) ([]byte, error) {
+	A := new(big.Int).SetBytes(a)
+	if new(big.Int).Mod(A, srpN).Sign() == 0 {
+		return nil, errors.New("Invalid SRP public key")
+	}
+	// S = (A * v^u)^b
+	u := srpInt(srpPad(A), s.B)
+	S := new(big.Int).Exp(s.v, u, srpN)
+	S.Mul(S, A)
+	S.Exp(S.Mod(S, srpN), s.b, srpN)
+	K := srpHash(srpPad(S))
+	if !bytes.Equal(srpProof(user, s.salt, srpPad(A), s.B, K), m1) {
+		return nil, errors.New("Invalid SRP proof, setup code is incorrect")
+	}
+	s.K = K
+	return srpHash(srpPad(A), m1, K), nil
+}
+
+// HapKey derives a 32 byte key from secret with HKDF-SHA-512.
+func hapKey(secret []byte, salt, info string) []byte {
+	key := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha512.New, secret, []byte(salt), []byte(info)), key)
+	return key
+}
+
+// HapSeal encrypts plain with key and the nonce of a pairing message, e.g. PS-Msg05.
+func hapSeal(key []byte, nonce string, plain []byte) []byte {
+	aead, _ := chacha20poly1305.New(key)
+	return aead.Seal(nil, append(make([]byte, 4), nonce...), plain, nil)
+}
+
+// HapOpen decrypts and authenticates encrypted with key and the nonce of a pairing message.
+func hapOpen(key []byte, nonce string, encrypted []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, append(make([]byte, 4), nonce...), encrypted, nil)
+}
+
+// HapStore holds the identity of the accessory and its pairings, which are persisted.
+type hapStore struct {
+	Id           string // Device id, e.g. 1A:2B:3C:4D:5E:6F
+	SetupCode    string // Code to pair, e.g. 123-45-678
+	PrivateKey   []byte // Long-term Ed25519 key
+	ConfigNumber int    // Incremented when the accessories change
+	ConfigHash   string // Hash of the accessories of ConfigNumber
+	Pairings     []hapPairing
+}
+
+// HapPairing is a controller, e.g. an iPhone, that has been paired.
+type hapPairing struct {
+	Id        string
+	PublicKey []byte // Long-term Ed25519 key of the controller
+	Admin     bool
+}
+
+// Init generates the identity of the accessory if it is missing and returns true if it was changed.
+func (st *hapStore) init() (bool, error) {
+	changed := false
+	if st.Id == "" {
+		b := make([]byte, 6)
+		if _, err := rand.Read(b); err != nil {
+			return false, err
+		}
+		parts := []string{}
+		for _, x := range b {
+			parts = append(parts, fmt.Sprintf("%02X", x))
+		}
+		st.Id, changed = strings.Join(parts, ":"), true
+	}
+	if len(st.PrivateKey) != ed25519.PrivateKeySize {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return false, err
+		}
+		st.PrivateKey, changed = priv, true
+	}
+	if !validSetupCode(st.SetupCode) {
+		code, err := newSetupCode()
+		if err != nil {
+			return false, err
+		}
+		st.SetupCode, changed = code, true
+	}
+	if st.ConfigNumber < 1 {
+		st.ConfigNumber, changed = 1, true
+	}
+	return changed, nil
+}
+
+// Pairing returns the pairing of controller id, or nil.
+func (st *hapStore) pairing(id string) *hapPairing {
+	for i := range st.Pairings {
+		if st.Pairings[i].Id == id {
+			return &st.Pairings[i]
+		}
+	}
+	return nil
+}
+
+// NewSetupCode returns a random setup code, e.g. 123-45-678.
+func newSetupCode() (string, error) {
+	for {
+		n, err := rand.Int(rand.Reader, big.NewInt(100000000))
+		if err != nil {
+			return "", err
+		}
+		s := fmt.Sprintf("%08d", n)
+		code := s[:3] + "-" + s[3:5] + "-" + s[5:]
+		if validSetupCode(code) {
+			return code, nil
+		}
+	}
+}
+
+// ValidSetupCode returns false if code is not formatted as XXX-XX-XXX or is too trivial to be allowed.
+func validSetupCode(code string) bool {
+	digits := strings.ReplaceAll(code, "-", "")
+	if len(code) != 10 || code[3] != '-' || code[6] != '-' || len(digits) != 8 {
+		return false
+	}
+	if _, err := strconv.Atoi(digits); err != nil || digits == "12345678" || digits == "87654321" {
+		return false
+	}
+	return strings.Count(digits, digits[:1]) != 8
+}
+
+// HapAccessory is an accessory of the accessory database.
+type hapAccessory struct {
+	Aid      int           `json:"aid"`
+	Services []*hapService `json:"services"`
+}
+
+// HapService is a service of an accessory.
+type hapService struct {
+	Iid             int                  `json:"iid"`
+	Type            string               `json:"type"`
+	Primary         bool                 `json:"primary,omitempty"`
+	Characteristics []*hapCharacteristic `json:"characteristics"`
+}
+
+/* HapCharacteristic is a characteristic of a service. Read returns the current
+value, write carries out a write of a controller and returns an error if the
+value is invalid.*/
+type hapCharacteristic struct {
+	Iid      int                           `json:"iid"`
+	Type     string                        `json:"type"`
+	Perms    []string                      `json:"perms"`
+	Format   string                        `json:"format"`
+	Value    interface{}                   `json:"value,omitempty"`
+	Unit     string                        `json:"unit,omitempty"`
+	MinValue *float64                      `json:"minValue,omitempty"`
+	MaxValue *float64                      `json:"maxValue,omitempty"`
+	MinStep  *float64                      `json:"minStep,omitempty"`
+	read     func() interface{}            `json:"-"`
+	write    func(value interface{}) error `json:"-"`
+}
+
+// Can returns true if the characteristic has permission perm.
+func (c *hapCharacteristic) can(perm string) bool {
+	for _, p := range c.Perms {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// HapCharId identifies a characteristic by accessory and instance id.
+type hapCharId struct {
+	aid, iid int
+}
+
+/* HapConn is a connection of a controller. After pair-verify all traffic is
+encrypted in frames of at most hapMaxFrame bytes with ChaCha20-Poly1305.*/
+type hapConn struct {
+	net.Conn
+	mu         sync.Mutex // Guards writes, writeAead, writeCount and events
+	readAead   cipher.AEAD
+	writeAead  cipher.AEAD
+	readCount  uint64
+	writeCount uint64
+	buf        []byte             // Decrypted data that has not been read yet
+	verify     *hapVerify         // Pair-verify in progress
+	pairing    string             // Controller that is verified, guarded by hapServer.mu
+	events     map[hapCharId]bool // Characteristics the controller has subscribed to
+}
+
+// HapVerify is the state of a pair-verify in progress.
+type hapVerify struct {
+	shared, accessoryKey, controllerKey, key []byte
+}
+
+// Read reads decrypted data once the connection is encrypted.
+func (c *hapConn) Read(p []byte) (int, error) {
+	if c.readAead == nil {
+		return c.Conn.Read(p)
+	}
+	if len(c.buf) == 0 {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			return 0, err
+		}
+		frame := make([]byte, int(binary.LittleEndian.Uint16(header))+16)
+		if _, err := io.ReadFull(c.Conn, frame); err != nil {
+			return 0, err
+		}
+		plain, err := c.readAead.Open(nil, hapNonce(c.readCount), frame, header)
+		if err != nil {
+			return 0, fmt.Errorf("Unable to decrypt frame: %v", err)
+		}
+		c.readCount++
+		c.buf = plain
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// Send writes p, encrypted once the connection is encrypted. The caller should hold c.mu.
+func (c *hapConn) send(p []byte) error {
+	if c.writeAead == nil {
+		_, err := c.Conn.Write(p)
+		return err
+	}
+	var b bytes.Buffer
+	for len(p) > 0 {
+		n := min(len(p), hapMaxFrame)
+		header := make([]byte, 2)
+		binary.LittleEndian.PutUint16(header, uint16(n))
+		b.Write(header)
+		b.Write(c.writeAead.Seal(nil, hapNonce(c.writeCount), p[:n], header))
+		c.writeCount++
+		p = p[n:]
+	}
+	_, err := c.Conn.Write(b.Bytes())
+	return err
+}
+
+// Encrypt encrypts all further traffic with the keys derived from the shared secret of pair-verify.
+func (c *hapConn) encrypt(shared []byte) {
+	c.readAead, _ = chacha20poly1305.New(hapKey(shared, "Control-Salt", "Control-Write-Encryption-Key"))
+	c.writeAead, _ = chacha20poly1305.New(hapKey(shared, "Control-Salt", "Control-Read-Encryption-Key"))
+}
+
+// HapNonce returns the nonce of frame count.
+func hapNonce(count uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.LittleEndian.PutUint64(nonce[4:], count)
+	return nonce
+}
+
+// HapResponse is the response to a request of a controller.
+type hapResponse struct {
+	status      int
+	contentType string
+	body        []byte
+	upgrade     []byte // Shared secret, all traffic after the response is encrypted
+	closeAfter  string // Pairing of which all connections are closed after the response
+}
+
+/* HapServer is a HomeKit Accessory Protocol (HAP) server for IP accessories. It
+handles pairing with controllers and serves the accessory database returned by
+db. The identity and pairings are kept in store, which is saved to file.*/
+type hapServer struct {
+	db       func() []*hapAccessory
+	file     string
+	onChange func() // Called when the pairing status or configuration number has changed
+	mu       sync.Mutex
+	store    hapStore
+	setup    *hapSetup
+	attempts int // Failed pair-setup attempts
+	conns    map[*hapConn]struct{}
+	values   map[hapCharId]string // Last value per characteristic as JSON, to send events for changes
+}
+
+// HapSetup is the state of a pair-setup in progress.
+type hapSetup struct {
+	conn *hapConn
+	srp  *srpServer
+}
+
+// NewHapServer returns a server for the accessories of db with store, which is saved to file.
+func newHapServer(store hapStore, file string, db func() []*hapAccessory) *hapServer {
+	return &hapServer{db: db, file: file, store: store, conns: map[*hapConn]struct{}{}, values: map[hapCharId]string{}}
+}
+
+// Paired returns true if at least one controller has been paired.
+func (h *hapServer) paired() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.store.Pairings) > 0
+}
+
+// SetupCode returns the code with which a controller pairs.
+func (h *hapServer) setupCode() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.store.SetupCode
+}
+
+/* Save stores the identity and pairings in h.file, readable by the owner only
+as it holds the private key. The caller should hold h.mu.*/
+func (h *hapServer) save() {
+	if h.file != "" {
+		saveToJSONPerm(h.store, h.file, hapFileMode)
+	}
+}
+
+// Changed calls onChange, if set.
+func (h *hapServer) changed() {
+	if h.onChange != nil {
+		h.onChange()
+	}
+}
+
+// Serve accepts connections on l until l is closed, after which all connections are closed.
+func (h *hapServer) serve(l net.Listener) {
+	defer func() {
+		h.mu.Lock()
+		for c := range h.conns {
+			c.Close()
+		}
+		h.mu.Unlock()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Stopped accepting HomeKit connections: %v", err)
+			}
+			return
+		}
+		c := &hapConn{Conn: conn, events: map[hapCharId]bool{}}
+		h.mu.Lock()
+		h.conns[c] = struct{}{}
+		h.mu.Unlock()
+		go h.handleConn(c)
+	}
+}
+
+// HandleConn answers the requests of c until it is closed.
+func (h *hapServer) handleConn(c *hapConn) {
+	defer func() {
+		h.mu.Lock()
+		delete(h.conns, c)
+		if h.setup != nil && h.setup.conn == c {
+			h.setup = nil
+		}
+		h.mu.Unlock()
+		c.Close()
+	}()
+	r := bufio.NewReader(c)
+	for {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Closed HomeKit connection from %v: %v", c.RemoteAddr(), err)
+			}
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, hapMaxBody))
+		req.Body.Close()
+		if err != nil {
+			return
+		}
+		resp := h.handle(c, req, body)
+		var b bytes.Buffer
+		text := http.StatusText(resp.status)
+		if resp.status == hapAuthRequired {
+			text = "Connection Authorization Required"
+		}
+		fmt.Fprintf(&b, "HTTP/1.1 %v %v\r\n", resp.status, text)
+		if resp.contentType != "" {
+			fmt.Fprintf(&b, "Content-Type: %v\r\n", resp.contentType)
+		}
+		fmt.Fprintf(&b, "Content-Length: %v\r\n\r\n", len(resp.body))
+		b.Write(resp.body)
+		c.mu.Lock()
+		err = c.send(b.Bytes())
+		if resp.upgrade != nil {
+			c.encrypt(resp.upgrade)
+		}
+		c.mu.Unlock()
+		if err != nil {
+			return
+		}
+		if resp.closeAfter != "" {
+			h.closePairing(resp.closeAfter)
+		}
+	}
+}
+
+// Handle returns the response to req with body from connection c.
+func (h *hapServer) handle(c *hapConn, req *http.Request, body []byte) hapResponse {
+	h.mu.Lock()
+	verified := c.pairing != ""
+	h.mu.Unlock()
+	switch {
+	case req.URL.Path == "/pair-setup" && req.Method == http.MethodPost:
+		return h.tlvResponse(body, c, h.pairSetup)
+	case req.URL.Path == "/pair-verify" && req.Method == http.MethodPost:
+		return h.tlvResponse(body, c, h.pairVerify)
+	case req.URL.Path == "/identify" && req.Method == http.MethodPost:
+		if h.paired() {
+			return hapJSON(http.StatusBadRequest, map[string]int{"status": hapStatusUnauthorized})
+		}
+		log.Println("Identify HomeKit accessory")
+		return hapResponse{status: http.StatusNoContent}
+	case !verified:
+		return hapJSON(hapAuthRequired, map[string]int{"status": hapStatusUnauthorized})
+	case req.URL.Path == "/pairings" && req.Method == http.MethodPost:
+		return h.tlvResponse(body, c, h.pairings)
+	case req.URL.Path == "/accessories" && req.Method == http.MethodGet:
+		accessories := h.db()
+		for _, a := range accessories {
+			for _, s := range a.Services {
+				for _, ch := range s.Characteristics {
+					if ch.read != nil && ch.can(hapPermRead) {
+						ch.Value = ch.read()
+					}
+				}
+			}
+		}
+		return hapJSON(http.StatusOK, map[string]interface{}{"accessories": accessories})
+	case req.URL.Path == "/characteristics" && req.Method == http.MethodGet:
+		return h.readCharacteristics(c, req)
+	case req.URL.Path == "/characteristics" && req.Method == http.MethodPut:
+		return h.writeCharacteristics(c, body)
+	default:
+		return hapResponse{status: http.StatusNotFound}
+	}
+}
+
+// HapJSON returns a response with status and v as JSON.
+func hapJSON(status int, v interface{}) hapResponse {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Unable to encode HomeKit response: %v", err)
+		return hapResponse{status: http.StatusInternalServerError}
+	}
+	return hapResponse{status: status, contentType: hapContentTypeJSON, body: bs}
+}
+
+// TlvResponse decodes body as TLV8 and returns the TLV8 response of handler.
+func (h *hapServer) tlvResponse(body []byte, c *hapConn, handler func(c *hapConn, req tlv8) (tlv8, hapResponse)) hapResponse {
+	req, err := decodeTLV8(body)
+	if err != nil {
+		return hapResponse{status: http.StatusBadRequest}
+	}
+	t, resp := handler(c, req)
+	resp.status, resp.contentType, resp.body = http.StatusOK, hapContentTypeTLV8, t.encode()
+	return resp
+}
+
+/* PairSetup handles the messages of pair-setup (M1, M3 and M5), with which a
+controller that knows the setup code becomes the admin of the accessory. A
+message out of order ends the pair-setup in progress.*/
+func (h *hapServer) pairSetup(c *hapConn, req tlv8) (tlv8, hapResponse) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state := req.get(tlvState)
+	if len(state) != 1 {
+		return tlvFailure(2, tlvErrUnknown), hapResponse{}
+	}
+	if state[0] != 1 && (h.setup == nil || h.setup.conn != c) {
+		return tlvFailure(state[0]+1, tlvErrUnknown), hapResponse{}
+	}
+	switch state[0] {
+	case 1:
+		method := req.get(tlvMethod)
+		switch {
+		case len(method) != 1 || (method[0] != hapPairSetup && method[0] != hapPairSetupAuth):
+			return tlvFailure(2, tlvErrUnknown), hapResponse{}
+		case len(h.store.Pairings) > 0:
+			return tlvFailure(2, tlvErrUnavailable), hapResponse{}
+		case h.attempts >= hapMaxAttempts:
+			return tlvFailure(2, tlvErrMaxTries), hapResponse{}
+		case h.setup != nil && h.setup.conn != c:
+			return tlvFailure(2, tlvErrBusy), hapResponse{}
+		}
+		srp, err := newSrpServer(hapSrpUsername, h.store.SetupCode)
+		if err != nil {
+			log.Printf("Unable to start HomeKit pairing: %v", err)
+			return tlvFailure(2, tlvErrUnknown), hapResponse{}
+		}
+		h.setup = &hapSetup{c, srp}
+		return tlv8{tlvByte(tlvState, 2), {tlvSalt, srp.salt}, {tlvPublicKey, srp.B}}, hapResponse{}
+	case 3:
+		if h.setup.srp.K != nil {
+			h.setup = nil
+			return tlvFailure(4, tlvErrUnknown), hapResponse{}
+		}
+		proof, err := h.setup.srp.verify(hapSrpUsername, req.get(tlvPublicKey), req.get(tlvProof))
+		if err != nil {
+			h.attempts++
+			h.setup = nil
+			log.Printf("HomeKit pairing with %v failed: %v", c.RemoteAddr(), err)
+			return tlvFailure(4, tlvErrAuthentication), hapResponse{}
+		}
+		return tlv8{tlvByte(tlvState, 4), {tlvProof, proof}}, hapResponse{}
+	case 5:
+		// M5 is only accepted after the setup code has been verified with M3
+		K := h.setup.srp.K
+		h.setup = nil
+		if K == nil {
+			log.Printf("HomeKit pairing with %v failed: setup code has not been verified", c.RemoteAddr())
+			return tlvFailure(6, tlvErrAuthentication), hapResponse{}
+		}
+		key := hapKey(K, "Pair-Setup-Encrypt-Salt", "Pair-Setup-Encrypt-Info")
+		plain, err := hapOpen(key, "PS-Msg05", req.get(tlvEncryptedData))
+		if err != nil {
+			return tlvFailure(6, tlvErrAuthentication), hapResponse{}
+		}
+		sub, err := decodeTLV8(plain)
+		if err != nil {
+			return tlvFailure(6, tlvErrUnknown), hapResponse{}
+		}
+		id, ltpk, sig := sub.get(tlvIdentifier), sub.get(tlvPublicKey), sub.get(tlvSignature)
+		x := hapKey(K, "Pair-Setup-Controller-Sign-Salt", "Pair-Setup-Controller-Sign-Info")
+		if len(ltpk) != ed25519.PublicKeySize || !ed25519.Verify(ltpk, append(append(x, id...), ltpk...), sig) {
+			return tlvFailure(6, tlvErrAuthentication), hapResponse{}
+		}
+		h.store.Pairings = append(h.store.Pairings, hapPairing{string(id), ltpk, true})
+		h.save()
+		log.Printf("Paired HomeKit controller %v", string(id))
+		priv := ed25519.PrivateKey(h.store.PrivateKey)
+		pub := priv.Public().(ed25519.PublicKey)
+		x = hapKey(K, "Pair-Setup-Accessory-Sign-Salt", "Pair-Setup-Accessory-Sign-Info")
+		info := append(append(x, h.store.Id...), pub...)
+		sub = tlv8{{tlvIdentifier, []byte(h.store.Id)}, {tlvPublicKey, pub}, {tlvSignature, ed25519.Sign(priv, info)}}
+		go h.changed()
+		return tlv8{tlvByte(tlvState, 6), {tlvEncryptedData, hapSeal(key, "PS-Msg06", sub.encode())}}, hapResponse{}
+	default:
+		h.setup = nil
+		return tlvFailure(state[0]+1, tlvErrUnknown), hapResponse{}
+	}
+}
+
+/* PairVerify handles the messages of pair-verify (M1 and M3), with which a
+paired controller sets up an encrypted session.*/
+func (h *hapServer) pairVerify(c *hapConn, req tlv8) (tlv8, hapResponse) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state := req.get(tlvState)
+	if len(state) != 1 {
+		return tlvFailure(2, tlvErrUnknown), hapResponse{}
+	}
+	switch state[0] {
+	case 1:
+		controllerKey := req.get(tlvPublicKey)
+		pub, err := ecdh.X25519().NewPublicKey(controllerKey)
+		if err != nil {
+			return tlvFailure(2, tlvErrUnknown), hapResponse{}
+		}
+		priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return tlvFailure(2, tlvErrUnknown), hapResponse{}
+		}
+		shared, err := priv.ECDH(pub)
+		if err != nil {
+			return tlvFailure(2, tlvErrUnknown), hapResponse{}
+		}
+		accessoryKey := priv.PublicKey().Bytes()
+		info := append(append(append([]byte{}, accessoryKey...), h.store.Id...), controllerKey...)
+		sub := tlv8{{tlvIdentifier, []byte(h.store.Id)}, {tlvSignature, ed25519.Sign(h.store.PrivateKey, info)}}
+		key := hapKey(shared, "Pair-Verify-Encrypt-Salt", "Pair-Verify-Encrypt-Info")
+		c.verify = &hapVerify{shared, accessoryKey, controllerKey, key}
+		return tlv8{tlvByte(tlvState, 2), {tlvPublicKey, accessoryKey}, {tlvEncryptedData, hapSeal(key, "PV-Msg02", sub.encode())}}, hapResponse{}
+	case 3:
+		v := c.verify
+		c.verify = nil
+		if v == nil {
+			return tlvFailure(4, tlvErrUnknown), hapResponse{}
+		}
+		plain, err := hapOpen(v.key, "PV-Msg03", req.get(tlvEncryptedData))
+		if err != nil {
+			return tlvFailure(4, tlvErrAuthentication), hapResponse{}
+		}
+		sub, err := decodeTLV8(plain)
+		if err != nil {
+			return tlvFailure(4, tlvErrUnknown), hapResponse{}
+		}
+		id := sub.get(tlvIdentifier)
+		p := h.store.pairing(string(id))
+		info := append(append(append([]byte{}, v.controllerKey...), id...), v.accessoryKey...)
+		if p == nil || !ed25519.Verify(p.PublicKey, info, sub.get(tlvSignature)) {
+			log.Printf("HomeKit controller '%v' at %v failed to verify", string(id), c.RemoteAddr())
+			return tlvFailure(4, tlvErrAuthentication), hapResponse{}
+		}
+		c.pairing = p.Id
+		return tlv8{tlvByte(tlvState, 4)}, hapResponse{upgrade: v.shared}
+	default:
+		return tlvFailure(state[0]+1, tlvErrUnknown), hapResponse{}
+	}
+}
+
+// Pairings handles adding, removing and listing pairings by an admin controller.
+func (h *hapServer) pairings(c *hapConn, req tlv8) (tlv8, hapResponse) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	method := req.get(tlvMethod)
+	if p := h.store.pairing(c.pairing); p == nil || !p.Admin {
+		return tlvFailure(2, tlvErrAuthentication), hapResponse{}
+	}
+	if len(method) != 1 {
+		return tlvFailure(2, tlvErrUnknown), hapResponse{}
+	}
+	id := string(req.get(tlvIdentifier))
+	switch method[0] {
+	case hapAddPairing:
+		ltpk, perms := req.get(tlvPublicKey), req.get(tlvPermissions)
+		admin := len(perms) == 1 && perms[0]&hapPermissionsAdmin != 0
+		if p := h.store.pairing(id); p != nil {
+			if !bytes.Equal(p.PublicKey, ltpk) {
+				return tlvFailure(2, tlvErrUnknown), hapResponse{}
+			}
+			p.Admin = admin
+		} else {
+			if len(ltpk) != ed25519.PublicKeySize {
+				return tlvFailure(2, tlvErrUnknown), hapResponse{}
+			}
+			h.store.Pairings = append(h.store.Pairings, hapPairing{id, ltpk, admin})
+		}
+		h.save()
+		log.Printf("Added HomeKit controller %v (admin %v)", id, admin)
+		return tlv8{tlvByte(tlvState, 2)}, hapResponse{}
+	case hapRemovePairing:
+		pairings := []hapPairing{}
+		admins := 0
+		for _, p := range h.store.Pairings {
+			if p.Id != id {
+				pairings = append(pairings, p)
+				if p.Admin {
+					admins++
+				}
+			}
+		}
+		if admins == 0 {
+			// Without admin the accessory can not be managed, so it becomes unpaired
+			pairings = []hapPairing{}
+		}
+		h.store.Pairings = pairings
+		h.save()
+		log.Printf("Removed HomeKit controller %v, %v controllers left", id, len(pairings))
+		go h.changed()
+		closeAfter := id
+		if len(pairings) == 0 {
+			closeAfter = "*"
+		}
+		return tlv8{tlvByte(tlvState, 2)}, hapResponse{closeAfter: closeAfter}
+	case hapListPairings:
+		t := tlv8{tlvByte(tlvState, 2)}
+		for i, p := range h.store.Pairings {
+			if i > 0 {
+				t = append(t, tlvItem{tlvSeparator, nil})
+			}
+			perms := byte(0)
+			if p.Admin {
+				perms = hapPermissionsAdmin
+			}
+			t = append(t, tlvItem{tlvIdentifier, []byte(p.Id)}, tlvItem{tlvPublicKey, p.PublicKey}, tlvByte(tlvPermissions, perms))
+		}
+		return t, hapResponse{}
+	default:
+		return tlvFailure(2, tlvErrUnknown), hapResponse{}
+	}
+}
+
+// ClosePairing closes all connections verified by controller id, or all verified connections if id is *.
+func (h *hapServer) closePairing(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.conns {
+		if c.pairing != "" && (id == "*" || c.pairing == id) {
+			c.Close()
+		}
+	}
+}
+
+// Reset removes all pairings, e.g. when the admin controller is lost, and closes all connections.
+func (h *hapServer) reset() {
+	h.mu.Lock()
+	h.store.Pairings = []hapPairing{}
+	h.attempts = 0
+	h.save()
+	for c := range h.conns {
+		c.Close()
+	}
+	h.mu.Unlock()
+	log.Println("Removed all HomeKit pairings")
+	h.changed()
+}
+
+// Characteristics returns all characteristics of db by id.
+func (h *hapServer) characteristics() (map[hapCharId]*hapCharacteristic, []hapCharId) {
+	chars := map[hapCharId]*hapCharacteristic{}
+	ids := []hapCharId{}
+	for _, a := range h.db() {
+		for _, s := range a.Services {
+			for _, c := range s.Characteristics {
+				id := hapCharId{a.Aid, c.Iid}
+				chars[id] = c
+				ids = append(ids, id)
+			}
+		}
+	}
+	return chars, ids
+}
+
+// ReadCharacteristics responds with the values of the characteristics in query parameter id, e.g. id=1.9,2.9.
+func (h *hapServer) readCharacteristics(c *hapConn, req *http.Request) hapResponse {
+	chars, _ := h.characteristics()
+	q := req.URL.Query()
+	results := []map[string]interface{}{}
+	failed := false
+	for _, s := range strings.Split(q.Get("id"), ",") {
+		parts := strings.Split(s, ".")
+		aid, err1 := strconv.Atoi(parts[0])
+		iid, err2 := strconv.Atoi(parts[len(parts)-1])
+		if len(parts) != 2 || err1 != nil || err2 != nil {
+			return hapJSON(http.StatusBadRequest, map[string]int{"status": hapStatusInvalidValue})
+		}
+		id := hapCharId{aid, iid}
+		result := map[string]interface{}{"aid": aid, "iid": iid}
+		ch, ok := chars[id]
+		switch {
+		case !ok:
+			result["status"], failed = hapStatusNotFound, true
+		case !ch.can(hapPermRead) || ch.read == nil:
+			result["status"], failed = hapStatusWriteOnly, true
+		default:
+			result["value"] = ch.read()
+			if q.Get("type") == "1" {
+				result["type"] = ch.Type
+			}
+			if q.Get("perms") == "1" {
+				result["perms"] = ch.Perms
+			}
+			if q.Get("ev") == "1" {
+				c.mu.Lock()
+				result["ev"] = c.events[id]
+				c.mu.Unlock()
+			}
+		}
+		results = append(results, result)
+	}
+	if failed {
+		for _, r := range results {
+			if _, ok := r["status"]; !ok {
+				r["status"] = hapStatusSuccess
+			}
+		}
+		return hapJSON(http.StatusMultiStatus, map[string]interface{}{"characteristics": results})
+	}
+	return hapJSON(http.StatusOK, map[string]interface{}{"characteristics": results})
+}
+
+// WriteCharacteristics carries out the writes and event subscriptions in body.
+func (h *hapServer) writeCharacteristics(c *hapConn, body []byte) hapResponse {
+	var req struct {
+		Characteristics []struct {
+			Aid   int              `json:"aid"`
+			Iid   int              `json:"iid"`
+			Value *json.RawMessage `json:"value"`
+			Ev    *bool            `json:"ev"`
+		} `json:"characteristics"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return hapJSON(http.StatusBadRequest, map[string]int{"status": hapStatusInvalidValue})
+	}
+	chars, _ := h.characteristics()
+	results := []map[string]interface{}{}
+	failed := false
+	for _, w := range req.Characteristics {
+		id := hapCharId{w.Aid, w.Iid}
+		status := hapStatusSuccess
+		ch, ok := chars[id]
+		switch {
+		case !ok:
+			status = hapStatusNotFound
+		case w.Ev != nil && !ch.can(hapPermNotify):
+			status = hapStatusNoNotification
+		case w.Value != nil && (!ch.can(hapPermWrite) || ch.write == nil):
+			status = hapStatusReadOnly
+		}
+		if status == hapStatusSuccess && w.Ev != nil {
+			c.mu.Lock()
+			c.events[id] = *w.Ev
+			c.mu.Unlock()
+		}
+		if status == hapStatusSuccess && w.Value != nil {
+			var v interface{}
+			if err := json.Unmarshal(*w.Value, &v); err != nil {
+				status = hapStatusInvalidValue
+			} else if err := ch.write(v); err != nil {
+				log.Printf("Unable to write HomeKit characteristic %v.%v: %v", w.Aid, w.Iid, err)
+				status = hapStatusInvalidValue
+			}
+		}
+		if status != hapStatusSuccess {
+			failed = true
+		}
+		results = append(results, map[string]interface{}{"aid": w.Aid, "iid": w.Iid, "status": status})
+	}
+	if failed {
+		return hapJSON(http.StatusMultiStatus, map[string]interface{}{"characteristics": results})
+	}
+	return hapResponse{status: http.StatusNoContent}
+}
+
+/* Notify sends an event to the subscribed controllers for each characteristic
+that has changed since the last call. It also increments the configuration
+number if the accessories have changed.*/
+func (h *hapServer) notify() {
+	chars, ids := h.characteristics()
+	values := map[hapCharId]string{}
+	signature := []string{}
+	for _, id := range ids {
+		ch := chars[id]
+		signature = append(signature, fmt.Sprintf("%v.%v.%v", id.aid, id.iid, ch.Type))
+		if ch.can(hapPermNotify) && ch.read != nil {
+			bs, _ := json.Marshal(ch.read())
+			values[id] = string(bs)
+		}
+	}
+	sort.Strings(signature)
+	hash := fmt.Sprintf("%x", srpHash([]byte(strings.Join(signature, ",")))[:8])
+
+	h.mu.Lock()
+	configChanged := hash != h.store.ConfigHash
+	if configChanged {
+		if h.store.ConfigHash != "" {
+			if h.store.ConfigNumber++; h.store.ConfigNumber > 65535 {
+				h.store.ConfigNumber = 1
+			}
+		}
+		h.store.ConfigHash = hash
+		h.save()
+	}
+	changed := []hapCharId{}
+	for id, v := range values {
+		if old, ok := h.values[id]; ok && old != v {
+			changed = append(changed, id)
+		}
+	}
+	h.values = values
+	conns := []*hapConn{}
+	for c := range h.conns {
+		if c.pairing != "" {
+			conns = append(conns, c)
+		}
+	}
+	h.mu.Unlock()
+	if configChanged {
+		h.changed()
+	}
+	sort.Slice(changed, func(i, j int) bool {
+		return changed[i].aid < changed[j].aid || (changed[i].aid == changed[j].aid && changed[i].iid < changed[j].iid)
+	})
+	for _, c := range conns {
+		results := []map[string]interface{}{}
+		c.mu.Lock()
+		for _, id := range changed {
+			if c.events[id] {
+				results = append(results, map[string]interface{}{"aid": id.aid, "iid": id.iid, "value": json.RawMessage(values[id])})
+			}
+		}
+		if len(results) > 0 {
+			bs, _ := json.Marshal(map[string]interface{}{"characteristics": results})
+			msg := fmt.Sprintf("EVENT/1.0 200 OK\r\nContent-Type: %v\r\nContent-Length: %v\r\n\r\n%s", hapContentTypeJSON, len(bs), bs)
+			if err := c.send([]byte(msg)); err != nil {
+				log.Printf("Unable to send HomeKit event to %v: %v", c.RemoteAddr(), err)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Txt returns the TXT record with which the accessory is advertised over mDNS.
+func (h *hapServer) txt(name string, category int) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sf := 1
+	if len(h.store.Pairings) > 0 {
+		sf = 0
+	}
+	return []string{
+		fmt.Sprintf("c#=%v", h.store.ConfigNumber),
+		"ff=0",
+		"id=" + h.store.Id,
+		"md=" + name,
+		"pv=1.1",
+		"s#=1",
+		fmt.Sprintf("sf=%v", sf),
+		fmt.Sprintf("ci=%v", category),
+	}
+}
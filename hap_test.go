@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// hapClient is a minimal HomeKit controller for testing the HAP server.
+type hapClient struct {
+	t      *testing.T
+	conn   *hapConn
+	r      *textproto.Reader
+	id     string
+	pub    ed25519.PublicKey
+	priv   ed25519.PrivateKey
+	server ed25519.PublicKey // Long-term key of the accessory, received during pair-setup
+}
+
+// newHapClient connects to the HAP server at addr.
+func newHapClient(t *testing.T, addr string) *hapClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	c := &hapClient{t: t, conn: &hapConn{Conn: conn}, id: "11111111-2222-3333-4444-555555555555", pub: pub, priv: priv}
+	c.r = textproto.NewReader(bufio.NewReader(c.conn))
+	return c
+}
+
+// Request sends a request and returns the status and body of the response.
+func (c *hapClient) request(method, path, contentType string, body []byte) (int, []byte) {
+	c.t.Helper()
+	req := fmt.Sprintf("%v %v HTTP/1.1\r\nHost: test\r\nContent-Length: %v\r\n", method, path, len(body))
+	if contentType != "" {
+		req += "Content-Type: " + contentType + "\r\n"
+	}
+	c.conn.mu.Lock()
+	err := c.conn.send(append([]byte(req+"\r\n"), body...))
+	c.conn.mu.Unlock()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	status, _, resp := c.read("HTTP/1.1 ")
+	return status, resp
+}
+
+// Read reads a response or event starting with proto and returns its status, headers and body.
+func (c *hapClient) read(proto string) (int, textproto.MIMEHeader, []byte) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := c.r.ReadLine()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, proto) {
+		c.t.Fatalf("Want %v, got '%v'", proto, line)
+	}
+	status, _ := strconv.Atoi(strings.Fields(line)[1])
+	header, err := c.r.ReadMIMEHeader()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	n, _ := strconv.Atoi(header.Get("Content-Length"))
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.r.R, body); err != nil {
+		c.t.Fatal(err)
+	}
+	return status, header, body
+}
+
+// Tlv sends a TLV8 request to path and returns the decoded response.
+func (c *hapClient) tlv(path string, req tlv8) tlv8 {
+	c.t.Helper()
+	status, body := c.request("POST", path, hapContentTypeTLV8, req.encode())
+	if status != 200 {
+		c.t.Fatalf("%v: want status 200, got %v", path, status)
+	}
+	resp, err := decodeTLV8(body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp
+}
+
+// PairSetup carries out pair-setup with code and returns the error of the accessory, or 0.
+func (c *hapClient) pairSetup(code string) byte {
+	c.t.Helper()
+	resp := c.tlv("/pair-setup", tlv8{tlvByte(tlvState, 1), tlvByte(tlvMethod, hapPairSetup)})
+	if e := resp.get(tlvError); e != nil {
+		return e[0]
+	}
+	salt, B := resp.get(tlvSalt), new(big.Int).SetBytes(resp.get(tlvPublicKey))
+	// Client side of SRP: S = (B - k*g^x)^(a + u*x)
+	a, _ := rand.Int(rand.Reader, srpN)
+	A := new(big.Int).Exp(srpG, a, srpN)
+	u := srpInt(srpPad(A), srpPad(B))
+	x := srpInt(salt, srpHash([]byte(hapSrpUsername+":"+code)))
+	k := srpInt(srpN.Bytes(), srpPad(srpG))
+	base := new(big.Int).Sub(B, new(big.Int).Mul(k, new(big.Int).Exp(srpG, x, srpN)))
+	base.Mod(base, srpN)
+	S := new(big.Int).Exp(base, new(big.Int).Add(a, new(big.Int).Mul(u, x)), srpN)
+	K := srpHash(srpPad(S))
+	m1 := srpProof(hapSrpUsername, salt, srpPad(A), srpPad(B), K)
+	resp = c.tlv("/pair-setup", tlv8{tlvByte(tlvState, 3), {tlvPublicKey, srpPad(A)}, {tlvProof, m1}})
+	if e := resp.get(tlvError); e != nil {
+		return e[0]
+	}
+	if !bytes.Equal(resp.get(tlvProof), srpHash(srpPad(A), m1, K)) {
+		c.t.Fatal("Invalid SRP proof of accessory")
+	}
+	key := hapKey(K, "Pair-Setup-Encrypt-Salt", "Pair-Setup-Encrypt-Info")
+	info := append(hapKey(K, "Pair-Setup-Controller-Sign-Salt", "Pair-Setup-Controller-Sign-Info"), c.id...)
+	info = append(info, c.pub...)
+	sub := tlv8{{tlvIdentifier, []byte(c.id)}, {tlvPublicKey, c.pub}, {tlvSignature, ed25519.Sign(c.priv, info)}}
+	resp = c.tlv("/pair-setup", tlv8{tlvByte(tlvState, 5), {tlvEncryptedData, hapSeal(key, "PS-Msg05", sub.encode())}})
+	if e := resp.get(tlvError); e != nil {
+		return e[0]
+	}
+	plain, err := hapOpen(key, "PS-Msg06", resp.get(tlvEncryptedData))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	sub, _ = decodeTLV8(plain)
+	c.server = sub.get(tlvPublicKey)
+	info = append(hapKey(K, "Pair-Setup-Accessory-Sign-Salt", "Pair-Setup-Accessory-Sign-Info"), sub.get(tlvIdentifier)...)
+	if !ed25519.Verify(c.server, append(info, c.server...), sub.get(tlvSignature)) {
+		c.t.Fatal("Invalid signature of accessory in pair-setup")
+	}
+	return 0
+}
+
+// PairVerify carries out pair-verify and encrypts the connection, it returns the error of the accessory, or 0.
+func (c *hapClient) pairVerify() byte {
+	c.t.Helper()
+	priv, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	controllerKey := priv.PublicKey().Bytes()
+	resp := c.tlv("/pair-verify", tlv8{tlvByte(tlvState, 1), {tlvPublicKey, controllerKey}})
+	accessoryKey := resp.get(tlvPublicKey)
+	pub, err := ecdh.X25519().NewPublicKey(accessoryKey)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	shared, _ := priv.ECDH(pub)
+	key := hapKey(shared, "Pair-Verify-Encrypt-Salt", "Pair-Verify-Encrypt-Info")
+	plain, err := hapOpen(key, "PV-Msg02", resp.get(tlvEncryptedData))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	sub, _ := decodeTLV8(plain)
+	info := append(append(append([]byte{}, accessoryKey...), sub.get(tlvIdentifier)...), controllerKey...)
+	if !ed25519.Verify(c.server, info, sub.get(tlvSignature)) {
+		c.t.Fatal("Invalid signature of accessory in pair-verify")
+	}
+	info = append(append(append([]byte{}, controllerKey...), c.id...), accessoryKey...)
+	sub = tlv8{{tlvIdentifier, []byte(c.id)}, {tlvSignature, ed25519.Sign(c.priv, info)}}
+	resp = c.tlv("/pair-verify", tlv8{tlvByte(tlvState, 3), {tlvEncryptedData, hapSeal(key, "PV-Msg03", sub.encode())}})
+	if e := resp.get(tlvError); e != nil {
+		return e[0]
+	}
+	c.conn.readAead, _ = chacha20poly1305.New(hapKey(shared, "Control-Salt", "Control-Read-Encryption-Key"))
+	c.conn.writeAead, _ = chacha20poly1305.New(hapKey(shared, "Control-Salt", "Control-Write-Encryption-Key"))
+	return 0
+}
+
+// Characteristics reads the characteristics with ids (e.g. 2.9,2.10) and returns their values by id.
+func (c *hapClient) characteristics(ids string) map[string]interface{} {
+	c.t.Helper()
+	status, body := c.request("GET", "/characteristics?id="+ids, "", nil)
+	var resp struct {
+		Characteristics []struct {
+			Aid, Iid int
+			Value    interface{}
+		}
+	}
+	if err := json.Unmarshal(body, &resp); status != 200 || err != nil {
+		c.t.Fatalf("Want characteristics, got %v '%s' (%v)", status, body, err)
+	}
+	values := map[string]interface{}{}
+	for _, ch := range resp.Characteristics {
+		values[fmt.Sprintf("%v.%v", ch.Aid, ch.Iid)] = ch.Value
+	}
+	return values
+}
+
+func TestTLV8(t *testing.T) {
+	long := bytes.Repeat([]byte{7}, 300)
+	b := tlv8{tlvByte(tlvState, 1), {tlvPublicKey, long}, {tlvSeparator, nil}, {tlvIdentifier, []byte("id")}}.encode()
+	if len(b) != 3+2+255+2+45+2+4 {
+		t.Errorf("Want long value split into 2 fragments, got %v bytes", len(b))
+	}
+	got, err := decodeTLV8(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 4 || !bytes.Equal(got.get(tlvPublicKey), long) || string(got.get(tlvIdentifier)) != "id" {
+		t.Errorf("Want 4 items with joined fragments, got %v", got)
+	}
+	if _, err := decodeTLV8([]byte{tlvState, 2, 1}); err == nil {
+		t.Error("Want error for truncated item")
+	}
+}
+
+func TestSetupCode(t *testing.T) {
+	for code, want := range map[string]bool{"123-45-679": true, "123-45-678": false, "111-11-111": false, "12345-679": false, "abc-de-fgh": false} {
+		if got := validSetupCode(code); got != want {
+			t.Errorf("%v: want %v, got %v", code, want, got)
+		}
+	}
+	code, err := newSetupCode()
+	if err != nil || !validSetupCode(code) {
+		t.Errorf("Want valid setup code, got '%v' (%v)", code, err)
+	}
+}
+
+func TestHomekit(t *testing.T) {
+	s := setupApi(t)
+	muSunscrn.Lock()
+	s.Percent, s.Position = 40, partial
+	muSunscrn.Unlock()
+	s.init()
+	var store hapStore
+	if _, err := store.init(); err != nil {
+		t.Fatal(err)
+	}
+	// A store saved by an earlier version was readable by all users
+	SaveToJSON(store, fileHomekit)
+	h := newHapServer(store, fileHomekit, homekitAccessories)
+	changes := make(chan bool, 10)
+	h.onChange = func() { changes <- true }
+	h.notify()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go h.serve(l)
+
+	c := newHapClient(t, l.Addr().String())
+	if status, _ := c.request("GET", "/accessories", "", nil); status != hapAuthRequired {
+		t.Errorf("Want %v before pair-verify, got %v", hapAuthRequired, status)
+	}
+	wrong := "111-22-333"
+	if store.SetupCode == wrong {
+		wrong = "111-22-334"
+	}
+	if e := c.pairSetup(wrong); e != tlvErrAuthentication {
+		t.Errorf("Want authentication error for wrong setup code, got %v", e)
+	}
+	// M5 without the SRP exchange of M3 should not pair, also when sealed with a key of an empty session key
+	c.tlv("/pair-setup", tlv8{tlvByte(tlvState, 1), tlvByte(tlvMethod, hapPairSetup)})
+	key := hapKey(nil, "Pair-Setup-Encrypt-Salt", "Pair-Setup-Encrypt-Info")
+	info := append(append(hapKey(nil, "Pair-Setup-Controller-Sign-Salt", "Pair-Setup-Controller-Sign-Info"), c.id...), c.pub...)
+	sub := tlv8{{tlvIdentifier, []byte(c.id)}, {tlvPublicKey, c.pub}, {tlvSignature, ed25519.Sign(c.priv, info)}}
+	resp := c.tlv("/pair-setup", tlv8{tlvByte(tlvState, 5), {tlvEncryptedData, hapSeal(key, "PS-Msg05", sub.encode())}})
+	if e := resp.get(tlvError); len(e) != 1 || e[0] != tlvErrAuthentication || h.paired() {
+		t.Errorf("Want authentication error and no pairing for M5 after M1, got %v (paired %v)", e, h.paired())
+	}
+	if e := c.pairSetup(store.SetupCode); e != 0 {
+		t.Fatalf("Pair-setup failed with error %v", e)
+	}
+	if !h.paired() {
+		t.Error("Accessory should be paired")
+	}
+	var saved hapStore
+	if err := readJSON(fileHomekit, &saved); err != nil || saved.pairing(c.id) == nil || !saved.pairing(c.id).Admin {
+		t.Errorf("Want admin pairing saved, got %+v (%v)", saved.Pairings, err)
+	}
+	if fi, err := os.Stat(fileHomekit); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != hapFileMode {
+		t.Errorf("Want saved store with mode %v, got %v", os.FileMode(hapFileMode), fi.Mode().Perm())
+	}
+	if e := newHapClient(t, l.Addr().String()).pairSetup(store.SetupCode); e != tlvErrUnavailable {
+		t.Errorf("Want unavailable when already paired, got %v", e)
+	}
+	if e := c.pairVerify(); e != 0 {
+		t.Fatalf("Pair-verify failed with error %v", e)
+	}
+
+	// Accessory database over the encrypted connection
+	status, body := c.request("GET", "/accessories", "", nil)
+	var db struct {
+		Accessories []hapAccessory
+	}
+	if err := json.Unmarshal(body, &db); status != 200 || err != nil || len(db.Accessories) != 2 {
+		t.Fatalf("Want bridge and sunscreen, got %v '%s' (%v)", status, body, err)
+	}
+	if a := db.Accessories[1]; a.Aid != 2 || a.Services[1].Type != hapServiceCovering || a.Services[1].Characteristics[0].Value != 60.0 {
+		t.Errorf("Want window covering at 60%% open, got %s", body)
+	}
+	values := c.characteristics("2.9,2.10,2.11,1.11")
+	if values["2.9"] != 60.0 || values["2.10"] != 60.0 || values["2.11"] != 2.0 || values["1.11"] != 2380.9524 {
+		t.Errorf("Want positions 60, stopped and light, got %v", values)
+	}
+	if status, _ := c.request("GET", "/characteristics?id=2.99", "", nil); status != 207 {
+		t.Errorf("Want multi-status for unknown characteristic, got %v", status)
+	}
+
+	// Subscribe to the position state and set the target
+	put := `{"characteristics":[{"aid":2,"iid":11,"ev":true},{"aid":2,"iid":10,"value":30}]}`
+	if status, body := c.request("PUT", "/characteristics", hapContentTypeJSON, []byte(put)); status != 204 {
+		t.Errorf("Want 204, got %v '%s'", status, body)
+	}
+	muSunscrn.Lock()
+	xc := s.commands()
+	muSunscrn.Unlock()
+	if len(xc) == 0 || xc[0].Action != cmdGoto || xc[0].Target != 70 || xc[0].Source != srcHomekit {
+		t.Errorf("Want goto 70%% from homekit, got %+v", xc)
+	}
+	put = `{"characteristics":[{"aid":2,"iid":9,"value":30}]}`
+	if status, body := c.request("PUT", "/characteristics", hapContentTypeJSON, []byte(put)); status != 207 || !strings.Contains(string(body), strconv.Itoa(hapStatusReadOnly)) {
+		t.Errorf("Want read-only status, got %v '%s'", status, body)
+	}
+	waitFor(t, "movement", func() bool {
+		muSunscrn.Lock()
+		defer muSunscrn.Unlock()
+		return s.Position == moving
+	})
+	h.notify()
+	status, _, body = c.read("EVENT/1.0 ")
+	if status != 200 || !strings.Contains(string(body), `{"aid":2,"iid":11,"value":0}`) {
+		t.Errorf("Want event for decreasing position, got %v '%s'", status, body)
+	}
+
+	// Removing the last admin unpairs the accessory
+	remove := tlv8{tlvByte(tlvState, 1), tlvByte(tlvMethod, hapRemovePairing), {tlvIdentifier, []byte(c.id)}}
+	if resp := c.tlv("/pairings", remove); resp.get(tlvError) != nil {
+		t.Errorf("Want pairing removed, got error %v", resp.get(tlvError))
+	}
+	if h.paired() {
+		t.Error("Accessory should not be paired after removing the admin")
+	}
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Error("Want change of pairing status")
+	}
+	muSunscrn.Lock()
+	s.setMode(manual, "stop", srcWeb, false)
+	muSunscrn.Unlock()
+	waitFor(t, "stop", func() bool {
+		muSunscrn.Lock()
+		defer muSunscrn.Unlock()
+		return s.running == nil && len(s.queue) == 0
+	})
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	s.closeQueue()
+}
+
+func TestHomekitConfigNumber(t *testing.T) {
+	setupApi(t)
+	var store hapStore
+	store.init()
+	h := newHapServer(store, "", homekitAccessories)
+	h.notify()
+	if h.store.ConfigNumber != 1 {
+		t.Errorf("Want configuration number 1, got %v", h.store.ConfigNumber)
+	}
+	h.notify()
+	muSunscrn.Lock()
+	sunscreens = append(sunscreens, &Sunscreen{Id: 2, Name: "Back"})
+	muSunscrn.Unlock()
+	h.notify()
+	if h.store.ConfigNumber != 2 {
+		t.Errorf("Want configuration number 2 after adding a sunscreen, got %v", h.store.ConfigNumber)
+	}
+	if txt := strings.Join(h.txt("Test", homekitCategoryBridge), " "); !strings.Contains(txt, "c#=2") || !strings.Contains(txt, "sf=1") {
+		t.Errorf("Want configuration number and unpaired status in TXT record, got %v", txt)
+	}
+}
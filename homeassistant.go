@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Constants for the MQTT integration
+const (
+	mqttDefaultPort     = 1883
+	mqttDefaultTopic    = "gosunscreen"
+	mqttDiscoveryPrefix = "homeassistant" // Prefix Home Assistant subscribes to for discovery
+	mqttPublishInterval = time.Second     // Interval at which changed states are published
+	mqttOnline          = "online"
+	mqttOffline         = "offline"
+)
+
+var (
+	muMqtt   sync.Mutex
+	mqttQuit chan struct{} // Stops the running MQTT bridge, guarded by muMqtt
+)
+
+// mqttInvalid matches the characters of a topic that are not allowed in a discovery node id.
+var mqttInvalid = regexp.MustCompile("[^a-zA-Z0-9_-]+")
+
+/* MqttBridge publishes the state of the sunscreens and light sensors to an MQTT
+broker and carries out the commands it receives. States are published retained
+under base, e.g. gosunscreen/sunscreen/1/position, and only when they have
+changed. With discovery, Home Assistant configuration is published so each
+sunscreen appears as a cover and the light as a sensor.
+
+Commands (payloads are case insensitive):
+	<base>/sunscreen/<id>/set           OPEN, CLOSE or STOP
+	<base>/sunscreen/<id>/position/set  position in percent open (0-100)
+	<base>/sunscreen/<id>/mode/set      auto or manual*/
+type mqttBridge struct {
+	client    *mqttClient
+	base      string            // Base topic
+	discovery bool              // Publish Home Assistant discovery configuration
+	mu        sync.Mutex        // Guards published
+	published map[string]string // Last published payload per topic, reset on each connect
+}
+
+// StartMqtt (re)starts the MQTT bridge with the settings in config, or stops it if MQTT is disabled.
+func startMqtt() {
+	muConf.Lock()
+	enabled, host, port, user, pass := config.EnableMqtt, config.MqttHost, config.MqttPort, config.MqttUser, config.MqttPass
+	base, discovery := config.MqttTopic, config.MqttDiscovery
+	muConf.Unlock()
+	muMqtt.Lock()
+	defer muMqtt.Unlock()
+	if mqttQuit != nil {
+		close(mqttQuit)
+		mqttQuit = nil
+	}
+	if !enabled {
+		return
+	}
+	if port == 0 {
+		port = mqttDefaultPort
+	}
+	if base == "" {
+		base = mqttDefaultTopic
+	}
+	hostname, _ := os.Hostname()
+	client := newMqttClient(net.JoinHostPort(host, strconv.Itoa(port)), mqttDefaultTopic+"-"+hostname, user, pass)
+	b := newMqttBridge(client, base, discovery)
+	mqttQuit = make(chan struct{})
+	log.Printf("Starting MQTT bridge to %v with base topic '%v'", client.addr, base)
+	go client.run(mqttQuit)
+	go b.run(mqttQuit)
+}
+
+// NewMqttBridge returns a bridge for client, which subscribes to the command topics and sets the will.
+func newMqttBridge(client *mqttClient, base string, discovery bool) *mqttBridge {
+	b := &mqttBridge{client: client, base: base, discovery: discovery, published: map[string]string{}}
+	client.will = mqttMessage{Topic: base + "/status", Payload: mqttOffline, Retain: true}
+	client.subs = []string{base + "/sunscreen/+/set", base + "/sunscreen/+/position/set", base + "/sunscreen/+/mode/set"}
+	client.handler = b.handle
+	client.onConnect = func() {
+		b.mu.Lock()
+		b.published = map[string]string{}
+		b.mu.Unlock()
+		client.publish(base+"/status", mqttOnline, true)
+		b.publishStates()
+	}
+	return b
+}
+
+// Run publishes the changed states every mqttPublishInterval until quit is closed.
+func (b *mqttBridge) run(quit <-chan struct{}) {
+	t := time.NewTicker(mqttPublishInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-t.C:
+			if b.client.connected() {
+				b.publishStates()
+			}
+		}
+	}
+}
+
+/* PublishStates publishes all states that have changed since they were last
+published. Topics that no longer have a state, e.g. of a deleted sunscreen, are
+cleared.*/
+func (b *mqttBridge) publishStates() {
+	states := b.states()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for topic := range b.published {
+		if _, ok := states[topic]; !ok {
+			states[topic] = ""
+		}
+	}
+	for topic, payload := range states {
+		if old, ok := b.published[topic]; ok && old == payload {
+			continue
+		}
+		if err := b.client.publish(topic, payload, true); err != nil {
+			return
+		}
+		if payload == "" {
+			delete(b.published, topic)
+		} else {
+			b.published[topic] = payload
+		}
+	}
+}
+
+/* States returns the payload per topic of the current state of all sunscreens
+and the light sensors, including the discovery configuration.*/
+func (b *mqttBridge) states() map[string]string {
+	states := map[string]string{}
+	muSunscrn.Lock()
+	for _, s := range sunscreens {
+		topic := fmt.Sprintf("%v/sunscreen/%v", b.base, s.Id)
+		states[topic+"/state"] = coverState(s)
+		states[topic+"/position"] = "None"
+		if s.Position != unknown && s.Position != moving {
+			states[topic+"/position"] = fmt.Sprint(100 - s.Percent)
+		}
+		states[topic+"/mode"] = s.Mode
+		states[topic+"/start"] = s.Start.Format(time.RFC3339)
+		states[topic+"/stop"] = s.Stop.Format(time.RFC3339)
+		if b.discovery {
+			b.discover(states, s.Id, s.Name)
+		}
+	}
+	muSunscrn.Unlock()
+	muLS.Lock()
+	if l := lastLight(ls.Data); l != nil {
+		states[b.base+"/light"] = fmt.Sprint(*l)
+	}
+	for _, sn := range ls.Sensors {
+		if l := lastLight(sn.Data); l != nil {
+			states[fmt.Sprintf("%v/sensor/%v/light", b.base, sn.Id)] = fmt.Sprint(*l)
+		}
+	}
+	muLS.Unlock()
+	if b.discovery {
+		states[fmt.Sprintf("%v/sensor/%v/light/config", mqttDiscoveryPrefix, b.node())] = b.config(map[string]interface{}{
+			"name":        "Light",
+			"unique_id":   b.node() + "_light",
+			"state_topic": b.base + "/light",
+			"state_class": "measurement",
+			"icon":        "mdi:weather-sunny",
+		})
+	}
+	return states
+}
+
+// Discover adds the discovery configuration of the sunscreen with id and name to states.
+func (b *mqttBridge) discover(states map[string]string, id int, name string) {
+	topic := fmt.Sprintf("%v/sunscreen/%v", b.base, id)
+	object := fmt.Sprintf("sunscreen_%v", id)
+	states[fmt.Sprintf("%v/cover/%v/%v/config", mqttDiscoveryPrefix, b.node(), object)] = b.config(map[string]interface{}{
+		"name":               name,
+		"unique_id":          b.node() + "_" + object,
+		"device_class":       "shade",
+		"command_topic":      topic + "/set",
+		"state_topic":        topic + "/state",
+		"position_topic":     topic + "/position",
+		"set_position_topic": topic + "/position/set",
+	})
+	for _, t := range []string{"start", "stop"} {
+		states[fmt.Sprintf("%v/sensor/%v/%v_%v/config", mqttDiscoveryPrefix, b.node(), object, t)] = b.config(map[string]interface{}{
+			"name":         fmt.Sprintf("%v %v", name, t),
+			"unique_id":    fmt.Sprintf("%v_%v_%v", b.node(), object, t),
+			"device_class": "timestamp",
+			"state_topic":  topic + "/" + t,
+		})
+	}
+}
+
+// Config returns the discovery configuration with the availability and device added.
+func (b *mqttBridge) config(c map[string]interface{}) string {
+	c["availability_topic"] = b.base + "/status"
+	c["device"] = map[string]interface{}{
+		"identifiers":  []string{b.node()},
+		"name":         "gosunscreen",
+		"manufacturer": "gosunscreen",
+	}
+	bs, err := json.Marshal(c)
+	if err != nil {
+		log.Printf("Unable to encode discovery configuration: %v", err)
+	}
+	return string(bs)
+}
+
+// Node returns the base topic as an identifier for discovery, e.g. gosunscreen.
+func (b *mqttBridge) node() string {
+	return mqttInvalid.ReplaceAllString(b.base, "_")
+}
+
+/* CoverState returns the state of s as a Home Assistant cover: open, closed,
+opening, closing, stopped (partially open) or None (unknown). The caller should
+hold muSunscrn.*/
+func coverState(s *Sunscreen) string {
+	switch s.Position {
+	case up:
+		return "open"
+	case down:
+		return "closed"
+	case moving:
+		if s.travelUp {
+			return "opening"
+		}
+		return "closing"
+	case partial:
+		return "stopped"
+	default:
+		return "None"
+	}
+}
+
+// Handle carries out a command received on one of the command topics.
+func (b *mqttBridge) handle(msg mqttMessage) {
+	if msg.Retain {
+		// Retained commands are old and would move the sunscreens at each connect
+		log.Printf("Ignored retained MQTT command on '%v'", msg.Topic)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(msg.Topic, b.base+"/sunscreen/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	s := getSunscreen(id)
+	if err != nil || s == nil {
+		log.Printf("Ignored MQTT command for unknown sunscreen on '%v'", msg.Topic)
+		return
+	}
+	payload := strings.ToLower(strings.TrimSpace(msg.Payload))
+	// A movement is confirmed for a frost lock by suffixing it with confirm, e.g. "CLOSE CONFIRM" or "30 confirm"
+	confirmed := strings.HasSuffix(payload, " confirm")
+	payload = strings.TrimSpace(strings.TrimSuffix(payload, " confirm"))
+	mode, pos := manual, ""
+	switch strings.Join(parts[1:], "/") {
+	case "set":
+		switch payload {
+		case "open", up:
+			pos = up
+		case "close", down:
+			pos = down
+		case "stop":
+			pos = "stop"
+		default:
+			log.Printf("Ignored unknown MQTT command '%v' on '%v'", msg.Payload, msg.Topic)
+			return
+		}
+	case "position/set":
+		open, err := strconv.Atoi(payload)
+		if err != nil || open < 0 || open > 100 {
+			log.Printf("Ignored MQTT position '%v' on '%v', should be within range 0-100", msg.Payload, msg.Topic)
+			return
+		}
+		pos = fmt.Sprint(100 - open)
+	case "mode/set":
+		mode = payload
+	default:
+		log.Printf("Ignored MQTT message on unknown topic '%v'", msg.Topic)
+		return
+	}
+	log.Printf("Received MQTT command '%v' on '%v'", msg.Payload, msg.Topic)
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	if _, err := s.setMode(mode, pos, srcMqtt, confirmed); err != nil {
+		log.Println(err)
+	}
+}
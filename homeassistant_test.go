@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMqttBridge(t *testing.T) {
+	inTempDir(t)
+	hw = newSimGPIO()
+	broker := newTestBroker(t)
+	muSunscrn.Lock()
+	sunscreens = []*Sunscreen{{Id: 1, Name: "Front", Mode: auto, Position: partial, Percent: 30}}
+	muSunscrn.Unlock()
+	muLS.Lock()
+	ls = &LightSensor{Data: []int{40, 50}}
+	muLS.Unlock()
+	client := newMqttClient(broker.addr(), "test", "", "")
+	b := newMqttBridge(client, "home/screens", true)
+	quit := make(chan struct{})
+	defer close(quit)
+	go client.run(quit)
+	go b.run(quit)
+	waitFor(t, "states", func() bool { return broker.retainedPayload("home/screens/sunscreen/1/position") == "70" })
+	want := map[string]string{
+		"home/screens/status":            mqttOnline,
+		"home/screens/sunscreen/1/state": "stopped",
+		"home/screens/sunscreen/1/mode":  auto,
+		"home/screens/light":             "50",
+	}
+	for topic, payload := range want {
+		if got := broker.retainedPayload(topic); got != payload {
+			t.Errorf("%v: want '%v', got '%v'", topic, payload, got)
+		}
+	}
+	var cover map[string]interface{}
+	if err := json.Unmarshal([]byte(broker.retainedPayload("homeassistant/cover/home_screens/sunscreen_1/config")), &cover); err != nil {
+		t.Fatalf("Invalid discovery of cover: %v", err)
+	}
+	if cover["set_position_topic"] != "home/screens/sunscreen/1/position/set" || cover["availability_topic"] != "home/screens/status" || cover["name"] != "Front" {
+		t.Errorf("Unexpected discovery of cover: %v", cover)
+	}
+	if broker.retainedPayload("homeassistant/sensor/home_screens/light/config") == "" {
+		t.Errorf("Light sensor should be discovered")
+	}
+
+	// Commands switch to manual mode and are queued from source mqtt
+	broker.publish(mqttMessage{Topic: "home/screens/sunscreen/1/position/set", Payload: "20"})
+	waitFor(t, "command", func() bool {
+		muSunscrn.Lock()
+		defer muSunscrn.Unlock()
+		xc := sunscreens[0].commands()
+		return len(xc) > 0 && xc[0].Source == srcMqtt && xc[0].Target == 80
+	})
+	waitFor(t, "manual mode", func() bool { return broker.retainedPayload("home/screens/sunscreen/1/mode") == manual })
+	broker.publish(mqttMessage{Topic: "home/screens/sunscreen/1/mode/set", Payload: "AUTO"})
+	waitFor(t, "auto mode", func() bool { return broker.retainedPayload("home/screens/sunscreen/1/mode") == auto })
+
+	// A deleted sunscreen is removed from Home Assistant
+	muSunscrn.Lock()
+	sunscreens[0].closeQueue()
+	sunscreens = []*Sunscreen{}
+	muSunscrn.Unlock()
+	waitFor(t, "removal", func() bool {
+		return broker.retainedPayload("homeassistant/cover/home_screens/sunscreen_1/config") == "" &&
+			broker.retainedPayload("home/screens/sunscreen/1/state") == ""
+	})
+}
+
+func TestMqttConfirmedCommand(t *testing.T) {
+	s := setupApi(t)
+	resetFrost(t)
+	s.init()
+	muFrost.Lock()
+	frost.Enabled, frost.Locked = true, true
+	muFrost.Unlock()
+	b := newMqttBridge(newMqttClient("", "test", "", ""), mqttDefaultTopic, false)
+	b.handle(mqttMessage{Topic: "gosunscreen/sunscreen/1/position/set", Payload: "30"})
+	muSunscrn.Lock()
+	if xc := s.commands(); len(xc) != 1 || xc[0].Status != cmdCancelled {
+		t.Errorf("Want unconfirmed command cancelled during frost lock, got %+v", xc)
+	}
+	muSunscrn.Unlock()
+	b.handle(mqttMessage{Topic: "gosunscreen/sunscreen/1/position/set", Payload: "30 CONFIRM"})
+	muSunscrn.Lock()
+	if xc := s.commands(); len(xc) != 2 || xc[0].Status == cmdCancelled || xc[0].Target != 70 || !xc[0].Confirmed {
+		t.Errorf("Want confirmed command queued during frost lock, got %+v", xc)
+	}
+	s.submit(newCommand(cmdStop, 0, srcWeb))
+	muSunscrn.Unlock()
+	waitFor(t, "stop", func() bool {
+		muSunscrn.Lock()
+		defer muSunscrn.Unlock()
+		return s.running == nil && len(s.queue) == 0
+	})
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	s.closeQueue()
+}
+
+func TestMqttRetainedCommand(t *testing.T) {
+	inTempDir(t)
+	muSunscrn.Lock()
+	s := &Sunscreen{Id: 1, Name: "Front", Mode: auto, Position: up}
+	sunscreens = []*Sunscreen{s}
+	muSunscrn.Unlock()
+	b := newMqttBridge(newMqttClient("", "test", "", ""), mqttDefaultTopic, false)
+	b.handle(mqttMessage{Topic: "gosunscreen/sunscreen/1/set", Payload: "CLOSE", Retain: true})
+	b.handle(mqttMessage{Topic: "gosunscreen/sunscreen/2/set", Payload: "CLOSE"})
+	b.handle(mqttMessage{Topic: "gosunscreen/sunscreen/1/set", Payload: "sideways"})
+	b.handle(mqttMessage{Topic: "gosunscreen/sunscreen/1/set", Payload: "confirm"})
+	time.Sleep(10 * time.Millisecond)
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	if xc := s.commands(); len(xc) != 0 || s.Mode != auto {
+		t.Errorf("Retained, unknown and invalid commands should be ignored, got %v (mode %v)", xc, s.Mode)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Constants for the HomeKit bridge
+const (
+	homekitDefaultPort     = 51826
+	homekitDefaultName     = "gosunscreen"
+	homekitCategoryBridge  = 2
+	homekitNotifyInterval  = time.Second // Interval at which changed values are sent to controllers
+	homekitMinLux          = 0.0001
+	homekitMaxLux          = 100000.0
+	homekitManufacturer    = "gosunscreen"
+	homekitProtocolVersion = "1.1.0"
+	homekitFirmware        = "1.0.0"
+)
+
+// Constants for the types of HomeKit services and characteristics
+const (
+	hapServiceInfo         = "3E"
+	hapServiceProtocol     = "A2"
+	hapServiceLightSensor  = "84"
+	hapServiceCovering     = "8C"
+	hapCharIdentify        = "14"
+	hapCharManufacturer    = "20"
+	hapCharModel           = "21"
+	hapCharName            = "23"
+	hapCharSerialNumber    = "30"
+	hapCharFirmware        = "52"
+	hapCharVersion         = "37"
+	hapCharAmbientLight    = "6B"
+	hapCharCurrentPosition = "6D"
+	hapCharTargetPosition  = "7C"
+	hapCharPositionState   = "72"
+	hapPositionDecreasing  = 0
+	hapPositionIncreasing  = 1
+	hapPositionStopped     = 2
+)
+
+var (
+	muHomekit   sync.Mutex
+	homekitQuit chan struct{} // Stops the running HomeKit server, guarded by muHomekit
+	homekit     *hapServer    // Running HomeKit server, guarded by muHomekit
+)
+
+// HomekitStatus is the status of the HomeKit server as shown on the config page.
+type homekitStatus struct {
+	Running   bool
+	SetupCode string
+	Paired    bool
+}
+
+/* StartHomekit (re)starts the HomeKit bridge with the settings in config, or
+stops it if HomeKit is disabled. The bridge is advertised over mDNS, so the Home
+app finds it when adding an accessory.*/
+func startHomekit() {
+	muConf.Lock()
+	enabled, name, port := config.EnableHomekit, config.HomekitName, config.HomekitPort
+	muConf.Unlock()
+	muHomekit.Lock()
+	defer muHomekit.Unlock()
+	if homekitQuit != nil {
+		close(homekitQuit)
+		homekitQuit, homekit = nil, nil
+	}
+	if !enabled {
+		return
+	}
+	if name == "" {
+		name = homekitDefaultName
+	}
+	if port == 0 {
+		port = homekitDefaultPort
+	}
+	var store hapStore
+	if err := readJSON(fileHomekit, &store); err != nil {
+		log.Printf("Unable to start HomeKit bridge: %v", err)
+		return
+	}
+	// Files saved by earlier versions were readable by all users
+	if err := os.Chmod(fileHomekit, hapFileMode); err != nil {
+		log.Printf("Unable to start HomeKit bridge: %v", err)
+		return
+	}
+	if changed, err := store.init(); err != nil {
+		log.Printf("Unable to start HomeKit bridge: %v", err)
+		return
+	} else if changed {
+		saveToJSONPerm(store, fileHomekit, hapFileMode)
+	}
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		log.Printf("Unable to start HomeKit bridge: %v", err)
+		return
+	}
+	h := newHapServer(store, fileHomekit, homekitAccessories)
+	host, _ := os.Hostname()
+	m := &mdnsService{instance: name, service: "_hap._tcp", host: host, port: port, addrs: localAddrs,
+		txt: func() []string { return h.txt(name, homekitCategoryBridge) }}
+	h.onChange = m.announce
+	h.notify()
+	quit := make(chan struct{})
+	homekitQuit, homekit = quit, h
+	log.Printf("Starting HomeKit bridge '%v' at port %v with setup code %v", name, port, store.SetupCode)
+	go func() {
+		<-quit
+		l.Close()
+	}()
+	go h.serve(l)
+	go func() {
+		if err := m.run(quit); err != nil {
+			log.Printf("Unable to advertise HomeKit bridge over mDNS: %v", err)
+		}
+	}()
+	go homekitNotify(h, quit)
+}
+
+// HomekitNotify sends the changed values to the controllers every homekitNotifyInterval until quit is closed.
+func homekitNotify(h *hapServer, quit <-chan struct{}) {
+	t := time.NewTicker(homekitNotifyInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-t.C:
+			h.notify()
+		}
+	}
+}
+
+// GetHomekitStatus returns the status of the HomeKit server.
+func getHomekitStatus() homekitStatus {
+	muHomekit.Lock()
+	defer muHomekit.Unlock()
+	if homekit == nil {
+		return homekitStatus{}
+	}
+	return homekitStatus{true, homekit.setupCode(), homekit.paired()}
+}
+
+// ResetHomekit removes all pairings of the HomeKit server, so it can be paired again.
+func resetHomekit() {
+	muHomekit.Lock()
+	defer muHomekit.Unlock()
+	if homekit != nil {
+		homekit.reset()
+	}
+}
+
+/* HomekitAccessories returns the accessory database of the bridge. The bridge
+itself (aid 1) has the light sensor, each sunscreen is a window covering with
+aid Id+1. HomeKit positions are in percent open, so 100 is up.*/
+func homekitAccessories() []*hapAccessory {
+	muConf.Lock()
+	name := config.HomekitName
+	muConf.Unlock()
+	if name == "" {
+		name = homekitDefaultName
+	}
+	bridge := &hapAccessory{Aid: 1, Services: []*hapService{
+		homekitInfo(name, "Bridge", "0", func() { log.Println("Identify HomeKit bridge") }),
+		{Iid: 8, Type: hapServiceProtocol, Characteristics: []*hapCharacteristic{
+			homekitConst(9, hapCharVersion, homekitProtocolVersion),
+		}},
+		{Iid: 10, Type: hapServiceLightSensor, Characteristics: []*hapCharacteristic{
+			{Iid: 11, Type: hapCharAmbientLight, Perms: []string{hapPermRead, hapPermNotify}, Format: "float", Unit: "lux",
+				MinValue: floatPtr(homekitMinLux), MaxValue: floatPtr(homekitMaxLux), read: homekitLux},
+			homekitConst(12, hapCharName, "Light"),
+		}},
+	}}
+	accessories := []*hapAccessory{bridge}
+	for _, s := range listSunscreens() {
+		accessories = append(accessories, homekitSunscreen(s))
+	}
+	return accessories
+}
+
+// HomekitSunscreen returns the accessory of sunscreen s.
+func homekitSunscreen(s *Sunscreen) *hapAccessory {
+	muSunscrn.Lock()
+	id, name := s.Id, s.Name
+	muSunscrn.Unlock()
+	read := func(value func() int) func() interface{} {
+		return func() interface{} {
+			muSunscrn.Lock()
+			defer muSunscrn.Unlock()
+			return value()
+		}
+	}
+	position := func(perms ...string) *hapCharacteristic {
+		return &hapCharacteristic{Perms: perms, Format: "uint8", Unit: "percentage",
+			MinValue: floatPtr(0), MaxValue: floatPtr(100), MinStep: floatPtr(1)}
+	}
+	current := position(hapPermRead, hapPermNotify)
+	current.Iid, current.Type = 9, hapCharCurrentPosition
+	current.read = read(func() int { return 100 - s.Percent })
+	target := position(hapPermRead, hapPermWrite, hapPermNotify)
+	target.Iid, target.Type = 10, hapCharTargetPosition
+	target.read = read(func() int { return 100 - s.target() })
+	target.write = func(v interface{}) error {
+		f, ok := v.(float64)
+		if !ok || f < 0 || f > 100 {
+			return fmt.Errorf("Invalid target position '%v', should be within range 0-100", v)
+		}
+		log.Printf("Received HomeKit target position %v%% open for sunscreen '%v'", math.Round(f), name)
+		muSunscrn.Lock()
+		defer muSunscrn.Unlock()
+		_, err := s.setMode(manual, fmt.Sprint(100-int(math.Round(f))), srcHomekit, false)
+		return err
+	}
+	state := &hapCharacteristic{Iid: 11, Type: hapCharPositionState, Perms: []string{hapPermRead, hapPermNotify}, Format: "uint8",
+		MinValue: floatPtr(0), MaxValue: floatPtr(2), MinStep: floatPtr(1)}
+	state.read = read(func() int {
+		switch {
+		case s.Position != moving:
+			return hapPositionStopped
+		case s.travelUp:
+			return hapPositionIncreasing
+		}
+		return hapPositionDecreasing
+	})
+	return &hapAccessory{Aid: id + 1, Services: []*hapService{
+		homekitInfo(name, "Sunscreen", strconv.Itoa(id), func() { log.Printf("Identify HomeKit sunscreen '%v'", name) }),
+		{Iid: 8, Type: hapServiceCovering, Primary: true, Characteristics: []*hapCharacteristic{
+			current, target, state, homekitConst(12, hapCharName, name),
+		}},
+	}}
+}
+
+// HomekitInfo returns the accessory information service (iid 1 to 7) of an accessory.
+func homekitInfo(name, model, serial string, identify func()) *hapService {
+	return &hapService{Iid: 1, Type: hapServiceInfo, Characteristics: []*hapCharacteristic{
+		{Iid: 2, Type: hapCharIdentify, Perms: []string{hapPermWrite}, Format: "bool", write: func(interface{}) error {
+			identify()
+			return nil
+		}},
+		homekitConst(3, hapCharManufacturer, homekitManufacturer),
+		homekitConst(4, hapCharModel, model),
+		homekitConst(5, hapCharName, name),
+		homekitConst(6, hapCharSerialNumber, serial),
+		homekitConst(7, hapCharFirmware, homekitFirmware),
+	}}
+}
+
+// HomekitConst returns a read-only string characteristic with value.
+func homekitConst(iid int, typ, value string) *hapCharacteristic {
+	return &hapCharacteristic{Iid: iid, Type: typ, Perms: []string{hapPermRead}, Format: "string",
+		read: func() interface{} { return value }}
+}
+
+// HomekitLux returns the last light in lux, within the range HomeKit allows.
+func homekitLux() interface{} {
+	muLS.Lock()
+	l := lastLight(ls.Data)
+	muLS.Unlock()
+	if l == nil {
+		return homekitMinLux
+	}
+	return math.Max(homekitMinLux, math.Min(homekitMaxLux, math.Round(lux(*l)*10000)/10000))
+}
+
+// FloatPtr returns a pointer to f, e.g. for optional JSON fields.
+func floatPtr(f float64) *float64 {
+	return &f
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Constants for the InfluxDB exporter
+const (
+	fileInfluxBuffer = "./logs/influx_buffer.lp" // Points that could not be sent yet, in line protocol
+	influxInterval   = 10 * time.Second          // Interval at which points are sent
+	influxTimeout    = 10 * time.Second          // Timeout of a write request
+	influxBatch      = 5000                      // Maximum number of points per write request
+	influxMaxBuffer  = 100000                    // Maximum number of points kept on disk, older points are dropped
+)
+
+var (
+	muInflux     sync.Mutex
+	muInfluxFile sync.Mutex      // Guards the buffer file, which a stopped exporter may still write to
+	influxQuit   chan struct{}   // Stops the running exporter, guarded by muInflux
+	influxExport *influxExporter // Running exporter or nil, guarded by muInflux
+)
+
+// Escapers for the line protocol
+var (
+	influxMeasurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+	influxTagEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+	influxStringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+/* InfluxExporter pushes points in the InfluxDB line protocol to a write
+endpoint over HTTP, e.g. http://influx:8086/write?db=sunscreen (InfluxDB 1.x)
+or http://influx:8086/api/v2/write?org=home&bucket=sunscreen (InfluxDB 2.x).
+Points are sent in batches every influxInterval. While the endpoint is
+unavailable they are buffered in file and resent later, oldest first.*/
+type influxExporter struct {
+	url     string // Write endpoint, including database or bucket
+	token   string // Optional token, sent as Authorization: Token <token>
+	file    string // Buffer of points that could not be sent
+	client  *http.Client
+	mu      sync.Mutex // Guards pending
+	pending []string   // Points that have not been sent or buffered yet
+}
+
+// NewInfluxExporter returns an exporter to the write endpoint at url that buffers to file.
+func newInfluxExporter(url, token, file string) *influxExporter {
+	return &influxExporter{url: url, token: token, file: file, client: &http.Client{Timeout: influxTimeout}}
+}
+
+// StartInflux (re)starts the InfluxDB exporter with the settings in config, or stops it if it is disabled.
+func startInflux() {
+	muConf.Lock()
+	enabled, url, token := config.EnableInflux, config.InfluxUrl, config.InfluxToken
+	muConf.Unlock()
+	muInflux.Lock()
+	defer muInflux.Unlock()
+	if influxQuit != nil {
+		close(influxQuit)
+		influxQuit, influxExport = nil, nil
+	}
+	if !enabled {
+		return
+	}
+	influxExport = newInfluxExporter(url, token, fileInfluxBuffer)
+	influxQuit = make(chan struct{})
+	log.Printf("Starting InfluxDB exporter to %v", url)
+	go influxExport.run(influxQuit, influxInterval)
+}
+
+// ExportInflux adds points to the running exporter, if any.
+func exportInflux(points ...string) {
+	muInflux.Lock()
+	e := influxExport
+	muInflux.Unlock()
+	if e != nil {
+		e.add(points...)
+	}
+}
+
+/* ExportLight exports the combined light l and the readings of the sensors,
+as they are written to fileLight. The caller should hold muLS.*/
+func exportLight(t time.Time, l int, ok bool, readings []reading) {
+	points := []string{influxPoint("light", nil, []string{"light", fmt.Sprintf("%vi", l), "ok", fmt.Sprint(ok)}, t)}
+	for _, r := range readings {
+		failed := r.Value == 0 || r.Err != nil
+		if sn := ls.sensor(r.Id); sn != nil {
+			failed = sn.Failed
+		}
+		points = append(points, influxPoint("sensor_light",
+			[]string{"sensor", fmt.Sprint(r.Id), "name", ls.sensorName(r.Id)},
+			[]string{"light", fmt.Sprintf("%vi", r.Value), "failed", fmt.Sprint(failed)}, t))
+	}
+	exportInflux(points...)
+}
+
+// ExportMovement exports a movement of a sunscreen, as it is written to fileStats.
+func exportMovement(t time.Time, id int, name, mode, position, source string, percent int, light []int) {
+	if source == "" {
+		source = "none"
+	}
+	fields := []string{"percent", fmt.Sprintf("%vi", percent), "light_data", influxString(fmt.Sprint(light))}
+	if l := lastLight(light); l != nil {
+		fields = append(fields, "light", fmt.Sprintf("%vi", *l))
+	}
+	exportInflux(influxPoint("movement",
+		[]string{"sunscreen", fmt.Sprint(id), "name", name, "mode", mode, "position", position, "source", source}, fields, t))
+}
+
+/* InfluxPoint returns a point in line protocol with measurement (prefixed with
+gosunscreen_), tags and fields as key, value pairs, and timestamp t in
+nanoseconds. Field values should be formatted already, e.g. 5i, true or
+influxString("text"). Tags with an empty value are left out.*/
+func influxPoint(measurement string, tags, fields []string, t time.Time) string {
+	var b strings.Builder
+	b.WriteString(influxMeasurementEscaper.Replace("gosunscreen_" + measurement))
+	for i := 0; i+1 < len(tags); i += 2 {
+		if tags[i+1] != "" {
+			fmt.Fprintf(&b, ",%v=%v", influxTagEscaper.Replace(tags[i]), influxTagEscaper.Replace(tags[i+1]))
+		}
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		sep := ","
+		if i == 0 {
+			sep = " "
+		}
+		fmt.Fprintf(&b, "%v%v=%v", sep, influxTagEscaper.Replace(fields[i]), fields[i+1])
+	}
+	fmt.Fprintf(&b, " %v", t.UnixNano())
+	return b.String()
+}
+
+// InfluxString returns s as a string field value.
+func influxString(s string) string {
+	return `"` + influxStringEscaper.Replace(s) + `"`
+}
+
+// Add queues points to be sent with the next flush.
+func (e *influxExporter) add(points ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pending = append(e.pending, points...)
+}
+
+/* Run flushes the points every interval until quit is closed, after which the
+remaining points are buffered.*/
+func (e *influxExporter) run(quit <-chan struct{}, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	failing := false
+	for {
+		select {
+		case <-quit:
+			e.mu.Lock()
+			pending := e.pending
+			e.pending = nil
+			e.mu.Unlock()
+			muInfluxFile.Lock()
+			buffered, _ := readLines(e.file)
+			if err := e.buffer(append(buffered, pending...), len(buffered)); err != nil {
+				log.Printf("Unable to buffer InfluxDB points: %v", err)
+			}
+			muInfluxFile.Unlock()
+			return
+		case <-t.C:
+		}
+		muInfluxFile.Lock()
+		err := e.flush()
+		muInfluxFile.Unlock()
+		switch {
+		case err != nil && !failing:
+			log.Printf("Unable to send points to InfluxDB, buffering them in %v until it is available: %v", e.file, err)
+		case err == nil && failing:
+			log.Println("Sent buffered points to InfluxDB")
+		}
+		failing = err != nil
+	}
+}
+
+/* Flush sends the buffered and pending points in batches, oldest first. If a
+batch fails, the points that have not been sent are buffered and an error is
+returned. The caller should hold muInfluxFile.*/
+func (e *influxExporter) flush() error {
+	e.mu.Lock()
+	pending := e.pending
+	e.pending = nil
+	e.mu.Unlock()
+	buffered, err := readLines(e.file)
+	if err != nil {
+		log.Printf("Unable to read InfluxDB buffer %v, points in it are lost: %v", e.file, err)
+		buffered = nil
+	}
+	points := append(buffered, pending...)
+	sent := 0
+	for sent < len(points) {
+		n := min(len(points)-sent, influxBatch)
+		if err = e.send(points[sent : sent+n]); err != nil {
+			break
+		}
+		sent += n
+	}
+	if err == nil {
+		if len(buffered) > 0 {
+			os.Remove(e.file)
+		}
+		return nil
+	}
+	inFile := 0
+	if sent == 0 {
+		inFile = len(buffered)
+	}
+	if bufErr := e.buffer(points[sent:], inFile); bufErr != nil {
+		return fmt.Errorf("%v (unable to buffer points: %v)", err, bufErr)
+	}
+	return err
+}
+
+// Send writes points to the endpoint. Points rejected as invalid (400) are dropped, as resending them would fail again.
+func (e *influxExporter) send(points []string) error {
+	req, err := http.NewRequest(http.MethodPost, e.url, strings.NewReader(strings.Join(points, "\n")+"\n"))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if e.token != "" {
+		req.Header.Set("Authorization", "Token "+e.token)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode == http.StatusBadRequest:
+		log.Printf("InfluxDB rejected %v points, dropping them: %s", len(points), bytes.TrimSpace(body))
+		return nil
+	default:
+		return fmt.Errorf("InfluxDB responded with %v: %s", resp.Status, bytes.TrimSpace(body))
+	}
+}
+
+/* Buffer stores points in the buffer file, of which the first inFile are in
+the file already. Only the last influxMaxBuffer points are kept. The caller
+should hold muInfluxFile.*/
+func (e *influxExporter) buffer(points []string, inFile int) error {
+	if len(points) > influxMaxBuffer {
+		log.Printf("InfluxDB buffer is full, dropping %v oldest points", len(points)-influxMaxBuffer)
+		points, inFile = points[len(points)-influxMaxBuffer:], 0
+	}
+	switch {
+	case len(points) == inFile && inFile > 0:
+		return nil
+	case len(points) == 0:
+		os.Remove(e.file)
+		return nil
+	case inFile > 0:
+		f, err := os.OpenFile(e.file, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.WriteString(strings.Join(points[inFile:], "\n") + "\n")
+		return err
+	}
+	tmp := e.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(points, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.file)
+}
+
+// ReadLines returns the non-empty lines of file, or nil if file does not exist.
+func readLines(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lines := []string{}
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		if line := s.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, s.Err()
+}
+
+// CheckInfluxUrl returns an error if u is not an absolute http(s) url.
+func checkInfluxUrl(u string) error {
+	pu, err := url.Parse(u)
+	if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+		return fmt.Errorf("Url of InfluxDB '%v' should be an http(s) url, e.g. http://192.168.1.10:8086/write?db=sunscreen", u)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// influxStub is a local InfluxDB write endpoint that records the received points.
+type influxStub struct {
+	mu     sync.Mutex
+	status int // Status of the responses
+	auth   string
+	points []string
+}
+
+func (st *influxStub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.auth = req.Header.Get("Authorization")
+	if st.status != http.StatusNoContent {
+		http.Error(w, `{"error":"unavailable"}`, st.status)
+		return
+	}
+	st.points = append(st.points, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+	w.WriteHeader(st.status)
+}
+
+func (st *influxStub) setStatus(status int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.status = status
+}
+
+func (st *influxStub) received() []string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return append([]string{}, st.points...)
+}
+
+func TestInfluxPoint(t *testing.T) {
+	ts := time.Unix(1700000000, 5)
+	got := influxPoint("movement", []string{"name", "Front, left=1", "source", ""},
+		[]string{"percent", "40i", "light_data", influxString(`[1 "2"]`)}, ts)
+	want := `gosunscreen_movement,name=Front\,\ left\=1 percent=40i,light_data="[1 \"2\"]" 1700000000000000005`
+	if got != want {
+		t.Errorf("Want '%v', got '%v'", want, got)
+	}
+}
+
+func TestInfluxExporter(t *testing.T) {
+	inTempDir(t)
+	stub := &influxStub{status: http.StatusServiceUnavailable}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	e := newInfluxExporter(srv.URL+"/api/v2/write?bucket=sunscreen", "secret", "buffer.lp")
+	ts := time.Unix(1700000000, 0)
+	e.add(influxPoint("light", nil, []string{"light", "10i"}, ts))
+	if err := e.flush(); err == nil {
+		t.Fatal("Want error while InfluxDB is unavailable")
+	}
+	e.add(influxPoint("light", nil, []string{"light", "20i"}, ts))
+	e.flush()
+	if lines, _ := readLines("buffer.lp"); len(lines) != 2 {
+		t.Fatalf("Want 2 buffered points, got %v", lines)
+	}
+	stub.setStatus(http.StatusNoContent)
+	e.add(influxPoint("light", nil, []string{"light", "30i"}, ts))
+	if err := e.flush(); err != nil {
+		t.Fatal(err)
+	}
+	got := stub.received()
+	if len(got) != 3 || !strings.Contains(got[0], "light=10i") || !strings.Contains(got[2], "light=30i") {
+		t.Errorf("Want buffered points followed by the new point, got %v", got)
+	}
+	if stub.auth != "Token secret" {
+		t.Errorf("Want token authorization, got '%v'", stub.auth)
+	}
+	if lines, _ := readLines("buffer.lp"); lines != nil {
+		t.Errorf("Buffer should be removed after sending, got %v", lines)
+	}
+	// Invalid points are dropped instead of being resent forever
+	stub.setStatus(http.StatusBadRequest)
+	e.add("invalid")
+	if err := e.flush(); err != nil {
+		t.Errorf("Want invalid points to be dropped, got %v", err)
+	}
+}
+
+func TestInfluxBufferLimit(t *testing.T) {
+	inTempDir(t)
+	e := newInfluxExporter("http://127.0.0.1:1/write?db=sunscreen", "", "buffer.lp")
+	points := make([]string, influxMaxBuffer+10)
+	for i := range points {
+		points[i] = influxPoint("light", nil, []string{"light", "1i"}, time.Unix(int64(i), 0))
+	}
+	if err := e.buffer(points, 0); err != nil {
+		t.Fatal(err)
+	}
+	e.buffer(append(points[10:], "new"), influxMaxBuffer)
+	lines, _ := readLines("buffer.lp")
+	if len(lines) != influxMaxBuffer || lines[0] != points[11] || lines[len(lines)-1] != "new" {
+		t.Errorf("Want the last %v points, got %v starting with %v", influxMaxBuffer, len(lines), lines[0])
+	}
+}
+
+func TestInfluxExport(t *testing.T) {
+	inTempDir(t)
+	stub := &influxStub{status: http.StatusNoContent}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	muConf.Lock()
+	config = Config{EnableInflux: true, InfluxUrl: srv.URL + "/write?db=sunscreen"}
+	muConf.Unlock()
+	muLS.Lock()
+	ls = &LightSensor{Sensors: []Sensor{{Id: 1, Name: "Roof"}}}
+	muLS.Unlock()
+	startInflux()
+	defer func() {
+		muConf.Lock()
+		config.EnableInflux = false
+		muConf.Unlock()
+		startInflux()
+	}()
+	muInflux.Lock()
+	e := influxExport
+	muInflux.Unlock()
+	now := time.Now()
+	muLS.Lock()
+	exportLight(now, 42, true, []reading{{1, 40, nil}})
+	muLS.Unlock()
+	exportMovement(now, 1, "Front", auto, down, "", 100, []int{50, 42})
+	muInfluxFile.Lock()
+	e.flush()
+	muInfluxFile.Unlock()
+	got := strings.Join(stub.received(), "\n")
+	for _, want := range []string{
+		"gosunscreen_light light=42i,ok=true ",
+		"gosunscreen_sensor_light,sensor=1,name=Roof light=40i,failed=false ",
+		`gosunscreen_movement,sunscreen=1,name=Front,mode=auto,position=down,source=none percent=100i,light_data="[50 42]",light=42i `,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Points should contain '%v', got:\n%v", want, got)
+		}
+	}
+}
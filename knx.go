@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Constants for the KNXnet/IP service types used by tunnelling
+const (
+	knxConnectRequest     uint16 = 0x0205
+	knxConnectResponse    uint16 = 0x0206
+	knxStateRequest       uint16 = 0x0207
+	knxStateResponse      uint16 = 0x0208
+	knxDisconnectRequest  uint16 = 0x0209
+	knxDisconnectResponse uint16 = 0x020A
+	knxTunnelRequest      uint16 = 0x0420
+	knxTunnelAck          uint16 = 0x0421
+)
+
+// Constants for the cEMI message codes and group services (APCI)
+const (
+	cemiDataReq      byte   = 0x11 // L_Data.req, sent to the bus
+	cemiDataCon      byte   = 0x2E // L_Data.con, confirmation of a sent telegram
+	cemiDataInd      byte   = 0x29 // L_Data.ind, received from the bus
+	knxGroupRead     uint16 = 0x0000
+	knxGroupResponse uint16 = 0x0040
+	knxGroupWrite    uint16 = 0x0080
+)
+
+// Constants for the KNXnet/IP tunnelling client
+const (
+	knxDefaultPort    = 3671
+	knxHeaderSize     = 6
+	knxTimeout        = time.Second      // Time within which a tunnelling request is acknowledged
+	knxConnectTimeout = 10 * time.Second // Time within which a connect or connection state request is answered
+	knxHeartbeat      = 60 * time.Second // Interval of connection state requests
+	knxBackoffMin     = time.Second
+	knxBackoffMax     = 2 * time.Minute
+	knxMaxFrame       = 512
+)
+
+// KnxGroupAddr is a 3-level KNX group address, e.g. 1/2/3.
+type knxGroupAddr uint16
+
+// String returns the group address in the format main/middle/sub.
+func (ga knxGroupAddr) String() string {
+	return fmt.Sprintf("%d/%d/%d", ga>>11, (ga>>8)&0x07, ga&0xFF)
+}
+
+// ParseGroupAddr parses a 3-level group address, e.g. 1/2/3, with main group 0-31, middle group 0-7 and sub group 0-255.
+func parseGroupAddr(s string) (knxGroupAddr, error) {
+	parts := strings.Split(strings.TrimSpace(s), "/")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("Invalid group address '%v', should be main/middle/sub, e.g. 1/2/3", s)
+	}
+	limits := []int{31, 7, 255}
+	ga := 0
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || n > limits[i] {
+			return 0, fmt.Errorf("Invalid group address '%v', should be within range 0/0/0-31/7/255", s)
+		}
+		ga = ga<<[]int{0, 3, 8}[i] | n
+	}
+	if ga == 0 {
+		return 0, fmt.Errorf("Invalid group address '%v', 0/0/0 is not allowed", s)
+	}
+	return knxGroupAddr(ga), nil
+}
+
+/* KnxTelegram is a group telegram. Data holds the value after the APCI; with
+short, the value (at most 6 bits, e.g. DPT 1) is part of the APCI byte.*/
+type knxTelegram struct {
+	Dest  knxGroupAddr
+	Apci  uint16 // knxGroupRead, knxGroupResponse or knxGroupWrite
+	Data  []byte
+	short bool
+}
+
+// KnxShort returns a telegram to dest with a value of at most 6 bits, e.g. of DPT 1.
+func knxShort(dest knxGroupAddr, apci uint16, v byte) knxTelegram {
+	return knxTelegram{dest, apci, []byte{v & 0x3F}, true}
+}
+
+// Encode returns t as an L_Data.req cEMI frame.
+func (t knxTelegram) encode() []byte {
+	b := []byte{cemiDataReq, 0, 0xBC, 0xE0, 0, 0, 0, 0, 0, byte(t.Apci >> 8 & 0x03)}
+	binary.BigEndian.PutUint16(b[6:], uint16(t.Dest))
+	apci := byte(t.Apci)
+	if t.short {
+		b[8] = 1
+		return append(b, apci|t.Data[0]&0x3F)
+	}
+	b[8] = byte(len(t.Data) + 1)
+	return append(append(b, apci), t.Data...)
+}
+
+// DecodeCEMI decodes a cEMI frame with a group telegram and returns its message code.
+func decodeCEMI(b []byte) (byte, knxTelegram, error) {
+	var t knxTelegram
+	if len(b) < 2 || len(b) < 2+int(b[1])+9 {
+		return 0, t, errors.New("Truncated cEMI frame")
+	}
+	code := b[0]
+	b = b[2+int(b[1]):] // Skip additional info
+	if b[1]&0x80 == 0 {
+		return code, t, errors.New("cEMI frame is not addressed to a group")
+	}
+	t.Dest = knxGroupAddr(binary.BigEndian.Uint16(b[4:]))
+	n := int(b[6])
+	if len(b) < 9+n-1 || n < 1 {
+		return code, t, errors.New("Truncated cEMI frame")
+	}
+	t.Apci = uint16(b[7]&0x03)<<8 | uint16(b[8]&0xC0)
+	if n == 1 {
+		t.Data, t.short = []byte{b[8] & 0x3F}, true
+	} else {
+		t.Data = append([]byte{}, b[9:9+n-1]...)
+	}
+	return code, t, nil
+}
+
+// Dpt1 returns a DPT 1 value, e.g. DPT 1.008 where false is up and true is down.
+func dpt1(on bool) byte {
+	if on {
+		return 1
+	}
+	return 0
+}
+
+// Dpt5Encode returns percent (0-100) as DPT 5.001.
+func dpt5Encode(percent int) []byte {
+	return []byte{byte(math.Round(float64(max(0, min(percent, 100))) * 255 / 100))}
+}
+
+// Dpt5Decode returns the percentage (0-100) of DPT 5.001 value b.
+func dpt5Decode(b []byte) (int, error) {
+	if len(b) != 1 {
+		return 0, fmt.Errorf("Invalid DPT 5.001 value % x", b)
+	}
+	return int(math.Round(float64(b[0]) * 100 / 255)), nil
+}
+
+/* Dpt9Encode returns f as the 2-byte float of DPT 9 (e.g. 9.004 lux), which is
+0.01*M*2^E with a 12-bit signed mantissa M and a 4-bit exponent E. Values out of
+range are clamped.*/
+func dpt9Encode(f float64) []byte {
+	m := math.Max(-671088.64, math.Min(f, 670760.96)) * 100
+	e := 0
+	for math.Round(m) < -2048 || math.Round(m) > 2047 {
+		m /= 2
+		e++
+	}
+	m = math.Round(m)
+	mantissa := uint16(int16(m)) & 0x07FF
+	if m < 0 {
+		mantissa |= 0x8000
+	}
+	v := mantissa | uint16(e)<<11
+	return []byte{byte(v >> 8), byte(v)}
+}
+
+// Dpt9Decode returns the value of the 2-byte float b of DPT 9.
+func dpt9Decode(b []byte) (float64, error) {
+	if len(b) != 2 {
+		return 0, fmt.Errorf("Invalid DPT 9 value % x", b)
+	}
+	v := binary.BigEndian.Uint16(b)
+	m := int(v & 0x07FF)
+	if v&0x8000 != 0 {
+		m -= 2048
+	}
+	return 0.01 * float64(m) * math.Pow(2, float64(v>>11&0x0F)), nil
+}
+
+// KnxFrame returns a KNXnet/IP frame of service typ with body.
+func knxFrame(typ uint16, body ...[]byte) []byte {
+	b := make([]byte, knxHeaderSize)
+	b[0], b[1] = knxHeaderSize, 0x10
+	binary.BigEndian.PutUint16(b[2:], typ)
+	for _, p := range body {
+		b = append(b, p...)
+	}
+	binary.BigEndian.PutUint16(b[4:], uint16(len(b)))
+	return b
+}
+
+// ParseKnxFrame returns the service type and body of a KNXnet/IP frame.
+func parseKnxFrame(b []byte) (uint16, []byte, error) {
+	if len(b) < knxHeaderSize || b[0] != knxHeaderSize || b[1] != 0x10 {
+		return 0, nil, errors.New("Invalid KNXnet/IP header")
+	}
+	if n := int(binary.BigEndian.Uint16(b[4:])); n != len(b) {
+		return 0, nil, fmt.Errorf("Invalid KNXnet/IP frame length %v, received %v bytes", n, len(b))
+	}
+	return binary.BigEndian.Uint16(b[2:]), b[knxHeaderSize:], nil
+}
+
+// KnxHPAI returns the host protocol address information (UDP over IPv4) of addr.
+func knxHPAI(addr *net.UDPAddr) []byte {
+	b := []byte{8, 1, 0, 0, 0, 0, 0, 0}
+	if ip := addr.IP.To4(); ip != nil {
+		copy(b[2:], ip)
+	}
+	binary.BigEndian.PutUint16(b[6:], uint16(addr.Port))
+	return b
+}
+
+/* KnxTunnel is a minimal KNXnet/IP tunnelling client. It keeps a tunnel
+connection to the gateway, reconnecting with an exponential backoff when it is
+lost, and passes received group telegrams to handler.*/
+type knxTunnel struct {
+	gateway    string // Address of the gateway, host:port
+	handler    func(t knxTelegram)
+	onConnect  func() // Called after each connect, e.g. to publish states
+	timeout    time.Duration
+	heartbeat  time.Duration
+	backoffMin time.Duration
+	backoffMax time.Duration
+	muSend     sync.Mutex // Serializes tunnelling requests, as each should be acknowledged before the next
+	mu         sync.Mutex // Guards conn, channel and seq
+	conn       *net.UDPConn
+	channel    byte
+	seq        byte // Sequence number of the next tunnelling request
+	acks       chan byte
+}
+
+// NewKnxTunnel returns a client for the gateway at addr, which is started by run.
+func newKnxTunnel(addr string) *knxTunnel {
+	return &knxTunnel{
+		gateway:    addr,
+		timeout:    knxTimeout,
+		heartbeat:  knxHeartbeat,
+		backoffMin: knxBackoffMin,
+		backoffMax: knxBackoffMax,
+		acks:       make(chan byte, 8),
+	}
+}
+
+/* Run connects to the gateway and keeps reconnecting when the connection is
+lost or refused, waiting twice as long after each failed attempt. It returns
+when quit is closed, after disconnecting from the gateway.*/
+func (k *knxTunnel) run(quit <-chan struct{}) {
+	backoff := k.backoffMin
+	for {
+		connected, err := k.session(quit)
+		select {
+		case <-quit:
+			return
+		default:
+		}
+		if connected {
+			backoff = k.backoffMin
+			log.Printf("KNX tunnel to %v lost, reconnecting in %v: %v", k.gateway, backoff, err)
+		} else {
+			log.Printf("Unable to connect to KNX gateway %v, retrying in %v: %v", k.gateway, backoff, err)
+		}
+		select {
+		case <-quit:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > k.backoffMax {
+			backoff = k.backoffMax
+		}
+	}
+}
+
+/* Session opens a tunnel connection and handles incoming frames until the
+connection is lost or quit is closed. Connected is true if the gateway has
+accepted the connection.*/
+func (k *knxTunnel) session(quit <-chan struct{}) (connected bool, err error) {
+	raddr, err := net.ResolveUDPAddr("udp4", k.gateway)
+	if err != nil {
+		return false, err
+	}
+	conn, err := net.DialUDP("udp4", nil, raddr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	local := knxHPAI(conn.LocalAddr().(*net.UDPAddr))
+	// Tunnel connection on the link layer
+	if _, err := conn.Write(knxFrame(knxConnectRequest, local, local, []byte{4, 4, 2, 0})); err != nil {
+		return false, err
+	}
+	buf := make([]byte, knxMaxFrame)
+	conn.SetReadDeadline(time.Now().Add(knxConnectTimeout))
+	var body []byte
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return false, err
+		}
+		var typ uint16
+		if typ, body, err = parseKnxFrame(buf[:n]); err == nil && typ == knxConnectResponse {
+			break
+		}
+	}
+	switch {
+	case len(body) < 2:
+		return false, errors.New("Invalid connect response")
+	case body[1] != 0:
+		return false, fmt.Errorf("Connection refused with status %#02x", body[1])
+	}
+	channel := body[0]
+	log.Printf("Connected to KNX gateway %v on channel %v", k.gateway, channel)
+	k.mu.Lock()
+	k.conn, k.channel, k.seq = conn, channel, 0
+	k.mu.Unlock()
+	done := make(chan struct{})
+	defer func() {
+		k.mu.Lock()
+		k.conn = nil
+		k.mu.Unlock()
+		close(done)
+	}()
+	go k.keepAlive(done, local)
+	go func() {
+		select {
+		case <-quit:
+			conn.Write(knxFrame(knxDisconnectRequest, []byte{channel, 0}, local))
+			conn.Close()
+		case <-done:
+		}
+	}()
+	// Telegrams are handled separately, so the handler can send while frames are received
+	telegrams := make(chan knxTelegram, 32)
+	defer close(telegrams)
+	go func() {
+		for t := range telegrams {
+			k.handler(t)
+		}
+	}()
+	if k.onConnect != nil {
+		go k.onConnect()
+	}
+	var recvSeq byte
+	for {
+		// The gateway answers each connection state request, so the connection is lost if nothing is received
+		conn.SetReadDeadline(time.Now().Add(k.heartbeat + knxConnectTimeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return true, err
+		}
+		typ, body, err := parseKnxFrame(buf[:n])
+		if err != nil {
+			log.Printf("Ignored KNXnet/IP frame: %v", err)
+			continue
+		}
+		switch {
+		case typ == knxTunnelRequest && len(body) >= 4 && body[1] == channel:
+			seq := body[2]
+			conn.Write(knxFrame(knxTunnelAck, []byte{4, channel, seq, 0}))
+			if seq != recvSeq {
+				// Repeated request of which the acknowledgement was lost
+				continue
+			}
+			recvSeq++
+			code, t, err := decodeCEMI(body[4:])
+			if err == nil && code == cemiDataInd && k.handler != nil {
+				select {
+				case telegrams <- t:
+				default:
+					log.Printf("Dropped KNX telegram to %v, handler does not keep up", t.Dest)
+				}
+			}
+		case typ == knxTunnelAck && len(body) >= 4 && body[1] == channel:
+			if body[3] == 0 {
+				select {
+				case k.acks <- body[2]:
+				default:
+				}
+			}
+		case typ == knxStateResponse && len(body) >= 2 && body[1] != 0:
+			return true, fmt.Errorf("Connection state error %#02x", body[1])
+		case typ == knxDisconnectRequest && len(body) >= 1 && body[0] == channel:
+			conn.Write(knxFrame(knxDisconnectResponse, []byte{channel, 0}))
+			return true, errors.New("Disconnected by gateway")
+		}
+	}
+}
+
+// KeepAlive sends a connection state request every heartbeat until done is closed.
+func (k *knxTunnel) keepAlive(done <-chan struct{}, local []byte) {
+	t := time.NewTicker(k.heartbeat)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			k.mu.Lock()
+			if k.conn != nil {
+				k.conn.Write(knxFrame(knxStateRequest, []byte{k.channel, 0}, local))
+			}
+			k.mu.Unlock()
+		}
+	}
+}
+
+// Connected returns true if the tunnel connection is open.
+func (k *knxTunnel) connected() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.conn != nil
+}
+
+/* Send sends telegram t to the bus and waits until the gateway acknowledges it.
+The request is repeated once; without acknowledgement the connection is closed,
+so it is reconnected.*/
+func (k *knxTunnel) send(t knxTelegram) error {
+	k.muSend.Lock()
+	defer k.muSend.Unlock()
+	k.mu.Lock()
+	conn, channel, seq := k.conn, k.channel, k.seq
+	k.mu.Unlock()
+	if conn == nil {
+		return errors.New("Not connected to KNX gateway")
+	}
+	frame := knxFrame(knxTunnelRequest, []byte{4, channel, seq, 0}, t.encode())
+	for attempt := 0; attempt < 2; attempt++ {
+		if _, err := conn.Write(frame); err != nil {
+			return err
+		}
+		timeout := time.After(k.timeout)
+	wait:
+		for {
+			select {
+			case ack := <-k.acks:
+				if ack == seq {
+					k.mu.Lock()
+					k.seq++
+					k.mu.Unlock()
+					return nil
+				}
+			case <-timeout:
+				break wait
+			}
+		}
+	}
+	conn.Close()
+	return fmt.Errorf("KNX gateway did not acknowledge telegram to %v", t.Dest)
+}
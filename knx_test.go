@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* knxGateway is a local KNXnet/IP tunnelling gateway emulator. It accepts one
+tunnel connection, acknowledges the telegrams it receives and records them.*/
+type knxGateway struct {
+	t         *testing.T
+	conn      *net.UDPConn
+	mu        sync.Mutex
+	client    *net.UDPAddr // Data endpoint of the connected client
+	seq       byte         // Sequence number of the next telegram to the client
+	telegrams []knxTelegram
+	acks      []byte // Sequence numbers acknowledged by the client
+	drop      int    // Number of telegrams from the client that are not acknowledged
+}
+
+// newKnxGateway starts a gateway emulator on a local UDP port.
+func newKnxGateway(t *testing.T) *knxGateway {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	g := &knxGateway{t: t, conn: conn}
+	go g.serve()
+	return g
+}
+
+func (g *knxGateway) serve() {
+	buf := make([]byte, knxMaxFrame)
+	for {
+		n, from, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		typ, body, err := parseKnxFrame(buf[:n])
+		if err != nil {
+			g.t.Errorf("Gateway received invalid frame: %v", err)
+			continue
+		}
+		switch typ {
+		case knxConnectRequest:
+			g.mu.Lock()
+			g.client = from
+			g.mu.Unlock()
+			g.conn.WriteToUDP(knxFrame(knxConnectResponse, []byte{7, 0}, knxHPAI(g.conn.LocalAddr().(*net.UDPAddr)), []byte{4, 4, 0x11, 0xFF}), from)
+		case knxStateRequest:
+			g.conn.WriteToUDP(knxFrame(knxStateResponse, []byte{body[0], 0}), from)
+		case knxTunnelRequest:
+			code, tg, err := decodeCEMI(body[4:])
+			if err != nil || code != cemiDataReq || body[1] != 7 {
+				g.t.Errorf("Gateway received invalid telegram % x (%v)", body, err)
+				continue
+			}
+			g.mu.Lock()
+			drop := g.drop > 0
+			if drop {
+				g.drop--
+			} else {
+				g.telegrams = append(g.telegrams, tg)
+			}
+			g.mu.Unlock()
+			if !drop {
+				g.conn.WriteToUDP(knxFrame(knxTunnelAck, []byte{4, 7, body[2], 0}), from)
+			}
+		case knxTunnelAck:
+			g.mu.Lock()
+			g.acks = append(g.acks, body[2])
+			g.mu.Unlock()
+		case knxDisconnectRequest:
+			g.mu.Lock()
+			g.client = nil
+			g.mu.Unlock()
+			g.conn.WriteToUDP(knxFrame(knxDisconnectResponse, []byte{body[0], 0}), from)
+		}
+	}
+}
+
+// connected returns true if a client has a tunnel connection.
+func (g *knxGateway) connected() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.client != nil
+}
+
+// indicate sends telegram t from the bus to the client, as an L_Data.ind.
+func (g *knxGateway) indicate(t knxTelegram) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	cemi := t.encode()
+	cemi[0] = cemiDataInd
+	g.conn.WriteToUDP(knxFrame(knxTunnelRequest, []byte{4, 7, g.seq, 0}, cemi), g.client)
+	g.seq++
+}
+
+// received returns the telegrams received from the client.
+func (g *knxGateway) received() []knxTelegram {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]knxTelegram{}, g.telegrams...)
+}
+
+// find returns the last received telegram to ga with service apci, or nil.
+func (g *knxGateway) find(ga knxGroupAddr, apci uint16) *knxTelegram {
+	telegrams := g.received()
+	for i := len(telegrams) - 1; i >= 0; i-- {
+		if telegrams[i].Dest == ga && telegrams[i].Apci == apci {
+			return &telegrams[i]
+		}
+	}
+	return nil
+}
+
+func TestGroupAddr(t *testing.T) {
+	tests := []struct {
+		s    string
+		ga   knxGroupAddr
+		fail bool
+	}{
+		{"1/2/3", 0x0A03, false},
+		{"31/7/255", 0xFFFF, false},
+		{" 0/0/1", 1, false},
+		{"0/0/0", 0, true},
+		{"32/0/0", 0, true},
+		{"1/8/0", 0, true},
+		{"1/2", 0, true},
+		{"a/b/c", 0, true},
+	}
+	for _, tt := range tests {
+		ga, err := parseGroupAddr(tt.s)
+		if (err != nil) != tt.fail || ga != tt.ga {
+			t.Errorf("%v: want %v (error %v), got %v (%v)", tt.s, tt.ga, tt.fail, ga, err)
+		}
+		if !tt.fail && ga.String() != strings.TrimSpace(tt.s) {
+			t.Errorf("Want %v, got %v", strings.TrimSpace(tt.s), ga)
+		}
+	}
+}
+
+func TestDpt(t *testing.T) {
+	for _, tt := range []struct {
+		percent int
+		b       byte
+	}{{0, 0}, {50, 128}, {100, 255}, {101, 255}} {
+		if got := dpt5Encode(tt.percent); got[0] != tt.b {
+			t.Errorf("DPT 5.001 of %v: want %v, got %v", tt.percent, tt.b, got[0])
+		}
+	}
+	if p, err := dpt5Decode([]byte{128}); p != 50 || err != nil {
+		t.Errorf("Want 50%%, got %v (%v)", p, err)
+	}
+	tests := []struct {
+		f    float64
+		b    []byte
+		back float64
+	}{
+		{0, []byte{0x00, 0x00}, 0},
+		{0.01, []byte{0x00, 0x01}, 0.01},
+		{20.48, []byte{0x0C, 0x00}, 20.48},
+		{-30, []byte{0x8A, 0x24}, -30},
+		{2380.95, []byte{0x3F, 0x44}, 2380.8},
+		{1e6, []byte{0x7F, 0xFF}, 670760.96},
+	}
+	for _, tt := range tests {
+		got := dpt9Encode(tt.f)
+		if !bytes.Equal(got, tt.b) {
+			t.Errorf("DPT 9 of %v: want % x, got % x", tt.f, tt.b, got)
+		}
+		if f, err := dpt9Decode(got); err != nil || f < tt.back-0.001 || f > tt.back+0.001 {
+			t.Errorf("DPT 9 % x: want %v, got %v (%v)", got, tt.back, f, err)
+		}
+	}
+}
+
+func TestCEMI(t *testing.T) {
+	for _, tg := range []knxTelegram{
+		knxShort(0x0A03, knxGroupWrite, 1),
+		{Dest: 0x0A04, Apci: knxGroupResponse, Data: []byte{0x0C, 0x00}},
+		knxShort(0x0A05, knxGroupRead, 0),
+	} {
+		b := tg.encode()
+		code, got, err := decodeCEMI(b)
+		if err != nil || code != cemiDataReq || got.Dest != tg.Dest || got.Apci != tg.Apci || !bytes.Equal(got.Data, tg.Data) || got.short != tg.short {
+			t.Errorf("Want %+v, got %+v from % x (%v)", tg, got, b, err)
+		}
+	}
+	// GroupValueWrite 1 to 1/2/3 as sent by a wall switch
+	want := []byte{0x11, 0x00, 0xBC, 0xE0, 0x00, 0x00, 0x0A, 0x03, 0x01, 0x00, 0x81}
+	if got := knxShort(0x0A03, knxGroupWrite, 1).encode(); !bytes.Equal(got, want) {
+		t.Errorf("Want % x, got % x", want, got)
+	}
+}
+
+func TestKnxBridge(t *testing.T) {
+	s := setupApi(t)
+	muSunscrn.Lock()
+	s.Percent, s.Position = 40, partial
+	s.KnxUpDown, s.KnxStop, s.KnxPosition, s.KnxState = "1/0/1", "1/0/2", "1/0/3", "1/0/4"
+	muSunscrn.Unlock()
+	s.init()
+	g := newKnxGateway(t)
+	tunnel := newKnxTunnel(g.conn.LocalAddr().String())
+	tunnel.timeout, tunnel.backoffMin = 100*time.Millisecond, 10*time.Millisecond
+	newKnxBridge(tunnel, "1/0/10")
+	quit := make(chan struct{})
+	go tunnel.run(quit)
+
+	// States are published after connecting
+	waitFor(t, "published states", func() bool {
+		return g.find(0x0804, knxGroupWrite) != nil && g.find(0x080A, knxGroupWrite) != nil
+	})
+	if tg := g.find(0x0804, knxGroupWrite); tg.Data[0] != 102 {
+		t.Errorf("Want position 40%% (102), got %v", tg.Data)
+	}
+	if tg := g.find(0x080A, knxGroupWrite); !bytes.Equal(tg.Data, dpt9Encode(100000/42.0)) {
+		t.Errorf("Want light in lux, got % x", tg.Data)
+	}
+
+	// Read of a status address is answered
+	g.indicate(knxShort(0x0804, knxGroupRead, 0))
+	waitFor(t, "read response", func() bool { return g.find(0x0804, knxGroupResponse) != nil })
+
+	// Position command from the bus
+	g.indicate(knxTelegram{Dest: 0x0803, Apci: knxGroupWrite, Data: dpt5Encode(70)})
+	waitFor(t, "position command", func() bool {
+		muSunscrn.Lock()
+		defer muSunscrn.Unlock()
+		xc := s.commands()
+		return len(xc) > 0 && xc[0].Action == cmdGoto && xc[0].Target == 70 && xc[0].Source == srcKnx
+	})
+	g.indicate(knxShort(0x0802, knxGroupWrite, 1))
+	waitFor(t, "stop", func() bool {
+		muSunscrn.Lock()
+		defer muSunscrn.Unlock()
+		return s.running == nil && len(s.queue) == 0
+	})
+	waitFor(t, "acknowledged telegrams", func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return bytes.Equal(g.acks, []byte{0, 1, 2})
+	})
+
+	// Without acknowledgement the tunnel reconnects
+	g.mu.Lock()
+	g.drop = 2
+	g.mu.Unlock()
+	if err := tunnel.send(knxShort(0x0801, knxGroupWrite, 0)); err == nil {
+		t.Error("Want error without acknowledgement")
+	}
+	waitFor(t, "reconnect", tunnel.connected)
+	if err := tunnel.send(knxShort(0x0801, knxGroupWrite, 0)); err != nil {
+		t.Errorf("Want telegram sent after reconnect, got %v", err)
+	}
+	close(quit)
+	waitFor(t, "disconnect", func() bool { return !g.connected() })
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	s.closeQueue()
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// knxPublishInterval is the interval at which changed states are published to the KNX bus.
+const knxPublishInterval = time.Second
+
+var (
+	muKnx   sync.Mutex
+	knxQuit chan struct{} // Stops the running KNX bridge, guarded by muKnx
+)
+
+/* KnxBridge carries out the commands that wall switches and visualisations
+send to the group addresses of the sunscreens, and publishes the position of
+each sunscreen and the light to their status group addresses. A group address
+may be shared by several sunscreens, e.g. to move all of them at once.
+
+Group addresses per sunscreen (all optional):
+	KnxUpDown    DPT 1.008, 0 is up and 1 is down
+	KnxStop      DPT 1.007, any value stops the sunscreen
+	KnxPosition  DPT 5.001, position in percent down
+	KnxState     DPT 5.001, published position in percent down
+The light is published to config.KnxLight as DPT 9.004 (lux).*/
+type knxBridge struct {
+	tunnel    *knxTunnel
+	light     string                  // Group address of the light, optional
+	mu        sync.Mutex              // Guards published
+	published map[knxGroupAddr]string // Last published value per group address, reset on each connect
+}
+
+// StartKnx (re)starts the KNX bridge with the settings in config, or stops it if KNX is disabled.
+func startKnx() {
+	muConf.Lock()
+	enabled, gateway, light := config.EnableKnx, config.KnxGateway, config.KnxLight
+	muConf.Unlock()
+	muKnx.Lock()
+	defer muKnx.Unlock()
+	if knxQuit != nil {
+		close(knxQuit)
+		knxQuit = nil
+	}
+	if !enabled {
+		return
+	}
+	tunnel := newKnxTunnel(knxAddr(gateway))
+	b := newKnxBridge(tunnel, light)
+	knxQuit = make(chan struct{})
+	log.Printf("Starting KNX bridge to gateway %v", tunnel.gateway)
+	go tunnel.run(knxQuit)
+	go b.run(knxQuit)
+}
+
+// KnxAddr returns gateway as host:port, with the default port if gateway has none.
+func knxAddr(gateway string) string {
+	if _, _, err := net.SplitHostPort(gateway); err == nil {
+		return gateway
+	}
+	return net.JoinHostPort(gateway, strconv.Itoa(knxDefaultPort))
+}
+
+// CheckKnxGateway returns an error if gateway is not a host with an optional port.
+func checkKnxGateway(gateway string) error {
+	host, port, err := net.SplitHostPort(knxAddr(gateway))
+	if err != nil || host == "" || strings.ContainsAny(host, "/ ") {
+		return fmt.Errorf("Invalid gateway '%v', should be a host with optional port, e.g. 192.168.1.30:3671", gateway)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("Invalid port '%v', should be within range 1-65535", port)
+	}
+	return nil
+}
+
+// NewKnxBridge returns a bridge over tunnel, which handles the received telegrams and publishes after each connect.
+func newKnxBridge(tunnel *knxTunnel, light string) *knxBridge {
+	b := &knxBridge{tunnel: tunnel, light: light, published: map[knxGroupAddr]string{}}
+	tunnel.handler = b.handle
+	tunnel.onConnect = func() {
+		b.mu.Lock()
+		b.published = map[knxGroupAddr]string{}
+		b.mu.Unlock()
+		b.publishStates()
+	}
+	return b
+}
+
+// Run publishes the changed states every knxPublishInterval until quit is closed.
+func (b *knxBridge) run(quit <-chan struct{}) {
+	t := time.NewTicker(knxPublishInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-t.C:
+			if b.tunnel.connected() {
+				b.publishStates()
+			}
+		}
+	}
+}
+
+/* States returns the telegram per status group address with the position of
+each sunscreen that is not moving and the last light.*/
+func (b *knxBridge) states() map[knxGroupAddr]knxTelegram {
+	states := map[knxGroupAddr]knxTelegram{}
+	muSunscrn.Lock()
+	for _, s := range sunscreens {
+		if ga, err := parseGroupAddr(s.KnxState); err == nil && s.Position != unknown && s.Position != moving {
+			states[ga] = knxTelegram{Dest: ga, Apci: knxGroupWrite, Data: dpt5Encode(s.Percent)}
+		}
+	}
+	muSunscrn.Unlock()
+	muLS.Lock()
+	if ga, err := parseGroupAddr(b.light); err == nil {
+		if l := lastLight(ls.Data); l != nil {
+			states[ga] = knxTelegram{Dest: ga, Apci: knxGroupWrite, Data: dpt9Encode(lux(*l))}
+		}
+	}
+	muLS.Unlock()
+	return states
+}
+
+// PublishStates writes the states that have changed since they were last published to the bus.
+func (b *knxBridge) publishStates() {
+	states := b.states()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ga, t := range states {
+		value := fmt.Sprintf("% x", t.Data)
+		if old, ok := b.published[ga]; ok && old == value {
+			continue
+		}
+		if err := b.tunnel.send(t); err != nil {
+			log.Printf("Unable to publish to KNX group address %v: %v", ga, err)
+			return
+		}
+		b.published[ga] = value
+	}
+}
+
+/* Handle carries out a write to a command group address of one or more
+sunscreens, and answers a read of a status group address.*/
+func (b *knxBridge) handle(t knxTelegram) {
+	if t.Dest == 0 {
+		return
+	}
+	switch t.Apci {
+	case knxGroupRead:
+		if st, ok := b.states()[t.Dest]; ok {
+			st.Apci = knxGroupResponse
+			if err := b.tunnel.send(st); err != nil {
+				log.Printf("Unable to answer KNX read of %v: %v", t.Dest, err)
+			}
+		}
+	case knxGroupWrite:
+		for _, s := range listSunscreens() {
+			muSunscrn.Lock()
+			pos := ""
+			switch t.Dest {
+			case knxGroup(s.KnxUpDown):
+				pos = map[bool]string{false: up, true: down}[t.Data[len(t.Data)-1]&0x01 == 1]
+			case knxGroup(s.KnxStop):
+				pos = "stop"
+			case knxGroup(s.KnxPosition):
+				percent, err := dpt5Decode(t.Data)
+				if err != nil {
+					log.Printf("Ignored KNX position on %v for sunscreen '%v': %v", t.Dest, s.Name, err)
+					break
+				}
+				pos = fmt.Sprint(percent)
+			}
+			if pos != "" {
+				log.Printf("Received KNX command '%v' on %v for sunscreen '%v'", pos, t.Dest, s.Name)
+				if _, err := s.setMode(manual, pos, srcKnx, false); err != nil {
+					log.Println(err)
+				}
+			}
+			muSunscrn.Unlock()
+		}
+	}
+}
+
+// KnxGroup returns the group address of s, or 0 (which is never used) if s is empty or invalid.
+func knxGroup(s string) knxGroupAddr {
+	ga, err := parseGroupAddr(s)
+	if err != nil {
+		return 0
+	}
+	return ga
+}
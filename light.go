@@ -3,17 +3,26 @@ package main
 import (
 	"fmt"
 	"log"
+	"math"
+	"sort"
 	"time"
+)
 
-	"github.com/stianeikeland/go-rpio/v4"
+// Constants for the policy used to combine the light of multiple sensors
+const (
+	fusionMedian = "median"
+	fusionMin    = "min"
+	fusionMax    = "max"
+	fusionScreen = "screen"
 )
 
-/* LightSensor represents a physical lightsensor for which data can be collected
-through the corresponding GPIO pin.*/
+/* LightSensor represents the light measurement for which data can be collected
+through one or more physical sensors. The light of all available sensors is
+combined into one value according to the Fusion policy.*/
 type LightSensor struct {
-	Pin          rpio.Pin      // pin for retrieving light value.
+	Sensors      []Sensor      // Physical sensors used for measuring light.
+	Fusion       string        // Policy for combining the light of the sensors: median, min, max or screen.
 	Interval     time.Duration // Interval for checking current light in seconds.
-	LightFactor  int           // Factor for correcting the measured analog light value.
 	Start        time.Time     // Start time for measuring light.
 	Stop         time.Time     // Stop time for measuring light.
 	Good         int           // Max measured light value that counts as "good weather".
@@ -26,26 +35,55 @@ type LightSensor struct {
 	Data         []int         // collected light values.
 }
 
+/* Sensor represents a physical lightsensor for which data can be collected
+through the corresponding GPIO pin. A sensor that returns zero light or errors
+is excluded (Failed) until it returned valid light sensorRecover times in a row.*/
+type Sensor struct {
+	Id          int    // Autogenerated ID for sensor
+	Name        string // Name of sensor
+	Pin         Pin    // pin for retrieving light value.
+	LightFactor int    // Factor for correcting the measured analog light value.
+	Failed      bool   // True if the sensor is excluded because of zero light or errors.
+	Data        []int  // collected light values of this sensor.
+	valid       int    // Number of valid measurements in a row since the sensor failed.
+}
+
+// Reading represents the light measured by one sensor.
+type reading struct {
+	Id    int   // Id of the sensor
+	Value int   // Measured light, corrected with the LightFactor of the sensor
+	Err   error // Error while measuring light
+}
+
 const (
-	maxCount                  = 9999999          // Maximum allowed count value while measuring light.
-	freq                      = 10               // Number of times light is measured to get an average value.
-	LightMin                  = 5                // Minimum value that can be stored for LightSensor.Good, Neutral or Bad.
-	IntervalMin time.Duration = time.Second * 60 // Minimum seconds the interval should have
+	maxCount                    = 9999999          // Maximum allowed count value while measuring light.
+	freq                        = 10               // Number of times light is measured to get an average value.
+	LightMin                    = 5                // Minimum value that can be stored for LightSensor.Good, Neutral or Bad.
+	IntervalMin   time.Duration = time.Second * 60 // Minimum seconds the interval should have
+	sensorRecover               = 3                // Number of valid measurements in a row for a failed sensor to be included again.
+	luxFactor                   = 100000.0         // Illuminance in lux of light value 1, see lux.
 )
 
-/* GetLight Takes a pin, measures the current light from the sensor on that rpio pin and
+/* Lux returns an indication of the illuminance in lux of light. The light
+sensor measures the charge time of a capacitor, which is roughly inversely
+proportional to the illuminance.*/
+func lux(light int) float64 {
+	return luxFactor / math.Max(float64(light), 1)
+}
+
+/* GetLight Takes a pin, measures the current light from the sensor on that GPIO pin and
 returns the value and error message.*/
-func getLight(pin rpio.Pin) (int, error) {
+func getLight(pin Pin) (int, error) {
 	count := 0
 	// Output on the pin for 0.1 seconds
-	pin.Output()
-	pin.Low()
+	hw.Output(pin)
+	hw.Write(pin, Low)
 	time.Sleep(100 * time.Millisecond)
 
 	// Change the pin back to input
-	pin.Input()
+	hw.Input(pin)
 	// Count until the pin goes high
-	for pin.Read() == rpio.Low {
+	for hw.Read(pin) == Low {
 		count++
 		if count > maxCount {
 			return count, fmt.Errorf("Count is getting too high (%v)", count)
@@ -58,11 +96,11 @@ func getLight(pin rpio.Pin) (int, error) {
 }
 
 /* GetCurrentLight takes a pin and frequency, collects the input from the light
-sensor on that rpio pin and returns the average value as a slice of int together
+sensor on that GPIO pin and returns the average value as a slice of int together
 with any errors. If int returned is zero, it means no light was measured
 (which is accompanied with an error). However, it can be the case that some of
 the attempts failed (ie errors generated), but a light value was measured.*/
-func getAvgLight(pin rpio.Pin, freq int) (int, error) {
+func getAvgLight(pin Pin, freq int) (int, error) {
 	values := []int{}
 	var errs string
 	var err error
@@ -112,33 +150,24 @@ func calcAverageZ(xi ...int) int {
 	return sum / count
 }
 
-func (ls *LightSensor) MonitorMove(s *Sunscreen) {
+/* MonitorMove monitors the light between the Start and Stop of the light sensor
+and evaluates the position of every sunscreen in auto mode that is within its
+own Start and Stop. Outside these times, sunscreens in auto mode are moved up.*/
+func (ls *LightSensor) MonitorMove() {
 	for {
 		muLS.Lock()
 		switch {
 		case time.Now().After(ls.Stop):
-			muSunscrn.Lock()
-			if s.Mode == auto {
-				muSunscrn.Unlock()
-				s.Up()
-			} else {
-				muSunscrn.Unlock()
-			}
+			upAuto(listSunscreens())
 			log.Println("Reset Start and Stop for light monitoring to tomorrow")
-			// Reset Start and Stop for both Sunscreen and Lightsensor to tomorrow
+			// Reset Start and Stop for both Sunscreens and Lightsensor to tomorrow
 			muLS.Unlock()
-			updateStartStop(s, ls, 1)
+			updateStartStop(ls, 1)
 			muLS.Lock()
 			fallthrough
 		case time.Now().Before(ls.Start):
 			log.Printf("Sleep light monitoring for %v until %v", time.Until(ls.Start), ls.Start)
-			muSunscrn.Lock()
-			if s.Mode == auto {
-				muSunscrn.Unlock()
-				s.Up()
-			} else {
-				muSunscrn.Unlock()
-			}
+			upAuto(listSunscreens())
 			// Sleep until Start
 			d := time.Until(ls.Start)
 			muLS.Unlock()
@@ -146,31 +175,63 @@ func (ls *LightSensor) MonitorMove(s *Sunscreen) {
 		default:
 			log.Printf("Start monitoring light every %v", ls.Interval)
 			// Monitor light
-			light := make(chan int, 2)
+			light := make(chan []reading, 2)
 			quit := make(chan bool)
-			go sendLight(ls.Pin, ls.Interval, ls.LightFactor, light, quit)
+			go sendLight(append([]Sensor{}, ls.Sensors...), ls.Interval, light, quit)
 			// Receive light
 			for time.Now().After(ls.Start) && time.Now().Before(ls.Stop) {
 				muLS.Unlock()
-				l := <-light
+				readings := <-light
 				// Saving light
 				muLS.Lock()
-				maxL := max(ls.TimesGood, ls.TimesNeutral, ls.TimesBad) + ls.Outliers + 1
-				ls.Data = addData(ls.Data, maxL, l)
-				appendCSV(fileLight, [][]string{{time.Now().Format("02-01-2006 15:04:05"), fmt.Sprint(l)}})
-				if s != nil {
-					data, good, neutral, bad, tGood, tNeutral, tBad, outliers := ls.Data, ls.Good, ls.Neutral, ls.Bad, ls.TimesGood, ls.TimesNeutral, ls.TimesBad, ls.Outliers
-					muLS.Unlock()
-					m := max(tGood, tNeutral, tBad) + outliers
+				l, ok := ls.process(readings)
+				now := time.Now()
+				row := []string{now.Format("02-01-2006 15:04:05"), fmt.Sprint(l)}
+				for _, r := range readings {
+					row = append(row, fmt.Sprintf("%v=%v", ls.sensorName(r.Id), r.Value))
+				}
+				appendCSV(fileLight, [][]string{row})
+				exportLight(now, l, ok, readings)
+				events.publish(evtLight, lightState(ok))
+				if !ok {
+					log.Println("No light sensor available, skip evaluating sunscreens")
+					continue
+				}
+				data, good, neutral, bad, tGood, tNeutral, tBad, outliers := copyData(ls.Data), ls.Good, ls.Neutral, ls.Bad, ls.TimesGood, ls.TimesNeutral, ls.TimesBad, ls.Outliers
+				sensorData := map[int][]int{}
+				if ls.Fusion == fusionScreen {
+					for _, sn := range ls.Sensors {
+						if !sn.Failed {
+							sensorData[sn.Id] = copyData(sn.Data)
+						}
+					}
+				}
+				muLS.Unlock()
+				m := max(tGood, tNeutral, tBad) + outliers
+				for _, s := range listSunscreens() {
 					muSunscrn.Lock()
-					mode := s.Mode
+					mode, start, stop, sensor := s.Mode, s.Start, s.Stop, s.Sensor
 					muSunscrn.Unlock()
-					// Only evaluatie sunscreen position if enough data has been gathered and mode == auto
-					if len(data) >= m && mode == auto {
-						s.evaluate(data, good, neutral, bad, tGood, tNeutral, tBad, outliers)
+					// With fusion policy screen, use data of the sensor assigned to the sunscreen if available
+					screenData := data
+					if d, ok := sensorData[sensor]; ok {
+						screenData = d
+					}
+					switch {
+					case mode != auto:
+					case windLocked():
+						s.decide("none", "Locked up by wind")
+					case frostLocked():
+						s.decide("none", "Locked by frost: "+getFrostStatus().Reason)
+					case time.Now().Before(start) || time.Now().After(stop):
+						s.decide(up, "Outside start and stop of sunscreen")
+						s.Up(srcSchedule)
+					case len(screenData) >= m:
+						// Only evaluate sunscreen position if enough data has been gathered
+						s.evaluate(screenData, good, neutral, bad, tGood, tNeutral, tBad, outliers)
 					}
-					muLS.Lock()
 				}
+				muLS.Lock()
 			}
 			muLS.Unlock()
 			close(quit)
@@ -178,30 +239,191 @@ func (ls *LightSensor) MonitorMove(s *Sunscreen) {
 	}
 }
 
-/*SendLight gathers light from pin every interval and send the light value
-on to a channel. This loop runs until the quit chan is closed.*/
-func sendLight(pin rpio.Pin, interval time.Duration, lightFactor int, light chan<- int, quit <-chan bool) {
+// UpAuto moves all sunscreens in auto mode up.
+func upAuto(screens []*Sunscreen) {
+	for _, s := range screens {
+		muSunscrn.Lock()
+		mode := s.Mode
+		muSunscrn.Unlock()
+		if mode == auto {
+			s.Up(srcSchedule)
+		}
+	}
+}
+
+/*SendLight gathers light from all sensors every interval and sends the
+readings on to a channel. This loop runs until the quit chan is closed.*/
+func sendLight(sensors []Sensor, interval time.Duration, light chan<- []reading, quit <-chan bool) {
 	for {
 		select {
 		case _, _ = <-quit:
 			log.Println("Closing monitorLight")
 			return
 		default:
-			l, err := getAvgLight(pin, freq)
-			l = l / lightFactor
-			// Errorhandling
-			switch {
-			case l == 0:
-				log.Printf("Zero light gathered. Errors: %v", err)
-			case err != nil:
-				log.Printf("Light gathered: %v with errors: %v", l, err)
+			readings := []reading{}
+			for _, sn := range sensors {
+				begin := time.Now()
+				l, err := getAvgLight(sn.Pin, freq)
+				countMeasurement(sn, time.Since(begin), l == 0 || err != nil)
+				l = l / max(sn.LightFactor, 1)
+				// Errorhandling
+				switch {
+				case l == 0:
+					log.Printf("Zero light gathered by '%v'. Errors: %v", sn.Name, err)
+				case err != nil:
+					log.Printf("Light gathered by '%v': %v with errors: %v", sn.Name, l, err)
+				}
+				readings = append(readings, reading{sn.Id, l, err})
 			}
-			light <- l
+			light <- readings
 			time.Sleep(interval)
 		}
 	}
 }
 
+// Window returns the number of light values kept for evaluating the sunscreens. The caller should hold muLS.
+func (ls *LightSensor) window() int {
+	return max(ls.TimesGood, ls.TimesNeutral, ls.TimesBad) + ls.Outliers + 1
+}
+
+/* Process takes the readings of the sensors and adds the light of every
+available sensor to its Data. Sensors that return zero light or errors are
+excluded and an alert is raised. It returns the combined light of all available
+sensors, which is also added to ls.Data, and false if no sensor is available.
+The caller should hold muLS.*/
+func (ls *LightSensor) process(readings []reading) (int, bool) {
+	maxL := ls.window()
+	values := []int{}
+	for _, r := range readings {
+		sn := ls.sensor(r.Id)
+		if sn == nil {
+			continue
+		}
+		switch {
+		case r.Value == 0 || r.Err != nil:
+			sn.valid = 0
+			if !sn.Failed {
+				sn.Failed = true
+				sn.Data = []int{}
+				msg := fmt.Sprintf("Light sensor '%v' returned light %v with errors: %v. Sensor is excluded until it returns valid light %v times in a row.", sn.Name, r.Value, r.Err, sensorRecover)
+				log.Println(msg)
+				go sendMail("Light sensor "+sn.Name+" failed", msg)
+			}
+			continue
+		case sn.Failed:
+			sn.valid++
+			if sn.valid < sensorRecover {
+				continue
+			}
+			sn.Failed = false
+			msg := fmt.Sprintf("Light sensor '%v' returned valid light %v times in a row and is included again.", sn.Name, sensorRecover)
+			log.Println(msg)
+			go sendMail("Light sensor "+sn.Name+" recovered", msg)
+		}
+		sn.Data = addData(sn.Data, maxL, r.Value)
+		values = append(values, r.Value)
+	}
+	if len(values) == 0 {
+		return 0, false
+	}
+	l := fuse(ls.Fusion, values...)
+	ls.Data = addData(ls.Data, maxL, l)
+	return l, true
+}
+
+// Sensor returns the sensor with id, or nil if it does not exist. The caller should hold muLS.
+func (ls *LightSensor) sensor(id int) *Sensor {
+	for i := range ls.Sensors {
+		if ls.Sensors[i].Id == id {
+			return &ls.Sensors[i]
+		}
+	}
+	return nil
+}
+
+// SensorName returns the name of the sensor with id. The caller should hold muLS.
+func (ls *LightSensor) sensorName(id int) string {
+	if sn := ls.sensor(id); sn != nil {
+		return sn.Name
+	}
+	return fmt.Sprint(id)
+}
+
+// AddSensor adds a new sensor with the next available Id and returns it. The caller should hold muLS.
+func (ls *LightSensor) addSensor() *Sensor {
+	id := 1
+	for _, sn := range ls.Sensors {
+		if sn.Id >= id {
+			id = sn.Id + 1
+		}
+	}
+	ls.Sensors = append(ls.Sensors, Sensor{
+		Id:          id,
+		Name:        fmt.Sprintf("Light sensor %v", id),
+		LightFactor: 1,
+		Data:        []int{},
+	})
+	return &ls.Sensors[len(ls.Sensors)-1]
+}
+
+// DeleteSensor removes the sensor with id. It returns false if the id is unknown. The caller should hold muLS.
+func (ls *LightSensor) deleteSensor(id int) bool {
+	for i, sn := range ls.Sensors {
+		if sn.Id == id {
+			ls.Sensors = append(ls.Sensors[:i], ls.Sensors[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+/* Fuse takes the light of multiple sensors and combines it into one value
+according to policy. Policy screen uses the median, since each sunscreen uses
+the data of its own sensor.*/
+func fuse(policy string, xi ...int) int {
+	switch policy {
+	case fusionMin:
+		return min(xi...)
+	case fusionMax:
+		return max(xi...)
+	default:
+		return median(xi...)
+	}
+}
+
+// Median takes multiple int and returns the median. It returns zero if no values are given.
+func median(xi ...int) int {
+	if len(xi) == 0 {
+		return 0
+	}
+	xs := append([]int{}, xi...)
+	sort.Ints(xs)
+	if len(xs)%2 == 0 {
+		return (xs[len(xs)/2-1] + xs[len(xs)/2]) / 2
+	}
+	return xs[len(xs)/2]
+}
+
+// FusionPolicies returns all fusion policies.
+func fusionPolicies() []string {
+	return []string{fusionMedian, fusionMin, fusionMax, fusionScreen}
+}
+
+// ValidFusion returns true if policy is a known fusion policy.
+func validFusion(policy string) bool {
+	for _, v := range fusionPolicies() {
+		if v == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// CopyData returns a copy of xi, since addData changes the slice in place.
+func copyData(xi []int) []int {
+	return append([]int{}, xi...)
+}
+
 func addData(xi []int, maxL, x int) []int {
 	if len(xi) < maxL {
 		xi = append(xi, x)
@@ -1,26 +1,93 @@
 package main
 
 import (
+	"fmt"
+	"reflect"
 	"testing"
-
-	"github.com/stianeikeland/go-rpio/v4"
 )
 
-const (
-	lightSensor = rpio.Pin(23)
-	freq        = 10
-)
+var lightSensor = Pin{Line: 23}
 
-// func TestGetLight(t *testing.T) {
-// 	rpio.Open()
-// 	defer rpio.Close()
-// 	light, err := getLight(lightSensor)
-// 	t.Log(light, err)
-// }
+func TestGetLight(t *testing.T) {
+	sim := newSimGPIO()
+	sim.SetLight(lightSensor, simScript(1200))
+	hw = sim
+	light, err := getLight(lightSensor)
+	if err != nil || light != 1200 {
+		t.Errorf("Want 1200, got %v (%v)", light, err)
+	}
+}
 
 func TestGetAvgLight(t *testing.T) {
-	rpio.Open()
-	defer rpio.Close()
-	light, err := getAvgLight(LightPin, freq)
+	sim := newSimGPIO()
+	sim.SetLight(lightSensor, simScript(1000, 0, 2000))
+	hw = sim
+	light, err := getAvgLight(lightSensor, 3)
+	if light != 1500 {
+		t.Errorf("Want 1500, got %v", light)
+	}
 	t.Log(light, err)
 }
+
+func TestFuse(t *testing.T) {
+	tests := []struct {
+		policy string
+		xi     []int
+		want   int
+	}{
+		{fusionMedian, []int{30, 10, 20}, 20},
+		{fusionMedian, []int{30, 10, 20, 40}, 25},
+		{fusionMin, []int{30, 10, 20}, 10},
+		{fusionMax, []int{30, 10, 20}, 30},
+		{fusionScreen, []int{30, 10, 20}, 20},
+	}
+	for _, tt := range tests {
+		if got := fuse(tt.policy, tt.xi...); got != tt.want {
+			t.Errorf("fuse(%v, %v): want %v, got %v", tt.policy, tt.xi, tt.want, got)
+		}
+	}
+}
+
+func TestProcessFailover(t *testing.T) {
+	ls := &LightSensor{Fusion: fusionMin, TimesGood: 5, TimesNeutral: 5, TimesBad: 5}
+	ls.addSensor()
+	ls.addSensor()
+	if l, ok := ls.process([]reading{{1, 100, nil}, {2, 200, nil}}); !ok || l != 100 {
+		t.Errorf("Want 100, got %v (%v)", l, ok)
+	}
+	// Sensor 1 fails and should be excluded
+	if l, ok := ls.process([]reading{{1, 0, nil}, {2, 200, nil}}); !ok || l != 200 || !ls.Sensors[0].Failed {
+		t.Errorf("Want 200 with sensor 1 excluded, got %v (%v) %+v", l, ok, ls.Sensors[0])
+	}
+	for i := 1; i < sensorRecover; i++ {
+		if l, _ := ls.process([]reading{{1, 100, nil}, {2, 200, nil}}); l != 200 {
+			t.Errorf("Sensor 1 should still be excluded, got %v", l)
+		}
+	}
+	// Sensor 1 returned valid light sensorRecover times in a row
+	if l, _ := ls.process([]reading{{1, 100, nil}, {2, 200, nil}}); l != 100 || ls.Sensors[0].Failed {
+		t.Errorf("Sensor 1 should be included again, got %v", l)
+	}
+	if _, ok := ls.process([]reading{{1, 0, nil}, {2, 0, nil}}); ok {
+		t.Errorf("No sensor should be available")
+	}
+	if want := []int{100, 200, 200, 200, 100}; fmt.Sprint(ls.Data) != fmt.Sprint(want) {
+		t.Errorf("Want data %v, got %v", want, ls.Data)
+	}
+}
+
+func TestAddData(t *testing.T) {
+	var data []int
+	for x := 1; x <= 3; x++ {
+		data = addData(data, 3, x)
+	}
+	if !reflect.DeepEqual(data, []int{1, 2, 3}) {
+		t.Errorf("Want values appended while not full, got %v", data)
+	}
+	for x := 4; x <= 5; x++ {
+		data = addData(data, 3, x)
+	}
+	if !reflect.DeepEqual(data, []int{5, 4, 1}) {
+		t.Errorf("Want values shifted in front when full, got %v", data)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Constants for mDNS (RFC 6762) and DNS-SD (RFC 6763)
+const (
+	dnsTypeA             uint16 = 1
+	dnsTypePTR           uint16 = 12
+	dnsTypeTXT           uint16 = 16
+	dnsTypeSRV           uint16 = 33
+	dnsTypeANY           uint16 = 255
+	dnsClassIN           uint16 = 1
+	dnsCacheFlush        uint16 = 1 << 15 // Class bit of records that replace cached records
+	dnsUnicast           uint16 = 1 << 15 // Class bit of questions that accept a unicast response
+	mdnsPort                    = 5353
+	mdnsHostTTL                 = 120  // TTL of records with a host name or address
+	mdnsServiceTTL              = 4500 // TTL of other records
+	mdnsServices                = "_services._dns-sd._udp.local."
+	mdnsMaxMessage              = 9000
+	mdnsAnnounceInterval        = time.Second
+)
+
+// mdnsGroup is the IPv4 multicast address of mDNS.
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+
+// DnsQuestion is a question of a DNS message.
+type dnsQuestion struct {
+	name  string // Name in lower case, ending with a dot
+	typ   uint16
+	class uint16
+}
+
+// DnsRecord is a resource record of a DNS message.
+type dnsRecord struct {
+	name  string
+	typ   uint16
+	class uint16
+	ttl   uint32
+	data  []byte
+}
+
+// DnsMessage is a parsed DNS message.
+type dnsMessage struct {
+	id        uint16
+	response  bool
+	questions []dnsQuestion
+	answers   []dnsRecord
+}
+
+/* MdnsService is a DNS-SD service that is advertised over mDNS, e.g. instance
+"Sunscreens" of service "_hap._tcp" at port 51826 of host "raspberrypi".*/
+type mdnsService struct {
+	instance string
+	service  string
+	host     string
+	port     int
+	txt      func() []string // TXT record, read each time it is sent
+	addrs    func() []net.IP // IPv4 addresses of the host
+	mu       sync.Mutex      // Guards conn
+	conn     *net.UDPConn
+}
+
+// ServiceName returns the name of the service, e.g. _hap._tcp.local.
+func (m *mdnsService) serviceName() string {
+	return m.service + ".local."
+}
+
+// InstanceName returns the name of the instance, e.g. Sunscreens._hap._tcp.local.
+func (m *mdnsService) instanceName() string {
+	return strings.ReplaceAll(m.instance, ".", "-") + "." + m.serviceName()
+}
+
+// HostName returns the name of the host, e.g. raspberrypi.local.
+func (m *mdnsService) hostName() string {
+	return m.host + ".local."
+}
+
+/* Run answers mDNS queries for the service until quit is closed. It announces
+the service at start and sends a goodbye when quit is closed.*/
+func (m *mdnsService) run(quit <-chan struct{}) error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.conn = conn
+	m.mu.Unlock()
+	go func() {
+		<-quit
+		m.send(m.records(0), mdnsGroup)
+		conn.Close()
+	}()
+	go m.announce()
+	buf := make([]byte, mdnsMaxMessage)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-quit:
+				return nil
+			default:
+			}
+			return err
+		}
+		msg, err := parseDNS(buf[:n])
+		if err != nil || msg.response {
+			continue
+		}
+		answers, unicast := m.answer(msg)
+		switch {
+		case len(answers) == 0:
+		case from.Port != mdnsPort:
+			// Legacy unicast query, e.g. of a plain DNS resolver
+			m.sendReply(msg.id, answers, from)
+		case unicast:
+			m.send(answers, from)
+		default:
+			m.send(answers, mdnsGroup)
+		}
+	}
+}
+
+// Announce sends all records of the service twice, as required when they have changed.
+func (m *mdnsService) announce() {
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			time.Sleep(mdnsAnnounceInterval)
+		}
+		m.send(m.records(-1), mdnsGroup)
+	}
+}
+
+/* Answer returns the records that answer the questions of msg and whether all
+questions accept a unicast response.*/
+func (m *mdnsService) answer(msg dnsMessage) ([]dnsRecord, bool) {
+	service, instance, host := strings.ToLower(m.serviceName()), strings.ToLower(m.instanceName()), strings.ToLower(m.hostName())
+	answers := []dnsRecord{}
+	added := map[uint16]bool{}
+	add := func(records []dnsRecord, types ...uint16) {
+		for _, r := range records {
+			for _, t := range types {
+				if r.typ == t && !added[t] {
+					answers = append(answers, r)
+				}
+			}
+		}
+		for _, t := range types {
+			added[t] = true
+		}
+	}
+	unicast := true
+	all := m.records(-1)
+	for _, q := range msg.questions {
+		if q.class&dnsUnicast == 0 {
+			unicast = false
+		}
+		any := q.typ == dnsTypeANY
+		switch {
+		case q.name == mdnsServices && (q.typ == dnsTypePTR || any):
+			answers = append(answers, dnsRecord{mdnsServices, dnsTypePTR, dnsClassIN, mdnsServiceTTL, dnsName(m.serviceName())})
+		case q.name == service && (q.typ == dnsTypePTR || any):
+			add(all, dnsTypePTR, dnsTypeSRV, dnsTypeTXT, dnsTypeA)
+		case q.name == instance && (q.typ == dnsTypeSRV || q.typ == dnsTypeTXT || any):
+			add(all, dnsTypeSRV, dnsTypeTXT, dnsTypeA)
+		case q.name == host && (q.typ == dnsTypeA || any):
+			add(all, dnsTypeA)
+		}
+	}
+	return answers, unicast
+}
+
+// Records returns all records of the service with ttl, or with their default TTL if ttl is negative.
+func (m *mdnsService) records(ttl int) []dnsRecord {
+	hostTTL, serviceTTL := uint32(mdnsHostTTL), uint32(mdnsServiceTTL)
+	if ttl >= 0 {
+		hostTTL, serviceTTL = uint32(ttl), uint32(ttl)
+	}
+	srv := make([]byte, 6)
+	binary.BigEndian.PutUint16(srv[4:], uint16(m.port))
+	txt := []byte{}
+	for _, s := range m.txt() {
+		txt = append(append(txt, byte(len(s))), s...)
+	}
+	records := []dnsRecord{
+		{m.serviceName(), dnsTypePTR, dnsClassIN, serviceTTL, dnsName(m.instanceName())},
+		{m.instanceName(), dnsTypeSRV, dnsClassIN | dnsCacheFlush, hostTTL, append(srv, dnsName(m.hostName())...)},
+		{m.instanceName(), dnsTypeTXT, dnsClassIN | dnsCacheFlush, serviceTTL, txt},
+	}
+	for _, ip := range m.addrs() {
+		records = append(records, dnsRecord{m.hostName(), dnsTypeA, dnsClassIN | dnsCacheFlush, hostTTL, ip.To4()})
+	}
+	return records
+}
+
+// Send sends a response with answers to addr.
+func (m *mdnsService) send(answers []dnsRecord, addr *net.UDPAddr) {
+	m.sendReply(0, answers, addr)
+}
+
+// SendReply sends a response with id and answers to addr.
+func (m *mdnsService) sendReply(id uint16, answers []dnsRecord, addr *net.UDPAddr) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn == nil {
+		return
+	}
+	if _, err := m.conn.WriteToUDP(encodeDNS(id, answers), addr); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("Unable to send mDNS response to %v: %v", addr, err)
+	}
+}
+
+// DnsName returns name (e.g. host.local.) in the wire format of DNS, without compression.
+func dnsName(name string) []byte {
+	b := []byte{}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		b = append(append(b, byte(len(label))), label...)
+	}
+	return append(b, 0)
+}
+
+// EncodeDNS returns a response message with id and answers.
+func encodeDNS(id uint16, answers []dnsRecord) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b, id)
+	binary.BigEndian.PutUint16(b[2:], 0x8400) // Response, authoritative
+	binary.BigEndian.PutUint16(b[6:], uint16(len(answers)))
+	for _, r := range answers {
+		b = append(b, dnsName(r.name)...)
+		rr := make([]byte, 10)
+		binary.BigEndian.PutUint16(rr, r.typ)
+		binary.BigEndian.PutUint16(rr[2:], r.class)
+		binary.BigEndian.PutUint32(rr[4:], r.ttl)
+		binary.BigEndian.PutUint16(rr[8:], uint16(len(r.data)))
+		b = append(append(b, rr...), r.data...)
+	}
+	return b
+}
+
+// ParseDNS parses a DNS message, names are returned in lower case.
+func parseDNS(b []byte) (dnsMessage, error) {
+	var msg dnsMessage
+	if len(b) < 12 {
+		return msg, errors.New("DNS message too short")
+	}
+	msg.id = binary.BigEndian.Uint16(b)
+	msg.response = b[2]&0x80 != 0
+	qd, an := int(binary.BigEndian.Uint16(b[4:])), int(binary.BigEndian.Uint16(b[6:]))
+	off := 12
+	for i := 0; i < qd; i++ {
+		name, n, err := readDNSName(b, off)
+		if err != nil || n+4 > len(b) {
+			return msg, errors.New("Invalid DNS question")
+		}
+		msg.questions = append(msg.questions, dnsQuestion{name, binary.BigEndian.Uint16(b[n:]), binary.BigEndian.Uint16(b[n+2:])})
+		off = n + 4
+	}
+	for i := 0; i < an; i++ {
+		name, n, err := readDNSName(b, off)
+		if err != nil || n+10 > len(b) {
+			return msg, errors.New("Invalid DNS record")
+		}
+		length := int(binary.BigEndian.Uint16(b[n+8:]))
+		if n+10+length > len(b) {
+			return msg, errors.New("Invalid DNS record")
+		}
+		msg.answers = append(msg.answers, dnsRecord{name, binary.BigEndian.Uint16(b[n:]), binary.BigEndian.Uint16(b[n+2:]),
+			binary.BigEndian.Uint32(b[n+4:]), b[n+10 : n+10+length]})
+		off = n + 10 + length
+	}
+	return msg, nil
+}
+
+// ReadDNSName reads the name at off in message b, following compression pointers, and returns it and the offset after it.
+func readDNSName(b []byte, off int) (string, int, error) {
+	labels := []string{}
+	end := -1
+	for jumps := 0; jumps < 20; {
+		if off >= len(b) {
+			return "", 0, errors.New("Truncated DNS name")
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")) + ".", end, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(b) {
+				return "", 0, errors.New("Truncated DNS name")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3FFF)
+			jumps++
+		default:
+			if off+1+l > len(b) {
+				return "", 0, errors.New("Truncated DNS name")
+			}
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+	return "", 0, errors.New("Too many compression pointers in DNS name")
+}
+
+// LocalAddrs returns the IPv4 addresses of the host, except loopback addresses.
+func localAddrs() []net.IP {
+	ips := []net.IP{}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Printf("Unable to list network addresses: %v", err)
+		return ips
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil && !ipnet.IP.IsLoopback() {
+			ips = append(ips, ipnet.IP.To4())
+		}
+	}
+	return ips
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// mdnsQuery returns a query message for name and typ.
+func mdnsQuery(name string, typ uint16, unicast bool) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b[4:], 1)
+	q := make([]byte, 4)
+	binary.BigEndian.PutUint16(q, typ)
+	binary.BigEndian.PutUint16(q[2:], dnsClassIN)
+	if unicast {
+		q[2] |= 0x80
+	}
+	return append(append(b, dnsName(name)...), q...)
+}
+
+func TestMdnsAnswer(t *testing.T) {
+	m := &mdnsService{instance: "Sun.screens", service: "_hap._tcp", host: "pi", port: 51826,
+		txt:   func() []string { return []string{"c#=1", "sf=1"} },
+		addrs: func() []net.IP { return []net.IP{net.IPv4(192, 168, 1, 10)} }}
+	tests := []struct {
+		name    string
+		typ     uint16
+		unicast bool
+		want    []uint16
+	}{
+		{"_hap._tcp.local.", dnsTypePTR, false, []uint16{dnsTypePTR, dnsTypeSRV, dnsTypeTXT, dnsTypeA}},
+		{"Sun-screens._HAP._tcp.local.", dnsTypeSRV, true, []uint16{dnsTypeSRV, dnsTypeTXT, dnsTypeA}},
+		{"pi.local.", dnsTypeA, false, []uint16{dnsTypeA}},
+		{mdnsServices, dnsTypePTR, false, []uint16{dnsTypePTR}},
+		{"other._tcp.local.", dnsTypePTR, false, []uint16{}},
+	}
+	for _, tt := range tests {
+		msg, err := parseDNS(mdnsQuery(tt.name, tt.typ, tt.unicast))
+		if err != nil {
+			t.Fatal(err)
+		}
+		answers, unicast := m.answer(msg)
+		if unicast != tt.unicast || len(answers) != len(tt.want) {
+			t.Errorf("%v: want %v answers (unicast %v), got %v (%v)", tt.name, len(tt.want), tt.unicast, len(answers), unicast)
+			continue
+		}
+		for i, a := range answers {
+			if a.typ != tt.want[i] {
+				t.Errorf("%v: want type %v for answer %v, got %v", tt.name, tt.want[i], i, a.typ)
+			}
+		}
+	}
+
+	// Answers survive encoding and parsing
+	msg, _ := parseDNS(mdnsQuery("_hap._tcp.local.", dnsTypePTR, false))
+	answers, _ := m.answer(msg)
+	resp, err := parseDNS(encodeDNS(0, answers))
+	if err != nil || !resp.response || len(resp.answers) != 4 {
+		t.Fatalf("Want response with 4 answers, got %+v (%v)", resp, err)
+	}
+	ptr, srv, txt, a := resp.answers[0], resp.answers[1], resp.answers[2], resp.answers[3]
+	if name, _, _ := readDNSName(ptr.data, 0); name != "sun-screens._hap._tcp.local." {
+		t.Errorf("Want PTR to instance, got %v", name)
+	}
+	if port := binary.BigEndian.Uint16(srv.data[4:]); port != 51826 || srv.class != dnsClassIN|dnsCacheFlush {
+		t.Errorf("Want SRV with port 51826 and cache flush, got %v and class %x", port, srv.class)
+	}
+	if string(txt.data) != "\x04c#=1\x04sf=1" {
+		t.Errorf("Want TXT record, got %q", txt.data)
+	}
+	if a.name != "pi.local." || !net.IP(a.data).Equal(net.IPv4(192, 168, 1, 10)) || a.ttl != mdnsHostTTL {
+		t.Errorf("Want A record of host, got %+v", a)
+	}
+}
+
+func TestReadDNSName(t *testing.T) {
+	// Second name is compressed, pointing to "local." in the first name
+	b := append(dnsName("pi.local."), 3, 'f', 'o', 'o', 0xC0, 3)
+	name, off, err := readDNSName(b, 0)
+	if err != nil || name != "pi.local." || off != 10 {
+		t.Errorf("Want pi.local. ending at 10, got %v at %v (%v)", name, off, err)
+	}
+	name, off, err = readDNSName(b, 10)
+	if err != nil || name != "foo.local." || off != len(b) {
+		t.Errorf("Want foo.local. ending at %v, got %v at %v (%v)", len(b), name, off, err)
+	}
+	loop := []byte{0xC0, 0}
+	if _, _, err := readDNSName(loop, 0); err == nil || !strings.Contains(err.Error(), "compression") {
+		t.Errorf("Want error for pointer loop, got %v", err)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets holds the upper bounds in seconds of the buckets of the light measurement latency.
+var latencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// labelEscaper escapes label values in the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// movementKey identifies a movement counter.
+type movementKey struct {
+	id                      int
+	name, direction, source string
+}
+
+// metricKey identifies the metrics of a sunscreen or light sensor.
+type metricKey struct {
+	id   int
+	name string
+}
+
+// sensorMetrics holds the metrics of a light sensor.
+type sensorMetrics struct {
+	errors  int       // Number of failed light measurements
+	latency histogram // Duration of getAvgLight
+}
+
+// Histogram counts observations in cumulative buckets, as a Prometheus histogram.
+type histogram struct {
+	counts []uint64 // Number of observations per bucket of latencyBuckets
+	count  uint64
+	sum    float64
+}
+
+// Observe adds observation v in seconds to the histogram.
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	for i, b := range latencyBuckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+/* Metrics holds the counters that are exposed on /metrics. Gauges, e.g. the
+position of the sunscreens, are read from the current state when scraped.*/
+var metrics = struct {
+	mu           sync.Mutex
+	movements    map[movementKey]int          // Number of movements
+	runTime      map[metricKey]float64        // Seconds the motor of a sunscreen has run
+	sensors      map[metricKey]*sensorMetrics // Measurements per light sensor
+	mailFailures int                          // Number of mails that could not be sent
+}{
+	movements: map[movementKey]int{},
+	runTime:   map[metricKey]float64{},
+	sensors:   map[metricKey]*sensorMetrics{},
+}
+
+// CountMovement records a movement of sunscreen s that ran the motor for elapsed. The caller should hold muSunscrn.
+func (s *Sunscreen) countMovement(goUp bool, source string, elapsed time.Duration) {
+	direction := down
+	if goUp {
+		direction = up
+	}
+	if source == "" {
+		source = "none"
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.movements[movementKey{s.Id, s.Name, direction, source}]++
+	metrics.runTime[metricKey{s.Id, s.Name}] += elapsed.Seconds()
+}
+
+// MovementCount returns the number of movements up or down of the sunscreen with id since start.
+func movementCount(id int, goUp bool) int {
+	direction := down
+	if goUp {
+		direction = up
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	n := 0
+	for k, v := range metrics.movements {
+		if k.id == id && k.direction == direction {
+			n += v
+		}
+	}
+	return n
+}
+
+// CountMeasurement records a light measurement of sensor sn that took d, and whether it failed.
+func countMeasurement(sn Sensor, d time.Duration, failed bool) {
+	key := metricKey{sn.Id, sn.Name}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	m, ok := metrics.sensors[key]
+	if !ok {
+		m = &sensorMetrics{}
+		metrics.sensors[key] = m
+	}
+	m.latency.observe(d.Seconds())
+	if failed {
+		m.errors++
+	}
+}
+
+// CountMailFailure records a mail that could not be sent.
+func countMailFailure() {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.mailFailures++
+}
+
+/* HandlerMetrics exposes the metrics in the Prometheus text format. It is
+authorised like the API, so Prometheus should scrape it with basic_auth.*/
+func handlerMetrics(w http.ResponseWriter, req *http.Request) {
+	if !apiAuthorized(req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gosunscreen"`)
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w)
+}
+
+// metricWriter writes metric families in the Prometheus text format.
+type metricWriter struct {
+	w    io.Writer
+	name string // Name of the current metric family
+}
+
+// Family starts a metric family with name, type and help text.
+func (mw *metricWriter) family(name, typ, help string) {
+	mw.name = name
+	fmt.Fprintf(mw.w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+}
+
+// Sample writes a sample of the current family with suffix (e.g. _bucket), value and labels as name, value pairs.
+func (mw *metricWriter) sample(suffix string, value float64, labels ...string) {
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	l := ""
+	if len(pairs) > 0 {
+		l = "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(mw.w, "%v%v%v %v\n", mw.name, suffix, l, value)
+}
+
+// WriteMetrics writes all metrics to w in the Prometheus text format.
+func writeMetrics(w io.Writer) {
+	mw := &metricWriter{w: w}
+	muLS.Lock()
+	light, window, windowSize := lastLight(ls.Data), len(ls.Data), ls.window()
+	sensors := append([]Sensor{}, ls.Sensors...)
+	muLS.Unlock()
+	mw.family("gosunscreen_light", "gauge", "Last combined light, lower is brighter.")
+	if light != nil {
+		mw.sample("", float64(*light))
+	}
+	mw.family("gosunscreen_sensor_light", "gauge", "Last light per sensor, lower is brighter.")
+	for _, sn := range sensors {
+		if l := lastLight(sn.Data); l != nil {
+			mw.sample("", float64(*l), "sensor", fmt.Sprint(sn.Id), "name", sn.Name)
+		}
+	}
+	mw.family("gosunscreen_sensor_failed", "gauge", "1 if the sensor is excluded because of zero light or errors.")
+	for _, sn := range sensors {
+		mw.sample("", boolValue(sn.Failed), "sensor", fmt.Sprint(sn.Id), "name", sn.Name)
+	}
+	mw.family("gosunscreen_light_window", "gauge", "Number of light values in the rolling window used for evaluating the sunscreens.")
+	mw.sample("", float64(window))
+	mw.family("gosunscreen_light_window_size", "gauge", "Maximum number of light values in the rolling window.")
+	mw.sample("", float64(windowSize))
+
+	muSunscrn.Lock()
+	screens := copySunscreens()
+	muSunscrn.Unlock()
+	sort.Slice(screens, func(i, j int) bool { return screens[i].Id < screens[j].Id })
+	mw.family("gosunscreen_sunscreen_percent", "gauge", "Position of the sunscreen in percent down, 0 is up and 100 is down.")
+	for _, s := range screens {
+		mw.sample("", float64(s.Percent), "sunscreen", fmt.Sprint(s.Id), "name", s.Name)
+	}
+	mw.family("gosunscreen_sunscreen_position", "gauge", "1 for the current position of the sunscreen.")
+	for _, s := range screens {
+		for _, p := range []string{up, down, partial, moving, unknown} {
+			mw.sample("", boolValue(s.Position == p), "sunscreen", fmt.Sprint(s.Id), "name", s.Name, "position", p)
+		}
+	}
+	mw.family("gosunscreen_sunscreen_mode", "gauge", "1 for the current mode of the sunscreen.")
+	for _, s := range screens {
+		for _, m := range []string{auto, manual} {
+			mw.sample("", boolValue(s.Mode == m), "sunscreen", fmt.Sprint(s.Id), "name", s.Name, "mode", m)
+		}
+	}
+	mw.family("gosunscreen_sunscreen_seconds_until", "gauge", "Seconds until the next start or stop of the sunscreen.")
+	for _, s := range screens {
+		for _, e := range []struct {
+			event string
+			t     time.Time
+		}{{"start", s.Start}, {"stop", s.Stop}} {
+			if !e.t.IsZero() {
+				mw.sample("", secondsUntil(e.t), "sunscreen", fmt.Sprint(s.Id), "name", s.Name, "event", e.event)
+			}
+		}
+	}
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	mw.family("gosunscreen_movements_total", "counter", "Number of movements per direction and source of the command.")
+	movements := []movementKey{}
+	for k := range metrics.movements {
+		movements = append(movements, k)
+	}
+	sort.Slice(movements, func(i, j int) bool {
+		a, b := movements[i], movements[j]
+		return fmt.Sprint(a.id, a.name, a.direction, a.source) < fmt.Sprint(b.id, b.name, b.direction, b.source)
+	})
+	for _, k := range movements {
+		mw.sample("", float64(metrics.movements[k]), "sunscreen", fmt.Sprint(k.id), "name", k.name, "direction", k.direction, "source", k.source)
+	}
+	mw.family("gosunscreen_motor_run_seconds_total", "counter", "Total time the motor of the sunscreen has run.")
+	keys := []metricKey{}
+	for k := range metrics.runTime {
+		keys = append(keys, k)
+	}
+	for _, k := range sortKeys(keys) {
+		mw.sample("", metrics.runTime[k], "sunscreen", fmt.Sprint(k.id), "name", k.name)
+	}
+	keys = []metricKey{}
+	for k := range metrics.sensors {
+		keys = append(keys, k)
+	}
+	keys = sortKeys(keys)
+	mw.family("gosunscreen_light_errors_total", "counter", "Number of light measurements that returned zero light or errors.")
+	for _, k := range keys {
+		mw.sample("", float64(metrics.sensors[k].errors), "sensor", fmt.Sprint(k.id), "name", k.name)
+	}
+	mw.family("gosunscreen_light_measurement_seconds", "histogram", "Duration of measuring the average light of a sensor.")
+	for _, k := range keys {
+		h := metrics.sensors[k].latency
+		id := fmt.Sprint(k.id)
+		for i, b := range latencyBuckets {
+			mw.sample("_bucket", float64(h.counts[i]), "sensor", id, "name", k.name, "le", fmt.Sprint(b))
+		}
+		mw.sample("_bucket", float64(h.count), "sensor", id, "name", k.name, "le", "+Inf")
+		mw.sample("_sum", h.sum, "sensor", id, "name", k.name)
+		mw.sample("_count", float64(h.count), "sensor", id, "name", k.name)
+	}
+	mw.family("gosunscreen_mail_failures_total", "counter", "Number of mails that could not be sent.")
+	mw.sample("", float64(metrics.mailFailures))
+}
+
+// SortKeys sorts keys by id and name and returns them.
+func sortKeys(keys []metricKey) []metricKey {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].id != keys[j].id {
+			return keys[i].id < keys[j].id
+		}
+		return keys[i].name < keys[j].name
+	})
+	return keys
+}
+
+// BoolValue returns 1 if b is true, otherwise 0.
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+/* SecondsUntil returns the seconds until the next occurrence of the time of day
+of t: t itself if it is in the future, otherwise the same time on a later day.*/
+func secondsUntil(t time.Time) float64 {
+	d := time.Until(t)
+	if d < 0 {
+		d += (-d/(24*time.Hour) + 1) * 24 * time.Hour
+	}
+	return d.Seconds()
+}
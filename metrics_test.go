@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	for _, v := range []float64{0.005, 0.2, 0.2, 30} {
+		h.observe(v)
+	}
+	if h.count != 4 || h.sum != 30.405 {
+		t.Errorf("Want count 4 and sum 30.405, got %v and %v", h.count, h.sum)
+	}
+	// Buckets are cumulative: 0.01 has 1, 0.25 and up have 3, 30 only counts for +Inf
+	if h.counts[0] != 1 || h.counts[3] != 1 || h.counts[4] != 3 || h.counts[len(h.counts)-1] != 3 {
+		t.Errorf("Unexpected buckets %v", h.counts)
+	}
+}
+
+func TestSecondsUntil(t *testing.T) {
+	if got := secondsUntil(time.Now().Add(time.Hour)); got < 3590 || got > 3600 {
+		t.Errorf("Want about 3600 seconds, got %v", got)
+	}
+	if got := secondsUntil(time.Now().Add(-time.Hour)); got < 23*3600-10 || got > 23*3600 {
+		t.Errorf("Passed time should be tomorrow, want about %v seconds, got %v", 23*3600, got)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := setupApi(t)
+	metrics.mu.Lock()
+	metrics.movements, metrics.runTime, metrics.sensors, metrics.mailFailures =
+		map[movementKey]int{}, map[metricKey]float64{}, map[metricKey]*sensorMetrics{}, 0
+	metrics.mu.Unlock()
+	muSunscrn.Lock()
+	s.Name, s.Position, s.Percent = `Front "left"`, partial, 40
+	s.Start = time.Now().Add(time.Hour)
+	s.countMovement(false, srcWeb, 1500*time.Millisecond)
+	s.countMovement(false, srcWeb, time.Second)
+	muSunscrn.Unlock()
+	countMeasurement(ls.Sensors[0], 20*time.Millisecond, true)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	handlerMetrics(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Want 401 without credentials, got %v", w.Code)
+	}
+	req.SetBasicAuth("admin", "secret")
+	w = httptest.NewRecorder()
+	handlerMetrics(w, req)
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE gosunscreen_light gauge\ngosunscreen_light 42\n",
+		`gosunscreen_sensor_light{sensor="1",name="Roof"} 42`,
+		"gosunscreen_light_window 1\n",
+		"gosunscreen_light_window_size 6\n",
+		`gosunscreen_sunscreen_percent{sunscreen="1",name="Front \"left\""} 40`,
+		`gosunscreen_sunscreen_position{sunscreen="1",name="Front \"left\"",position="partial"} 1`,
+		`gosunscreen_sunscreen_position{sunscreen="1",name="Front \"left\"",position="up"} 0`,
+		`gosunscreen_sunscreen_mode{sunscreen="1",name="Front \"left\"",mode="auto"} 1`,
+		`gosunscreen_sunscreen_seconds_until{sunscreen="1",name="Front \"left\"",event="start"} 3`,
+		`gosunscreen_movements_total{sunscreen="1",name="Front \"left\"",direction="down",source="web"} 2`,
+		`gosunscreen_motor_run_seconds_total{sunscreen="1",name="Front \"left\""} 2.5`,
+		`gosunscreen_light_errors_total{sensor="1",name="Roof"} 1`,
+		`gosunscreen_light_measurement_seconds_bucket{sensor="1",name="Roof",le="0.01"} 0`,
+		`gosunscreen_light_measurement_seconds_bucket{sensor="1",name="Roof",le="0.025"} 1`,
+		`gosunscreen_light_measurement_seconds_count{sensor="1",name="Roof"} 1`,
+		"gosunscreen_mail_failures_total 0\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Metrics should contain %q, got:\n%v", want, body)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Constants for the Modbus function codes that are supported
+const (
+	modbusReadCoils      byte = 0x01
+	modbusReadHolding    byte = 0x03
+	modbusReadInputs     byte = 0x04
+	modbusWriteCoil      byte = 0x05
+	modbusWriteRegister  byte = 0x06
+	modbusWriteCoils     byte = 0x0F
+	modbusWriteRegisters byte = 0x10
+)
+
+// Constants for the Modbus exception codes
+const (
+	modbusIllegalFunction byte = 0x01
+	modbusIllegalAddress  byte = 0x02
+	modbusIllegalValue    byte = 0x03
+	modbusDeviceFailure   byte = 0x04
+)
+
+// Constants for the Modbus TCP server
+const (
+	modbusDefaultPort    = 502
+	modbusIdleTimeout    = 2 * time.Minute // Connections without requests are closed
+	modbusBlock          = 10              // Number of registers and coils per sunscreen
+	modbusMaxRead        = 125             // Maximum number of registers per read
+	modbusMaxReadCoils   = 2000            // Maximum number of coils per read
+	modbusMaxWrite       = 123             // Maximum number of registers per write
+	modbusMaxWriteCoils  = 1968            // Maximum number of coils per write
+	modbusNoValue        = 0xFFFF          // Value of an input register that is not available
+	modbusMaxRequestSize = 253             // Maximum size of a request PDU
+)
+
+var (
+	muModbus   sync.Mutex
+	modbusQuit chan struct{} // Stops the running Modbus server, guarded by muModbus
+)
+
+// modbusException is an error that is returned to the client as a Modbus exception code.
+type modbusException byte
+
+func (e modbusException) Error() string {
+	return fmt.Sprintf("Modbus exception %v", byte(e))
+}
+
+// ModbusRegisters provides the data model of a Modbus server.
+type modbusRegisters interface {
+	coils(addr uint16, n int) ([]bool, error)
+	writeCoil(addr uint16, on bool) error
+	holding(addr uint16, n int) ([]uint16, error)
+	writeHolding(addr uint16, value uint16) error
+	inputs(addr uint16, n int) ([]uint16, error)
+}
+
+/* ModbusServer is a minimal Modbus TCP server (slave) that serves the
+registers and coils of regs. It answers requests for any unit identifier.*/
+type modbusServer struct {
+	regs  modbusRegisters
+	mu    sync.Mutex // Guards conns
+	conns map[net.Conn]struct{}
+}
+
+// NewModbusServer returns a server for regs, which is started by serve.
+func newModbusServer(regs modbusRegisters) *modbusServer {
+	return &modbusServer{regs: regs, conns: map[net.Conn]struct{}{}}
+}
+
+// StartModbus (re)starts the Modbus TCP server with the settings in config, or stops it if Modbus is disabled.
+func startModbus() {
+	muConf.Lock()
+	enabled, port := config.EnableModbus, config.ModbusPort
+	muConf.Unlock()
+	muModbus.Lock()
+	defer muModbus.Unlock()
+	if modbusQuit != nil {
+		close(modbusQuit)
+		modbusQuit = nil
+	}
+	if !enabled {
+		return
+	}
+	if port == 0 {
+		port = modbusDefaultPort
+	}
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		log.Printf("Unable to start Modbus TCP server: %v", err)
+		return
+	}
+	log.Printf("Starting Modbus TCP server at port %v", port)
+	modbusQuit = make(chan struct{})
+	go newModbusServer(modbusSunscreens{}).serve(l, modbusQuit)
+}
+
+/* Serve accepts connections on l and handles their requests until quit is
+closed, after which l and all connections are closed.*/
+func (m *modbusServer) serve(l net.Listener, quit <-chan struct{}) {
+	go func() {
+		<-quit
+		l.Close()
+		m.mu.Lock()
+		for conn := range m.conns {
+			conn.Close()
+		}
+		m.mu.Unlock()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			log.Printf("Unable to accept Modbus connection: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		m.mu.Lock()
+		m.conns[conn] = struct{}{}
+		m.mu.Unlock()
+		go m.handleConn(conn)
+	}
+}
+
+// HandleConn answers the requests on conn until it is closed or idle for modbusIdleTimeout.
+func (m *modbusServer) handleConn(conn net.Conn) {
+	defer func() {
+		m.mu.Lock()
+		delete(m.conns, conn)
+		m.mu.Unlock()
+		conn.Close()
+	}()
+	header := make([]byte, 7)
+	for {
+		conn.SetReadDeadline(time.Now().Add(modbusIdleTimeout))
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Closed Modbus connection from %v: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		// MBAP header: transaction id, protocol id (0), length of unit id and PDU, unit id
+		length := binary.BigEndian.Uint16(header[4:6])
+		if binary.BigEndian.Uint16(header[2:4]) != 0 || length < 2 || length > modbusMaxRequestSize+1 {
+			log.Printf("Closed Modbus connection from %v: invalid header % x", conn.RemoteAddr(), header)
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return
+		}
+		resp := m.handle(pdu)
+		binary.BigEndian.PutUint16(header[4:6], uint16(len(resp)+1))
+		if _, err := conn.Write(append(append([]byte{}, header...), resp...)); err != nil {
+			return
+		}
+	}
+}
+
+/* Handle returns the response PDU to request PDU pdu, which is an exception
+response if the request could not be carried out.*/
+func (m *modbusServer) handle(pdu []byte) []byte {
+	fc := pdu[0]
+	resp, err := m.dispatch(fc, pdu[1:])
+	if err != nil {
+		code := modbusDeviceFailure
+		if e, ok := err.(modbusException); ok {
+			code = byte(e)
+		} else {
+			log.Printf("Unable to carry out Modbus function %v: %v", fc, err)
+		}
+		return []byte{fc | 0x80, code}
+	}
+	return append([]byte{fc}, resp...)
+}
+
+// Dispatch carries out function fc with the data of the request and returns the data of the response.
+func (m *modbusServer) dispatch(fc byte, data []byte) ([]byte, error) {
+	word := func(i int) uint16 { return binary.BigEndian.Uint16(data[2*i:]) }
+	switch fc {
+	case modbusReadCoils:
+		if len(data) != 4 {
+			return nil, modbusException(modbusIllegalValue)
+		}
+		n := int(word(1))
+		if n < 1 || n > modbusMaxReadCoils {
+			return nil, modbusException(modbusIllegalValue)
+		}
+		coils, err := m.regs.coils(word(0), n)
+		if err != nil {
+			return nil, err
+		}
+		resp := make([]byte, 1+(n+7)/8)
+		resp[0] = byte(len(resp) - 1)
+		for i, on := range coils {
+			if on {
+				resp[1+i/8] |= 1 << (i % 8)
+			}
+		}
+		return resp, nil
+	case modbusReadHolding, modbusReadInputs:
+		if len(data) != 4 {
+			return nil, modbusException(modbusIllegalValue)
+		}
+		n := int(word(1))
+		if n < 1 || n > modbusMaxRead {
+			return nil, modbusException(modbusIllegalValue)
+		}
+		read := m.regs.holding
+		if fc == modbusReadInputs {
+			read = m.regs.inputs
+		}
+		values, err := read(word(0), n)
+		if err != nil {
+			return nil, err
+		}
+		resp := make([]byte, 1+2*n)
+		resp[0] = byte(2 * n)
+		for i, v := range values {
+			binary.BigEndian.PutUint16(resp[1+2*i:], v)
+		}
+		return resp, nil
+	case modbusWriteCoil:
+		if len(data) != 4 || (word(1) != 0xFF00 && word(1) != 0) {
+			return nil, modbusException(modbusIllegalValue)
+		}
+		return data, m.regs.writeCoil(word(0), word(1) == 0xFF00)
+	case modbusWriteRegister:
+		if len(data) != 4 {
+			return nil, modbusException(modbusIllegalValue)
+		}
+		return data, m.regs.writeHolding(word(0), word(1))
+	case modbusWriteCoils:
+		if len(data) < 5 {
+			return nil, modbusException(modbusIllegalValue)
+		}
+		n := int(word(1))
+		if n < 1 || n > modbusMaxWriteCoils || int(data[4]) != (n+7)/8 || len(data) != 5+int(data[4]) {
+			return nil, modbusException(modbusIllegalValue)
+		}
+		for i := 0; i < n; i++ {
+			if err := m.regs.writeCoil(word(0)+uint16(i), data[5+i/8]&(1<<(i%8)) != 0); err != nil {
+				return nil, err
+			}
+		}
+		return data[:4], nil
+	case modbusWriteRegisters:
+		if len(data) < 5 {
+			return nil, modbusException(modbusIllegalValue)
+		}
+		n := int(word(1))
+		if n < 1 || n > modbusMaxWrite || int(data[4]) != 2*n || len(data) != 5+2*n {
+			return nil, modbusException(modbusIllegalValue)
+		}
+		for i := 0; i < n; i++ {
+			if err := m.regs.writeHolding(word(0)+uint16(i), binary.BigEndian.Uint16(data[5+2*i:])); err != nil {
+				return nil, err
+			}
+		}
+		return data[:4], nil
+	default:
+		return nil, modbusException(modbusIllegalFunction)
+	}
+}
+
+/* ModbusSunscreens maps the sunscreens onto Modbus registers and coils. Each
+sunscreen has a block of modbusBlock addresses starting at (Id-1)*modbusBlock,
+e.g. sunscreen 2 starts at address 10. Writes are carried out like commands of
+the web interface, so they set the sunscreen to manual. Unused addresses within
+a block read as 0.
+
+Coils (writing 1 carries out the command, writing 0 is ignored):
+	+0  up, reads 1 while moving up
+	+1  down, reads 1 while moving down
+	+2  stop
+Holding registers:
+	+0  target position in percent down (0-100)
+	+1  mode, 0 is auto and 1 is manual
+Input registers (65535 if not available):
+	+0  current position in percent down
+	+1  position, 0 up, 1 down, 2 partial, 3 moving, 4 unknown
+	+2  latest light, lower is brighter
+	+3  number of movements up since start
+	+4  number of movements down since start*/
+type modbusSunscreens struct{}
+
+// modbusPositions holds the value of input register +1 per position.
+var modbusPositions = map[string]uint16{up: 0, down: 1, partial: 2, moving: 3, unknown: 4}
+
+// ModbusSunscreen returns the sunscreen at addr and the offset of addr within its block.
+func modbusSunscreen(addr uint16) (*Sunscreen, uint16, error) {
+	s := getSunscreen(int(addr/modbusBlock) + 1)
+	if s == nil {
+		return nil, 0, modbusException(modbusIllegalAddress)
+	}
+	return s, addr % modbusBlock, nil
+}
+
+// Registers returns n registers from addr, with the value of each register as returned by value.
+func (modbusSunscreens) registers(addr uint16, n int, value func(s *Sunscreen, offset uint16) uint16) ([]uint16, error) {
+	if int(addr)+n > 0x10000 {
+		return nil, modbusException(modbusIllegalAddress)
+	}
+	values := []uint16{}
+	for i := 0; i < n; i++ {
+		s, offset, err := modbusSunscreen(addr + uint16(i))
+		if err != nil {
+			return nil, err
+		}
+		muSunscrn.Lock()
+		values = append(values, value(s, offset))
+		muSunscrn.Unlock()
+	}
+	return values, nil
+}
+
+func (m modbusSunscreens) coils(addr uint16, n int) ([]bool, error) {
+	values, err := m.registers(addr, n, func(s *Sunscreen, offset uint16) uint16 {
+		switch {
+		case s.Position != moving:
+			return 0
+		case offset == 0 && s.travelUp, offset == 1 && !s.travelUp:
+			return 1
+		}
+		return 0
+	})
+	coils := []bool{}
+	for _, v := range values {
+		coils = append(coils, v == 1)
+	}
+	return coils, err
+}
+
+func (modbusSunscreens) writeCoil(addr uint16, on bool) error {
+	s, offset, err := modbusSunscreen(addr)
+	if err != nil {
+		return err
+	}
+	pos := map[uint16]string{0: up, 1: down, 2: "stop"}[offset]
+	if pos == "" {
+		return modbusException(modbusIllegalAddress)
+	}
+	if !on {
+		return nil
+	}
+	log.Printf("Received Modbus command %v for sunscreen '%v'", pos, s.Name)
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	_, err = s.setMode(manual, pos, srcModbus, false)
+	return err
+}
+
+func (m modbusSunscreens) holding(addr uint16, n int) ([]uint16, error) {
+	return m.registers(addr, n, func(s *Sunscreen, offset uint16) uint16 {
+		switch offset {
+		case 0:
+			return uint16(s.target())
+		case 1:
+			if s.Mode == manual {
+				return 1
+			}
+		}
+		return 0
+	})
+}
+
+func (modbusSunscreens) writeHolding(addr uint16, value uint16) error {
+	s, offset, err := modbusSunscreen(addr)
+	if err != nil {
+		return err
+	}
+	mode, pos := manual, ""
+	switch {
+	case offset == 0 && value <= 100:
+		pos = fmt.Sprint(value)
+	case offset == 1 && value <= 1:
+		mode = map[uint16]string{0: auto, 1: manual}[value]
+	case offset <= 1:
+		return modbusException(modbusIllegalValue)
+	default:
+		return modbusException(modbusIllegalAddress)
+	}
+	log.Printf("Received Modbus write of %v to register %v for sunscreen '%v'", value, addr, s.Name)
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	_, err = s.setMode(mode, pos, srcModbus, false)
+	return err
+}
+
+func (m modbusSunscreens) inputs(addr uint16, n int) ([]uint16, error) {
+	light := uint16(modbusNoValue)
+	muLS.Lock()
+	if l := lastLight(ls.Data); l != nil {
+		light = uint16(min(*l, modbusNoValue-1))
+	}
+	muLS.Unlock()
+	return m.registers(addr, n, func(s *Sunscreen, offset uint16) uint16 {
+		switch offset {
+		case 0:
+			if s.Position == unknown {
+				return modbusNoValue
+			}
+			return uint16(s.Percent)
+		case 1:
+			return modbusPositions[s.Position]
+		case 2:
+			return light
+		case 3, 4:
+			return uint16(movementCount(s.Id, offset == 3))
+		}
+		return 0
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// modbusRequest sends request PDU pdu with transaction id tid over conn and returns the response PDU.
+func modbusRequest(t *testing.T, conn net.Conn, tid uint16, pdu ...byte) []byte {
+	t.Helper()
+	frame := make([]byte, 7, 7+len(pdu))
+	binary.BigEndian.PutUint16(frame, tid)
+	binary.BigEndian.PutUint16(frame[4:], uint16(len(pdu)+1))
+	frame[6] = 1
+	if _, err := conn.Write(append(frame, pdu...)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint16(header) != tid || header[6] != 1 {
+		t.Errorf("Want transaction %v for unit 1, got header % x", tid, header)
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(header[4:])-1)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestModbusServer(t *testing.T) {
+	s := setupApi(t)
+	muSunscrn.Lock()
+	s.Percent, s.Position = 40, partial
+	muSunscrn.Unlock()
+	s.init()
+	metrics.mu.Lock()
+	metrics.movements = map[movementKey]int{{1, "Front", up, srcWeb}: 2, {1, "Front", up, srcAuto}: 1, {1, "Front", down, srcWeb}: 4}
+	metrics.mu.Unlock()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	quit := make(chan struct{})
+	defer close(quit)
+	go newModbusServer(modbusSunscreens{}).serve(l, quit)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		name      string
+		req, resp []byte
+	}{
+		{"read inputs", []byte{modbusReadInputs, 0, 0, 0, 5}, []byte{modbusReadInputs, 10, 0, 40, 0, 2, 0, 42, 0, 3, 0, 4}},
+		{"read holding", []byte{modbusReadHolding, 0, 0, 0, 2}, []byte{modbusReadHolding, 4, 0, 40, 0, 0}},
+		{"read coils", []byte{modbusReadCoils, 0, 0, 0, 3}, []byte{modbusReadCoils, 1, 0}},
+		{"unknown sunscreen", []byte{modbusReadInputs, 0, 10, 0, 1}, []byte{modbusReadInputs | 0x80, modbusIllegalAddress}},
+		{"unknown function", []byte{0x2B, 0x0E, 1, 0}, []byte{0x2B | 0x80, modbusIllegalFunction}},
+		{"too many registers", []byte{modbusReadHolding, 0, 0, 0, 126}, []byte{modbusReadHolding | 0x80, modbusIllegalValue}},
+		{"invalid target", []byte{modbusWriteRegister, 0, 0, 0, 101}, []byte{modbusWriteRegister | 0x80, modbusIllegalValue}},
+		{"read-only register", []byte{modbusWriteRegister, 0, 2, 0, 1}, []byte{modbusWriteRegister | 0x80, modbusIllegalAddress}},
+		{"set manual", []byte{modbusWriteRegister, 0, 1, 0, 1}, []byte{modbusWriteRegister, 0, 1, 0, 1}},
+		{"coil off", []byte{modbusWriteCoil, 0, 1, 0, 0}, []byte{modbusWriteCoil, 0, 1, 0, 0}},
+	}
+	for i, tt := range tests {
+		if got := modbusRequest(t, conn, uint16(i), tt.req...); !bytes.Equal(got, tt.resp) {
+			t.Errorf("%v: want % x, got % x", tt.name, tt.resp, got)
+		}
+	}
+	muSunscrn.Lock()
+	if s.Mode != manual || s.running != nil || len(s.queue) != 0 {
+		t.Errorf("Want manual without commands, got %v with %v", s.Mode, s.commands())
+	}
+	muSunscrn.Unlock()
+
+	// Writing target and mode at once submits a command like the web interface
+	if got := modbusRequest(t, conn, 20, modbusWriteRegisters, 0, 0, 0, 2, 4, 0, 70, 0, 1); !bytes.Equal(got, []byte{modbusWriteRegisters, 0, 0, 0, 2}) {
+		t.Errorf("Want write of 2 registers, got % x", got)
+	}
+	muSunscrn.Lock()
+	xc := s.commands()
+	muSunscrn.Unlock()
+	if len(xc) == 0 || xc[0].Action != cmdGoto || xc[0].Target != 70 || xc[0].Source != srcModbus {
+		t.Fatalf("Want goto 70%% from modbus, got %+v", xc)
+	}
+	if got := modbusRequest(t, conn, 21, modbusReadHolding, 0, 0, 0, 1); !bytes.Equal(got, []byte{modbusReadHolding, 2, 0, 70}) {
+		t.Errorf("Want target 70, got % x", got)
+	}
+	if got := modbusRequest(t, conn, 22, modbusWriteCoils, 0, 0, 0, 3, 1, 4); !bytes.Equal(got, []byte{modbusWriteCoils, 0, 0, 0, 3}) {
+		t.Errorf("Want write of 3 coils, got % x", got)
+	}
+	waitFor(t, "stop", func() bool {
+		muSunscrn.Lock()
+		defer muSunscrn.Unlock()
+		return s.running == nil && len(s.queue) == 0
+	})
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	s.closeQueue()
+}
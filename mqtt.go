@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Constants for the MQTT (3.1.1) packet types, shifted into the high nibble of the first byte
+const (
+	mqttConnect     byte = 1 << 4
+	mqttConnack     byte = 2 << 4
+	mqttPublish     byte = 3 << 4
+	mqttPuback      byte = 4 << 4
+	mqttSubscribe   byte = 8 << 4
+	mqttSuback      byte = 9 << 4
+	mqttPingreq     byte = 12 << 4
+	mqttPingresp    byte = 13 << 4
+	mqttDisconnect  byte = 14 << 4
+	mqttMaxPacket        = 1 << 20 // Maximum size of a received packet
+	mqttDialTimeout      = 10 * time.Second
+)
+
+// Constants for the reconnect backoff and keep alive of the MQTT client
+const (
+	mqttBackoffMin = time.Second
+	mqttBackoffMax = 2 * time.Minute
+	mqttKeepAlive  = 30 * time.Second
+)
+
+// mqttReturnCodes holds the reason per return code of a refused connection.
+var mqttReturnCodes = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// MqttMessage represents a message published to or received from a broker.
+type mqttMessage struct {
+	Topic   string
+	Payload string
+	Retain  bool
+}
+
+/* MqttClient is a minimal MQTT 3.1.1 client that publishes and receives
+messages with QoS 0. It keeps reconnecting to the broker with an exponential
+backoff until it is stopped. The broker publishes will when the connection is
+lost without a disconnect.*/
+type mqttClient struct {
+	addr       string        // Address of the broker, host:port
+	clientId   string        // Client identifier, unique per broker
+	user, pass string        // Optional credentials
+	keepAlive  time.Duration // Maximum time between packets sent to the broker
+	will       mqttMessage   // Message the broker publishes when the connection is lost
+	subs       []string      // Topic filters subscribed to after each connect
+	handler    func(msg mqttMessage)
+	onConnect  func() // Called after each connect, e.g. to publish states
+	backoffMin time.Duration
+	backoffMax time.Duration
+	mu         sync.Mutex // Guards conn, packetId and writes to conn
+	conn       net.Conn
+	packetId   uint16
+}
+
+// NewMqttClient returns a client for the broker at addr, which is started by run.
+func newMqttClient(addr, clientId, user, pass string) *mqttClient {
+	return &mqttClient{
+		addr:       addr,
+		clientId:   clientId,
+		user:       user,
+		pass:       pass,
+		keepAlive:  mqttKeepAlive,
+		backoffMin: mqttBackoffMin,
+		backoffMax: mqttBackoffMax,
+	}
+}
+
+/* Run connects to the broker and keeps reconnecting when the connection is lost
+or refused, waiting twice as long after each failed attempt. It returns when
+quit is closed, after disconnecting from the broker.*/
+func (c *mqttClient) run(quit <-chan struct{}) {
+	backoff := c.backoffMin
+	for {
+		connected, err := c.session(quit)
+		select {
+		case <-quit:
+			return
+		default:
+		}
+		if connected {
+			backoff = c.backoffMin
+			log.Printf("MQTT connection to %v lost, reconnecting in %v: %v", c.addr, backoff, err)
+		} else {
+			log.Printf("Unable to connect to MQTT broker %v, retrying in %v: %v", c.addr, backoff, err)
+		}
+		select {
+		case <-quit:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > c.backoffMax {
+			backoff = c.backoffMax
+		}
+	}
+}
+
+/* Session connects to the broker and handles incoming packets until the
+connection is lost or quit is closed. Connected is true if the broker has
+accepted the connection.*/
+func (c *mqttClient) session(quit <-chan struct{}) (connected bool, err error) {
+	conn, err := net.DialTimeout("tcp", c.addr, mqttDialTimeout)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(mqttDialTimeout))
+	if _, err := conn.Write(c.connectPacket()); err != nil {
+		return false, err
+	}
+	typ, body, err := readPacket(r)
+	switch {
+	case err != nil:
+		return false, err
+	case typ != mqttConnack || len(body) != 2:
+		return false, fmt.Errorf("Expected CONNACK, got packet type %v", typ>>4)
+	case body[1] != 0:
+		return false, fmt.Errorf("Connection refused: %v", mqttReturnCodes[body[1]])
+	}
+	conn.SetDeadline(time.Time{})
+	log.Printf("Connected to MQTT broker %v", c.addr)
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	done := make(chan struct{})
+	defer func() {
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+		close(done)
+	}()
+	go c.ping(done)
+	go func() {
+		select {
+		case <-quit:
+			c.disconnect()
+		case <-done:
+		}
+	}()
+	if len(c.subs) > 0 {
+		if err := c.subscribe(c.subs...); err != nil {
+			return true, err
+		}
+	}
+	if c.onConnect != nil {
+		go c.onConnect()
+	}
+	for {
+		// The broker answers each ping, so the connection is lost if nothing is received
+		conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		typ, body, err := readPacket(r)
+		if err != nil {
+			return true, err
+		}
+		switch typ & 0xF0 {
+		case mqttPublish:
+			msg, id, err := parsePublish(typ, body)
+			if err != nil {
+				return true, err
+			}
+			if id != 0 {
+				c.write(mqttPuback, []byte{byte(id >> 8), byte(id)})
+			}
+			if c.handler != nil {
+				c.handler(msg)
+			}
+		case mqttSuback:
+			if n := len(body); n > 2 && body[n-1] == 0x80 {
+				log.Printf("MQTT broker %v refused a subscription", c.addr)
+			}
+		}
+	}
+}
+
+// Ping sends a PINGREQ every half keep alive period until done is closed.
+func (c *mqttClient) ping(done <-chan struct{}) {
+	t := time.NewTicker(c.keepAlive / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			c.write(mqttPingreq, nil)
+		}
+	}
+}
+
+// Disconnect publishes the will (as the broker does not) and closes the connection.
+func (c *mqttClient) disconnect() {
+	if c.will.Topic != "" {
+		c.publish(c.will.Topic, c.will.Payload, c.will.Retain)
+	}
+	c.write(mqttDisconnect, nil)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// Connected returns true if the client is connected to the broker.
+func (c *mqttClient) connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+/* Publish sends payload to topic with QoS 0. It returns an error if the client
+is not connected, the message is not queued.*/
+func (c *mqttClient) publish(topic, payload string, retain bool) error {
+	var flags byte
+	if retain {
+		flags = 1
+	}
+	return c.write(mqttPublish|flags, append(mqttString(topic), payload...))
+}
+
+// Subscribe subscribes to the topic filters with QoS 0.
+func (c *mqttClient) subscribe(filters ...string) error {
+	c.mu.Lock()
+	c.packetId++
+	if c.packetId == 0 {
+		c.packetId = 1
+	}
+	body := []byte{byte(c.packetId >> 8), byte(c.packetId)}
+	c.mu.Unlock()
+	for _, f := range filters {
+		body = append(append(body, mqttString(f)...), 0)
+	}
+	return c.write(mqttSubscribe|0x02, body)
+}
+
+// Write sends a packet with header and body, if the client is connected.
+func (c *mqttClient) write(header byte, body []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return errors.New("Not connected to MQTT broker")
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.keepAlive))
+	_, err := c.conn.Write(mqttPacket(header, body))
+	return err
+}
+
+// ConnectPacket returns the CONNECT packet with a clean session, the will and the credentials.
+func (c *mqttClient) connectPacket() []byte {
+	flags := byte(0x02)
+	payload := mqttString(c.clientId)
+	if c.will.Topic != "" {
+		flags |= 0x04
+		if c.will.Retain {
+			flags |= 0x20
+		}
+		payload = append(append(payload, mqttString(c.will.Topic)...), mqttString(c.will.Payload)...)
+	}
+	if c.user != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(c.user)...)
+		if c.pass != "" {
+			flags |= 0x40
+			payload = append(payload, mqttString(c.pass)...)
+		}
+	}
+	keepAlive := uint16(c.keepAlive / time.Second)
+	body := append(mqttString("MQTT"), 4, flags, byte(keepAlive>>8), byte(keepAlive))
+	return mqttPacket(mqttConnect, append(body, payload...))
+}
+
+// MqttPacket returns a packet with header, the remaining length and body.
+func mqttPacket(header byte, body []byte) []byte {
+	b := []byte{header}
+	n := len(body)
+	for {
+		d := byte(n % 128)
+		if n /= 128; n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			break
+		}
+	}
+	return append(b, body...)
+}
+
+// MqttString returns s prefixed with its length, as strings are encoded in MQTT packets.
+func mqttString(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// ReadPacket reads a packet from r and returns its first byte and body.
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for {
+		d, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(d&0x7F) << shift
+		if d&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, errors.New("Malformed remaining length of MQTT packet")
+		}
+	}
+	if n > mqttMaxPacket {
+		return 0, nil, fmt.Errorf("MQTT packet of %v bytes is too large", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// ParsePublish returns the message and packet id (0 for QoS 0) of a PUBLISH packet.
+func parsePublish(header byte, body []byte) (mqttMessage, uint16, error) {
+	msg := mqttMessage{Retain: header&0x01 == 1}
+	topic, rest, err := readMqttString(body)
+	if err != nil {
+		return msg, 0, err
+	}
+	msg.Topic = topic
+	var id uint16
+	if qos := header >> 1 & 0x03; qos > 0 {
+		if len(rest) < 2 {
+			return msg, 0, errors.New("Malformed MQTT PUBLISH packet")
+		}
+		id, rest = binary.BigEndian.Uint16(rest), rest[2:]
+	}
+	msg.Payload = string(rest)
+	return msg, id, nil
+}
+
+// ReadMqttString returns the length prefixed string at the start of b and the remaining bytes.
+func readMqttString(b []byte) (string, []byte, error) {
+	if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+		return "", nil, errors.New("Malformed string in MQTT packet")
+	}
+	n := 2 + int(binary.BigEndian.Uint16(b))
+	return string(b[2:n]), b[n:], nil
+}
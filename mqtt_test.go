@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* testBroker is a minimal local MQTT broker for testing: it accepts
+connections, keeps retained messages, forwards messages to matching
+subscriptions and publishes the will of connections that are lost.*/
+type testBroker struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	connects int                        // Number of accepted connections
+	conns    map[net.Conn]*brokerClient // Open connections
+	retained map[string]mqttMessage
+	received []mqttMessage // All messages published by clients
+}
+
+type brokerClient struct {
+	id   string
+	will *mqttMessage
+	subs []string
+	user string
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{ln: ln, conns: map[net.Conn]*brokerClient{}, retained: map[string]mqttMessage{}}
+	t.Cleanup(b.close)
+	go b.serve()
+	return b
+}
+
+func (b *testBroker) addr() string {
+	return b.ln.Addr().String()
+}
+
+func (b *testBroker) close() {
+	b.ln.Close()
+	b.drop()
+}
+
+// Drop closes all connections as if the network failed, so the wills are published.
+func (b *testBroker) drop() {
+	b.mu.Lock()
+	conns := []net.Conn{}
+	for conn := range b.conns {
+		conns = append(conns, conn)
+	}
+	b.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+func (b *testBroker) serve() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *testBroker) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	typ, body, err := readPacket(r)
+	if err != nil || typ != mqttConnect {
+		return
+	}
+	c := parseConnect(body)
+	b.mu.Lock()
+	b.connects++
+	b.conns[conn] = c
+	b.mu.Unlock()
+	conn.Write(mqttPacket(mqttConnack, []byte{0, 0}))
+	for {
+		typ, body, err := readPacket(r)
+		if err != nil {
+			break
+		}
+		switch typ & 0xF0 {
+		case mqttPublish:
+			msg, _, err := parsePublish(typ, body)
+			if err == nil {
+				b.publish(msg)
+			}
+		case mqttSubscribe:
+			id, rest := body[:2], body[2:]
+			filters := []string{}
+			for len(rest) > 0 {
+				f, r, err := readMqttString(rest)
+				if err != nil || len(r) == 0 {
+					return
+				}
+				filters, rest = append(filters, f), r[1:]
+			}
+			b.mu.Lock()
+			c.subs = append(c.subs, filters...)
+			retained := []mqttMessage{}
+			for _, msg := range b.retained {
+				if matchAny(filters, msg.Topic) {
+					retained = append(retained, msg)
+				}
+			}
+			b.mu.Unlock()
+			conn.Write(mqttPacket(mqttSuback, append(id, make([]byte, len(filters))...)))
+			for _, msg := range retained {
+				conn.Write(publishPacket(msg))
+			}
+		case mqttPingreq:
+			conn.Write(mqttPacket(mqttPingresp, nil))
+		case mqttDisconnect:
+			c.will = nil
+		}
+	}
+	b.mu.Lock()
+	delete(b.conns, conn)
+	b.mu.Unlock()
+	if c.will != nil {
+		b.publish(*c.will)
+	}
+}
+
+// Publish stores msg if it is retained and forwards it to all matching subscriptions.
+func (b *testBroker) publish(msg mqttMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.received = append(b.received, msg)
+	if msg.Retain {
+		if msg.Payload == "" {
+			delete(b.retained, msg.Topic)
+		} else {
+			b.retained[msg.Topic] = msg
+		}
+	}
+	forward := msg
+	forward.Retain = false
+	for conn, c := range b.conns {
+		if matchAny(c.subs, msg.Topic) {
+			conn.Write(publishPacket(forward))
+		}
+	}
+}
+
+// Retained returns the retained payload of topic.
+func (b *testBroker) retainedPayload(topic string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.retained[topic].Payload
+}
+
+func (b *testBroker) connections() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.connects
+}
+
+func parseConnect(body []byte) *brokerClient {
+	_, rest, _ := readMqttString(body) // Protocol name
+	flags := rest[1]
+	rest = rest[4:]
+	c := &brokerClient{}
+	c.id, rest, _ = readMqttString(rest)
+	if flags&0x04 != 0 {
+		will := &mqttMessage{Retain: flags&0x20 != 0}
+		will.Topic, rest, _ = readMqttString(rest)
+		will.Payload, rest, _ = readMqttString(rest)
+		c.will = will
+	}
+	if flags&0x80 != 0 {
+		c.user, _, _ = readMqttString(rest)
+	}
+	return c
+}
+
+func publishPacket(msg mqttMessage) []byte {
+	var flags byte
+	if msg.Retain {
+		flags = 1
+	}
+	return mqttPacket(mqttPublish|flags, append(mqttString(msg.Topic), msg.Payload...))
+}
+
+// MatchAny returns true if topic matches one of the filters, which may contain the wildcards + and #.
+func matchAny(filters []string, topic string) bool {
+	for _, f := range filters {
+		fp, tp := strings.Split(f, "/"), strings.Split(topic, "/")
+		match := true
+		for i := range fp {
+			if fp[i] == "#" {
+				break
+			}
+			if i >= len(tp) || (fp[i] != "+" && fp[i] != tp[i]) {
+				match = false
+				break
+			}
+			if i == len(fp)-1 && len(tp) > len(fp) {
+				match = false
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// waitFor polls cond until it returns true, or fails the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("Timed out waiting for %v", what)
+}
+
+func TestMqttPacket(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384, 300000} {
+		p := mqttPacket(mqttPublish, make([]byte, n))
+		typ, body, err := readPacket(bufio.NewReader(strings.NewReader(string(p))))
+		if err != nil || typ != mqttPublish || len(body) != n {
+			t.Errorf("Packet with %v bytes: got type %v, %v bytes (%v)", n, typ, len(body), err)
+		}
+	}
+	msg, id, err := parsePublish(mqttPublish|0x02|0x01, append(append(mqttString("a/b"), 0, 7), "payload"...))
+	if err != nil || id != 7 || msg != (mqttMessage{"a/b", "payload", true}) {
+		t.Errorf("Want QoS 1 message a/b with id 7, got %+v, id %v (%v)", msg, id, err)
+	}
+}
+
+func TestMqttClient(t *testing.T) {
+	broker := newTestBroker(t)
+	received := make(chan mqttMessage, 10)
+	c := newMqttClient(broker.addr(), "test", "user", "secret")
+	c.backoffMin = 10 * time.Millisecond
+	c.will = mqttMessage{"test/status", "offline", true}
+	c.subs = []string{"test/+/set"}
+	c.handler = func(msg mqttMessage) { received <- msg }
+	connected := make(chan struct{}, 10)
+	c.onConnect = func() {
+		c.publish("test/status", "online", true)
+		connected <- struct{}{}
+	}
+	quit := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		c.run(quit)
+		close(stopped)
+	}()
+	<-connected
+	waitFor(t, "online status", func() bool { return broker.retainedPayload("test/status") == "online" })
+	broker.publish(mqttMessage{Topic: "test/1/set", Payload: "OPEN"})
+	broker.publish(mqttMessage{Topic: "test/1/state", Payload: "open"})
+	select {
+	case msg := <-received:
+		if msg.Topic != "test/1/set" || msg.Payload != "OPEN" {
+			t.Errorf("Want OPEN on test/1/set, got %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message on subscribed topic was not received")
+	}
+	// Lost connection: the broker publishes the will and the client reconnects
+	broker.drop()
+	waitFor(t, "will", func() bool { return broker.retainedPayload("test/status") == "offline" })
+	<-connected
+	waitFor(t, "reconnect", func() bool { return broker.retainedPayload("test/status") == "online" })
+	if n := broker.connections(); n != 2 {
+		t.Errorf("Want 2 connections, got %v", n)
+	}
+	close(quit)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client did not stop")
+	}
+	waitFor(t, "offline after stop", func() bool { return broker.retainedPayload("test/status") == "offline" })
+}
+
+func TestMqttBackoff(t *testing.T) {
+	// Reserve a port without a broker, so connecting fails
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	c := newMqttClient(addr, "test", "", "")
+	c.backoffMin, c.backoffMax = 20*time.Millisecond, 80*time.Millisecond
+	connected := make(chan struct{}, 1)
+	c.onConnect = func() { connected <- struct{}{} }
+	quit := make(chan struct{})
+	defer close(quit)
+	go c.run(quit)
+	time.Sleep(200 * time.Millisecond)
+	// The broker becomes available, the client connects within the maximum backoff
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("Unable to listen on %v again: %v", addr, err)
+	}
+	broker := &testBroker{ln: ln, conns: map[net.Conn]*brokerClient{}, retained: map[string]mqttMessage{}}
+	defer broker.close()
+	go broker.serve()
+	select {
+	case <-connected:
+	case <-time.After(time.Second):
+		t.Fatal("Client did not reconnect after the broker became available")
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Constants for the action of a command
+const (
+	cmdMove      = "move"      // Move the sunscreen in the opposite direction of its position
+	cmdStop      = "stop"      // Stop the current movement and cancel all queued commands
+	cmdGoto      = "goto"      // Move the sunscreen to a position in percent down
+	cmdCalibrate = "calibrate" // Measure the travel time up (0) or down (100) as part of a calibration
+)
+
+// Constants for the source of a command
+const (
+	srcAuto     = "auto"     // Light based evaluation of MonitorMove
+	srcSchedule = "schedule" // Start/stop times of the sunscreen
+	srcWeb      = "web"      // User through the web interface
+	srcMqtt     = "mqtt"     // User through a home automation hub connected over MQTT
+	srcApi      = "api"      // Client of the JSON API
+	srcModbus   = "modbus"   // Building management system connected over Modbus TCP
+	srcHomekit  = "homekit"  // User through the Home app of a HomeKit controller
+	srcKnx      = "knx"      // Wall switch or visualisation on the KNX bus
+	srcWind     = "wind"     // Wind lock of the anemometer, see windStatus
+	srcRain     = "rain"     // Rain lock of the rain sensor, see rainStatus
+)
+
+// Constants for the status of a command
+const (
+	cmdQueued    = "queued"
+	cmdRunning   = "running"
+	cmdCompleted = "completed"
+	cmdCancelled = "cancelled"
+	cmdFailed    = "failed"
+)
+
+// cmdHistory is the number of ended commands that is kept per sunscreen.
+const cmdHistory = 5
+
+// Priority per source, commands with a higher priority are executed first.
+var priorities = map[string]int{
+	srcAuto:     0,
+	srcSchedule: 1,
+	srcWeb:      2,
+	srcMqtt:     2,
+	srcApi:      2,
+	srcModbus:   2,
+	srcHomekit:  2,
+	srcKnx:      2,
+	srcWind:     3,
+	srcRain:     3,
+}
+
+// cmdId is the Id of the last command, it is guarded by muSunscrn.
+var cmdId int
+
+/* Command represents a request to move or stop a sunscreen. Commands are
+queued per sunscreen and executed one at a time by the worker of that
+sunscreen. All fields are guarded by muSunscrn.*/
+type Command struct {
+	Id        int       // Autogenerated ID for command
+	Action    string    // Action of command: move, stop, goto or calibrate
+	Target    int       // Position in percent down if Action is goto or calibrate
+	Source    string    // Source of command: web, mqtt, api, modbus, homekit, knx, auto, schedule, wind or rain
+	Priority  int       // Commands with a higher priority are executed first
+	Status    string    // Status of command: queued, running, completed, cancelled or failed
+	Err       string    // Error if the command failed
+	Queued    time.Time // Time the command was submitted
+	Started   time.Time // Time the command started running
+	Ended     time.Time // Time the command was completed, cancelled or failed
+	Confirmed bool      // True if the user confirmed the command, which is required during a frost lock
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// NewCommand returns a command for action from source, with the priority of that source.
+func newCommand(action string, target int, source string) *Command {
+	return &Command{
+		Action:   action,
+		Target:   max(min(target, 100), 0),
+		Source:   source,
+		Priority: priorities[source],
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Text returns a description of the command, e.g. "goto 40%".
+func (c Command) Text() string {
+	if c.Action == cmdGoto || c.Action == cmdCalibrate {
+		return fmt.Sprintf("%v %v", c.Action, positionText(c.Target))
+	}
+	return c.Action
+}
+
+func (c *Command) String() string {
+	return fmt.Sprintf("#%v %v (%v)", c.Id, c.Text(), c.Source)
+}
+
+// Wait blocks until the command has been completed or cancelled.
+func (c *Command) Wait() {
+	<-c.done
+}
+
+// Cancelled returns true if the command has been cancelled. The caller should hold muSunscrn.
+func (c *Command) cancelled() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+/* Submit adds c to the queue of the sunscreen and returns the command that
+will carry out the request. A stop command cancels all queued and running
+commands of the same or lower priority. A command from a user (web or mqtt)
+supersedes the commands of the same or lower priority, so the sunscreen can be reversed
+mid-travel. If the same goto command is queued or running already, that command
+is returned instead. During a calibration, only calibrate and stop commands are
+accepted, and during a wind lock only stop commands and those of the lock.
+During a frost lock, automatic commands, including the retractions of a wind or
+rain lock, are ignored and commands of users should be confirmed. During a rain
+lock, auto mode can not move the sunscreen down, unless it ignores rain. The
+caller should hold muSunscrn.*/
+func (s *Sunscreen) submit(c *Command) *Command {
+	cmdId++
+	c.Id, c.Queued = cmdId, time.Now()
+	if s.calibration != nil && c.Action != cmdCalibrate && c.Action != cmdStop {
+		log.Printf("Ignored command %v, sunscreen '%v' is being calibrated", c, s.Name)
+		close(c.stop)
+		c.Started = c.Queued
+		s.endCommand(c, cmdCancelled)
+		return c
+	}
+	if c.Action != cmdStop && c.Source != srcWind && windLocked() {
+		log.Printf("Ignored command %v, sunscreen '%v' is locked by wind", c, s.Name)
+		close(c.stop)
+		c.Started, c.Err = c.Queued, "Locked by wind"
+		s.endCommand(c, cmdCancelled)
+		return c
+	}
+	if c.Action != cmdStop && frostLocked() {
+		switch {
+		case c.Source == srcWind || c.Source == srcRain:
+			log.Printf("WARNING: ignored retraction of sunscreen '%v' by %v, it is locked by frost and may be frozen to its frame", s.Name, c.Source)
+			close(c.stop)
+			c.Started, c.Err = c.Queued, "Locked by frost"
+			s.endCommand(c, cmdCancelled)
+			return c
+		case automatic(c.Source):
+			log.Printf("Ignored command %v, sunscreen '%v' is locked by frost", c, s.Name)
+			close(c.stop)
+			c.Started, c.Err = c.Queued, "Locked by frost"
+			s.endCommand(c, cmdCancelled)
+			return c
+		case !c.Confirmed:
+			log.Printf("Ignored command %v, sunscreen '%v' is locked by frost and the command is not confirmed", c, s.Name)
+			close(c.stop)
+			c.Started, c.Err = c.Queued, "Locked by frost, confirmation required"
+			s.endCommand(c, cmdCancelled)
+			return c
+		default:
+			log.Printf("WARNING: moving sunscreen '%v' during frost lock by confirmed command %v, it may be frozen to its frame", s.Name, c)
+		}
+	}
+	if c.Source == srcAuto && c.Action == cmdGoto && c.Target > 0 && !s.IgnoreRain && rainLocked() {
+		log.Printf("Ignored command %v, sunscreen '%v' is locked by rain", c, s.Name)
+		close(c.stop)
+		c.Started, c.Err = c.Queued, "Locked by rain"
+		s.endCommand(c, cmdCancelled)
+		return c
+	}
+	if c.Action == cmdStop {
+		log.Printf("Stopping sunscreen '%v' by %v", s.Name, c.Source)
+		s.cancelCommands(c.Priority)
+		c.Started = c.Queued
+		s.endCommand(c, cmdCompleted)
+		return c
+	}
+	if c.Action == cmdGoto {
+		if s.running == nil && len(s.queue) == 0 && s.Position != unknown && s.Percent == c.Target {
+			// Nothing to do, the command is not recorded
+			c.Status, c.Started, c.Ended = cmdCompleted, c.Queued, c.Queued
+			close(c.done)
+			return c
+		}
+		for _, q := range append([]*Command{s.running}, s.queue...) {
+			if q != nil && q.Action == cmdGoto && q.Target == c.Target && q.Priority >= c.Priority && !q.cancelled() {
+				return q
+			}
+		}
+	}
+	if c.Priority >= priorities[srcWeb] {
+		s.cancelCommands(c.Priority)
+	}
+	// Insert after all commands of the same or higher priority
+	i := len(s.queue)
+	for i > 0 && s.queue[i-1].Priority < c.Priority {
+		i--
+	}
+	s.queue = append(s.queue[:i], append([]*Command{c}, s.queue[i:]...)...)
+	c.Status = cmdQueued
+	log.Printf("Queued command %v for sunscreen '%v'", c, s.Name)
+	if s.wake == nil {
+		s.wake = make(chan struct{}, 1)
+		go s.worker(s.wake)
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return c
+}
+
+/* CancelCommands cancels all queued commands and the running command with a
+priority of at most prio. The caller should hold muSunscrn.*/
+func (s *Sunscreen) cancelCommands(prio int) {
+	queue := []*Command{}
+	for _, q := range s.queue {
+		if q.Priority > prio {
+			queue = append(queue, q)
+			continue
+		}
+		log.Printf("Cancelled command %v for sunscreen '%v'", q, s.Name)
+		close(q.stop)
+		s.endCommand(q, cmdCancelled)
+	}
+	s.queue = queue
+	if s.running != nil && s.running.Priority <= prio && !s.running.cancelled() {
+		log.Printf("Cancelled running command %v for sunscreen '%v'", s.running, s.Name)
+		close(s.running.stop)
+	}
+}
+
+// EndCommand marks c as ended with status and adds it to the history. The caller should hold muSunscrn.
+func (s *Sunscreen) endCommand(c *Command, status string) {
+	c.Status, c.Ended = status, time.Now()
+	close(c.done)
+	s.history = append(s.history, c)
+	if len(s.history) > cmdHistory {
+		s.history = s.history[len(s.history)-cmdHistory:]
+	}
+}
+
+/* Worker executes the queued commands of the sunscreen one at a time, highest
+priority first, each time it is woken up. It returns when wake is closed.*/
+func (s *Sunscreen) worker(wake <-chan struct{}) {
+	for range wake {
+		for {
+			muSunscrn.Lock()
+			if len(s.queue) == 0 {
+				muSunscrn.Unlock()
+				break
+			}
+			c := s.queue[0]
+			s.queue = s.queue[1:]
+			if c.Source == srcAuto && s.Mode != auto {
+				log.Printf("Cancelled command %v for sunscreen '%v', mode is %v", c, s.Name, s.Mode)
+				close(c.stop)
+				s.endCommand(c, cmdCancelled)
+				muSunscrn.Unlock()
+				continue
+			}
+			c.Status, c.Started = cmdRunning, time.Now()
+			s.running = c
+			target := c.Target
+			if c.Action == cmdMove {
+				target = s.toggleTarget()
+			}
+			muSunscrn.Unlock()
+			var err error
+			if c.Action == cmdCalibrate {
+				err = s.measure(target, c.stop)
+			} else {
+				err = s.moveTo(target, c.stop)
+			}
+			if err != nil {
+				log.Printf("Command %v failed: %v", c, err)
+			}
+			muSunscrn.Lock()
+			s.running = nil
+			status := cmdCompleted
+			switch {
+			case err != nil:
+				status, c.Err = cmdFailed, err.Error()
+			case c.cancelled() && c.Action != cmdCalibrate:
+				// Stopping is the normal end of a calibrate command
+				status = cmdCancelled
+			}
+			s.endCommand(c, status)
+			muSunscrn.Unlock()
+		}
+	}
+}
+
+/* CloseQueue cancels all commands of the sunscreen and stops its worker, e.g.
+when the sunscreen is deleted. The caller should hold muSunscrn.*/
+func (s *Sunscreen) closeQueue() {
+	s.cancelCommands(len(priorities))
+	if s.wake != nil {
+		close(s.wake)
+		s.wake = nil
+	}
+}
+
+/* Commands returns a copy of the running, queued and recently ended commands
+of the sunscreen, e.g. for showing them on a page. The caller should hold muSunscrn.*/
+func (s *Sunscreen) commands() []Command {
+	xc := []Command{}
+	if s.running != nil {
+		xc = append(xc, *s.running)
+	}
+	for _, c := range s.queue {
+		xc = append(xc, *c)
+	}
+	for i := len(s.history) - 1; i >= 0; i-- {
+		xc = append(xc, *s.history[i])
+	}
+	return xc
+}
+
+/* Target returns the position in percent down the sunscreen is moving to, which
+is the target of the first running or queued goto command, or its position if
+there is none. The caller should hold muSunscrn.*/
+func (s *Sunscreen) target() int {
+	for _, c := range append([]*Command{s.running}, s.queue...) {
+		if c != nil && c.Action == cmdGoto && !c.cancelled() {
+			return c.Target
+		}
+	}
+	return s.Percent
+}
+
+// CancelCommand cancels the queued or running command with id. It returns false if no such command exists.
+func cancelCommand(id int) bool {
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	for _, s := range sunscreens {
+		if s.running != nil && s.running.Id == id {
+			if !s.running.cancelled() {
+				log.Printf("Cancelled running command %v for sunscreen '%v'", s.running, s.Name)
+				close(s.running.stop)
+			}
+			return true
+		}
+		for i, c := range s.queue {
+			if c.Id == id {
+				log.Printf("Cancelled command %v for sunscreen '%v'", c, s.Name)
+				s.queue = append(s.queue[:i], s.queue[i+1:]...)
+				close(c.stop)
+				s.endCommand(c, cmdCancelled)
+				return true
+			}
+		}
+	}
+	return false
+}
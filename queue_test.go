@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+
+// newQueueScreen returns a sunscreen without a worker, so queued commands are not executed.
+func newQueueScreen() *Sunscreen {
+	return &Sunscreen{Id: 1, Name: "Test", Mode: auto, Position: up, wake: make(chan struct{}, 1)}
+}
+
+func TestSubmitPriority(t *testing.T) {
+	s := newQueueScreen()
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	a := s.submit(newCommand(cmdGoto, 100, srcAuto))
+	b := s.submit(newCommand(cmdGoto, 0, srcSchedule))
+	if got := s.submit(newCommand(cmdGoto, 100, srcAuto)); got != a {
+		t.Errorf("Same command should return the queued command %v, got %v", a, got)
+	}
+	if len(s.queue) != 2 || s.queue[0] != b || s.queue[1] != a {
+		t.Fatalf("Want schedule command before auto command, got %v", s.queue)
+	}
+	if got := s.submit(newCommand(cmdGoto, 0, srcAuto)); got != b {
+		t.Errorf("Queued command with a higher priority should be returned, got %v", got)
+	}
+	c := s.submit(newCommand(cmdGoto, 50, srcWeb))
+	if len(s.queue) != 1 || s.queue[0] != c || a.Status != cmdCancelled || b.Status != cmdCancelled {
+		t.Errorf("Web command should supersede all queued commands, got %v", s.queue)
+	}
+}
+
+func TestSubmitStop(t *testing.T) {
+	s := newQueueScreen()
+	muSunscrn.Lock()
+	running := newCommand(cmdGoto, 100, srcWeb)
+	s.running = running
+	if got := s.submit(newCommand(cmdGoto, 0, srcAuto)); got.Status != cmdQueued {
+		t.Errorf("Want auto command queued, got %v", got.Status)
+	}
+	stop := s.submit(newCommand(cmdStop, 0, srcWeb))
+	muSunscrn.Unlock()
+	stop.Wait()
+	if !running.cancelled() || len(s.queue) != 0 || len(s.history) != 2 {
+		t.Errorf("Stop should cancel the running and queued commands, got queue %v and history %v", s.queue, s.history)
+	}
+}
+
+func TestSubmitNoop(t *testing.T) {
+	s := newQueueScreen()
+	muSunscrn.Lock()
+	c := s.submit(newCommand(cmdGoto, 0, srcSchedule))
+	muSunscrn.Unlock()
+	c.Wait()
+	if c.Status != cmdCompleted || len(s.queue) != 0 || len(s.history) != 0 {
+		t.Errorf("Command to current position should complete without being queued, got %v", c.Status)
+	}
+}
+
+func TestCancelCommand(t *testing.T) {
+	s := newQueueScreen()
+	muSunscrn.Lock()
+	sunscreens = []*Sunscreen{s}
+	c := s.submit(newCommand(cmdGoto, 100, srcWeb))
+	muSunscrn.Unlock()
+	defer func() { sunscreens = []*Sunscreen{} }()
+	if !cancelCommand(c.Id) {
+		t.Fatalf("Command %v should be cancelled", c)
+	}
+	c.Wait()
+	if c.Status != cmdCancelled || len(s.queue) != 0 {
+		t.Errorf("Want cancelled command removed from queue, got %v", c.Status)
+	}
+	if cancelCommand(c.Id) {
+		t.Errorf("Command %v should no longer be cancellable", c)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rainSample is the interval at which the input of the rain sensor is read.
+const rainSample = 100 * time.Millisecond
+
+var (
+	muRain   sync.Mutex
+	rain     = &rainStatus{} // Guarded by muRain
+	rainQuit chan struct{}   // Stops the running rain sensor, guarded by muRain
+)
+
+/* RainStatus represents the rain detected by the rain sensor and the rain lock.
+The input of the sensor should be stable for config.RainDebounce before rain or
+dry weather is detected. When rain is detected, all sunscreens that do not
+ignore rain are moved up and locked: auto mode does not move them down until it
+has been dry for config.RainDry. Users can still move them down. During a frost
+lock the sunscreens are not moved up, as rain below freezing means snow or ice
+and the sunscreens may be frozen to their frame.*/
+type rainStatus struct {
+	Enabled bool      // True if the rain sensor is monitored
+	Raining bool      // True if rain is detected
+	Locked  bool      // True if auto mode is locked up because of rain
+	Since   time.Time // Time the lock was last set or released
+	Dry     time.Time // Time since which it is dry, zero if it is raining
+	change  time.Time // Time since which the input differs from Raining, zero if it does not
+}
+
+/* StartRain (re)starts monitoring the rain sensor with the settings in config,
+or stops it if the rain sensor is disabled. A rain lock is released when the
+rain sensor is disabled.*/
+func startRain() {
+	muConf.Lock()
+	enabled, pin, polarity := config.EnableRain, config.RainPin, config.RainPolarity
+	muConf.Unlock()
+	muRain.Lock()
+	defer muRain.Unlock()
+	if rainQuit != nil {
+		close(rainQuit)
+		rainQuit = nil
+	}
+	rain.Enabled, rain.change = enabled, time.Time{}
+	if !enabled {
+		if rain.Locked {
+			log.Println("Released rain lock, rain sensor is disabled")
+			rain.Locked, rain.Since = false, time.Now()
+		}
+		rain.Raining, rain.Dry = false, time.Time{}
+		return
+	}
+	wet := Low
+	if polarity == activeHigh {
+		wet = High
+	}
+	log.Printf("Starting rain sensor on pin %v", pin)
+	rainQuit = make(chan struct{})
+	go monitorRain(pin, wet, rainQuit)
+}
+
+// RainLocked returns true if auto mode is locked up because of rain.
+func rainLocked() bool {
+	muRain.Lock()
+	defer muRain.Unlock()
+	return rain.Locked
+}
+
+// GetRainStatus returns a copy of the rain status, e.g. for showing it on a page.
+func getRainStatus() rainStatus {
+	muRain.Lock()
+	defer muRain.Unlock()
+	return *rain
+}
+
+/* MonitorRain reads the rain sensor on pin every rainSample, of which the input
+is wet when rain is detected, until quit is closed.*/
+func monitorRain(pin Pin, wet State, quit <-chan struct{}) {
+	hw.Input(pin)
+	t := time.NewTicker(rainSample)
+	defer t.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-t.C:
+		}
+		muConf.Lock()
+		debounce, dry := config.RainDebounce, config.RainDry
+		muConf.Unlock()
+		muRain.Lock()
+		raining := rain.Raining
+		rained, released := rain.update(hw.Read(pin) == wet, debounce, dry, time.Now())
+		status := *rain
+		muRain.Unlock()
+		if released || status.Raining != raining {
+			events.publish(evtRain, status)
+		}
+		switch {
+		case rained:
+			msg := fmt.Sprintf("Rain detected, moving sunscreens up and locking auto mode until it has been dry for %v.", dry)
+			log.Println(msg)
+			go sendMail("Sunscreens locked by rain", msg)
+			for _, s := range listSunscreens() {
+				muSunscrn.Lock()
+				if !s.IgnoreRain {
+					s.retract(srcRain)
+				}
+				muSunscrn.Unlock()
+			}
+		case released:
+			log.Printf("It has been dry for %v, released rain lock", dry)
+		}
+	}
+}
+
+/* Update takes the input of the rain sensor at now and detects rain or dry
+weather once the input has been stable for debounce. The lock is set when rain
+is detected and released when it has been dry for dry. It returns true for
+rained when rain is detected, and true for released when the lock is released.
+The caller should hold muRain.*/
+func (r *rainStatus) update(wet bool, debounce, dry time.Duration, now time.Time) (rained, released bool) {
+	switch {
+	case wet == r.Raining:
+		r.change = time.Time{}
+	case r.change.IsZero() && debounce > 0:
+		r.change = now
+	case now.Sub(r.change) >= debounce:
+		r.Raining, r.change = wet, time.Time{}
+		if wet {
+			r.Dry = time.Time{}
+			rained = true
+			if !r.Locked {
+				r.Locked, r.Since = true, now
+			}
+		} else {
+			log.Println("Rain stopped")
+			r.Dry = now
+		}
+	}
+	if r.Locked && !r.Raining && now.Sub(r.Dry) >= dry {
+		r.Locked, r.Since = false, now
+		released = true
+	}
+	return rained, released
+}
+
+/* Locks returns the safety locks that apply to the sunscreen, e.g. "wind",
+"frost" or "wind rain", or an empty string if there are none. The caller should hold
+muSunscrn.*/
+func (s *Sunscreen) locks() string {
+	xs := []string{}
+	if windLocked() {
+		xs = append(xs, srcWind)
+	}
+	if frostLocked() {
+		xs = append(xs, "frost")
+	}
+	if !s.IgnoreRain && rainLocked() {
+		xs = append(xs, srcRain)
+	}
+	return strings.Join(xs, " ")
+}
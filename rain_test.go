@@ -0,0 +1,134 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRainUpdate(t *testing.T) {
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		after    time.Duration
+		wet      bool
+		rained   bool
+		released bool
+		locked   bool
+	}{
+		{0, false, false, false, false},
+		{time.Second, true, false, false, false},                    // Wet, debouncing
+		{2 * time.Second, false, false, false, false},               // Bounced back
+		{3 * time.Second, true, false, false, false},                // Wet, debouncing
+		{5 * time.Second, true, true, false, true},                  // Wet for 2 seconds
+		{time.Minute, false, false, false, true},                    // Dry, debouncing
+		{time.Minute + 2*time.Second, false, false, false, true},    // Dry for 2 seconds
+		{5 * time.Minute, true, false, false, true},                 // Wet, debouncing
+		{5*time.Minute + 2*time.Second, true, true, false, true},    // Rain again
+		{6 * time.Minute, false, false, false, true},                // Dry, debouncing
+		{6*time.Minute + 2*time.Second, false, false, false, true},  // Dry
+		{16*time.Minute + time.Second, false, false, false, true},   // Dry for 9:59
+		{16*time.Minute + 2*time.Second, false, false, true, false}, // Dry for 10 minutes
+		{20 * time.Minute, false, false, false, false},
+	}
+	r := &rainStatus{}
+	for _, tt := range tests {
+		rained, released := r.update(tt.wet, 2*time.Second, 10*time.Minute, start.Add(tt.after))
+		if rained != tt.rained || released != tt.released || r.Locked != tt.locked {
+			t.Errorf("Wet %v at %v: want rained %v, released %v and locked %v, got %v, %v and %v", tt.wet, tt.after, tt.rained, tt.released, tt.locked, rained, released, r.Locked)
+		}
+	}
+	if !r.Since.Equal(start.Add(16*time.Minute+2*time.Second)) || !r.Dry.Equal(start.Add(6*time.Minute+2*time.Second)) {
+		t.Errorf("Want lock released at 16:02 after dry since 6:02, got %+v", r)
+	}
+
+	// Without debounce and dry period, rain is detected and released at once
+	r = &rainStatus{}
+	if rained, _ := r.update(true, 0, 0, start); !rained || !r.Locked {
+		t.Error("Want rain detected at once")
+	}
+	if _, released := r.update(false, 0, 0, start); !released || r.Locked {
+		t.Error("Want lock released at once")
+	}
+}
+
+func TestRainLock(t *testing.T) {
+	s := setupApi(t)
+	glass := &Sunscreen{Id: 2, Name: "Glass", Mode: auto, Position: up, IgnoreRain: true}
+	muSunscrn.Lock()
+	s.Position, s.Percent = down, 100
+	sunscreens = append(sunscreens, glass)
+	muSunscrn.Unlock()
+	s.init()
+	muRain.Lock()
+	rain = &rainStatus{Enabled: true}
+	muRain.Unlock()
+	t.Cleanup(func() {
+		muRain.Lock()
+		rain = &rainStatus{}
+		muRain.Unlock()
+	})
+	pin := Pin{Line: 6}
+	hw.(*simGPIO).SetLevel(pin, Low)
+	quit, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		monitorRain(pin, Low, quit)
+		close(done)
+	}()
+	waitFor(t, "rain lock", rainLocked)
+	close(quit)
+	<-done
+
+	muSunscrn.Lock()
+	if xc := s.commands(); len(xc) != 1 || xc[0].Source != srcRain || xc[0].Target != 0 {
+		t.Errorf("Want sunscreen moving up by rain, got %+v", xc)
+	}
+	if xc := glass.commands(); len(xc) != 0 {
+		t.Errorf("Want sunscreen that ignores rain not moved, got %+v", xc)
+	}
+	if s.locks() != srcRain || glass.locks() != "" {
+		t.Errorf("Want rain lock for sunscreen only, got '%v' and '%v'", s.locks(), glass.locks())
+	}
+	// Auto mode can not move down, users can
+	if c := s.submit(newCommand(cmdGoto, 100, srcAuto)); c.Status != cmdCancelled || c.Err != "Locked by rain" {
+		t.Errorf("Want auto command cancelled, got %+v", c)
+	}
+	if c, err := s.setMode(manual, "50", srcWeb, false); err != nil || c.Status != cmdQueued {
+		t.Errorf("Want command of user queued, got %+v (%v)", c, err)
+	}
+	s.submit(newCommand(cmdStop, 0, srcRain))
+	muSunscrn.Unlock()
+	waitFor(t, "stop", func() bool {
+		muSunscrn.Lock()
+		defer muSunscrn.Unlock()
+		return s.running == nil && len(s.queue) == 0
+	})
+
+	// Evaluating good light does not move the sunscreen down
+	muSunscrn.Lock()
+	s.Position, s.Percent = up, 0
+	n := len(s.commands())
+	muSunscrn.Unlock()
+	s.evaluate([]int{5, 5, 5, 5, 5}, 10, 20, 30, 5, 5, 5, 0)
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	if len(s.commands()) != n {
+		t.Errorf("Want no command during rain lock, got %+v", s.commands())
+	}
+	s.closeQueue()
+}
+
+func TestMovementLock(t *testing.T) {
+	setupApi(t)
+	rows := [][]string{
+		{"01-06-2023 12:00:00", "auto", "down", "[5 5]", "1"},
+		{"01-06-2023 13:00:00", "manual", "up", "[9]", "1", "wind rain"},
+	}
+	movements := movementHistory(rows)
+	if len(movements) != 2 || movements[0].Lock != "" || movements[1].Lock != "wind rain" {
+		t.Errorf("Want locks of movements, got %+v", movements)
+	}
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	if stats := statsWithName(rows); stats[0][5] != "" || stats[1][5] != "wind rain" || stats[1][4] != "Front" {
+		t.Errorf("Want stats with lock, got %v", stats)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Constants for the polarity of the relays of a sunscreen
+const (
+	activeLow  = "low"  // Relay is energised when the pin is low
+	activeHigh = "high" // Relay is energised when the pin is high
+)
+
+// relayDeadTime is the default time between releasing one relay and energising the other.
+const relayDeadTime = 500 * time.Millisecond
+
+// relayPoll is the interval at which the condition to end a movement is checked.
+const relayPoll = 10 * time.Millisecond
+
+// Actuator drives the motor of a sunscreen up or down.
+type actuator interface {
+	init()               // Init prepares the actuator and stops the motor.
+	start(up bool) error // Start runs the motor up or down.
+	halt(atEnd bool)     // Halt stops the motor. AtEnd is true if the motor has reached an end stop and stopped by itself.
+}
+
+/* DeadTimer is implemented by actuators that should not start within a
+dead-time after running in the opposite direction.*/
+type deadTimer interface {
+	deadTimeLeft(up bool) time.Duration // DeadTimeLeft returns the time until the actuator can start up or down.
+}
+
+/* Relay drives the up and down relays of a sunscreen. It never energises both
+relays at the same time (interlock) and after releasing one relay, it does not
+energise the other relay before the dead-time has passed, so the motor comes to
+a standstill before changing direction. Violations are returned as errors.*/
+type relay struct {
+	mu        sync.Mutex
+	up        Pin
+	down      Pin
+	on        State         // State of a pin that energises its relay
+	deadTime  time.Duration // Minimum time between releasing one relay and energising the other
+	energised bool          // True if last is energised
+	last      Pin           // Pin that was energised last
+	released  time.Time     // Time last was released
+}
+
+// NewRelay returns a relay driver for the pins up and down with polarity low or high.
+func newRelay(up, down Pin, polarity string, deadTime time.Duration) (*relay, error) {
+	r := &relay{up: up, down: down, deadTime: deadTime}
+	switch polarity {
+	case activeLow, "":
+		r.on = Low
+	case activeHigh:
+		r.on = High
+	default:
+		return nil, fmt.Errorf("Unknown polarity '%v', should be %v or %v", polarity, activeLow, activeHigh)
+	}
+	if up == down {
+		return nil, fmt.Errorf("Pin up and pin down should be different pins, both are %v", up)
+	}
+	if deadTime < 0 {
+		return nil, fmt.Errorf("Dead-time should not be negative, got %v", deadTime)
+	}
+	return r, nil
+}
+
+// Init sets both pins to output and releases both relays.
+func (r *relay) init() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range []Pin{r.down, r.up} {
+		hw.Output(p)
+		hw.Write(p, r.off())
+	}
+	r.energised = false
+}
+
+// Off returns the state of a pin that releases its relay.
+func (r *relay) off() State {
+	return r.on ^ 1
+}
+
+// Other returns the opposite pin of p. The caller should hold r.mu.
+func (r *relay) other(p Pin) (Pin, error) {
+	switch p {
+	case r.up:
+		return r.down, nil
+	case r.down:
+		return r.up, nil
+	default:
+		return p, fmt.Errorf("Pin %v is not the up (%v) or down (%v) pin", p, r.up, r.down)
+	}
+}
+
+/* Energise energises the relay of p. It returns an error instead if the other
+relay is energised or its dead-time has not passed yet.*/
+func (r *relay) energise(p Pin) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	other, err := r.other(p)
+	if err != nil {
+		return err
+	}
+	switch {
+	case r.energised && r.last == p:
+		return nil
+	case r.energised:
+		return fmt.Errorf("Interlock: unable to energise pin %v while pin %v is energised", p, other)
+	case hw.Read(other) == r.on:
+		return fmt.Errorf("Interlock: unable to energise pin %v, pin %v reads as energised", p, other)
+	case r.last == other && time.Since(r.released) < r.deadTime:
+		return fmt.Errorf("Dead-time: unable to energise pin %v within %v after releasing pin %v", p, r.deadTime, other)
+	}
+	hw.Write(p, r.on)
+	r.energised, r.last = true, p
+	return nil
+}
+
+// Release releases the relay of p.
+func (r *relay) release(p Pin) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hw.Write(p, r.off())
+	if r.energised && r.last == p {
+		r.energised, r.released = false, time.Now()
+	}
+}
+
+// Wait returns the time until the dead-time has passed for energising p.
+func (r *relay) wait(p Pin) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.last == p || r.released.IsZero() {
+		return 0
+	}
+	return r.deadTime - time.Since(r.released)
+}
+
+/* Start energises the relay up or down. Within the dead-time after a change of
+direction it fails, so callers should wait for the dead-time first, see
+waitDeadTime.*/
+func (r *relay) start(up bool) error {
+	return r.energise(r.pin(up))
+}
+
+// DeadTimeLeft returns the time until the dead-time has passed for starting up or down.
+func (r *relay) deadTimeLeft(up bool) time.Duration {
+	return r.wait(r.pin(up))
+}
+
+// Pin returns the pin of the relay up or down.
+func (r *relay) pin(up bool) Pin {
+	if up {
+		return r.up
+	}
+	return r.down
+}
+
+// Halt releases the energised relay. Relays always stop the motor, so atEnd is not used.
+func (r *relay) halt(atEnd bool) {
+	r.mu.Lock()
+	p, energised := r.last, r.energised
+	r.mu.Unlock()
+	if energised {
+		r.release(p)
+	}
+}
+
+/* Run starts a for dur, or until stop is closed or until returns true, and
+returns how long the motor has run. End is true if the movement is meant to
+reach an end stop.*/
+func run(a actuator, up bool, dur time.Duration, end bool, stop <-chan struct{}, until func() bool) (time.Duration, error) {
+	if !waitDeadTime(a, up, stop) {
+		return 0, nil
+	}
+	if err := a.start(up); err != nil {
+		return 0, err
+	}
+	elapsed := travelFor(dur, stop, until)
+	a.halt((end && elapsed == dur) || (until != nil && until()))
+	return elapsed, nil
+}
+
+/* WaitDeadTime blocks until actuator a can start up or down, if it has a
+dead-time, or until stop is closed. It returns false if stop was closed.*/
+func waitDeadTime(a actuator, up bool, stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	default:
+	}
+	dt, ok := a.(deadTimer)
+	if !ok || dt.deadTimeLeft(up) <= 0 {
+		return true
+	}
+	t := time.NewTimer(dt.deadTimeLeft(up))
+	defer t.Stop()
+	select {
+	case <-stop:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+/* TravelFor blocks for dur, or until stop is closed or until returns true. Until
+is optional and checked every relayPoll. It returns the time it has blocked,
+which is dur if it was not interrupted.*/
+func travelFor(dur time.Duration, stop <-chan struct{}, until func() bool) time.Duration {
+	start := time.Now()
+	t := time.NewTimer(dur)
+	defer t.Stop()
+	var poll <-chan time.Time
+	if until != nil {
+		ticker := time.NewTicker(relayPoll)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	for {
+		select {
+		case <-t.C:
+			return dur
+		case <-poll:
+			if !until() {
+				continue
+			}
+		case <-stop:
+		}
+		if elapsed := time.Since(start); elapsed < dur {
+			return elapsed
+		}
+		return dur
+	}
+}
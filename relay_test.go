@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewRelay(t *testing.T) {
+	tests := []struct {
+		up, down Pin
+		polarity string
+		deadTime time.Duration
+		ok       bool
+	}{
+		{Pin{Line: 22}, Pin{Line: 17}, activeLow, 0, true},
+		{Pin{Line: 22}, Pin{Line: 17}, activeHigh, time.Second, true},
+		{Pin{Line: 22}, Pin{Line: 17}, "", 0, true},
+		{Pin{Line: 22}, Pin{Line: 17}, "inverted", 0, false},
+		{Pin{Line: 17}, Pin{Line: 17}, activeLow, 0, false},
+		{Pin{Line: 22}, Pin{Line: 17}, activeLow, -time.Second, false},
+	}
+	for _, tt := range tests {
+		if _, err := newRelay(tt.up, tt.down, tt.polarity, tt.deadTime); (err == nil) != tt.ok {
+			t.Errorf("newRelay(%v, %v, %v, %v): want ok=%v, got %v", tt.up, tt.down, tt.polarity, tt.deadTime, tt.ok, err)
+		}
+	}
+}
+
+func TestRelayPolarity(t *testing.T) {
+	hw = newSimGPIO()
+	up, down := Pin{Line: 22}, Pin{Line: 17}
+	r, _ := newRelay(up, down, activeHigh, 0)
+	r.init()
+	if hw.Read(up) != Low || hw.Read(down) != Low {
+		t.Fatalf("Active-high relays should be released with low pins")
+	}
+	if err := r.energise(down); err != nil || hw.Read(down) != High {
+		t.Errorf("Active-high relay should be energised with a high pin (%v)", err)
+	}
+	r.release(down)
+	if hw.Read(down) != Low {
+		t.Errorf("Active-high relay should be released with a low pin")
+	}
+}
+
+func TestRelayInterlock(t *testing.T) {
+	hw = newSimGPIO()
+	up, down := Pin{Line: 22}, Pin{Line: 17}
+	r, _ := newRelay(up, down, activeLow, time.Hour)
+	r.init()
+	if err := r.energise(down); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.energise(up); err == nil || hw.Read(up) != High {
+		t.Errorf("Up should not be energised while down is energised")
+	}
+	r.release(down)
+	if err := r.energise(up); err == nil || hw.Read(up) != High {
+		t.Errorf("Up should not be energised within the dead-time")
+	}
+	if err := r.energise(down); err != nil {
+		t.Errorf("Down should be energised again without dead-time: %v", err)
+	}
+	r.release(down)
+	// A pin that is energised outside of the driver also blocks the other pin
+	r, _ = newRelay(up, down, activeLow, 0)
+	hw.Write(down, Low)
+	if err := r.energise(up); err == nil {
+		t.Errorf("Up should not be energised while down reads as energised")
+	}
+	if err := r.energise(Pin{Line: 5}); err == nil {
+		t.Errorf("Unknown pin should not be energised")
+	}
+}
+
+func TestRelayDeadTime(t *testing.T) {
+	hw = newSimGPIO()
+	up, down := Pin{Line: 22}, Pin{Line: 17}
+	r, _ := newRelay(up, down, activeLow, 100*time.Millisecond)
+	r.init()
+	if _, err := run(r, false, 0, false, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := run(r, true, 0, false, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("Move should wait for the dead-time before changing direction, waited %v", d)
+	}
+}
+
+func TestRelayDeadTimeStop(t *testing.T) {
+	hw = newSimGPIO()
+	up, down := Pin{Line: 22}, Pin{Line: 17}
+	r, _ := newRelay(up, down, activeLow, time.Second)
+	r.init()
+	if _, err := run(r, false, 0, false, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(stop) })
+	start := time.Now()
+	if elapsed, err := run(r, true, time.Second, false, stop, nil); err != nil || elapsed != 0 {
+		t.Errorf("Want move stopped during the dead-time, got %v (%v)", elapsed, err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("Stop should interrupt the dead-time, waited %v", d)
+	}
+	if hw.Read(up) == Low {
+		t.Error("Relay up should not be energised after a stop during the dead-time")
+	}
+}
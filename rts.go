@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Constants for the buttons of a Somfy RTS remote
+const (
+	rtsMy   byte = 0x1 // Stops the motor, or moves it to its favourite position when it is not moving
+	rtsUp   byte = 0x2
+	rtsDown byte = 0x4
+	rtsProg byte = 0x8 // Pairs the remote with a motor that is in programming mode
+)
+
+// Timing of a Somfy RTS transmission
+const (
+	rtsSymbol     = 640 * time.Microsecond   // Half of a Manchester encoded bit
+	rtsWakeUp     = 9415 * time.Microsecond  // Wake-up pulse before the first frame
+	rtsWakeUpGap  = 89565 * time.Microsecond // Silence after the wake-up pulse
+	rtsSoftSync   = 4550 * time.Microsecond  // Software sync pulse before the data
+	rtsFrameGap   = 30415 * time.Microsecond // Silence after each frame
+	rtsRepeat     = 2                        // Number of times a frame is repeated
+	rtsFirstSyncs = 2                        // Hardware sync pulses before the first frame
+	rtsSyncs      = 7                        // Hardware sync pulses before a repeated frame
+)
+
+// RtsCodes holds the next rolling code per address of a virtual remote, it is guarded by muRTS.
+var rtsCodes = map[uint32]uint16{}
+
+// MuRTS guards rtsCodes and makes sure only one frame is transmitted at a time.
+var muRTS sync.Mutex
+
+// Pulse represents a period during which a pin is kept at a level.
+type pulse struct {
+	Level State
+	Dur   time.Duration
+}
+
+// Pulser is implemented by GPIO backends that can output a train of pulses themselves.
+type pulser interface {
+	Pulse(p Pin, pulses []pulse)
+}
+
+/* RtsFrame returns the obfuscated 7 byte frame a Somfy RTS remote with address
+sends when button is pressed with rolling code code. Byte 0 holds the key (0xA
+and the 4 lowest bits of the rolling code), byte 1 the button and checksum,
+bytes 2-3 the rolling code, most significant byte first, and bytes 4-6 the
+address, least significant byte first as receivers decode it. Each byte is then
+XORed with the previous obfuscated byte.*/
+func rtsFrame(button byte, code uint16, address uint32) [7]byte {
+	f := [7]byte{
+		0xA0 | byte(code&0x0F),
+		button << 4,
+		byte(code >> 8),
+		byte(code),
+		byte(address),
+		byte(address >> 8),
+		byte(address >> 16),
+	}
+	var checksum byte
+	for _, b := range f {
+		checksum ^= b ^ (b >> 4)
+	}
+	f[1] |= checksum & 0x0F
+	for i := 1; i < len(f); i++ {
+		f[i] ^= f[i-1]
+	}
+	return f
+}
+
+/* RtsPulses returns the pulses to transmit frame: a wake-up pulse, the frame
+itself and rtsRepeat repetitions, each preceded by hardware and software sync
+pulses. Bits are Manchester encoded, most significant bit first: a 1 is a rising
+edge and a 0 a falling edge halfway the bit.*/
+func rtsPulses(frame [7]byte) []pulse {
+	pulses := []pulse{{High, rtsWakeUp}, {Low, rtsWakeUpGap}}
+	for n := 0; n <= rtsRepeat; n++ {
+		syncs := rtsSyncs
+		if n == 0 {
+			syncs = rtsFirstSyncs
+		}
+		for i := 0; i < syncs; i++ {
+			pulses = append(pulses, pulse{High, 4 * rtsSymbol}, pulse{Low, 4 * rtsSymbol})
+		}
+		pulses = append(pulses, pulse{High, rtsSoftSync}, pulse{Low, rtsSymbol})
+		for i := 0; i < 8*len(frame); i++ {
+			if frame[i/8]>>(7-i%8)&1 == 1 {
+				pulses = append(pulses, pulse{Low, rtsSymbol}, pulse{High, rtsSymbol})
+			} else {
+				pulses = append(pulses, pulse{High, rtsSymbol}, pulse{Low, rtsSymbol})
+			}
+		}
+		pulses = append(pulses, pulse{Low, rtsFrameGap})
+	}
+	return pulses
+}
+
+/* Transmit outputs pulses on p. Backends that implement pulser output the
+pulses themselves, otherwise the pin is written at the scheduled times while
+busy waiting, as sleeping is not precise enough for the Manchester timing.*/
+func transmit(p Pin, pulses []pulse) {
+	if pl, ok := hw.(pulser); ok {
+		pl.Pulse(p, pulses)
+		return
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	start := time.Now()
+	var at time.Duration
+	for _, pl := range pulses {
+		hw.Write(p, pl.Level)
+		at += pl.Dur
+		if d := at - time.Since(start); d > 2*time.Millisecond {
+			time.Sleep(d - time.Millisecond)
+		}
+		for time.Since(start) < at {
+		}
+	}
+	hw.Write(p, Low)
+}
+
+/* NextRtsCode returns the rolling code to use for the virtual remote with
+address and stores the incremented code in fileRTS, so a code is never used
+twice, even if the program stops. The caller should hold muRTS.*/
+func nextRtsCode(address uint32) uint16 {
+	code, ok := rtsCodes[address]
+	if !ok {
+		code = 1
+	}
+	rtsCodes[address] = code + 1
+	SaveToJSON(rtsCodes, fileRTS)
+	return code
+}
+
+// LoadRtsCodes reads the rolling codes of all virtual remotes from fileRTS.
+func loadRtsCodes() error {
+	muRTS.Lock()
+	defer muRTS.Unlock()
+	rtsCodes = map[uint32]uint16{}
+	return readJSON(fileRTS, &rtsCodes)
+}
+
+// NewRtsAddress returns a random address for a virtual remote.
+func newRtsAddress() uint32 {
+	b := make([]byte, 3)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Unable to generate random RTS address: %v", err)
+	}
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2]) | 1
+}
+
+// RtsActuator drives a Somfy RTS motor by transmitting frames of a virtual remote through a 433 MHz transmitter.
+type rtsActuator struct {
+	pin     Pin    // GPIO pin of the transmitter
+	address uint32 // Address of the virtual remote
+}
+
+func newRtsActuator(pin Pin, address uint32) (*rtsActuator, error) {
+	if address == 0 || address > 0xFFFFFF {
+		return nil, fmt.Errorf("Address of RTS remote should be within range 0x000001-0xFFFFFF, got %#06x", address)
+	}
+	return &rtsActuator{pin: pin, address: address}, nil
+}
+
+func (a *rtsActuator) init() {
+	hw.Output(a.pin)
+	hw.Write(a.pin, Low)
+}
+
+func (a *rtsActuator) start(up bool) error {
+	if up {
+		a.send(rtsUp)
+	} else {
+		a.send(rtsDown)
+	}
+	return nil
+}
+
+// Halt sends My to stop the motor, unless it has stopped by itself at an end stop.
+func (a *rtsActuator) halt(atEnd bool) {
+	if !atEnd {
+		a.send(rtsMy)
+	}
+}
+
+/* Program sends Prog from the virtual remote of the sunscreen, which pairs the
+remote with the motor if the motor is in programming mode (e.g. after pressing
+Prog on an already paired remote).*/
+func (s *Sunscreen) program() error {
+	muSunscrn.Lock()
+	a, ok := s.actuator.(*rtsActuator)
+	name := s.Name
+	muSunscrn.Unlock()
+	if !ok {
+		return fmt.Errorf("Unable to program sunscreen '%v', actuator is not %v", name, actuatorRTS)
+	}
+	log.Printf("Sending prog for sunscreen '%v' from RTS address %#06x", name, a.address)
+	a.send(rtsProg)
+	return nil
+}
+
+// Send transmits a frame for button with the next rolling code of the virtual remote.
+func (a *rtsActuator) send(button byte) {
+	muRTS.Lock()
+	defer muRTS.Unlock()
+	code := nextRtsCode(a.address)
+	transmit(a.pin, rtsPulses(rtsFrame(button, code, a.address)))
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+/* DecodeRtsFrame decodes a received frame the way receivers do, e.g. the
+Somfy RTS decoder of rtl_433: it deobfuscates the frame, checks that the
+checksum folds to zero and reads the address least significant byte first.*/
+func decodeRtsFrame(f [7]byte) (key, button byte, code uint16, address uint32, ok bool) {
+	for i := len(f) - 1; i > 0; i-- {
+		f[i] ^= f[i-1]
+	}
+	var checksum byte
+	for _, b := range f {
+		checksum ^= b
+	}
+	checksum = (checksum & 0x0F) ^ (checksum >> 4)
+	if checksum != 0 || f[0]>>4 != 0xA {
+		return 0, 0, 0, 0, false
+	}
+	return f[0], f[1] >> 4, uint16(f[2])<<8 | uint16(f[3]), uint32(f[6])<<16 | uint32(f[5])<<8 | uint32(f[4]), true
+}
+
+func TestRtsFrame(t *testing.T) {
+	tests := []struct {
+		button  byte
+		code    uint16
+		address uint32
+	}{
+		{rtsUp, 0x1234, 0x123456},
+		{rtsDown, 0x0007, 0xABCDEF},
+		{rtsMy, 0xFFFF, 0x000001},
+		{rtsProg, 0, 0xFFFFFF},
+	}
+	for _, tt := range tests {
+		f := rtsFrame(tt.button, tt.code, tt.address)
+		key, button, code, address, ok := decodeRtsFrame(f)
+		if !ok || button != tt.button || code != tt.code || address != tt.address {
+			t.Errorf("rtsFrame(%#x, %#04x, %#06x) = % X: decoded %#x, %#04x, %#06x (ok %v)", tt.button, tt.code, tt.address, f, button, code, address, ok)
+		}
+		if key != 0xA0|byte(tt.code&0x0F) {
+			t.Errorf("Key of frame % X should hold the low nibble of rolling code %#04x", f, tt.code)
+		}
+		// A single bit error is detected by the checksum
+		for bit := 0; bit < 56; bit++ {
+			g := f
+			g[bit/8] ^= 1 << (bit % 8)
+			if k, b, c, a, ok := decodeRtsFrame(g); ok && k == key && b == tt.button && c == tt.code && a == tt.address {
+				t.Errorf("Frame % X with bit %v flipped should not decode to the same command", f, bit)
+			}
+		}
+	}
+}
+
+func TestRtsPulses(t *testing.T) {
+	frame := rtsFrame(rtsMy, 42, 0x1A2B3C)
+	pulses := rtsPulses(frame)
+	if pulses[0] != (pulse{High, rtsWakeUp}) || pulses[1] != (pulse{Low, rtsWakeUpGap}) {
+		t.Fatalf("Transmission should start with a wake-up pulse, got %v", pulses[:2])
+	}
+	i := 2
+	for n := 0; n <= rtsRepeat; n++ {
+		syncs := rtsSyncs
+		if n == 0 {
+			syncs = rtsFirstSyncs
+		}
+		for j := 0; j < syncs; j++ {
+			if pulses[i] != (pulse{High, 4 * rtsSymbol}) || pulses[i+1] != (pulse{Low, 4 * rtsSymbol}) {
+				t.Fatalf("Frame %v: want hardware sync %v, got %v", n, j, pulses[i:i+2])
+			}
+			i += 2
+		}
+		if pulses[i].Dur != rtsSoftSync {
+			t.Fatalf("Frame %v: want software sync, got %v", n, pulses[i])
+		}
+		i += 2
+		// Decode the Manchester encoded bits back into a frame
+		var got [7]byte
+		for b := 0; b < 56; b++ {
+			first, second := pulses[i], pulses[i+1]
+			if first.Dur != rtsSymbol || second.Dur != rtsSymbol || first.Level == second.Level {
+				t.Fatalf("Frame %v: bit %v is not Manchester encoded: %v", n, b, pulses[i:i+2])
+			}
+			if second.Level == High {
+				got[b/8] |= 1 << (7 - b%8)
+			}
+			i += 2
+		}
+		if got != frame {
+			t.Errorf("Frame %v: want % X, got % X", n, frame, got)
+		}
+		if pulses[i] != (pulse{Low, rtsFrameGap}) {
+			t.Errorf("Frame %v: want frame gap, got %v", n, pulses[i])
+		}
+		i++
+	}
+	if i != len(pulses) {
+		t.Errorf("Want %v pulses, got %v", i, len(pulses))
+	}
+}
+
+// resetRtsCodes clears the rolling codes of all virtual remotes, also at the end of the test.
+func resetRtsCodes(t *testing.T) {
+	reset := func() {
+		muRTS.Lock()
+		rtsCodes = map[uint32]uint16{}
+		muRTS.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestNextRtsCode(t *testing.T) {
+	inTempDir(t)
+	resetRtsCodes(t)
+	muRTS.Lock()
+	for want := uint16(1); want <= 3; want++ {
+		if got := nextRtsCode(0x123456); got != want {
+			t.Errorf("Want rolling code %v, got %v", want, got)
+		}
+	}
+	muRTS.Unlock()
+	if err := loadRtsCodes(); err != nil {
+		t.Fatal(err)
+	}
+	muRTS.Lock()
+	defer muRTS.Unlock()
+	if got := nextRtsCode(0x123456); got != 4 {
+		t.Errorf("Rolling code should be persisted, want 4 after reloading, got %v", got)
+	}
+	if got := nextRtsCode(0x654321); got != 1 {
+		t.Errorf("Each address should have its own rolling code, want 1, got %v", got)
+	}
+}
+
+func TestRtsActuator(t *testing.T) {
+	inTempDir(t)
+	resetRtsCodes(t)
+	sim := newSimGPIO()
+	hw = sim
+	pin := Pin{Line: 25}
+	if _, err := newRtsActuator(pin, 0); err == nil {
+		t.Errorf("Address 0 should be invalid")
+	}
+	a, err := newRtsActuator(pin, 0x123456)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.init()
+	buttons := func() []byte {
+		xb := []byte{}
+		for _, pulses := range sim.Trains(pin) {
+			// Decode the button from the first frame after the wake-up and sync pulses
+			i := 2 + 2*rtsFirstSyncs + 2
+			var f [7]byte
+			for b := 0; b < 16; b++ {
+				if pulses[i+2*b+1].Level == High {
+					f[b/8] |= 1 << (7 - b%8)
+				}
+			}
+			xb = append(xb, (f[1]^f[0])>>4)
+		}
+		return xb
+	}
+	// Stopped halfway, My stops the motor
+	if _, err := run(a, true, time.Millisecond, false, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := buttons(); len(got) != 2 || got[0] != rtsUp || got[1] != rtsMy {
+		t.Errorf("Stopping mid-way: want buttons [%v %v], got %v", rtsUp, rtsMy, got)
+	}
+	// Full travel to the end, the motor stops by itself so My would move it to its favourite position
+	if _, err := run(a, false, 0, true, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := buttons(); len(got) != 3 || got[2] != rtsDown {
+		t.Errorf("Travel to the end: want buttons [%v %v %v], got %v", rtsUp, rtsMy, rtsDown, got)
+	}
+	// Already stopped, nothing is sent
+	stop := make(chan struct{})
+	close(stop)
+	if _, err := run(a, true, time.Second, false, stop, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := buttons(); len(got) != 3 {
+		t.Errorf("Stopped command should not transmit, got buttons %v", got)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"io/ioutil"
@@ -14,33 +15,71 @@ import (
 
 	"github.com/kelvins/sunrisesunset"
 	"github.com/satori/go.uuid"
-	"github.com/stianeikeland/go-rpio/v4"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type Config struct {
-	RefreshRate time.Duration            // Number of seconds the main page should refresh
-	MoveHistory int                      // Number of sunscreen movements to be shown
-	LogRecords  int                      // Number of log records that are shown
-	Username    string                   // Username for logging in
-	Password    []byte                   // Password for logging in
-	IpWhitelist []string                 // Whitelisted IPs
-	Port        int                      // Port of the localhost
-	EnableMail  bool                     // Enable mail functionality
-	MailFrom    string                   // E-mail address from, often same as username
-	MailUser    string                   // E-mail Username
-	MailPass    string                   // E-mail Password
-	MailTo      []string                 // E-mail to
-	MailHost    string                   // E-mail host
-	MailPort    int                      // E-mail host port
-	Cert        string                   // location and name of cert.pem for HTTPS connection
-	Key         string                   // location and name of cert.pem for HTTPS connection
-	Location    sunrisesunset.Parameters // Contains Latiude, longitude, UtcOffset and Date for calculation when sun rises and sets
+	RefreshRate        time.Duration            // Number of seconds the main page should refresh
+	MoveHistory        int                      // Number of sunscreen movements to be shown
+	LogRecords         int                      // Number of log records that are shown
+	Username           string                   // Username for logging in
+	Password           []byte                   // Password for logging in
+	IpWhitelist        []string                 // Whitelisted IPs
+	Port               int                      // Port of the localhost
+	EnableMail         bool                     // Enable mail functionality
+	MailFrom           string                   // E-mail address from, often same as username
+	MailUser           string                   // E-mail Username
+	MailPass           string                   // E-mail Password
+	MailTo             []string                 // E-mail to
+	MailHost           string                   // E-mail host
+	MailPort           int                      // E-mail host port
+	EnableMqtt         bool                     // Enable MQTT integration
+	MqttHost           string                   // MQTT broker host
+	MqttPort           int                      // MQTT broker port, 1883 if 0
+	MqttUser           string                   // MQTT username, optional
+	MqttPass           string                   // MQTT password, optional
+	MqttTopic          string                   // Base topic of all MQTT messages, gosunscreen if empty
+	MqttDiscovery      bool                     // Publish Home Assistant discovery configuration
+	EnableInflux       bool                     // Push light and movements to InfluxDB
+	InfluxUrl          string                   // InfluxDB write endpoint, including database or bucket
+	InfluxToken        string                   // InfluxDB token, optional
+	EnableModbus       bool                     // Enable Modbus TCP server
+	ModbusPort         int                      // Modbus TCP port, 502 if 0
+	EnableHomekit      bool                     // Enable HomeKit bridge
+	HomekitName        string                   // Name of the HomeKit bridge, gosunscreen if empty
+	HomekitPort        int                      // HomeKit TCP port, 51826 if 0
+	EnableKnx          bool                     // Enable KNX integration
+	KnxGateway         string                   // KNXnet/IP gateway, host with optional port (3671 if omitted)
+	KnxLight           string                   // Optional KNX group address to which the light is published (DPT 9.004)
+	EnableWind         bool                     // Enable the anemometer
+	WindPin            Pin                      // GPIO input of the anemometer
+	WindFactor         float64                  // Wind speed in m/s per pulse per second
+	WindLock           float64                  // Wind speed in m/s at which all sunscreens are moved up and locked
+	WindRelease        float64                  // Wind speed in m/s below which the wind should stay to release the lock
+	WindCalm           time.Duration            // Duration the wind should stay below WindRelease to release the lock
+	EnableRain         bool                     // Enable the rain sensor
+	RainPin            Pin                      // GPIO input of the rain sensor
+	RainPolarity       string                   // State of the input when rain is detected: low or high
+	RainDebounce       time.Duration            // Duration the input should be stable before rain or dry weather is detected
+	RainDry            time.Duration            // Duration it should be dry to release the rain lock
+	EnableTemp         bool                     // Enable the temperature sensors
+	TempIndoor         string                   // Id of the indoor DS18B20 temperature sensor, e.g. 28-0316a2795aff
+	TempOutdoor        string                   // Id of the outdoor DS18B20 temperature sensor
+	EnableFrost        bool                     // Enable frost protection, which requires the outdoor temperature sensor
+	FrostTemp          float64                  // Outdoor temperature in °C below which the sunscreens are locked because of frost
+	EnableForecast     bool                     // Enable the weather forecast for Location
+	ForecastProvider   string                   // Provider of the weather forecast, i.e. open-meteo
+	ForecastUrl        string                   // Optional url of the forecast API instead of the default url of the provider
+	ForecastMaxTemp    float64                  // Forecast maximum temperature in °C above which sunscreens are lowered pre-emptively
+	ForecastCloudCover float64                  // Forecast cloud cover in percent below which sunscreens are lowered pre-emptively
+	Cert               string                   // location and name of cert.pem for HTTPS connection
+	Key                string                   // location and name of cert.pem for HTTPS connection
+	Location           sunrisesunset.Parameters // Contains Latiude, longitude, UtcOffset and Date for calculation when sun rises and sets
 }
 
 var (
 	tpl        *template.Template
-	fm         = template.FuncMap{"fdateHM": hourMinute, "fsliceString": sliceToString, "fminutes": minutes, "fseconds": seconds, "fspacecomma": spaceToComma}
+	fm         = template.FuncMap{"fdateHM": hourMinute, "fsliceString": sliceToString, "fminutes": minutes, "fseconds": seconds, "fmilliseconds": milliseconds, "fhex": hex, "fspacecomma": spaceToComma, "fsliceFusion": fusionPolicies, "fpresets": presetsToString, "ffloat": optionalFloat, "ftemp": temperature}
 	dbSessions = map[string]string{}
 )
 
@@ -63,12 +102,17 @@ func startServer() {
 	http.HandleFunc("/", handlerMain)
 	http.Handle("/favicon.ico", http.NotFoundHandler())
 	http.HandleFunc("/mode/", handlerMode)
+	http.HandleFunc("/command/", handlerCommand)
+	http.HandleFunc("/calibrate/", handlerCalibrate)
 	http.HandleFunc("/config/", handlerConfig)
 	http.HandleFunc("/log/", handlerLog)
 	http.HandleFunc("/login", handlerLogin)
 	http.HandleFunc("/logout", handlerLogout)
 	http.HandleFunc("/light", handlerLight)
 	http.HandleFunc("/stop", handlerStop)
+	http.HandleFunc("/events", handlerEvents)
+	http.HandleFunc("/metrics", handlerMetrics)
+	http.HandleFunc(apiPrefix, handlerAPI)
 	err := http.ListenAndServeTLS(":"+fmt.Sprint(port), cert, key, nil)
 	if err != nil {
 		log.Println("ERROR: Unable to launch TLS, launching without TLS...", err)
@@ -112,11 +156,70 @@ func handlerConfig(w http.ResponseWriter, req *http.Request) {
 	}
 	var err error
 	var msgs []string
-	//mu.Lock()
-	// defer mu.Unlock()
+	// Url options: '/config/add', '/config/delete/<id>', '/config/prog/<id>', '/config/sensor/add', '/config/sensor/delete/<id>' or '/config/homekit/reset'
+	url := strings.Split(req.URL.Path, "/")
+	switch fromSlice(url, 2) {
+	case "sensor":
+		muLS.Lock()
+		switch fromSlice(url, 3) {
+		case "add":
+			sn := ls.addSensor()
+			log.Printf("Added light sensor '%v'", sn.Name)
+		case "delete":
+			id, err := strToInt(fromSlice(url, 4))
+			if err != nil || !ls.deleteSensor(id) {
+				log.Printf("Unable to delete unknown light sensor '%v'", fromSlice(url, 4))
+			} else {
+				log.Printf("Deleted light sensor %v", id)
+			}
+		}
+		SaveToJSON(ls, fileLightsensor)
+		muLS.Unlock()
+		http.Redirect(w, req, "/config/", http.StatusSeeOther)
+		return
+	case "homekit":
+		if fromSlice(url, 3) == "reset" {
+			resetHomekit()
+		}
+		http.Redirect(w, req, "/config/", http.StatusSeeOther)
+		return
+	case "add":
+		s := newSunscreen()
+		muSunscrn.Lock()
+		saveSunscreens()
+		muSunscrn.Unlock()
+		updateStartStop(ls, 0)
+		log.Printf("Added sunscreen '%v'", s.Name)
+		http.Redirect(w, req, "/config/", http.StatusSeeOther)
+		return
+	case "prog":
+		id, err := strToInt(fromSlice(url, 3))
+		s := getSunscreen(id)
+		if err != nil || s == nil {
+			log.Printf("Unable to program unknown sunscreen '%v'", fromSlice(url, 3))
+		} else if err := s.program(); err != nil {
+			log.Println(err)
+		}
+		http.Redirect(w, req, "/config/", http.StatusSeeOther)
+		return
+	case "delete":
+		id, err := strToInt(fromSlice(url, 3))
+		if err != nil || !deleteSunscreen(id) {
+			log.Printf("Unable to delete unknown sunscreen '%v'", fromSlice(url, 3))
+		} else {
+			muSunscrn.Lock()
+			saveSunscreens()
+			muSunscrn.Unlock()
+			updateStartStop(ls, 0)
+			log.Printf("Deleted sunscreen %v", id)
+		}
+		http.Redirect(w, req, "/config/", http.StatusSeeOther)
+		return
+	}
 	if req.Method == http.MethodPost {
 		// Store lightsensor config
-		msgsNew := updateLightsensor(req)
+		muLS.Lock()
+		msgsNew := updateLightsensor(req, ls).messages()
 		if len(msgsNew) == 0 {
 			SaveToJSON(ls, fileLightsensor)
 			log.Println("Saved lightsensor")
@@ -125,25 +228,44 @@ func handlerConfig(w http.ResponseWriter, req *http.Request) {
 			log.Println(msg)
 			msgsNew = append(msgsNew, msg)
 		}
+		muLS.Unlock()
 		msgs = append(msgs, msgsNew...)
 
-		// Store sunscreen config
-		msgsNew = updateSunscreen(req)
-		if len(msgsNew) == 0 {
-			SaveToJSON(s, fileSunscrn)
-			log.Println("Saved sunscreen")
-		} else {
-			msg := "Unable to save Sunscreen, please correct errors"
-			log.Println(msg)
-			msgsNew = append(msgsNew, msg)
+		// Store sunscreens config
+		for _, s := range listSunscreens() {
+			muSunscrn.Lock()
+			errs, pinsChanged := updateSunscreen(req, s)
+			muSunscrn.Unlock()
+			s.resetAutoTime(0)
+			if pinsChanged {
+				s.init()
+			}
+			msgsNew = errs.messages()
+			if len(msgsNew) == 0 {
+				muSunscrn.Lock()
+				saveSunscreens()
+				log.Printf("Saved sunscreen '%v'", s.Name)
+				muSunscrn.Unlock()
+			} else {
+				msg := fmt.Sprintf("Unable to save Sunscreen '%v', please correct errors", s.Name)
+				log.Println(msg)
+				msgsNew = append(msgsNew, msg)
+			}
+			msgs = append(msgs, msgsNew...)
 		}
-		msgs = append(msgs, msgsNew...)
+		updateStartStop(ls, 0)
 
 		//Store general config
-		msgsNew = updateConfig(req)
+		muConf.Lock()
+		old := config
+		msgsNew = updateConfig(req, &config).messages()
 		if len(msgsNew) == 0 {
 			SaveToJSON(config, fileConfig)
+		}
+		muConf.Unlock()
+		if len(msgsNew) == 0 {
 			log.Println("Saved general config")
+			restartChangedServices(old)
 		} else {
 			msg := "Unable to save general config, please correct errors"
 			log.Println(msg)
@@ -154,17 +276,28 @@ func handlerConfig(w http.ResponseWriter, req *http.Request) {
 		log.Println("Updated configuration")
 	}
 
+	homekit, w1 := getHomekitStatus(), w1Sensors()
+	muConf.Lock()
+	muLS.Lock()
+	muSunscrn.Lock()
 	data := struct {
-		Sunscreen
+		Sunscreens []Sunscreen
 		LightSensor
 		Config
-		Msgs []string
+		Homekit   homekitStatus
+		W1Sensors []string
+		Msgs      []string
 	}{
-		*s,
+		copySunscreens(),
 		*ls,
 		config,
+		homekit,
+		w1,
 		msgs,
 	}
+	muSunscrn.Unlock()
+	muLS.Unlock()
+	muConf.Unlock()
 
 	err = tpl.ExecuteTemplate(w, "config.gohtml", data)
 	if err != nil {
@@ -267,6 +400,7 @@ func handlerMain(w http.ResponseWriter, req *http.Request) {
 	}
 
 	stats := readCSV(fileStats)
+	wind, rain, temp, frost, today := getWindStatus(), getRainStatus(), getTempStatus(), getFrostStatus(), cachedForecast(time.Now())
 	muConf.Lock()
 	if len(stats) != 0 {
 		stats = stats[MaxIntSlice(0, len(stats)-config.MoveHistory):]
@@ -277,22 +411,39 @@ func handlerMain(w http.ResponseWriter, req *http.Request) {
 	if ls != nil {
 		lighHistory = len(ls.Data)
 	}
+	stats = statsWithName(stats)
+	commands := map[int][]Command{}
+	for _, s := range sunscreens {
+		commands[s.Id] = s.commands()
+	}
 	data := struct {
-		S            Sunscreen
+		Sunscreens   []Sunscreen
+		Commands     map[int][]Command
 		LS           LightSensor
 		Time         string
 		RefreshRate  time.Duration
 		Stats        [][]string
 		MoveHistory  int
 		LightHistory int
+		Wind         windStatus
+		Rain         rainStatus
+		Temp         tempStatus
+		Frost        frostStatus
+		Forecast     *forecast
 	}{
-		*s,
+		copySunscreens(),
+		commands,
 		*ls,
 		time.Now().Format("_2 Jan 06 15:04:05"),
 		config.RefreshRate, //int(config.RefreshRate.Seconds()),
 		reverseXSS(stats),
 		config.MoveHistory,
 		lighHistory,
+		wind,
+		rain,
+		temp,
+		frost,
+		today,
 	}
 	muSunscrn.Unlock()
 	muLS.Unlock()
@@ -325,52 +476,166 @@ func handlerLight(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-// HandlerMode sets the mode for the sunscreen, i.e. auto, or manual
+/* HandlerMode sets the mode for a sunscreen, i.e. auto, or manual. If the url
+does not contain the Id of a sunscreen, the mode is set for all sunscreens.*/
 func handlerMode(w http.ResponseWriter, req *http.Request) {
 	if !alreadyLoggedIn(req) {
 		http.Redirect(w, req, "/login", http.StatusSeeOther)
 		return
 	}
-	// Url options: '/mode/auto" or '/mode/manual/up' or '/mode/manual/down'
+	// Url options: '/mode/<id>/auto" or '/mode/<id>/manual/up' or '/mode/<id>/manual/down' or '/mode/<id>/manual/stop'
 	url := strings.Split(req.URL.Path, "/")
+	screens := listSunscreens()
+	if id, err := strconv.Atoi(fromSlice(url, 2)); err == nil {
+		s := getSunscreen(id)
+		if s == nil {
+			log.Println("Unknown sunscreen:", req.URL.Path)
+			http.Redirect(w, req, "/", http.StatusFound)
+			return
+		}
+		screens = []*Sunscreen{s}
+		url = append(url[:2], url[3:]...)
+	}
 	mode := fromSlice(url, 2)
+	// Position is up, down, stop, a preset, a percentage or the form value Percent
+	newPos := fromSlice(url, 3)
+	if newPos == "" {
+		newPos = req.FormValue("Percent")
+	}
+	// The form value confirm confirms a movement during a frost lock
+	confirmed := req.FormValue("confirm") == "true"
 	muSunscrn.Lock()
-	switch mode {
-	case auto:
-		if s.Mode != auto {
-			s.Mode = auto
-			SaveToJSON(s, fileSunscrn)
-			log.Printf("Set mode to auto (%v)\n", s.Mode)
-		} else {
-			log.Printf("Mode is already auto (%v)\n", s.Mode)
-		}
-	case manual:
-		if s.Mode != manual {
-			log.Println("Mode is set to manual")
-			s.Mode = manual
-			SaveToJSON(s, fileSunscrn)
-		}
-		newPos := fromSlice(url, 3)
-		switch newPos {
-		case up:
-			go s.Up()
-		case down:
-			go s.Down()
-		default:
-			log.Printf("Unknown command for manual position: '%v'", newPos)
+	for _, s := range screens {
+		if _, err := s.setMode(mode, newPos, srcWeb, confirmed); err != nil {
+			log.Println(err)
 		}
-	default:
-		log.Println("Unknown mode:", req.URL.Path)
 	}
 	muSunscrn.Unlock()
-	// TODO: remove this log? log.Println("Mode=", site.Sunscreens[i].Mode, "and Position=", site.Sunscreens[i].Position)
 	http.Redirect(w, req, "/", http.StatusFound)
 }
 
+func handlerCommand(w http.ResponseWriter, req *http.Request) {
+	if !alreadyLoggedIn(req) {
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return
+	}
+	// Url options: '/command/cancel/<id>'
+	url := strings.Split(req.URL.Path, "/")
+	id, err := strconv.Atoi(fromSlice(url, 3))
+	switch {
+	case fromSlice(url, 2) != "cancel" || err != nil:
+		log.Println("Unknown command request:", req.URL.Path)
+	case !cancelCommand(id):
+		log.Printf("Command %v is not queued or running", id)
+	}
+	http.Redirect(w, req, "/", http.StatusFound)
+}
+
+/* HandlerCalibrate shows the calibration wizard of a sunscreen and carries out
+the calibration actions. If the request accepts application/json, the state of
+the calibration is returned as JSON instead, so the wizard can be used as an API.*/
+func handlerCalibrate(w http.ResponseWriter, req *http.Request) {
+	if !alreadyLoggedIn(req) {
+		http.Redirect(w, req, "/login", http.StatusSeeOther)
+		return
+	}
+	// Url options: '/calibrate/<id>' or '/calibrate/<id>/<action>' with action start, next, stop, save or cancel
+	url := strings.Split(req.URL.Path, "/")
+	id, err := strToInt(fromSlice(url, 2))
+	s := getSunscreen(id)
+	if err != nil || s == nil {
+		log.Println("Unknown sunscreen:", req.URL.Path)
+		http.Redirect(w, req, "/config/", http.StatusFound)
+		return
+	}
+	var msgs []string
+	action := fromSlice(url, 3)
+	muSunscrn.Lock()
+	if action != "" {
+		if err := s.calibrate(action); err != nil {
+			log.Println(err)
+			msgs = append(msgs, err.Error())
+		}
+	}
+	data := struct {
+		Id          int
+		Name        string
+		Position    string
+		DurDown     time.Duration
+		DurUp       time.Duration
+		Calibration *Calibration
+		Msgs        []string
+	}{
+		Id:       s.Id,
+		Name:     s.Name,
+		Position: s.positionText(),
+		DurDown:  s.DurDown,
+		DurUp:    s.DurUp,
+		Msgs:     msgs,
+	}
+	if s.calibration != nil {
+		cal := *s.calibration
+		data.Calibration = &cal
+	}
+	muSunscrn.Unlock()
+	if strings.Contains(req.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		if len(msgs) != 0 {
+			w.WriteHeader(http.StatusConflict)
+		}
+		json.NewEncoder(w).Encode(data)
+		return
+	}
+	if action != "" && len(msgs) == 0 {
+		http.Redirect(w, req, fmt.Sprintf("/calibrate/%v", s.Id), http.StatusFound)
+		return
+	}
+	err = tpl.ExecuteTemplate(w, "calibrate.gohtml", data)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+/* StatsWithName takes the movement stats and replaces the Id of the sunscreen in
+the last column by its name. Stats stored before multiple sunscreens were
+supported get an empty name. The caller should hold muSunscrn.*/
+func statsWithName(stats [][]string) [][]string {
+	names := map[string]string{}
+	for _, s := range sunscreens {
+		names[fmt.Sprint(s.Id)] = s.Name
+	}
+	xxs := [][]string{}
+	for _, xs := range stats {
+		row := make([]string, 6)
+		copy(row, xs)
+		if name, ok := names[row[4]]; ok {
+			row[4] = name
+		}
+		xxs = append(xxs, row)
+	}
+	return xxs
+}
+
 func hourMinute(t time.Time) string {
 	return t.Format("15:04")
 }
 
+// OptionalFloat formats a number for a form, or returns an empty string if there is no number.
+func optionalFloat(f *float64) string {
+	if f == nil {
+		return ""
+	}
+	return fmt.Sprint(*f)
+}
+
+// Temperature formats a temperature for a page, or returns "-" if the temperature is unavailable.
+func temperature(c *float64) string {
+	if c == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f °C", *c)
+}
+
 func minutes(d time.Duration) string {
 	return fmt.Sprint(d.Minutes())
 }
@@ -379,6 +644,17 @@ func seconds(d time.Duration) string {
 	return fmt.Sprint(d.Seconds())
 }
 
+func milliseconds(d time.Duration) string {
+	return fmt.Sprint(d.Milliseconds())
+}
+
+func hex(x uint32) string {
+	if x == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%#06x", x)
+}
+
 func sliceToString(xs []string) string {
 	return strings.Join(xs, ",")
 }
@@ -419,6 +695,9 @@ func alreadyLoggedIn(req *http.Request) bool {
 // StoTime receives a string of time (format hh:mm) and a day offset, and returns a type time with today's and the supplied hours and minutes + the offset in days
 func stoTime(t string, days int) (time.Time, error) {
 	timeNow := time.Now()
+	if len(t) != 5 || t[2] != ':' {
+		return time.Time{}, fmt.Errorf("Time '%v' should be formatted as hh:mm", t)
+	}
 	timeHour, err := strconv.Atoi(t[:2])
 	if err != nil {
 		return time.Time{}, err
@@ -431,116 +710,271 @@ func stoTime(t string, days int) (time.Time, error) {
 	return time.Date(timeNow.Year(), timeNow.Month(), timeNow.Day()+days, int(timeHour), int(timeMinute), 0, 0, time.Local), nil
 }
 
-func updateSunscreen(req *http.Request) []string {
-	muSunscrn.Lock()
-	if s == nil {
-		s = &Sunscreen{}
+// FieldError represents an invalid value of a form or API field.
+type fieldError struct {
+	Field   string
+	Message string
+}
+
+// FormErrors holds the validation errors of a form.
+type formErrors []fieldError
+
+// Messages returns the messages of all errors, e.g. for showing them on a page.
+func (errs formErrors) messages() []string {
+	msgs := []string{}
+	for _, e := range errs {
+		msgs = append(msgs, e.Message)
 	}
-	var msgs []string
-	appendMsgs := func(msg string) {
-		msgs = append(msgs, msg)
+	return msgs
+}
+
+/* UpdateSunscreen reads, validates and stores the config of sunscreen s. The
+form fields of a sunscreen are suffixed with its Id, e.g. "DurUp-1". It returns
+true if the actuator or limit switches have changed, so the sunscreen should be
+initiated again. The caller should hold muSunscrn.*/
+func updateSunscreen(req *http.Request, s *Sunscreen) (formErrors, bool) {
+	var msgs formErrors
+	appendMsgs := func(field, msg string) {
+		msgs = append(msgs, fieldError{field, msg})
 		log.Println(msg)
 	}
-	if req.PostFormValue("AutoStart") == "" {
+	formValue := func(key string) string {
+		return req.PostFormValue(fmt.Sprintf("%v-%v", key, s.Id))
+	}
+	if name := strings.TrimSpace(formValue("Name")); name != "" {
+		s.Name = name
+	}
+	if sensor, err := strToInt(formValue("Sensor")); err != nil {
+		appendMsgs("Sensor", fmt.Sprintf("Unable to save Sensor '%v' (%v)", formValue("Sensor"), err))
+	} else {
+		s.Sensor = sensor
+	}
+	if formValue("AutoStart") == "" {
 		s.AutoStart = false
-		start, err := stoTime(req.PostFormValue("Start"), 0)
+		start, err := stoTime(formValue("Start"), 0)
 		if err != nil {
-			appendMsgs(fmt.Sprintf("Unable to save Start time '%v' (%v)", start, err))
+			appendMsgs("Start", fmt.Sprintf("Unable to save Start time '%v' (%v)", start, err))
 		} else {
 			s.Start = start
 		}
 	} else {
 		s.AutoStart = true
-		sunStart, err := time.ParseDuration(req.PostFormValue("SunStart") + "m")
+		sunStart, err := time.ParseDuration(formValue("SunStart") + "m")
 		if err != nil {
-			appendMsgs(fmt.Sprintf("Unable to save SunStart '%v' (%v)", sunStart, err))
+			appendMsgs("SunStart", fmt.Sprintf("Unable to save SunStart '%v' (%v)", sunStart, err))
 		} else {
 			s.SunStart = sunStart
 		}
 	}
-	if req.PostFormValue("AutoStop") == "" {
+	if formValue("AutoStop") == "" {
 		s.AutoStop = false
-		stop, err := stoTime(req.PostFormValue("Stop"), 0)
+		stop, err := stoTime(formValue("Stop"), 0)
 		if err != nil {
-			appendMsgs(fmt.Sprintf("Unable to save Stop time '%v' (%v)", stop, err))
+			appendMsgs("Stop", fmt.Sprintf("Unable to save Stop time '%v' (%v)", stop, err))
 		} else {
 			s.Stop = stop
 		}
 	} else {
 		s.AutoStop = true
-		sunStop, err := time.ParseDuration(req.PostFormValue("SunStop") + "m")
+		sunStop, err := time.ParseDuration(formValue("SunStop") + "m")
 		if err != nil {
-			appendMsgs(fmt.Sprintf("Unable to save SunStart '%v' (%v)", sunStop, err))
+			appendMsgs("SunStop", fmt.Sprintf("Unable to save SunStart '%v' (%v)", sunStop, err))
 		} else {
 			s.SunStop = sunStop
 		}
 	}
-	muSunscrn.Unlock()
-	s.resetAutoTime(0)
-	muSunscrn.Lock()
-	stopLimit, err := time.ParseDuration(req.PostFormValue("StopLimit") + "m")
+	stopLimit, err := time.ParseDuration(formValue("StopLimit") + "m")
 	if err != nil {
-		appendMsgs(fmt.Sprintf("Unable to save StopLimit '%v' (%v)", stopLimit, err))
+		appendMsgs("StopLimit", fmt.Sprintf("Unable to save StopLimit '%v' (%v)", stopLimit, err))
 	} else {
 		s.StopLimit = stopLimit
 	}
-	durDown, err := time.ParseDuration(req.PostFormValue("DurDown") + "s")
+	durDown, err := time.ParseDuration(formValue("DurDown") + "s")
 	if err != nil {
-		appendMsgs(fmt.Sprintf("Unable to save DurDown '%v' (%v)", durDown, err))
+		appendMsgs("DurDown", fmt.Sprintf("Unable to save DurDown '%v' (%v)", durDown, err))
 	} else {
 		s.DurDown = durDown
 	}
-	durUp, err := time.ParseDuration(req.PostFormValue("DurUp") + "s")
+	durUp, err := time.ParseDuration(formValue("DurUp") + "s")
 	if err != nil {
-		appendMsgs(fmt.Sprintf("Unable to save DurUp '%v' (%v)", durUp, err))
+		appendMsgs("DurUp", fmt.Sprintf("Unable to save DurUp '%v' (%v)", durUp, err))
 	} else {
 		s.DurUp = durUp
 	}
-	pinDown, err := strToInt(req.PostFormValue("PinDown"))
-	if !(pinDown > 0 && pinDown < 28) || err != nil {
-		appendMsgs(fmt.Sprintf("Unable to save Led Pin '%v' (%v)", pinDown, err))
+	presets, err := parsePresets(formValue("Presets"))
+	if err != nil {
+		appendMsgs("Presets", fmt.Sprintf("Unable to save Presets (%v)", err))
 	} else {
-		s.PinDown = rpio.Pin(pinDown)
+		s.Presets = presets
 	}
-	pinUp, err := strToInt(req.PostFormValue("PinUp"))
-	if !(pinUp > 0 && pinUp < 28) || err != nil {
-		appendMsgs(fmt.Sprintf("Unable to save Led Pin '%v' (%v)", pinUp, err))
+	autoPreset := strings.TrimSpace(formValue("AutoPreset"))
+	if _, ok := s.preset(autoPreset); autoPreset != "" && !ok {
+		appendMsgs("AutoPreset", fmt.Sprintf("Unable to save Auto preset, unknown preset '%v'", autoPreset))
 	} else {
-		s.PinUp = rpio.Pin(pinUp)
+		s.AutoPreset = autoPreset
 	}
-	muSunscrn.Unlock()
-	return msgs
+	rehome, err := strToInt(formValue("Rehome"))
+	if err != nil {
+		appendMsgs("Rehome", fmt.Sprintf("Unable to save Rehome '%v' (%v)", formValue("Rehome"), err))
+	} else {
+		s.Rehome = rehome
+	}
+	pinsChanged := false
+	switch actuator := formValue("Actuator"); actuator {
+	case actuatorRelay, actuatorRTS, actuatorHTTP:
+		pinsChanged = pinsChanged || actuator != s.Actuator
+		s.Actuator = actuator
+	default:
+		appendMsgs("Actuator", fmt.Sprintf("Unable to save Actuator '%v', should be %v, %v or %v", actuator, actuatorRelay, actuatorRTS, actuatorHTTP))
+	}
+	switch device := formValue("Device"); device {
+	case deviceShelly, deviceTasmota:
+		pinsChanged = pinsChanged || device != s.Device
+		s.Device = device
+	default:
+		appendMsgs("Device", fmt.Sprintf("Unable to save Device '%v', should be %v or %v", device, deviceShelly, deviceTasmota))
+	}
+	if deviceUrl := strings.TrimSpace(formValue("DeviceUrl")); deviceUrl != "" || s.Actuator == actuatorHTTP {
+		if err := checkDeviceUrl(deviceUrl); err != nil {
+			appendMsgs("DeviceUrl", fmt.Sprintf("Unable to save Device url (%v)", err))
+		} else if deviceUrl != s.DeviceUrl {
+			s.DeviceUrl = deviceUrl
+			pinsChanged = true
+		}
+	}
+	if v := formValue("RtsPin"); v != "" || s.Actuator == actuatorRTS {
+		rtsPin, err := readPin(v)
+		if err != nil {
+			appendMsgs("RtsPin", fmt.Sprintf("Unable to save RTS transmitter pin '%v' (%v)", v, err))
+		} else if rtsPin != s.RtsPin {
+			s.RtsPin = rtsPin
+			pinsChanged = true
+		}
+	}
+	if v := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(formValue("RtsAddress"))), "0x"); v != "" {
+		address, err := strconv.ParseUint(v, 16, 24)
+		if err != nil || address == 0 {
+			appendMsgs("RtsAddress", fmt.Sprintf("Unable to save RTS address '%v', should be a hexadecimal number within range 0x000001-0xFFFFFF", formValue("RtsAddress")))
+		} else if uint32(address) != s.RtsAddress {
+			s.RtsAddress = uint32(address)
+			pinsChanged = true
+		}
+	} else if s.Actuator == actuatorRTS && s.RtsAddress == 0 {
+		s.RtsAddress = newRtsAddress()
+		pinsChanged = true
+		log.Printf("Generated RTS address %#06x for sunscreen '%v'", s.RtsAddress, s.Name)
+	}
+	switch polarity := formValue("Polarity"); polarity {
+	case activeLow, activeHigh:
+		pinsChanged = pinsChanged || polarity != s.Polarity
+		s.Polarity = polarity
+	default:
+		appendMsgs("Polarity", fmt.Sprintf("Unable to save Polarity '%v', should be %v or %v", polarity, activeLow, activeHigh))
+	}
+	deadTime, err := time.ParseDuration(formValue("DeadTime") + "ms")
+	if err != nil || deadTime < 0 {
+		appendMsgs("DeadTime", fmt.Sprintf("Unable to save Dead-time '%v' (should be a positive number of milliseconds)", formValue("DeadTime")))
+	} else {
+		pinsChanged = pinsChanged || deadTime != s.DeadTime
+		s.DeadTime = deadTime
+	}
+	pinDown, err := readPin(formValue("PinDown"))
+	if err != nil {
+		appendMsgs("PinDown", fmt.Sprintf("Unable to save Pin Down '%v' (%v)", pinDown, err))
+	} else if pinDown != s.PinDown {
+		s.PinDown = pinDown
+		pinsChanged = true
+	}
+	pinUp, err := readPin(formValue("PinUp"))
+	if err != nil {
+		appendMsgs("PinUp", fmt.Sprintf("Unable to save Pin Up '%v' (%v)", pinUp, err))
+	} else if pinUp != s.PinUp {
+		s.PinUp = pinUp
+		pinsChanged = true
+	}
+	for _, limit := range []struct {
+		key string
+		pin **Pin
+	}{{"LimitUp", &s.LimitUp}, {"LimitDown", &s.LimitDown}} {
+		p, err := readOptionalPin(formValue(limit.key))
+		switch {
+		case err != nil:
+			appendMsgs(limit.key, fmt.Sprintf("Unable to save %v '%v' (%v)", limit.key, formValue(limit.key), err))
+		case p != nil && s.Actuator == actuatorRelay && (*p == s.PinUp || *p == s.PinDown):
+			appendMsgs(limit.key, fmt.Sprintf("Unable to save %v '%v', pin is used for a relay", limit.key, p))
+		case p != nil && s.Actuator == actuatorRTS && *p == s.RtsPin:
+			appendMsgs(limit.key, fmt.Sprintf("Unable to save %v '%v', pin is used for the RTS transmitter", limit.key, p))
+		case !samePin(p, *limit.pin):
+			*limit.pin = p
+			pinsChanged = true
+		}
+	}
+	s.IgnoreRain = formValue("IgnoreRain") != ""
+	s.ForecastLower = formValue("ForecastLower") != ""
+	for _, t := range []struct {
+		key   string
+		value **float64
+	}{{"IndoorMin", &s.IndoorMin}, {"IndoorMax", &s.IndoorMax}, {"OutdoorMin", &s.OutdoorMin}, {"OutdoorMax", &s.OutdoorMax}} {
+		f, err := readOptionalFloat(formValue(t.key))
+		if err != nil {
+			appendMsgs(t.key, fmt.Sprintf("Unable to save %v '%v' (should be a temperature in °C or empty)", t.key, formValue(t.key)))
+		} else {
+			*t.value = f
+		}
+	}
+	for _, knx := range []struct {
+		key string
+		ga  *string
+	}{{"KnxUpDown", &s.KnxUpDown}, {"KnxStop", &s.KnxStop}, {"KnxPosition", &s.KnxPosition}, {"KnxState", &s.KnxState}} {
+		v := strings.TrimSpace(formValue(knx.key))
+		if v == "" {
+			*knx.ga = ""
+		} else if ga, err := parseGroupAddr(v); err != nil {
+			appendMsgs(knx.key, fmt.Sprintf("Unable to save %v (%v)", knx.key, err))
+		} else {
+			*knx.ga = ga.String()
+		}
+	}
+	limitTimeout, err := time.ParseDuration(formValue("LimitTimeout") + "s")
+	if err != nil || limitTimeout < 0 {
+		appendMsgs("LimitTimeout", fmt.Sprintf("Unable to save LimitTimeout '%v' (should be a positive number of seconds)", formValue("LimitTimeout")))
+	} else {
+		s.LimitTimeout = limitTimeout
+	}
+	if pinsChanged && s.Actuator == actuatorRelay && s.PinUp == s.PinDown {
+		appendMsgs("PinUp", fmt.Sprintf("Pin up and pin down of sunscreen '%v' should be different pins", s.Name))
+	}
+	return msgs, pinsChanged
 }
 
-// UpdateLightsensor reads, validates and stores light sensor
-func updateLightsensor(req *http.Request) []string {
-	var msgs []string
-	appendMsgs := func(msg string) {
-		msgs = append(msgs, msg)
+// UpdateLightsensor reads, validates and stores the light sensor config in l. The caller should hold muLS.
+func updateLightsensor(req *http.Request, l *LightSensor) formErrors {
+	var msgs formErrors
+	appendMsgs := func(field, msg string) {
+		msgs = append(msgs, fieldError{field, msg})
 		log.Println(msg)
 	}
-	muLS.Lock()
 	good, err := strToInt(req.PostFormValue("Good"))
 	if err != nil {
-		appendMsgs(fmt.Sprintf("Unable to save Light Good Value: %v", err))
+		appendMsgs("Good", fmt.Sprintf("Unable to save Light Good Value: %v", err))
 	}
 	neutral, err := strToInt(req.PostFormValue("Neutral"))
 	if err != nil {
-		appendMsgs(fmt.Sprintf("Unable to save Light Neutral Value: %v", err))
+		appendMsgs("Neutral", fmt.Sprintf("Unable to save Light Neutral Value: %v", err))
 	}
 	bad, err := strToInt(req.PostFormValue("Bad"))
 	if err != nil {
-		appendMsgs(fmt.Sprintf("Unable to save Light Bad Value: %v", err))
+		appendMsgs("Bad", fmt.Sprintf("Unable to save Light Bad Value: %v", err))
 	}
 	if (good < neutral && neutral < bad) && err == nil {
-		ls.Good = good
-		ls.Neutral = neutral
-		ls.Bad = bad
+		l.Good = good
+		l.Neutral = neutral
+		l.Bad = bad
 	} else {
 		if err != nil {
-			appendMsgs(fmt.Sprintf("Error while reading light values: %v", err))
+			appendMsgs("Good", fmt.Sprintf("Error while reading light values: %v", err))
 		} else {
-			appendMsgs(fmt.Sprintf("Light values incorrect, (good<neutral<bad): %v<%v<%v", good, neutral, bad))
+			appendMsgs("Good", fmt.Sprintf("Light values incorrect, (good<neutral<bad): %v<%v<%v", good, neutral, bad))
 		}
 	}
 	// Light Threshold
@@ -548,156 +982,356 @@ func updateLightsensor(req *http.Request) []string {
 		LightMin := 5
 		timesGood, err := strToInt(req.PostFormValue("TimesGood"))
 		if err != nil {
-			appendMsgs(fmt.Sprintf("Error reading Light Times Good: %v", err))
+			appendMsgs("TimesGood", fmt.Sprintf("Error reading Light Times Good: %v", err))
 		} else {
 			if timesGood < LightMin {
-				appendMsgs(fmt.Sprintf("Light Times Good should be minimum %v (was %v)", LightMin, timesGood))
+				appendMsgs("TimesGood", fmt.Sprintf("Light Times Good should be minimum %v (was %v)", LightMin, timesGood))
 				timesGood = LightMin
 			}
-			ls.TimesGood = timesGood
+			l.TimesGood = timesGood
 		}
 		timesNeutral, err := strToInt(req.PostFormValue("TimesNeutral"))
 		if err != nil {
-			appendMsgs(fmt.Sprintf("Error reading Light Times Neutral: %v", err))
+			appendMsgs("TimesNeutral", fmt.Sprintf("Error reading Light Times Neutral: %v", err))
 		} else {
 			if timesNeutral < LightMin {
-				appendMsgs(fmt.Sprint("Light Times Neutral should be minimum %v (was %v)", LightMin, timesNeutral))
+				appendMsgs("TimesNeutral", fmt.Sprintf("Light Times Neutral should be minimum %v (was %v)", LightMin, timesNeutral))
 				timesNeutral = LightMin
 			}
-			ls.TimesNeutral = timesNeutral
+			l.TimesNeutral = timesNeutral
 		}
 		timesBad, err := strToInt(req.PostFormValue("TimesBad"))
 		if err != nil {
-			appendMsgs(fmt.Sprintf("Error reading Light Times Bad: %v", err))
+			appendMsgs("TimesBad", fmt.Sprintf("Error reading Light Times Bad: %v", err))
 		} else {
 			if timesBad < LightMin {
-				appendMsgs(fmt.Sprint("Light Times Bad should be minimum %v (was %v)", LightMin, timesBad))
+				appendMsgs("TimesBad", fmt.Sprintf("Light Times Bad should be minimum %v (was %v)", LightMin, timesBad))
 				timesBad = LightMin
 			}
-			ls.TimesBad = timesBad
+			l.TimesBad = timesBad
 		}
 	}
 	outliers, err := strToInt(req.PostFormValue("Outliers"))
 	if err != nil {
-		appendMsgs(fmt.Sprintf("Error reading Outliers ('%v'): %v", outliers, err))
+		appendMsgs("Outliers", fmt.Sprintf("Error reading Outliers ('%v'): %v", outliers, err))
 	} else {
-		ls.Outliers = outliers
+		l.Outliers = outliers
 	}
-	lightFactor, err := strToInt(req.PostFormValue("LightFactor"))
-	if err != nil || lightFactor == 0 {
-		appendMsgs(fmt.Sprintf("LightFactor (%v) should a number greater than zero: %v", lightFactor, err))
+	fusion := req.PostFormValue("Fusion")
+	if !validFusion(fusion) {
+		appendMsgs("Fusion", fmt.Sprintf("Unable to save Fusion '%v', should be %v, %v, %v or %v", fusion, fusionMedian, fusionMin, fusionMax, fusionScreen))
 	} else {
-		ls.LightFactor = lightFactor
+		l.Fusion = fusion
 	}
-	pin, err := strToInt(req.PostFormValue("PinLight"))
-	if !(pin > 0 && pin < 28) || err != nil {
-		appendMsgs(fmt.Sprintf("Unable to save Led Pin '%v' (%v)", pin, err))
-	} else {
-		ls.Pin = rpio.Pin(pin)
+	// Sensors, the form fields of a sensor are suffixed with its Id, e.g. "SensorPin-1"
+	for i := range l.Sensors {
+		sn := &l.Sensors[i]
+		formValue := func(key string) string {
+			return req.PostFormValue(fmt.Sprintf("%v-%v", key, sn.Id))
+		}
+		if name := strings.TrimSpace(formValue("SensorName")); name != "" {
+			sn.Name = name
+		}
+		lightFactor, err := strToInt(formValue("LightFactor"))
+		if err != nil || lightFactor == 0 {
+			appendMsgs(fmt.Sprintf("LightFactor-%v", sn.Id), fmt.Sprintf("LightFactor (%v) of '%v' should a number greater than zero: %v", lightFactor, sn.Name, err))
+		} else {
+			sn.LightFactor = lightFactor
+		}
+		pin, err := readPin(formValue("SensorPin"))
+		if err != nil {
+			appendMsgs(fmt.Sprintf("SensorPin-%v", sn.Id), fmt.Sprintf("Unable to save Light Pin '%v' of '%v' (%v)", pin, sn.Name, err))
+		} else {
+			sn.Pin = pin
+		}
 	}
 	interval, err := time.ParseDuration(req.PostFormValue("Interval") + "s")
 	if err != nil || interval < IntervalMin {
-		appendMsgs(fmt.Sprintf("Unable to save Interval '%v', should be minimal %v seconds (%v)", interval, IntervalMin, err))
+		appendMsgs("Interval", fmt.Sprintf("Unable to save Interval '%v', should be minimal %v seconds (%v)", interval, IntervalMin, err))
 	} else {
-		ls.Interval = interval
+		l.Interval = interval
 	}
-	muLS.Unlock()
 	return msgs
 }
 
-// UpdateConfig reads, validates and stores config
-func updateConfig(req *http.Request) []string {
-	var msgs []string
-	appendMsgs := func(msg string) {
-		msgs = append(msgs, msg)
+// UpdateConfig reads, validates and stores the general config in c. The caller should hold muConf.
+func updateConfig(req *http.Request, c *Config) formErrors {
+	var msgs formErrors
+	appendMsgs := func(field, msg string) {
+		msgs = append(msgs, fieldError{field, msg})
 		log.Println(msg)
 	}
-	muConf.Lock()
 	// Read, validate and store config
 	refreshRate, err := time.ParseDuration(req.PostFormValue("RefreshRate") + "m")
 	if err != nil {
-		appendMsgs(fmt.Sprintf("Unable to save RefreshRate '%v' (%v)", refreshRate, err))
+		appendMsgs("RefreshRate", fmt.Sprintf("Unable to save RefreshRate '%v' (%v)", refreshRate, err))
 	} else {
-		config.RefreshRate = refreshRate
+		c.RefreshRate = refreshRate
 	}
 	moveHistory, err := strToInt(req.PostFormValue("MoveHistory"))
 	if err != nil {
-		appendMsgs(fmt.Sprintf("Unable to save MoveHistory (%v)", err))
+		appendMsgs("MoveHistory", fmt.Sprintf("Unable to save MoveHistory (%v)", err))
 	} else {
-		config.MoveHistory = moveHistory
+		c.MoveHistory = moveHistory
 	}
 	logRecords, err := strToInt(req.PostFormValue("LogRecords"))
 	if err != nil {
-		appendMsgs(fmt.Sprintf("Unable to save LogRecords (%v)", err))
+		appendMsgs("LogRecords", fmt.Sprintf("Unable to save LogRecords (%v)", err))
 	} else {
-		config.LogRecords = logRecords
+		c.LogRecords = logRecords
 	}
-	config.IpWhitelist = stringToSlice(req.PostFormValue("IpWhitelist"))
+	c.IpWhitelist = stringToSlice(req.PostFormValue("IpWhitelist"))
 	port, err := strToInt(req.PostFormValue("Port"))
 	if err != nil || !(port >= 1000 && port <= 9999) {
-		appendMsgs(fmt.Sprintf("Unable to save port '%v', should be within range 1000-9999 (%v)", port, err))
+		appendMsgs("Port", fmt.Sprintf("Unable to save port '%v', should be within range 1000-9999 (%v)", port, err))
 	} else {
-		config.Port = port
+		c.Port = port
 	}
-	config.Cert = req.PostFormValue("Cert")
-	config.Key = req.PostFormValue("Key")
-	if req.PostFormValue("Username") != "" && req.PostFormValue("Username") != config.Username {
-		err = bcrypt.CompareHashAndPassword(config.Password, []byte(req.PostFormValue("CurrentPassword")))
+	c.Cert = req.PostFormValue("Cert")
+	c.Key = req.PostFormValue("Key")
+	if req.PostFormValue("Username") != "" && req.PostFormValue("Username") != c.Username {
+		err = bcrypt.CompareHashAndPassword(c.Password, []byte(req.PostFormValue("CurrentPassword")))
 		if err != nil {
-			appendMsgs(fmt.Sprintf("Current password is incorrect, username has not been updated"))
+			appendMsgs("Username", fmt.Sprintf("Current password is incorrect, username has not been updated"))
 		} else {
-			config.Username = req.PostFormValue("Username")
-			appendMsgs(fmt.Sprintf("New username saved"))
+			c.Username = req.PostFormValue("Username")
+			appendMsgs("Username", fmt.Sprintf("New username saved"))
 		}
 	}
 	if req.PostFormValue("Password") != "" {
-		err = bcrypt.CompareHashAndPassword(config.Password, []byte(req.PostFormValue("CurrentPassword")))
+		err = bcrypt.CompareHashAndPassword(c.Password, []byte(req.PostFormValue("CurrentPassword")))
 		if err != nil {
-			appendMsgs(fmt.Sprintf("Current password is incorrect, password has not been updated"))
+			appendMsgs("Password", fmt.Sprintf("Current password is incorrect, password has not been updated"))
 		} else {
-			config.Password, _ = bcrypt.GenerateFromPassword([]byte(req.PostFormValue("Password")), bcrypt.MinCost)
-			appendMsgs(fmt.Sprintf("New password saved"))
+			c.Password, _ = bcrypt.GenerateFromPassword([]byte(req.PostFormValue("Password")), bcrypt.MinCost)
+			appendMsgs("Password", fmt.Sprintf("New password saved"))
 		}
 	}
 	// Mail config
 	if req.PostFormValue("EnableMail") == "" {
-		config.EnableMail = false
+		c.EnableMail = false
 	} else {
 		//enableMail, err = strconv.ParseBool(req.PostFormValue("EnableMail"))
-		config.EnableMail = true
+		c.EnableMail = true
 	}
-	config.MailFrom = req.PostFormValue("MailFrom")
-	config.MailUser = req.PostFormValue("MailUser")
+	c.MailFrom = req.PostFormValue("MailFrom")
+	c.MailUser = req.PostFormValue("MailUser")
 	if req.PostFormValue("MailPass") != "" {
-		config.MailPass = req.PostFormValue("MailPass")
+		c.MailPass = req.PostFormValue("MailPass")
 	}
-	config.MailTo = stringToSlice(req.PostFormValue("MailTo"))
-	config.MailHost = req.PostFormValue("MailHost")
+	c.MailTo = stringToSlice(req.PostFormValue("MailTo"))
+	c.MailHost = req.PostFormValue("MailHost")
 	mailPort, err := strToInt(req.PostFormValue("MailPort"))
 	if err != nil {
-		appendMsgs(fmt.Sprintf("Unable to save mail port: %v", err))
+		appendMsgs("MailPort", fmt.Sprintf("Unable to save mail port: %v", err))
 	} else {
-		config.MailPort = mailPort
+		c.MailPort = mailPort
+	}
+	// MQTT config
+	c.EnableMqtt = req.PostFormValue("EnableMqtt") != ""
+	c.MqttHost = strings.TrimSpace(req.PostFormValue("MqttHost"))
+	if c.EnableMqtt && c.MqttHost == "" {
+		appendMsgs("MqttHost", "Unable to enable MQTT without MQTT host")
+	}
+	if v := req.PostFormValue("MqttPort"); v != "" {
+		mqttPort, err := strToInt(v)
+		if err != nil || mqttPort == 0 || mqttPort > 65535 {
+			appendMsgs("MqttPort", fmt.Sprintf("Unable to save MQTT port '%v', should be within range 1-65535", v))
+		} else {
+			c.MqttPort = mqttPort
+		}
+	} else {
+		c.MqttPort = 0
+	}
+	c.MqttUser = req.PostFormValue("MqttUser")
+	if req.PostFormValue("MqttPass") != "" {
+		c.MqttPass = req.PostFormValue("MqttPass")
+	}
+	c.MqttTopic = strings.Trim(strings.TrimSpace(req.PostFormValue("MqttTopic")), "/")
+	if strings.ContainsAny(c.MqttTopic, "+#") {
+		appendMsgs("MqttTopic", fmt.Sprintf("Unable to save MQTT topic '%v', wildcards + and # are not allowed", c.MqttTopic))
+	}
+	c.MqttDiscovery = req.PostFormValue("MqttDiscovery") != ""
+	// InfluxDB config
+	c.EnableInflux = req.PostFormValue("EnableInflux") != ""
+	c.InfluxUrl = strings.TrimSpace(req.PostFormValue("InfluxUrl"))
+	if c.InfluxUrl != "" || c.EnableInflux {
+		if err := checkInfluxUrl(c.InfluxUrl); err != nil {
+			appendMsgs("InfluxUrl", fmt.Sprintf("Unable to save InfluxDB url (%v)", err))
+		}
+	}
+	if req.PostFormValue("InfluxToken") != "" {
+		c.InfluxToken = req.PostFormValue("InfluxToken")
+	}
+	// Modbus config
+	c.EnableModbus = req.PostFormValue("EnableModbus") != ""
+	if v := req.PostFormValue("ModbusPort"); v != "" {
+		modbusPort, err := strToInt(v)
+		if err != nil || modbusPort == 0 || modbusPort > 65535 {
+			appendMsgs("ModbusPort", fmt.Sprintf("Unable to save Modbus port '%v', should be within range 1-65535", v))
+		} else {
+			c.ModbusPort = modbusPort
+		}
+	} else {
+		c.ModbusPort = 0
+	}
+	// HomeKit config
+	c.EnableHomekit = req.PostFormValue("EnableHomekit") != ""
+	c.HomekitName = strings.TrimSpace(req.PostFormValue("HomekitName"))
+	if len(c.HomekitName) > 63 {
+		appendMsgs("HomekitName", fmt.Sprintf("Unable to save HomeKit name '%v', should be at most 63 characters", c.HomekitName))
+	}
+	if v := req.PostFormValue("HomekitPort"); v != "" {
+		homekitPort, err := strToInt(v)
+		if err != nil || homekitPort == 0 || homekitPort > 65535 {
+			appendMsgs("HomekitPort", fmt.Sprintf("Unable to save HomeKit port '%v', should be within range 1-65535", v))
+		} else {
+			c.HomekitPort = homekitPort
+		}
+	} else {
+		c.HomekitPort = 0
+	}
+	// KNX config
+	c.EnableKnx = req.PostFormValue("EnableKnx") != ""
+	c.KnxGateway = strings.TrimSpace(req.PostFormValue("KnxGateway"))
+	if c.KnxGateway != "" || c.EnableKnx {
+		if err := checkKnxGateway(c.KnxGateway); err != nil {
+			appendMsgs("KnxGateway", fmt.Sprintf("Unable to save KNX gateway (%v)", err))
+		}
+	}
+	c.KnxLight = strings.TrimSpace(req.PostFormValue("KnxLight"))
+	if ga, err := parseGroupAddr(c.KnxLight); c.KnxLight != "" && err != nil {
+		appendMsgs("KnxLight", fmt.Sprintf("Unable to save KNX light group address (%v)", err))
+	} else if c.KnxLight != "" {
+		c.KnxLight = ga.String()
+	}
+	// Anemometer config
+	c.EnableWind = req.PostFormValue("EnableWind") != ""
+	if v := req.PostFormValue("WindPin"); v != "" || c.EnableWind {
+		windPin, err := readPin(v)
+		if err != nil {
+			appendMsgs("WindPin", fmt.Sprintf("Unable to save anemometer pin '%v' (%v)", v, err))
+		} else {
+			c.WindPin = windPin
+		}
+	}
+	for _, f := range []struct {
+		field string
+		value *float64
+	}{{"WindFactor", &c.WindFactor}, {"WindLock", &c.WindLock}, {"WindRelease", &c.WindRelease}} {
+		v := req.PostFormValue(f.field)
+		x, err := strconv.ParseFloat(v, 64)
+		if err != nil || x < 0 || (c.EnableWind && x == 0) {
+			appendMsgs(f.field, fmt.Sprintf("Unable to save %v '%v', should be a number greater than zero", f.field, v))
+		} else {
+			*f.value = x
+		}
+	}
+	if c.EnableWind && c.WindFactor > 0 && c.WindLock/c.WindFactor > windMaxFreq {
+		appendMsgs("WindLock", fmt.Sprintf("Unable to save WindLock '%v', should be at most %v m/s (%v Hz) with WindFactor %v", c.WindLock, windMaxFreq*c.WindFactor, windMaxFreq, c.WindFactor))
+	}
+	if c.EnableWind && c.WindRelease > c.WindLock {
+		appendMsgs("WindRelease", fmt.Sprintf("Unable to save WindRelease '%v', should be at most WindLock (%v)", c.WindRelease, c.WindLock))
+	}
+	windCalm, err := time.ParseDuration(req.PostFormValue("WindCalm") + "m")
+	if err != nil || windCalm < 0 {
+		appendMsgs("WindCalm", fmt.Sprintf("Unable to save WindCalm '%v' (should be a positive number of minutes)", req.PostFormValue("WindCalm")))
+	} else {
+		c.WindCalm = windCalm
+	}
+	// Rain sensor config
+	c.EnableRain = req.PostFormValue("EnableRain") != ""
+	if v := req.PostFormValue("RainPin"); v != "" || c.EnableRain {
+		rainPin, err := readPin(v)
+		if err != nil {
+			appendMsgs("RainPin", fmt.Sprintf("Unable to save rain sensor pin '%v' (%v)", v, err))
+		} else {
+			c.RainPin = rainPin
+		}
+	}
+	switch v := req.PostFormValue("RainPolarity"); v {
+	case activeLow, activeHigh:
+		c.RainPolarity = v
+	case "":
+		c.RainPolarity = activeLow
+	default:
+		appendMsgs("RainPolarity", fmt.Sprintf("Unable to save RainPolarity '%v', should be %v or %v", v, activeLow, activeHigh))
+	}
+	rainDebounce, err := time.ParseDuration(req.PostFormValue("RainDebounce") + "s")
+	if err != nil || rainDebounce < 0 {
+		appendMsgs("RainDebounce", fmt.Sprintf("Unable to save RainDebounce '%v' (should be a positive number of seconds)", req.PostFormValue("RainDebounce")))
+	} else {
+		c.RainDebounce = rainDebounce
+	}
+	rainDry, err := time.ParseDuration(req.PostFormValue("RainDry") + "m")
+	if err != nil || rainDry < 0 {
+		appendMsgs("RainDry", fmt.Sprintf("Unable to save RainDry '%v' (should be a positive number of minutes)", req.PostFormValue("RainDry")))
+	} else {
+		c.RainDry = rainDry
+	}
+	// Temperature sensor config
+	c.EnableTemp = req.PostFormValue("EnableTemp") != ""
+	c.TempIndoor = strings.TrimSpace(req.PostFormValue("TempIndoor"))
+	c.TempOutdoor = strings.TrimSpace(req.PostFormValue("TempOutdoor"))
+	for _, id := range []string{"TempIndoor", "TempOutdoor"} {
+		if v := strings.TrimSpace(req.PostFormValue(id)); strings.ContainsAny(v, "/\\ ") || v == "." || v == ".." {
+			appendMsgs(id, fmt.Sprintf("Unable to save %v '%v', should be the id of a 1-Wire sensor, e.g. 28-0316a2795aff", id, v))
+		}
+	}
+	if c.EnableTemp && c.TempIndoor == "" && c.TempOutdoor == "" {
+		appendMsgs("TempIndoor", "Unable to enable temperature sensors without indoor or outdoor sensor")
+	}
+	// Frost protection config
+	c.EnableFrost = req.PostFormValue("EnableFrost") != ""
+	frostTemp, err := strconv.ParseFloat(req.PostFormValue("FrostTemp"), 64)
+	if err != nil {
+		appendMsgs("FrostTemp", fmt.Sprintf("Unable to save FrostTemp '%v' (should be a temperature in °C)", req.PostFormValue("FrostTemp")))
+	} else {
+		c.FrostTemp = frostTemp
+	}
+	if c.EnableFrost && (!c.EnableTemp || c.TempOutdoor == "") {
+		appendMsgs("EnableFrost", "Unable to enable frost protection without enabled outdoor temperature sensor")
 	}
 	lat, err := strconv.ParseFloat(req.PostFormValue("Latitude"), 64)
 	if err != nil {
-		appendMsgs(fmt.Sprintf("Unable to save location latitude ('%v'): %v", lat, err))
+		appendMsgs("Latitude", fmt.Sprintf("Unable to save location latitude ('%v'): %v", lat, err))
 	} else {
-		config.Location.Latitude = lat
+		c.Location.Latitude = lat
 	}
 	long, err := strconv.ParseFloat(req.PostFormValue("Longitude"), 64)
 	if err != nil {
-		appendMsgs(fmt.Sprintf("Unable to save location longitude ('%v'): %v", long, err))
+		appendMsgs("Longitude", fmt.Sprintf("Unable to save location longitude ('%v'): %v", long, err))
 	} else {
-		config.Location.Longitude = long
+		c.Location.Longitude = long
 	}
 	utcOffset, err := strconv.ParseFloat(req.PostFormValue("UtcOffset"), 64)
 	if err != nil {
-		appendMsgs(fmt.Sprintf("Unable to save location UtcOffset ('%v'): %v", utcOffset, err))
+		appendMsgs("UtcOffset", fmt.Sprintf("Unable to save location UtcOffset ('%v'): %v", utcOffset, err))
 	} else {
-		config.Location.UtcOffset = utcOffset
+		c.Location.UtcOffset = utcOffset
+	}
+	// Weather forecast config
+	c.EnableForecast = req.PostFormValue("EnableForecast") != ""
+	c.ForecastProvider = req.PostFormValue("ForecastProvider")
+	if c.ForecastProvider == "" {
+		c.ForecastProvider = providerOpenMeteo
+	}
+	c.ForecastUrl = strings.TrimSpace(req.PostFormValue("ForecastUrl"))
+	if _, err := newForecastProvider(c.ForecastProvider, c.ForecastUrl); err != nil {
+		appendMsgs("ForecastUrl", fmt.Sprintf("Unable to save weather forecast: %v", err))
+	}
+	forecastMaxTemp, err := strconv.ParseFloat(req.PostFormValue("ForecastMaxTemp"), 64)
+	if err != nil {
+		appendMsgs("ForecastMaxTemp", fmt.Sprintf("Unable to save ForecastMaxTemp '%v' (should be a temperature in °C)", req.PostFormValue("ForecastMaxTemp")))
+	} else {
+		c.ForecastMaxTemp = forecastMaxTemp
+	}
+	forecastCloudCover, err := strconv.ParseFloat(req.PostFormValue("ForecastCloudCover"), 64)
+	if err != nil || forecastCloudCover < 0 || forecastCloudCover > 100 {
+		appendMsgs("ForecastCloudCover", fmt.Sprintf("Unable to save ForecastCloudCover '%v' (should be a percentage within range 0-100)", req.PostFormValue("ForecastCloudCover")))
+	} else {
+		c.ForecastCloudCover = forecastCloudCover
 	}
-	muConf.Unlock()
 	return msgs
 }
 
@@ -714,6 +1348,7 @@ func readCSV(file string) [][]string {
 	}
 	defer f.Close()
 	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
 	lines, err := r.ReadAll()
 	if err != nil {
 		log.Fatal(err)
@@ -748,6 +1383,47 @@ func strToInt(s string) (int, error) {
 	return i, err
 }
 
+// ReadPin parses a pin as entered in a form and checks if it is available on the GPIO backend.
+func readPin(s string) (Pin, error) {
+	p, err := parsePin(s)
+	if err != nil {
+		return p, err
+	}
+	return p, hw.Check(p)
+}
+
+// ReadOptionalPin parses a pin like readPin, but returns nil if no pin is entered.
+func readOptionalPin(s string) (*Pin, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	p, err := readPin(s)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// ReadOptionalFloat parses a number as entered in a form, or returns nil if no number is entered.
+func readOptionalFloat(s string) (*float64, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// SamePin returns true if both pins are nil or refer to the same pin.
+func samePin(p1, p2 *Pin) bool {
+	if p1 == nil || p2 == nil {
+		return p1 == p2
+	}
+	return *p1 == *p2
+}
+
 // GetIP gets a requests IP address by reading off the forwarded-for
 // header (for proxies) and falls back to use the remote address.
 func getIP(req *http.Request) string {
@@ -788,8 +1464,14 @@ func handlerStop(w http.ResponseWriter, req *http.Request) {
 	}
 
 	log.Println("Closing down...")
-	s.Up()
-	rpio.Close()
+	cmds := []*Command{}
+	for _, s := range listSunscreens() {
+		cmds = append(cmds, s.Up(srcWeb))
+	}
+	for _, c := range cmds {
+		c.Wait()
+	}
+	hw.Close()
 	log.Println("Shutting down")
 	os.Exit(3)
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Constants for the type of smart relay of actuator http
+const (
+	deviceShelly  = "shelly"  // Shelly 2.5 (or compatible) in roller mode
+	deviceTasmota = "tasmota" // Tasmota with shutter support
+)
+
+// Constants for the requests to a smart relay
+const (
+	deviceTimeout   = 5 * time.Second        // Timeout of a single request
+	deviceRetries   = 3                      // Number of attempts of a request
+	deviceRetryWait = 500 * time.Millisecond // Time between attempts
+)
+
+/* Positioner is implemented by actuators that can report the position of the
+motor, in percent down.*/
+type positioner interface {
+	position() (int, error)
+}
+
+/* SmartRelay drives a motor through the local HTTP API of a smart relay, e.g.
+a Shelly or Tasmota device. Requests time out after timeout and are attempted
+retries times, so a single lost request does not leave the motor running.*/
+type smartRelay struct {
+	device  string // Type of device: shelly or tasmota
+	url     string // Base url of the device, e.g. http://192.168.1.20
+	name    string // Url without password, for messages
+	client  *http.Client
+	retries int
+	wait    time.Duration
+}
+
+// NewSmartRelay returns an actuator for the device of type device at base url u.
+func newSmartRelay(device, u string) (*smartRelay, error) {
+	switch device {
+	case deviceShelly, deviceTasmota:
+	default:
+		return nil, fmt.Errorf("Unknown device '%v', should be %v or %v", device, deviceShelly, deviceTasmota)
+	}
+	if err := checkDeviceUrl(u); err != nil {
+		return nil, err
+	}
+	pu, _ := url.Parse(strings.TrimRight(u, "/"))
+	return &smartRelay{
+		device:  device,
+		url:     pu.String(),
+		name:    pu.Redacted(),
+		client:  &http.Client{Timeout: deviceTimeout},
+		retries: deviceRetries,
+		wait:    deviceRetryWait,
+	}, nil
+}
+
+// CheckDeviceUrl returns an error if u is not an absolute http(s) url.
+func checkDeviceUrl(u string) error {
+	pu, err := url.Parse(u)
+	if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+		return fmt.Errorf("Url of device '%v' should be an http(s) url, e.g. http://192.168.1.20", u)
+	}
+	return nil
+}
+
+// Init stops the motor, so it does not keep running after a restart.
+func (d *smartRelay) init() {
+	d.halt(false)
+}
+
+func (d *smartRelay) start(up bool) error {
+	switch {
+	case d.device == deviceShelly && up:
+		return d.get("/roller/0?go=open", nil)
+	case d.device == deviceShelly:
+		return d.get("/roller/0?go=close", nil)
+	case up:
+		return d.command("ShutterOpen1", nil)
+	default:
+		return d.command("ShutterClose1", nil)
+	}
+}
+
+/* Halt stops the motor. The device stops by itself at the end of its own
+travel time, but stopping a motor that is not running does no harm, so the stop
+is sent regardless of atEnd.*/
+func (d *smartRelay) halt(atEnd bool) {
+	var err error
+	if d.device == deviceShelly {
+		err = d.get("/roller/0?go=stop", nil)
+	} else {
+		err = d.command("ShutterStop1", nil)
+	}
+	if err != nil {
+		log.Printf("Unable to stop motor: %v", err)
+	}
+}
+
+/* Position reads the position of the motor in percent down from the device.
+Both devices report the position in percent open, and only know it after
+they have been calibrated.*/
+func (d *smartRelay) position() (int, error) {
+	if d.device == deviceShelly {
+		var status struct {
+			Positioning bool `json:"positioning"`
+			CurrentPos  int  `json:"current_pos"`
+		}
+		if err := d.get("/roller/0", &status); err != nil {
+			return 0, err
+		}
+		if !status.Positioning {
+			return 0, fmt.Errorf("Device %v is not calibrated, position is unknown", d.name)
+		}
+		return 100 - max(min(status.CurrentPos, 100), 0), nil
+	}
+	var status struct {
+		Shutter1 *struct {
+			Position int
+		}
+	}
+	if err := d.command("ShutterPosition1", &status); err != nil {
+		return 0, err
+	}
+	if status.Shutter1 == nil {
+		return 0, fmt.Errorf("Device %v did not report the position of Shutter1", d.name)
+	}
+	return 100 - max(min(status.Shutter1.Position, 100), 0), nil
+}
+
+// Command sends a Tasmota command and decodes the response into v, if v is not nil.
+func (d *smartRelay) command(cmnd string, v interface{}) error {
+	return d.get("/cm?cmnd="+url.QueryEscape(cmnd), v)
+}
+
+/* Get requests path from the device and decodes the JSON response into v, if v
+is not nil. Failed requests and server errors are retried.*/
+func (d *smartRelay) get(path string, v interface{}) error {
+	var err error
+	for i := 0; i < d.retries; i++ {
+		if i > 0 {
+			time.Sleep(d.wait)
+		}
+		var retry bool
+		retry, err = d.try(path, v)
+		if err == nil || !retry {
+			return err
+		}
+		log.Printf("Attempt %v of %v failed: %v", i+1, d.retries, err)
+	}
+	return err
+}
+
+// Try does a single request for get and returns whether it is worth retrying on an error.
+func (d *smartRelay) try(path string, v interface{}) (bool, error) {
+	resp, err := d.client.Get(d.url + path)
+	if err != nil {
+		return true, fmt.Errorf("Unable to reach device: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return true, fmt.Errorf("Unable to read response of %v%v: %v", d.name, path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode >= 500, fmt.Errorf("Device responded to %v%v with %v", d.name, path, resp.Status)
+	}
+	if v != nil {
+		if err := json.Unmarshal(body, v); err != nil {
+			return false, fmt.Errorf("Unable to decode response of %v%v: %v", d.name, path, err)
+		}
+	}
+	return false, nil
+}
@@ -3,9 +3,10 @@ package main
 import (
 	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
-
-	"github.com/stianeikeland/go-rpio/v4"
 )
 
 // Constants for sunscreen position
@@ -14,8 +15,19 @@ const (
 	up      = "up"
 	down    = "down"
 	moving  = "moving"
+	partial = "partial"
+)
+
+// Constants for the actuator type of a sunscreen
+const (
+	actuatorRelay = "relay" // Relays on PinUp and PinDown
+	actuatorRTS   = "rts"   // Somfy RTS radio through a 433 MHz transmitter on RtsPin
+	actuatorHTTP  = "http"  // Smart relay (Shelly or Tasmota) at DeviceUrl
 )
 
+// limitClosed is the state of the input of a closed limit switch, i.e. switches pull the pin low.
+const limitClosed = Low
+
 // Constants for suncreen mode
 const (
 	auto   = "auto"
@@ -24,109 +36,570 @@ const (
 
 // Sunscreen represents a physical Sunscreen that can be controlled through 2 GPIO pins: one for moving it up, and one for moving it down.
 type Sunscreen struct {
-	// TODO: remove ID and name?
-	Id        int           // Autogenerated ID for sunscreen
-	Name      string        // Name of sunscreen
-	Mode      string        // Mode of Sunscreen auto or manual
-	Position  string        // Current position of Sunscreen
-	DurDown   time.Duration // Duration to move Sunscreen down
-	DurUp     time.Duration // Duration to move Sunscreen up
-	PinDown   rpio.Pin      // GPIO pin for moving sunscreen down
-	PinUp     rpio.Pin      // GPIO pin for moving sunscreen up
-	AutoStart bool          // If true, Start is calculated based on config.Location.GetSunriseSunset() and SunStart
-	AutoStop  bool          // If true, Stop is calculated based on config.Location.GetSunriseSunset() and SunStop
-	SunStart  time.Duration // Duration after Sunrise to determine Start
-	SunStop   time.Duration // Duration after before Sunset to determine Stop
-	Start     time.Time     // Time after which Sunscreen can shine on the Sunscreen area
-	Stop      time.Time     // Time after which Sunscreen no can shine on the Sunscreen area
-	StopLimit time.Duration // Duration before Stop that Sunscreen no longer should go down
-}
-
-func move(pin rpio.Pin, dur time.Duration) {
-	pin.Low()
-	n := time.Now()
-	for time.Now().Before(n.Add(dur)) {
-		time.Sleep(time.Second)
-	}
-	pin.High()
-}
-
-// Init initiates the sunscreen
+	Id            int            // Autogenerated ID for sunscreen
+	Name          string         // Name of sunscreen
+	Mode          string         // Mode of Sunscreen auto or manual
+	Position      string         // Current position of Sunscreen
+	Percent       int            // Estimated position of Sunscreen in percent down, 0 is up and 100 is down
+	Presets       map[string]int // Named positions in percent down, e.g. "half": 50
+	AutoPreset    string         // Name of the preset auto mode moves the Sunscreen down to, if empty it moves down completely
+	Rehome        int            // Number of partial movements after which Sunscreen first moves to an end stop, 0 is never
+	Moves         int            // Number of partial movements since Sunscreen was last at an end stop
+	DurDown       time.Duration  // Duration to move Sunscreen down
+	DurUp         time.Duration  // Duration to move Sunscreen up
+	Actuator      string         // Type of actuator driving the motor: relay, rts or http
+	PinDown       Pin            // GPIO pin for moving sunscreen down
+	PinUp         Pin            // GPIO pin for moving sunscreen up
+	Polarity      string         // State of the pins that energises the relays: low or high
+	DeadTime      time.Duration  // Minimum time between releasing one relay and energising the other
+	RtsPin        Pin            // GPIO pin of the 433 MHz transmitter for actuator rts
+	RtsAddress    uint32         // Address of the virtual Somfy RTS remote for actuator rts
+	Device        string         // Type of smart relay for actuator http: shelly or tasmota
+	DeviceUrl     string         // Base url of the smart relay for actuator http, e.g. http://192.168.1.20
+	LimitUp       *Pin           // Optional GPIO input of the limit switch that closes when Sunscreen is up
+	LimitDown     *Pin           // Optional GPIO input of the limit switch that closes when Sunscreen is down
+	LimitTimeout  time.Duration  // Time after DurUp or DurDown within which a limit switch should close
+	KnxUpDown     string         // Optional KNX group address of up/down commands (DPT 1.008)
+	KnxStop       string         // Optional KNX group address of stop commands (DPT 1.007)
+	KnxPosition   string         // Optional KNX group address of position commands in percent down (DPT 5.001)
+	KnxState      string         // Optional KNX group address to which the position in percent down is published (DPT 5.001)
+	IgnoreRain    bool           // If true, rain neither moves the sunscreen up nor locks auto mode, e.g. for a glass-covered sunscreen
+	IndoorMin     *float64       // Optional indoor temperature in °C at or below which auto mode does not move down
+	IndoorMax     *float64       // Optional indoor temperature in °C above which auto mode moves down regardless of light
+	OutdoorMin    *float64       // Optional outdoor temperature in °C at or below which auto mode does not move down
+	OutdoorMax    *float64       // Optional outdoor temperature in °C above which auto mode moves down regardless of light
+	ForecastLower bool           // If true, auto mode lowers the sunscreen pre-emptively on days with a hot and clear forecast, see forecastPolicy
+	Sensor        int            // Id of the light sensor used when the light sensor fusion policy is screen
+	AutoStart     bool           // If true, Start is calculated based on config.Location.GetSunriseSunset() and SunStart
+	AutoStop      bool           // If true, Stop is calculated based on config.Location.GetSunriseSunset() and SunStop
+	SunStart      time.Duration  // Duration after Sunrise to determine Start
+	SunStop       time.Duration  // Duration after before Sunset to determine Stop
+	Start         time.Time      // Time after which Sunscreen can shine on the Sunscreen area
+	Stop          time.Time      // Time after which Sunscreen no can shine on the Sunscreen area
+	StopLimit     time.Duration  // Duration before Stop that Sunscreen no longer should go down
+	travelUp      bool           // True if the last movement was up
+	actuator      actuator       // Driver of the motor, set by init
+	calibration   *Calibration   // Calibration in progress, nil if not calibrating
+	queue         []*Command     // Queued commands, highest priority first
+	running       *Command       // Command that is being executed
+	history       []*Command     // Recently ended commands
+	wake          chan struct{}  // Wakes up the worker executing the queue
+}
+
+// NewSunscreen adds a new sunscreen with the next available Id to sunscreens and returns it.
+func newSunscreen() *Sunscreen {
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	id := 1
+	for _, s := range sunscreens {
+		if s.Id >= id {
+			id = s.Id + 1
+		}
+	}
+	s := &Sunscreen{
+		Id:       id,
+		Name:     fmt.Sprintf("Sunscreen %v", id),
+		Mode:     manual,
+		Position: unknown,
+		Actuator: actuatorRelay,
+		Polarity: activeLow,
+		DeadTime: relayDeadTime,
+		Device:   deviceShelly,
+	}
+	sunscreens = append(sunscreens, s)
+	return s
+}
+
+// DeleteSunscreen removes the sunscreen with id from sunscreens. It returns false if the id is unknown.
+func deleteSunscreen(id int) bool {
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	for i, s := range sunscreens {
+		if s.Id == id {
+			s.closeQueue()
+			sunscreens = append(sunscreens[:i], sunscreens[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// GetSunscreen returns the sunscreen with id, or nil if it does not exist.
+func getSunscreen(id int) *Sunscreen {
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	for _, s := range sunscreens {
+		if s.Id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// ListSunscreens returns a copy of the slice of sunscreens, so it can be ranged over without holding muSunscrn.
+func listSunscreens() []*Sunscreen {
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	return append([]*Sunscreen{}, sunscreens...)
+}
+
+/* CopySunscreens returns a copy of the values of all sunscreens, e.g. for
+showing them on a page. The caller should hold muSunscrn.*/
+func copySunscreens() []Sunscreen {
+	xs := []Sunscreen{}
+	for _, s := range sunscreens {
+		xs = append(xs, *s)
+	}
+	return xs
+}
+
+// SaveSunscreens stores all sunscreens in fileSunscrn. The caller should hold muSunscrn.
+func saveSunscreens() {
+	SaveToJSON(sunscreens, fileSunscrn)
+}
+
+// Init initiates the actuator of the sunscreen and stops the motor.
 func (s *Sunscreen) init() {
-	s.PinDown.Output()
-	s.PinDown.High()
-	s.PinUp.Output()
-	s.PinUp.High()
+	muSunscrn.Lock()
+	a, err := s.newActuator()
+	if err != nil {
+		log.Printf("Unable to initiate actuator of sunscreen '%v': %v", s.Name, err)
+		s.actuator = nil
+		muSunscrn.Unlock()
+		return
+	}
+	muSunscrn.Unlock()
+	// Actuators may need network requests, which should not block other sunscreens
+	a.init()
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	s.actuator = a
+	for _, p := range []*Pin{s.LimitUp, s.LimitDown} {
+		if p != nil {
+			hw.Input(*p)
+		}
+	}
+	if s.resync() {
+		saveSunscreens()
+	}
 	// Include below line if sunscreen needs to be repositioned to up
-	// s.Up()
+	// s.Up(srcSchedule)
 	// Include below if sunscreen needs to be manually corrected to auto and up
 	// s.Mode = auto
 	// s.Position = up
 }
 
-// Move moves the suncreen up or down based on the Sunscreen.Position. It updates the position accordingly.
-func (s *Sunscreen) Move() {
+// Move queues a command moving the sunscreen in the opposite direction of its position.
+func (s *Sunscreen) Move(source string) *Command {
 	muSunscrn.Lock()
-	oldPos := s.Position
-	oldMode := s.Mode
-	moveSunscrn := func(newPos string) {
-		log.Printf("Moving sunscreen from %v to %v", oldPos, newPos)
-		s.Position = moving
-		var pin rpio.Pin
-		var dur time.Duration
-		switch newPos {
-		case up:
-			pin, dur = s.PinUp, s.DurUp
-		case down:
-			pin, dur = s.PinDown, s.DurDown
-		}
-		muSunscrn.Unlock()
-		move(pin, dur)
-		muSunscrn.Lock()
-		s.Position = newPos
-		SaveToJSON(s, fileSunscrn)
-		muSunscrn.Unlock()
-		muLS.Lock()
-		data := ls.Data
-		muLS.Unlock()
-		appendCSV(fileStats, [][]string{{time.Now().Format("02-01-2006 15:04:05"), oldMode, newPos, fmt.Sprint(data)}})
-	}
+	defer muSunscrn.Unlock()
+	return s.submit(newCommand(cmdMove, 0, source))
+}
+
+// MoveTo queues a command moving the sunscreen to target, the position in percent down.
+func (s *Sunscreen) MoveTo(target int, source string) *Command {
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	return s.submit(newCommand(cmdGoto, target, source))
+}
+
+// Abort stops the movement of the sunscreen immediately and cancels all queued commands.
+func (s *Sunscreen) Abort(source string) *Command {
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	return s.submit(newCommand(cmdStop, 0, source))
+}
+
+/* ToggleTarget returns the position opposite to the position of the sunscreen.
+A sunscreen that was stopped halfway is reversed. The caller should hold muSunscrn.*/
+func (s *Sunscreen) toggleTarget() int {
 	switch s.Position {
-	case unknown, down:
-		moveSunscrn(up)
 	case up:
-		moveSunscrn(down)
-	case moving:
-		muSunscrn.Unlock()
-		log.Printf("Sunscreen is moving already, do nothing")
+		return 100
+	case partial:
+		if s.travelUp {
+			return 100
+		}
+		return 0
+	case unknown, down:
+		return 0
 	default:
-		muSunscrn.Unlock()
-		log.Fatalf("Unknown sunscreen position: '%v'", s.Position)
+		log.Fatalf("Unknown position of sunscreen '%v': '%v'", s.Name, s.Position)
+		return 0
 	}
-	// TODO: Configure send mail
-	// sendMail("Moved sunscreen "+new, fmt.Sprintf("Sunscreen moved from %s to %s.", old, new))
 }
 
-// Up checks if the suncreen's position is up. If not, it moves the suncreen up through method move().
-func (s *Sunscreen) Up() {
+/* MoveTo moves the sunscreen to target, the position in percent down (0 is up
+and 100 is down). The travel time is computed from DurUp and DurDown. Moving to
+0 or 100 always travels the full duration, so the sunscreen reaches its end stop
+and any drift of the estimated position is cancelled. If the position is unknown,
+or after Rehome partial movements, the sunscreen is first moved to an end stop.
+If stop is closed, the movement is stopped and the estimated position is
+recorded, or read back from actuators that report their position. With limit
+switches, a movement ends as soon as the switch in its direction closes, and
+moving to an end stop fails if the switch has not closed within LimitTimeout
+after the full duration. It should only be called by the worker of the
+sunscreen.*/
+func (s *Sunscreen) moveTo(target int, stop <-chan struct{}) error {
+	target = max(min(target, 100), 0)
 	muSunscrn.Lock()
-	if s.Position != up {
+	if s.Position != unknown && s.Percent == target {
 		muSunscrn.Unlock()
-		s.Move()
-	} else {
+		return nil
+	}
+	if s.actuator == nil {
 		muSunscrn.Unlock()
+		return fmt.Errorf("Actuator of sunscreen '%v' is not initiated, please check its configuration", s.Name)
+	}
+	oldPos, oldMode, from, position := s.positionText(), s.Mode, s.Percent, s.Position
+	source := ""
+	if s.running != nil {
+		source = s.running.Source
 	}
+	steps := []int{target}
+	switch {
+	case s.Position == unknown && target != 0 && target != 100:
+		steps = []int{0, target}
+	case target != 0 && target != 100 && s.Rehome > 0 && s.Moves >= s.Rehome:
+		// Re-home to the end stop closest to target
+		home := 0
+		if target >= 50 {
+			home = 100
+		}
+		log.Printf("Re-homing sunscreen '%v' to %v%% after %v partial movements", s.Name, home, s.Moves)
+		steps = []int{home, target}
+	}
+	newPos := positionText(target)
+	log.Printf("Moving sunscreen '%v' from %v to %v", s.Name, oldPos, newPos)
+	s.Position = moving
+	a := s.actuator
+	for _, step := range steps {
+		goUp, dur := s.travel(from, step)
+		s.travelUp = goUp
+		end := step == 0 || step == 100
+		var closed func() bool
+		if limit := s.limit(goUp); limit != nil {
+			closed = func() bool { return hw.Read(*limit) == limitClosed }
+			if end {
+				dur += s.LimitTimeout
+			}
+		}
+		muSunscrn.Unlock()
+		elapsed, err := run(a, goUp, dur, end, stop, closed)
+		readBack, readErr := -1, error(nil)
+		if p, ok := a.(positioner); ok && err == nil && elapsed < dur {
+			readBack, readErr = p.position()
+		}
+		muSunscrn.Lock()
+		if err == nil {
+			s.countMovement(goUp, source, elapsed)
+		}
+		if err != nil {
+			// Movement was not executed, keep the position of the last completed step
+			s.Position = position
+			if step != steps[0] {
+				s.Position = positionOf(s.Percent)
+			}
+			muSunscrn.Unlock()
+			return fmt.Errorf("Unable to move sunscreen '%v': %v", s.Name, err)
+		}
+		if closed != nil && closed() {
+			// Limit switch closed, the sunscreen is at the end stop
+			reached := 100
+			if goUp {
+				reached = 0
+			}
+			s.Percent, s.Moves, from = reached, 0, reached
+			if step != reached {
+				newPos = positionText(reached)
+				log.Printf("Sunscreen '%v' reached its end stop %v before %v", s.Name, newPos, positionText(step))
+				break
+			}
+			continue
+		}
+		if closed != nil && end && elapsed == dur {
+			s.Position = unknown
+			saveSunscreens()
+			muSunscrn.Unlock()
+			return fmt.Errorf("Sunscreen '%v' did not reach its end stop %v within %v", s.Name, positionText(step), dur)
+		}
+		if elapsed < dur {
+			// Movement was stopped, read back or estimate where the sunscreen is
+			s.Moves++
+			if readBack >= 0 && readErr == nil {
+				s.Percent = readBack
+				newPos = positionText(s.Percent)
+				log.Printf("Stopped sunscreen '%v' at position %v as reported by its actuator", s.Name, newPos)
+				break
+			}
+			if readErr != nil {
+				log.Printf("Unable to read back position of sunscreen '%v': %v", s.Name, readErr)
+			}
+			s.Percent = s.estimate(from, step, elapsed)
+			newPos = positionText(s.Percent)
+			log.Printf("Stopped sunscreen '%v' at estimated position %v", s.Name, newPos)
+			break
+		}
+		s.Percent, from = step, step
+		if end {
+			s.Moves = 0
+		} else {
+			s.Moves++
+		}
+	}
+	s.Position = positionOf(s.Percent)
+	id, name, percent, locks := s.Id, s.Name, s.Percent, s.locks()
+	saveSunscreens()
+	muSunscrn.Unlock()
+	muLS.Lock()
+	data := ls.Data
+	muLS.Unlock()
+	now := time.Now()
+	appendCSV(fileStats, [][]string{{now.Format("02-01-2006 15:04:05"), oldMode, newPos, fmt.Sprint(data), fmt.Sprint(id), locks}})
+	exportMovement(now, id, name, oldMode, newPos, source, percent, data)
+	return nil
 }
 
-// Down checks if s suncreen position is down. If not, it moves s suncreen down through method move().
-func (s *Sunscreen) Down() {
+// NewActuator returns the actuator of the sunscreen as configured. The caller should hold muSunscrn.
+func (s *Sunscreen) newActuator() (actuator, error) {
+	switch s.Actuator {
+	case actuatorRelay, "":
+		return newRelay(s.PinUp, s.PinDown, s.Polarity, s.DeadTime)
+	case actuatorRTS:
+		return newRtsActuator(s.RtsPin, s.RtsAddress)
+	case actuatorHTTP:
+		return newSmartRelay(s.Device, s.DeviceUrl)
+	default:
+		return nil, fmt.Errorf("Unknown actuator '%v', should be %v, %v or %v", s.Actuator, actuatorRelay, actuatorRTS, actuatorHTTP)
+	}
+}
+
+/* Resync sets the position based on the limit switches, e.g. at startup. It
+returns true if the position has changed. The caller should hold muSunscrn.*/
+func (s *Sunscreen) resync() bool {
+	if s.Position == moving {
+		return false
+	}
+	isUp := s.LimitUp != nil && hw.Read(*s.LimitUp) == limitClosed
+	isDown := s.LimitDown != nil && hw.Read(*s.LimitDown) == limitClosed
+	old := s.positionText()
+	switch {
+	case isUp && isDown:
+		log.Printf("Both limit switches of sunscreen '%v' are closed, please check the switches", s.Name)
+		s.Position = unknown
+	case isUp:
+		s.Position, s.Percent, s.Moves = up, 0, 0
+	case isDown:
+		s.Position, s.Percent, s.Moves = down, 100, 0
+	case s.Position == up && s.LimitUp != nil, s.Position == down && s.LimitDown != nil:
+		// Limit switch of the recorded position is open, so the sunscreen is somewhere in between
+		s.Position = unknown
+	}
+	if s.positionText() == old {
+		return false
+	}
+	log.Printf("Re-synced position of sunscreen '%v' from %v to %v based on its limit switches", s.Name, old, s.positionText())
+	return true
+}
+
+/* Limit returns the limit switch the sunscreen reaches when moving up or down,
+or nil if the sunscreen has no such switch. The caller should hold muSunscrn.*/
+func (s *Sunscreen) limit(up bool) *Pin {
+	if up {
+		return s.LimitUp
+	}
+	return s.LimitDown
+}
+
+/* Estimate returns the estimated position in percent down after moving for
+elapsed from position from towards position to. The caller should hold muSunscrn.*/
+func (s *Sunscreen) estimate(from, to int, elapsed time.Duration) int {
+	if to < from {
+		if s.DurUp == 0 {
+			return from
+		}
+		return max(from-int(100*elapsed/s.DurUp), 0)
+	}
+	if s.DurDown == 0 {
+		return from
+	}
+	return min(from+int(100*elapsed/s.DurDown), 100)
+}
+
+/* Travel returns the direction (true is up) and duration for moving the
+sunscreen from position from to position to, both in percent down. Moving to an
+end stop always takes the full duration. The caller should hold muSunscrn.*/
+func (s *Sunscreen) travel(from, to int) (bool, time.Duration) {
+	switch {
+	case to == 0:
+		return true, s.DurUp
+	case to == 100:
+		return false, s.DurDown
+	case to < from:
+		return true, s.DurUp * time.Duration(from-to) / 100
+	default:
+		return false, s.DurDown * time.Duration(to-from) / 100
+	}
+}
+
+/* SetMode sets the mode of the sunscreen to auto or manual. In manual mode,
+pos (stop, a preset or a percentage down) is queued as a command from source,
+unless pos is empty. Confirmed should be true if the user confirmed the
+movement, which is required during a frost lock. Only the web page, the API
+and MQTT can confirm a movement; HomeKit, KNX and Modbus can not, so they can
+not move sunscreens during a frost lock. It returns the command, or nil if no
+command was queued. The caller should hold muSunscrn.*/
+func (s *Sunscreen) setMode(mode, pos, source string, confirmed bool) (*Command, error) {
+	switch mode {
+	case auto:
+		if s.Mode != auto {
+			s.Mode = auto
+			saveSunscreens()
+			log.Printf("Set mode of sunscreen '%v' to auto (%v)\n", s.Name, s.Mode)
+		} else {
+			log.Printf("Mode of sunscreen '%v' is already auto (%v)\n", s.Name, s.Mode)
+		}
+	case manual:
+		if s.Mode != manual {
+			log.Printf("Mode of sunscreen '%v' is set to manual", s.Name)
+			s.Mode = manual
+			saveSunscreens()
+		}
+		if pos == "" {
+			return nil, nil
+		}
+		goTo := func(p int) *Command {
+			c := newCommand(cmdGoto, p, source)
+			c.Confirmed = confirmed
+			return s.submit(c)
+		}
+		if pos == "stop" {
+			return s.submit(newCommand(cmdStop, 0, source)), nil
+		} else if p, ok := s.preset(pos); ok {
+			return goTo(p), nil
+		} else if p, err := strconv.Atoi(pos); err == nil && p >= 0 && p <= 100 {
+			return goTo(p), nil
+		} else {
+			return nil, fmt.Errorf("Unknown command for manual position: '%v'", pos)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown mode: '%v'", mode)
+	}
+	return nil, nil
+}
+
+// Up queues a command moving the sunscreen up.
+func (s *Sunscreen) Up(source string) *Command {
+	return s.MoveTo(0, source)
+}
+
+/* Retract queues a command from source moving the sunscreen up, e.g. for
+safety. A calibration in progress is cancelled first, as it ignores other
+commands. The caller should hold muSunscrn.*/
+func (s *Sunscreen) retract(source string) *Command {
+	if s.calibration != nil {
+		log.Printf("Cancelled calibration of sunscreen '%v' by %v", s.Name, source)
+		s.calibration = nil
+		s.submit(newCommand(cmdStop, 0, source))
+	}
+	return s.submit(newCommand(cmdGoto, 0, source))
+}
+
+// Down queues a command moving the sunscreen completely down.
+func (s *Sunscreen) Down(source string) *Command {
+	return s.MoveTo(100, source)
+}
+
+/* Preset takes the name of a preset and returns its position in percent.
+The presets up and down are always available. The caller should hold muSunscrn.*/
+func (s *Sunscreen) preset(name string) (int, bool) {
+	switch name {
+	case up:
+		return 0, true
+	case down:
+		return 100, true
+	}
+	p, ok := s.Presets[name]
+	return p, ok
+}
+
+// AutoPercent returns the position in percent to which auto mode moves the sunscreen down.
+func (s *Sunscreen) autoPercent() int {
 	muSunscrn.Lock()
-	if s.Position != down {
-		muSunscrn.Unlock()
-		s.Move()
-	} else {
-		muSunscrn.Unlock()
+	defer muSunscrn.Unlock()
+	if p, ok := s.preset(s.AutoPreset); ok && p > 0 {
+		return p
 	}
+	return 100
+}
+
+// PositionText returns the position as text, i.e. up, down or the percentage when partially down.
+func (s *Sunscreen) positionText() string {
+	if s.Position == partial {
+		return positionText(s.Percent)
+	}
+	return s.Position
+}
+
+// PositionOf takes a position in percent and returns up, down or partial.
+func positionOf(percent int) string {
+	switch percent {
+	case 0:
+		return up
+	case 100:
+		return down
+	default:
+		return partial
+	}
+}
+
+// PositionText takes a position in percent and returns it as text, i.e. up, down or e.g. 40%.
+func positionText(percent int) string {
+	if p := positionOf(percent); p != partial {
+		return p
+	}
+	return fmt.Sprintf("%v%%", percent)
+}
+
+/* ParsePresets takes presets formatted as "name=percent" separated by commas
+(e.g. "half=50, view=70") and returns them as a map.*/
+func parsePresets(s string) (map[string]int, error) {
+	presets := map[string]int{}
+	for _, v := range stringToSlice(s) {
+		if v == "" {
+			continue
+		}
+		kv := strings.SplitN(v, "=", 2)
+		name := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || name == "" || name == up || name == down {
+			return nil, fmt.Errorf("Preset '%v' should be formatted as name=percent and can not be named %v or %v", v, up, down)
+		}
+		p, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || p < 0 || p > 100 {
+			return nil, fmt.Errorf("Percent of preset '%v' should be within range 0-100", v)
+		}
+		presets[name] = p
+	}
+	return presets, nil
+}
+
+// PresetsToString returns the presets formatted as "name=percent" separated by commas, sorted by percent.
+func presetsToString(presets map[string]int) string {
+	names := []string{}
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if presets[names[i]] == presets[names[j]] {
+			return names[i] < names[j]
+		}
+		return presets[names[i]] < presets[names[j]]
+	})
+	xs := []string{}
+	for _, name := range names {
+		xs = append(xs, fmt.Sprintf("%v=%v", name, presets[name]))
+	}
+	return strings.Join(xs, ", ")
 }
 
 func (s *Sunscreen) resetStartStop(d int) (err error) {
@@ -134,17 +607,16 @@ func (s *Sunscreen) resetStartStop(d int) (err error) {
 		return time.Date(time.Now().Year(), time.Now().Month(), time.Now().Day(), h, m, 0, 0, time.Now().Location()).AddDate(0, 0, d)
 	}
 	muSunscrn.Lock()
-	if s.AutoStart || s.AutoStop {
-		muSunscrn.Unlock()
-		err = s.resetAutoTime(d)
-	}
+	autoTime := s.AutoStart || s.AutoStop
 	if !s.AutoStart {
 		s.Start = resetDate(s.Start.Hour(), s.Start.Minute(), d)
-		muSunscrn.Unlock()
 	}
 	if !s.AutoStop {
 		s.Stop = resetDate(s.Stop.Hour(), s.Stop.Minute(), d)
-		muSunscrn.Unlock()
+	}
+	muSunscrn.Unlock()
+	if autoTime {
+		err = s.resetAutoTime(d)
 	}
 	return
 }
@@ -173,31 +645,64 @@ func (s *Sunscreen) resetAutoTime(d int) (err error) {
 
 /* Evaluate checks the position of the Sunscreen against the gathered light and
 parameters from the ligth sensor and moves the Sunscreen up or down if it
-meets the criteria.*/
+meets the criteria. The temperature rules of the Sunscreen keep it down in
+heat regardless of light, or up when it is not warm enough, see heatDecision.
+If no temperature rule applies and ForecastLower is set, a hot and clear
+forecast keeps it down as well within forecastWindow after Start, see
+forecastDecision. The outcome is published as a decision event.*/
 func (s *Sunscreen) evaluate(data []int, good, neutral, bad, timesGood, timesNeutral, timesBad, outliers int) {
 	counter := 0
+	st := getTempStatus()
 	muSunscrn.Lock()
-	position := s.Position
+	position, ignoreRain, forecastLower, start := s.Position, s.IgnoreRain, s.ForecastLower, s.Start
+	heat, heatReason := s.heatDecision(st)
 	muSunscrn.Unlock()
+	if now := time.Now(); heat == "" && forecastLower && !now.Before(start) && now.Sub(start) < forecastWindow {
+		heat, heatReason = forecastDecision(now)
+	}
 	switch position {
 	case up:
+		if heat == down && !ignoreRain && rainLocked() {
+			s.decide("none", heatReason+", but locked up by rain")
+			return
+		}
+		if heat == down {
+			s.decide(down, heatReason)
+			s.MoveTo(s.autoPercent(), srcAuto)
+			return
+		}
 		for _, v := range data[:(timesGood + outliers)] {
 			if v <= good {
 				counter++
 			}
 		}
+		if counter >= timesGood && !ignoreRain && rainLocked() {
+			s.decide("none", fmt.Sprintf("Light was good (at most %v) %v of %v times, but locked up by rain", good, counter, timesGood+outliers))
+			return
+		}
+		if counter >= timesGood && heat == up {
+			s.decide("none", fmt.Sprintf("Light was good (at most %v) %v of %v times, but %v", good, counter, timesGood+outliers, strings.ToLower(heatReason[:1])+heatReason[1:]))
+			return
+		}
 		if counter >= timesGood {
-			s.Down()
+			s.decide(down, fmt.Sprintf("Light was good (at most %v) %v of %v times", good, counter, timesGood+outliers))
+			s.MoveTo(s.autoPercent(), srcAuto)
+			return
+		}
+		s.decide("none", fmt.Sprintf("Light was good (at most %v) %v of %v times, %v needed", good, counter, timesGood+outliers, timesGood))
+	case down, partial:
+		if heat == down {
+			s.decide("none", heatReason)
 			return
 		}
-	case down:
 		for _, v := range data[:(timesBad + outliers)] {
 			if v >= bad {
 				counter++
 			}
 		}
 		if counter >= timesBad {
-			s.Up()
+			s.decide(up, fmt.Sprintf("Light was bad (at least %v) %v of %v times", bad, counter, timesBad+outliers))
+			s.Up(srcAuto)
 			return
 		}
 		counter = 0
@@ -207,8 +712,12 @@ func (s *Sunscreen) evaluate(data []int, good, neutral, bad, timesGood, timesNeu
 			}
 		}
 		if counter >= timesNeutral {
-			s.Up()
+			s.decide(up, fmt.Sprintf("Light was neutral (at least %v) %v of %v times", neutral, counter, timesNeutral+outliers))
+			s.Up(srcAuto)
 			return
 		}
+		s.decide("none", fmt.Sprintf("Light was neutral (at least %v) %v of %v times, %v needed", neutral, counter, timesNeutral+outliers, timesNeutral))
+	default:
+		s.decide("none", fmt.Sprintf("Position is %v", position))
 	}
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// inTempDir runs the test in a temporary directory with the config and log folders, so files are not written to the repository.
+func inTempDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	for _, folder := range []string{folderConfig, folderLog} {
+		if err := os.Mkdir(dir+"/"+folder, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestTravel(t *testing.T) {
+	s := &Sunscreen{DurDown: 20 * time.Second, DurUp: 30 * time.Second}
+	tests := []struct {
+		from, to int
+		up       bool
+		dur      time.Duration
+	}{
+		{0, 40, false, 8 * time.Second},
+		{40, 50, false, 2 * time.Second},
+		{50, 40, true, 3 * time.Second},
+		{40, 100, false, 20 * time.Second},
+		{40, 0, true, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		up, dur := s.travel(tt.from, tt.to)
+		if up != tt.up || dur != tt.dur {
+			t.Errorf("travel(%v, %v): want %v %v, got %v %v", tt.from, tt.to, tt.up, tt.dur, up, dur)
+		}
+	}
+}
+
+func TestParsePresets(t *testing.T) {
+	presets, err := parsePresets("half=50, view = 70,")
+	if err != nil || len(presets) != 2 || presets["half"] != 50 || presets["view"] != 70 {
+		t.Errorf("Want half=50 and view=70, got %v (%v)", presets, err)
+	}
+	if got := presetsToString(presets); got != "half=50, view=70" {
+		t.Errorf("Want 'half=50, view=70', got '%v'", got)
+	}
+	for _, v := range []string{"half", "half=101", "half=-5", "up=10", "=50"} {
+		if _, err := parsePresets(v); err == nil {
+			t.Errorf("Want error for '%v'", v)
+		}
+	}
+}
+
+func TestSetModePosition(t *testing.T) {
+	s := setupApi(t)
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	for _, pos := range []string{"-50", "101", "half"} {
+		if c, err := s.setMode(manual, pos, srcWeb, false); err == nil || c != nil {
+			t.Errorf("Want position '%v' rejected, got %+v (%v)", pos, c, err)
+		}
+	}
+	if xc := s.commands(); len(xc) != 0 {
+		t.Errorf("Want no commands, got %+v", xc)
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	s := &Sunscreen{DurDown: 20 * time.Second, DurUp: 30 * time.Second}
+	tests := []struct {
+		from, to int
+		elapsed  time.Duration
+		want     int
+	}{
+		{0, 100, 5 * time.Second, 25},
+		{20, 100, 30 * time.Second, 100},
+		{100, 0, 15 * time.Second, 50},
+		{10, 0, 15 * time.Second, 0},
+	}
+	for _, tt := range tests {
+		if got := s.estimate(tt.from, tt.to, tt.elapsed); got != tt.want {
+			t.Errorf("estimate(%v, %v, %v): want %v, got %v", tt.from, tt.to, tt.elapsed, tt.want, got)
+		}
+	}
+}
+
+func TestMove(t *testing.T) {
+	sim := newSimGPIO()
+	hw = sim
+	s := &Sunscreen{PinDown: Pin{Line: 17}, PinUp: Pin{Line: 22}}
+	s.init()
+	run(s.actuator, false, 0, false, nil, nil)
+	got := sim.History(s.PinDown)
+	want := []State{High, Low, High}
+	if len(got) != len(want) {
+		t.Fatalf("Want %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Want %v, got %v", want, got)
+		}
+	}
+	if st := hw.Read(s.PinUp); st != High {
+		t.Errorf("Pin up should be high, got %v", st)
+	}
+}
+
+func TestMoveStop(t *testing.T) {
+	sim := newSimGPIO()
+	hw = sim
+	p := Pin{Line: 17}
+	r, _ := newRelay(Pin{Line: 22}, p, activeLow, 0)
+	r.init()
+	stop := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(stop)
+	}()
+	start := time.Now()
+	elapsed, err := run(r, false, time.Minute, false, stop, nil)
+	if err != nil || time.Since(start) > time.Second || elapsed > time.Second {
+		t.Errorf("Movement should have been stopped, took %v (elapsed %v, %v)", time.Since(start), elapsed, err)
+	}
+	if h := sim.History(p); len(h) != 3 || h[1] != Low || h[2] != High {
+		t.Errorf("Relay should be energised and released, got %v", h)
+	}
+}
+
+func TestResync(t *testing.T) {
+	sim := newSimGPIO()
+	hw = sim
+	limitUp, limitDown := Pin{Line: 5}, Pin{Line: 6}
+	tests := []struct {
+		position   string
+		up, down   State
+		want       string
+		wantChange bool
+	}{
+		{unknown, limitClosed, High, up, true},
+		{partial, High, limitClosed, down, true},
+		{up, High, High, unknown, true},
+		{up, limitClosed, limitClosed, unknown, true},
+		{partial, High, High, partial, false},
+		{down, High, limitClosed, down, false},
+	}
+	for _, tt := range tests {
+		s := &Sunscreen{Position: tt.position, Percent: 40, LimitUp: &limitUp, LimitDown: &limitDown}
+		sim.SetLevel(limitUp, tt.up)
+		sim.SetLevel(limitDown, tt.down)
+		if changed := s.resync(); changed != tt.wantChange || s.Position != tt.want {
+			t.Errorf("resync from %v with switches %v/%v: want %v (%v), got %v (%v)", tt.position, tt.up, tt.down, tt.want, tt.wantChange, s.Position, changed)
+		}
+	}
+}
+
+func TestMoveToLimit(t *testing.T) {
+	inTempDir(t)
+	sim := newSimGPIO()
+	hw = sim
+	limitUp, limitDown := Pin{Line: 5}, Pin{Line: 6}
+	s := &Sunscreen{Name: "Test", Position: up, PinDown: Pin{Line: 17}, PinUp: Pin{Line: 22}, DurDown: time.Minute, DurUp: 50 * time.Millisecond, LimitUp: &limitUp, LimitDown: &limitDown, LimitTimeout: 50 * time.Millisecond}
+	sim.SetLevel(limitUp, limitClosed)
+	sim.SetLevel(limitDown, High)
+	s.init()
+	if s.Position != up {
+		t.Fatalf("Position should be up after init, got %v", s.Position)
+	}
+	sim.SetLevel(limitUp, High)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		sim.SetLevel(limitDown, limitClosed)
+	}()
+	start := time.Now()
+	if err := s.moveTo(60, nil); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second || s.Position != down || s.Percent != 100 {
+		t.Errorf("Move should end at the closed limit switch, got %v after %v", s.positionText(), time.Since(start))
+	}
+	// Limit switch up never closes
+	sim.SetLevel(limitUp, High)
+	if err := s.moveTo(0, nil); err == nil || s.Position != unknown {
+		t.Errorf("Move should time out with position unknown, got %v (%v)", s.Position, err)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Constants for the temperature sensors
+const (
+	tempInterval = time.Minute // Interval at which the temperatures are read
+	tempReset    = 85000       // Temperature in millidegrees of a DS18B20 that has not converted, i.e. after a power-on reset
+)
+
+var (
+	w1Dir    = "/sys/bus/w1/devices" // Directory of the 1-Wire devices in sysfs
+	muTemp   sync.Mutex
+	temp     = &tempStatus{} // Guarded by muTemp
+	tempQuit chan struct{}   // Stops reading the temperature sensors, guarded by muTemp
+)
+
+/* TempStatus represents the last temperatures read from the DS18B20 sensors
+configured as config.TempIndoor and config.TempOutdoor.*/
+type tempStatus struct {
+	Enabled bool      // True if the temperature sensors are read
+	Indoor  *float64  // Indoor temperature in °C, nil if unavailable
+	Outdoor *float64  // Outdoor temperature in °C, nil if unavailable
+	Time    time.Time // Time the temperatures were read
+}
+
+// StartTemp (re)starts reading the temperature sensors in config, or stops it if they are disabled.
+func startTemp() {
+	muConf.Lock()
+	enabled, indoor, outdoor := config.EnableTemp, config.TempIndoor, config.TempOutdoor
+	muConf.Unlock()
+	muTemp.Lock()
+	defer muTemp.Unlock()
+	if tempQuit != nil {
+		close(tempQuit)
+		tempQuit = nil
+	}
+	temp = &tempStatus{Enabled: enabled}
+	if !enabled {
+		return
+	}
+	log.Printf("Starting temperature sensors (indoor '%v', outdoor '%v')", indoor, outdoor)
+	tempQuit = make(chan struct{})
+	go monitorTemp(indoor, outdoor, tempQuit)
+}
+
+// GetTempStatus returns a copy of the last temperatures.
+func getTempStatus() tempStatus {
+	muTemp.Lock()
+	defer muTemp.Unlock()
+	return *temp
+}
+
+/* MonitorTemp reads the indoor and outdoor sensor every tempInterval until
+quit is closed. A sensor with an empty id is not read.*/
+func monitorTemp(indoor, outdoor string, quit <-chan struct{}) {
+	t := time.NewTicker(tempInterval)
+	defer t.Stop()
+	for {
+		st := tempStatus{Enabled: true, Time: time.Now()}
+		for _, sensor := range []struct {
+			id    string
+			value **float64
+		}{{indoor, &st.Indoor}, {outdoor, &st.Outdoor}} {
+			if sensor.id == "" {
+				continue
+			}
+			c, err := readDS18B20(sensor.id)
+			if err != nil {
+				log.Printf("Unable to read temperature sensor '%v': %v", sensor.id, err)
+				continue
+			}
+			*sensor.value = &c
+		}
+		muTemp.Lock()
+		select {
+		case <-quit:
+			muTemp.Unlock()
+			return
+		default:
+		}
+		*temp = st
+		muTemp.Unlock()
+		events.publish(evtTemp, st)
+		checkFrost(st.Outdoor)
+		select {
+		case <-quit:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+/* ReadDS18B20 returns the temperature in °C of the DS18B20 with id, e.g.
+28-0316a2795aff, as read through the w1_slave file of the kernel driver:
+	72 01 4b 46 7f ff 0e 10 57 : crc=57 YES
+	72 01 4b 46 7f ff 0e 10 57 t=23125*/
+func readDS18B20(id string) (float64, error) {
+	if id == "" || strings.ContainsAny(id, "/\\") || id == "." || id == ".." {
+		return 0, fmt.Errorf("Invalid sensor id '%v'", id)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(w1Dir, id, "w1_slave"))
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(strings.TrimSpace(lines[0]), "YES") {
+		return 0, fmt.Errorf("CRC check failed: %q", b)
+	}
+	i := strings.Index(lines[1], "t=")
+	if i == -1 {
+		return 0, fmt.Errorf("No temperature in %q", lines[1])
+	}
+	milli, err := strconv.Atoi(strings.TrimSpace(lines[1][i+2:]))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid temperature in %q", lines[1])
+	}
+	if milli == tempReset {
+		return 0, fmt.Errorf("Sensor returned its power-on value of %v °C", tempReset/1000)
+	}
+	return float64(milli) / 1000, nil
+}
+
+// W1Sensors returns the ids of all 1-Wire devices that provide a w1_slave file, e.g. DS18B20 sensors.
+func w1Sensors() []string {
+	files, _ := filepath.Glob(filepath.Join(w1Dir, "*", "w1_slave"))
+	ids := []string{}
+	for _, f := range files {
+		ids = append(ids, filepath.Base(filepath.Dir(f)))
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+/* HeatDecision returns the action of the temperature rules of the sunscreen,
+given the temperatures in st, with its reason. Down means the sunscreen should
+be down regardless of light, because the indoor or outdoor temperature is above
+IndoorMax or OutdoorMax. Up means the sunscreen should stay up, because the
+temperature is at most IndoorMin or OutdoorMin. The action is empty if no rule
+applies; rules of which the temperature is unavailable are skipped. The caller
+should hold muSunscrn.*/
+func (s *Sunscreen) heatDecision(st tempStatus) (string, string) {
+	rules := []struct {
+		name  string
+		value *float64
+		min   *float64
+		max   *float64
+	}{{"Indoor", st.Indoor, s.IndoorMin, s.IndoorMax}, {"Outdoor", st.Outdoor, s.OutdoorMin, s.OutdoorMax}}
+	for _, r := range rules {
+		if r.value != nil && r.max != nil && *r.value > *r.max {
+			return down, fmt.Sprintf("%v temperature %.1f °C is above %v °C", r.name, *r.value, *r.max)
+		}
+	}
+	for _, r := range rules {
+		if r.value != nil && r.min != nil && *r.value <= *r.min {
+			return up, fmt.Sprintf("%v temperature %.1f °C is at most %v °C", r.name, *r.value, *r.min)
+		}
+	}
+	return "", ""
+}
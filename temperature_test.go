@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeW1 points w1Dir to a temporary directory with the w1_slave files of sensors, also at the end of the test.
+func fakeW1(t *testing.T, sensors map[string]string) {
+	dir := t.TempDir()
+	for id, data := range sensors {
+		if err := os.Mkdir(filepath.Join(dir, id), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, id, "w1_slave"), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := w1Dir
+	w1Dir = dir
+	t.Cleanup(func() { w1Dir = old })
+}
+
+func TestReadDS18B20(t *testing.T) {
+	fakeW1(t, map[string]string{
+		"28-0316a2795aff": "72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n72 01 4b 46 7f ff 0e 10 57 t=23125\n",
+		"28-000000000001": "5e ff 4b 46 7f ff 0e 10 c6 : crc=c6 YES\n5e ff 4b 46 7f ff 0e 10 c6 t=-10125\n",
+		"28-000000000002": "72 01 4b 46 7f ff 0e 10 57 : crc=12 NO\n72 01 4b 46 7f ff 0e 10 57 t=23125\n",
+		"28-000000000003": "50 05 4b 46 7f ff 0c 10 1c : crc=1c YES\n50 05 4b 46 7f ff 0c 10 1c t=85000\n",
+	})
+	tests := []struct {
+		id   string
+		want float64
+		ok   bool
+	}{
+		{"28-0316a2795aff", 23.125, true},
+		{"28-000000000001", -10.125, true},
+		{"28-000000000002", 0, false}, // CRC failed
+		{"28-000000000003", 0, false}, // Power-on value
+		{"28-000000000004", 0, false}, // Missing
+		{"../28-0316a2795aff", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := readDS18B20(tt.id)
+		if got != tt.want || (err == nil) != tt.ok {
+			t.Errorf("Sensor '%v': want %v (ok %v), got %v (%v)", tt.id, tt.want, tt.ok, got, err)
+		}
+	}
+	want := []string{"28-000000000001", "28-000000000002", "28-000000000003", "28-0316a2795aff"}
+	if got := w1Sensors(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Want sensors %v, got %v", want, got)
+	}
+}
+
+func TestHeatDecision(t *testing.T) {
+	f := func(c float64) *float64 { return &c }
+	s := &Sunscreen{IndoorMin: f(20), IndoorMax: f(26), OutdoorMin: f(15), OutdoorMax: f(30)}
+	tests := []struct {
+		indoor, outdoor *float64
+		want            string
+	}{
+		{nil, nil, ""},
+		{f(23), f(22), ""},
+		{f(26.5), f(22), down},
+		{f(23), f(31), down},
+		{f(27), f(10), down}, // Heat supersedes cold
+		{f(20), f(22), up},
+		{f(23), f(15), up},
+		{nil, f(14), up},
+	}
+	for _, tt := range tests {
+		if got, reason := s.heatDecision(tempStatus{Indoor: tt.indoor, Outdoor: tt.outdoor}); got != tt.want || (got == "") != (reason == "") {
+			t.Errorf("Indoor %v, outdoor %v: want '%v', got '%v' (%v)", optionalFloat(tt.indoor), optionalFloat(tt.outdoor), tt.want, got, reason)
+		}
+	}
+	if got, _ := (&Sunscreen{}).heatDecision(tempStatus{Indoor: f(40), Outdoor: f(-5)}); got != "" {
+		t.Errorf("Want no decision without rules, got '%v'", got)
+	}
+}
+
+func TestTempEvaluate(t *testing.T) {
+	s := setupApi(t)
+	w := apiRequest(t, http.MethodPatch, "/api/v1/sunscreens/1/config", `{"IndoorMin": "23", "IndoorMax": "27"}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Want 200, got %v: %v", w.Code, w.Body.String())
+	}
+	var e apiError
+	if w = apiRequest(t, http.MethodPatch, "/api/v1/sunscreens/1/config", `{"OutdoorMax": "hot"}`, &e); w.Code != http.StatusUnprocessableEntity || e.Fields["OutdoorMax"] == "" {
+		t.Errorf("Want 422 for invalid temperature, got %v: %+v", w.Code, e)
+	}
+	muSunscrn.Lock()
+	if s.IndoorMin == nil || *s.IndoorMin != 23 || s.IndoorMax == nil || *s.IndoorMax != 27 || s.OutdoorMax != nil {
+		t.Errorf("Want temperature rules saved, got %+v", s)
+	}
+	muSunscrn.Unlock()
+	s.init()
+	setTemp := func(indoor float64) {
+		muTemp.Lock()
+		temp = &tempStatus{Enabled: true, Indoor: &indoor}
+		muTemp.Unlock()
+	}
+	t.Cleanup(func() {
+		muTemp.Lock()
+		temp = &tempStatus{}
+		muTemp.Unlock()
+	})
+
+	// Not warm enough, good light does not move the sunscreen down
+	setTemp(22)
+	s.evaluate([]int{5, 5, 5, 5, 5}, 10, 20, 30, 5, 5, 5, 0)
+	muSunscrn.Lock()
+	if xc := s.commands(); len(xc) != 0 {
+		t.Errorf("Want no command when not warm enough, got %+v", xc)
+	}
+	muSunscrn.Unlock()
+
+	// Heat moves the sunscreen down regardless of bad light
+	setTemp(28)
+	s.evaluate([]int{50, 50, 50, 50, 50}, 10, 20, 30, 5, 5, 5, 0)
+	muSunscrn.Lock()
+	if xc := s.commands(); len(xc) != 1 || xc[0].Source != srcAuto || xc[0].Target != 100 {
+		t.Errorf("Want sunscreen moving down by heat, got %+v", xc)
+	}
+	s.submit(newCommand(cmdStop, 0, srcWeb))
+	muSunscrn.Unlock()
+	waitFor(t, "stop", func() bool {
+		muSunscrn.Lock()
+		defer muSunscrn.Unlock()
+		return s.running == nil && len(s.queue) == 0
+	})
+
+	var status struct{ Temp tempStatus }
+	apiRequest(t, http.MethodGet, "/api/v1/status", "", &status)
+	if !status.Temp.Enabled || status.Temp.Indoor == nil || *status.Temp.Indoor != 28 || status.Temp.Outdoor != nil {
+		t.Errorf("Want temperatures in status, got %+v", status.Temp)
+	}
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	s.closeQueue()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Constants for the anemometer
+const (
+	windMaxFreq = 50                              // Highest pulse frequency in Hz that is counted, e.g. 33 m/s at 0.667 m/s per Hz
+	windSample  = time.Second / (4 * windMaxFreq) // Interval at which the input of the anemometer is sampled, 4 times per pulse at windMaxFreq
+	windPeriod  = 3 * time.Second                 // Period over which pulses are counted, i.e. the duration of a gust
+	windGusts   = 10                              // Number of recent gusts that is kept
+)
+
+var (
+	muWind   sync.Mutex
+	wind     = &windStatus{Gusts: []windGust{}} // Guarded by muWind
+	windQuit chan struct{}                      // Stops the running anemometer, guarded by muWind
+)
+
+/* WindStatus represents the wind measured by the anemometer and the wind lock.
+When the wind speed reaches config.WindLock, all sunscreens are moved up and
+locked: commands from auto mode and users are ignored until the wind speed has
+stayed below config.WindRelease for config.WindCalm. During a frost lock the
+sunscreens are not moved up, as they may be frozen to their frame, but an alert
+is sent instead.*/
+type windStatus struct {
+	Enabled bool       // True if the anemometer is monitored
+	Speed   float64    // Last measured wind speed in m/s
+	Locked  bool       // True if the sunscreens are locked up because of wind
+	Since   time.Time  // Time the lock was last set or released
+	Gusts   []windGust // Recent gusts that reached config.WindLock, new to old
+	calm    time.Time  // Time since which the wind speed is below config.WindRelease, zero if it is not
+}
+
+// WindGust represents a measured wind speed that reached config.WindLock.
+type windGust struct {
+	Time  time.Time
+	Speed float64 // Wind speed in m/s
+}
+
+/* StartWind (re)starts monitoring the anemometer with the settings in config,
+or stops it if the anemometer is disabled. A wind lock is released when the
+anemometer is disabled.*/
+func startWind() {
+	muConf.Lock()
+	enabled, pin := config.EnableWind, config.WindPin
+	muConf.Unlock()
+	muWind.Lock()
+	defer muWind.Unlock()
+	if windQuit != nil {
+		close(windQuit)
+		windQuit = nil
+	}
+	wind.Enabled, wind.Speed, wind.calm = enabled, 0, time.Time{}
+	if !enabled {
+		if wind.Locked {
+			log.Println("Released wind lock, anemometer is disabled")
+			wind.Locked, wind.Since = false, time.Now()
+		}
+		return
+	}
+	log.Printf("Starting anemometer on pin %v", pin)
+	windQuit = make(chan struct{})
+	go monitorWind(pin, windQuit)
+}
+
+// WindLocked returns true if the sunscreens are locked up because of wind.
+func windLocked() bool {
+	muWind.Lock()
+	defer muWind.Unlock()
+	return wind.Locked
+}
+
+// GetWindStatus returns a copy of the wind status, e.g. for showing it on a page.
+func getWindStatus() windStatus {
+	muWind.Lock()
+	defer muWind.Unlock()
+	w := *wind
+	w.Gusts = append([]windGust{}, wind.Gusts...)
+	return w
+}
+
+/* MonitorWind measures the wind speed every windPeriod by counting the pulses
+of the anemometer on pin, until quit is closed.*/
+func monitorWind(pin Pin, quit <-chan struct{}) {
+	hw.Input(pin)
+	for {
+		pulses := countPulses(pin, windPeriod)
+		select {
+		case <-quit:
+			return
+		default:
+		}
+		muConf.Lock()
+		factor, lock, release, calm := config.WindFactor, config.WindLock, config.WindRelease, config.WindCalm
+		muConf.Unlock()
+		speed := float64(pulses) / windPeriod.Seconds() * factor
+		muWind.Lock()
+		changed := wind.update(speed, lock, release, calm, time.Now())
+		locked := wind.Locked
+		muWind.Unlock()
+		events.publish(evtWind, getWindStatus())
+		switch {
+		case changed && locked:
+			msg := fmt.Sprintf("Wind speed of %.1f m/s reached %.1f m/s, moving all sunscreens up and locking them until the wind speed has stayed below %.1f m/s for %v.", speed, lock, release, calm)
+			if frostLocked() {
+				msg = fmt.Sprintf("WARNING: wind speed of %.1f m/s reached %.1f m/s, but the sunscreens are locked by frost and are not moved up. Please check the sunscreens, they are locked until the wind speed has stayed below %.1f m/s for %v.", speed, lock, release, calm)
+			}
+			log.Println(msg)
+			go sendMail("Sunscreens locked by wind", msg)
+			retractAll(srcWind)
+		case changed:
+			msg := fmt.Sprintf("Wind speed has stayed below %.1f m/s for %v, released wind lock.", release, calm)
+			log.Println(msg)
+			go sendMail("Wind lock released", msg)
+		}
+	}
+}
+
+/* CountPulses samples the input of the anemometer on pin every windSample
+for period and returns the number of pulses, i.e. the number of rising edges.
+Pulses above windMaxFreq may be missed, so the wind speed would be too low.*/
+func countPulses(pin Pin, period time.Duration) int {
+	pulses := 0
+	last := hw.Read(pin)
+	t := time.NewTicker(windSample)
+	defer t.Stop()
+	for end := time.Now().Add(period); time.Now().Before(end); <-t.C {
+		st := hw.Read(pin)
+		if st == High && last == Low {
+			pulses++
+		}
+		last = st
+	}
+	return pulses
+}
+
+/* Update takes the wind speed measured at now and sets or releases the lock
+with thresholds lock and release and the period calm the wind speed should stay
+below release. A speed that reaches lock is recorded as a gust. It returns true
+if the lock was set or released. The caller should hold muWind.*/
+func (w *windStatus) update(speed, lock, release float64, calm time.Duration, now time.Time) bool {
+	w.Speed = speed
+	switch {
+	case lock > 0 && speed >= lock:
+		w.calm = time.Time{}
+		w.Gusts = append([]windGust{{now, speed}}, w.Gusts...)
+		if len(w.Gusts) > windGusts {
+			w.Gusts = w.Gusts[:windGusts]
+		}
+		log.Printf("Wind gust of %.1f m/s", speed)
+		if !w.Locked {
+			w.Locked, w.Since = true, now
+			return true
+		}
+	case !w.Locked:
+	case speed >= release:
+		w.calm = time.Time{}
+	case w.calm.IsZero():
+		w.calm = now
+		fallthrough
+	default:
+		if now.Sub(w.calm) >= calm {
+			w.Locked, w.Since, w.calm = false, now, time.Time{}
+			return true
+		}
+	}
+	return false
+}
+
+// RetractAll moves all sunscreens up with a command from source, which supersedes the commands of auto mode and users.
+func retractAll(source string) {
+	for _, s := range listSunscreens() {
+		muSunscrn.Lock()
+		s.retract(source)
+		muSunscrn.Unlock()
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// resetWind clears the wind status, also at the end of the test.
+func resetWind(t *testing.T) {
+	reset := func() {
+		muWind.Lock()
+		wind = &windStatus{Gusts: []windGust{}}
+		muWind.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestWindUpdate(t *testing.T) {
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		after   time.Duration
+		speed   float64
+		changed bool
+		locked  bool
+	}{
+		{0, 5, false, false},
+		{3 * time.Second, 14.9, false, false},
+		{6 * time.Second, 15, true, true},
+		{9 * time.Second, 20, false, true},
+		{12 * time.Second, 9, false, true},   // Calm starts
+		{5 * time.Minute, 12, false, true},   // Above release, calm starts again
+		{6 * time.Minute, 8, false, true},    // Calm starts
+		{15 * time.Minute, 9.9, false, true}, // Calm for 9 minutes
+		{16 * time.Minute, 9.9, true, false}, // Calm for 10 minutes
+		{17 * time.Minute, 14, false, false},
+	}
+	w := &windStatus{Gusts: []windGust{}}
+	for _, tt := range tests {
+		now := start.Add(tt.after)
+		if changed := w.update(tt.speed, 15, 10, 10*time.Minute, now); changed != tt.changed || w.Locked != tt.locked {
+			t.Errorf("%v at %v: want changed %v and locked %v, got %v and %v", tt.speed, tt.after, tt.changed, tt.locked, changed, w.Locked)
+		}
+	}
+	if len(w.Gusts) != 2 || w.Gusts[0].Speed != 20 || w.Gusts[1].Speed != 15 {
+		t.Errorf("Want gusts of 20 and 15 m/s, got %+v", w.Gusts)
+	}
+	if !w.Since.Equal(start.Add(16 * time.Minute)) {
+		t.Errorf("Want lock released at %v, got %v", start.Add(16*time.Minute), w.Since)
+	}
+
+	// Without a calm period the lock is released at once
+	w = &windStatus{Gusts: []windGust{}}
+	w.update(20, 15, 10, 0, start)
+	if !w.update(9, 15, 10, 0, start) || w.Locked {
+		t.Error("Want lock released without calm period")
+	}
+	for i := 0; i < windGusts+5; i++ {
+		w.update(16, 15, 10, 0, start)
+	}
+	if len(w.Gusts) != windGusts {
+		t.Errorf("Want %v gusts, got %v", windGusts, len(w.Gusts))
+	}
+}
+
+func TestCountPulses(t *testing.T) {
+	sim := newSimGPIO()
+	hw = sim
+	p := Pin{Line: 5}
+	sim.SetFrequency(p, 50)
+	if pulses := countPulses(p, 200*time.Millisecond); pulses < 8 || pulses > 11 {
+		t.Errorf("Want 10 pulses at 50 Hz in 200 ms, got %v", pulses)
+	}
+	sim.SetFrequency(p, windMaxFreq)
+	if pulses := countPulses(p, time.Second); pulses < windMaxFreq-2 || pulses > windMaxFreq+1 {
+		t.Errorf("Want %v pulses at the maximum frequency in 1 s, got %v", windMaxFreq, pulses)
+	}
+	sim.SetLevel(p, High)
+	if pulses := countPulses(p, 50*time.Millisecond); pulses != 0 {
+		t.Errorf("Want no pulses at constant level, got %v", pulses)
+	}
+}
+
+func TestWindLock(t *testing.T) {
+	s := setupApi(t)
+	resetWind(t)
+	muSunscrn.Lock()
+	s.Mode, s.Position, s.Percent = manual, down, 100
+	muSunscrn.Unlock()
+	s.init()
+	muWind.Lock()
+	wind.update(20, 15, 10, time.Minute, time.Now())
+	muWind.Unlock()
+	retractAll(srcWind)
+
+	muSunscrn.Lock()
+	xc := s.commands()
+	if len(xc) != 1 || xc[0].Source != srcWind || xc[0].Target != 0 || xc[0].Priority != priorities[srcWind] {
+		t.Errorf("Want sunscreen moving up by wind, got %+v", xc)
+	}
+	// Users can not move the sunscreen, nor stop the lock
+	c, err := s.setMode(manual, down, srcWeb, false)
+	if err != nil || c.Status != cmdCancelled || c.Err != "Locked by wind" {
+		t.Errorf("Want command of user cancelled, got %+v (%v)", c, err)
+	}
+	s.setMode(manual, "stop", srcWeb, false)
+	if s.target() != 0 || s.running == nil && len(s.queue) == 0 {
+		t.Errorf("Want sunscreen still moving up, got %+v", s.commands())
+	}
+	muSunscrn.Unlock()
+
+	var status struct{ Wind windStatus }
+	apiRequest(t, http.MethodGet, "/api/v1/status", "", &status)
+	if !status.Wind.Locked || len(status.Wind.Gusts) != 1 || status.Wind.Gusts[0].Speed != 20 {
+		t.Errorf("Want wind lock with gust in status, got %+v", status.Wind)
+	}
+
+	muSunscrn.Lock()
+	s.submit(newCommand(cmdStop, 0, srcWind))
+	muSunscrn.Unlock()
+	waitFor(t, "stop", func() bool {
+		muSunscrn.Lock()
+		defer muSunscrn.Unlock()
+		return s.running == nil && len(s.queue) == 0
+	})
+	muSunscrn.Lock()
+	defer muSunscrn.Unlock()
+	s.closeQueue()
+}
+
+func TestWindConfig(t *testing.T) {
+	setupApi(t)
+	resetWind(t)
+	w := apiRequest(t, http.MethodPatch, "/api/v1/config", `{"WindPin": "5", "WindFactor": "0.667", "WindLock": "15", "WindRelease": "10", "WindCalm": "10"}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Want 200, got %v: %v", w.Code, w.Body.String())
+	}
+	muConf.Lock()
+	if config.WindPin != (Pin{Line: 5}) || config.WindFactor != 0.667 || config.WindCalm != 10*time.Minute {
+		t.Errorf("Want anemometer config saved, got %+v", config)
+	}
+	muConf.Unlock()
+	var resp apiError
+	w = apiRequest(t, http.MethodPatch, "/api/v1/config", `{"EnableWind": true, "WindRelease": "20"}`, &resp)
+	if w.Code != http.StatusUnprocessableEntity || resp.Fields["WindRelease"] == "" {
+		t.Errorf("Want 422 for release above lock, got %v: %+v", w.Code, resp)
+	}
+	w = apiRequest(t, http.MethodPatch, "/api/v1/config", `{"EnableWind": true, "WindFactor": "0"}`, &resp)
+	if w.Code != http.StatusUnprocessableEntity || resp.Fields["WindFactor"] == "" {
+		t.Errorf("Want 422 for zero factor, got %v: %+v", w.Code, resp)
+	}
+	w = apiRequest(t, http.MethodPatch, "/api/v1/config", `{"EnableWind": true, "WindFactor": "0.1", "WindRelease": "5"}`, &resp)
+	if w.Code != http.StatusUnprocessableEntity || resp.Fields["WindLock"] == "" {
+		t.Errorf("Want 422 for lock above the maximum pulse frequency, got %v: %+v", w.Code, resp)
+	}
+	if getWindStatus().Enabled {
+		t.Error("Want anemometer not started with invalid config")
+	}
+}